@@ -2,7 +2,10 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/abligh/gonbdserver/nbd"
+	"golang.org/x/net/context"
+	"os"
 )
 
 // main() is the main program entry
@@ -10,5 +13,59 @@ import (
 // this is a wrapper to enable us to put the interesting stuff in a package
 func main() {
 	flag.Parse()
-	nbd.Run(nil)
+	switch flag.Arg(0) {
+	case "":
+		nbd.Run(nil)
+	case "selftest":
+		if flag.NArg() != 2 {
+			fmt.Fprintf(os.Stderr, "Usage: %s [flags] selftest <export>\n", os.Args[0])
+			os.Exit(2)
+		}
+		if !nbd.SelfTestExport(os.Stdout, flag.Arg(1)) {
+			os.Exit(1)
+		}
+	case "replay":
+		if flag.NArg() != 3 {
+			fmt.Fprintf(os.Stderr, "Usage: %s [flags] replay <trace> <export>\n", os.Args[0])
+			os.Exit(2)
+		}
+		if !nbd.ReplayTraceExport(os.Stdout, flag.Arg(1), flag.Arg(2)) {
+			os.Exit(1)
+		}
+	case "convert":
+		fs := flag.NewFlagSet("convert", flag.ExitOnError)
+		from := fs.String("from", "", "Image to convert from, as driver:path or an export's name")
+		to := fs.String("to", "", "Image to convert to, as driver:path or an export's name")
+		fs.Parse(flag.Args()[1:])
+		if fs.NArg() != 0 || *from == "" || *to == "" {
+			fmt.Fprintf(os.Stderr, "Usage: %s [flags] convert -from <image> -to <image>\n", os.Args[0])
+			fs.PrintDefaults()
+			os.Exit(2)
+		}
+		if !nbd.Convert(context.Background(), os.Stdout, *from, *to) {
+			os.Exit(1)
+		}
+	case "probe":
+		fs := flag.NewFlagSet("probe", flag.ExitOnError)
+		var opts nbd.ProbeOptions
+		fs.BoolVar(&opts.Tls, "tls", false, "Negotiate TLS")
+		fs.BoolVar(&opts.TlsInsecure, "insecure", false, "Do not verify the server's TLS certificate")
+		fs.StringVar(&opts.TlsCaCertFile, "cacert", "", "Path to CA certificate to verify the server's TLS certificate with")
+		fs.StringVar(&opts.TlsCertFile, "cert", "", "Path to TLS client certificate")
+		fs.StringVar(&opts.TlsKeyFile, "key", "", "Path to TLS client key")
+		fs.StringVar(&opts.TlsServerName, "servername", "", "Server name to verify the server's TLS certificate against")
+		fs.BoolVar(&opts.Structured, "structured", false, "Request structured replies")
+		fs.Parse(flag.Args()[1:])
+		if fs.NArg() < 1 || fs.NArg() > 2 {
+			fmt.Fprintf(os.Stderr, "Usage: %s [flags] probe [probe flags] <address> [<export>]\n", os.Args[0])
+			fs.PrintDefaults()
+			os.Exit(2)
+		}
+		if !nbd.Probe(os.Stdout, fs.Arg(0), fs.Arg(1), opts) {
+			os.Exit(1)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n", flag.Arg(0))
+		os.Exit(2)
+	}
 }
@@ -0,0 +1,327 @@
+package nbd
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AccessLogConfig configures the access log: one record per connection, written
+// as a line of JSON as it closes, for audit rather than debugging
+type AccessLogConfig struct {
+	File     string        // a file to write to, or - for stdout; unset for no access log
+	FileMode string        // file mode
+	MaxSize  int64         // rotate the file once it would exceed this many bytes (0 for no limit)
+	MaxAge   time.Duration // rotate the file once it has been open this long (0 for no limit)
+	MaxFiles int           // number of rotated files kept (0 for the default)
+	Fields   []string      // the fields recorded, or empty for all
+}
+
+// The number of rotated access log files kept by default
+const defaultAccessLogFiles = 5
+
+// The fields of an access log record
+var accessLogFieldNames = map[string]bool{
+	"connected":     true, // when the connection was accepted
+	"peer":          true, // the client's address
+	"export":        true, // the export negotiated, if any
+	"tls_subject":   true, // the subject of the client's TLS certificate, if any
+	"bytes_read":    true, // bytes read by the client
+	"bytes_written": true, // bytes written (or zeroed) by the client
+	"commands":      true, // commands received, by name
+	"duration":      true, // seconds the connection was open
+	"reason":        true, // why the connection closed
+}
+
+// Why a connection closed, as recorded in the access log
+const (
+	closeNegotiationFailed  = "negotiation failed"
+	closeClientDisconnected = "client disconnected"
+	closeBackendFailed      = "backend failed"
+	closeServerShutdown     = "server shutdown"
+	closeExportRemoved      = "export removed"
+	closeConnectionLost     = "connection lost"
+)
+
+// accessLog is the access log the connections write to. Like the connection
+// accounting, this survives configuration reloads, though the file is reopened
+type accessLog struct {
+	mutex  sync.Mutex      // protects the below
+	w      io.WriteCloser  // where records are written, or nil for nowhere
+	fields map[string]bool // the fields recorded
+}
+
+var connectionAccessLog = &accessLog{}
+
+// accessLogFields returns the fields an access log configuration records
+func accessLogFields(ac *AccessLogConfig) (map[string]bool, error) {
+	if len(ac.Fields) == 0 {
+		return accessLogFieldNames, nil
+	}
+	fields := make(map[string]bool, len(ac.Fields))
+	for _, f := range ac.Fields {
+		if !accessLogFieldNames[f] {
+			return nil, fmt.Errorf("Bad access log field '%s'", f)
+		}
+		fields[f] = true
+	}
+	return fields, nil
+}
+
+// validateAccessLog checks an access log configuration
+func validateAccessLog(ac *AccessLogConfig) error {
+	if ac.MaxSize < 0 {
+		return fmt.Errorf("Bad access log maximum size %d", ac.MaxSize)
+	}
+	if ac.MaxAge < 0 {
+		return fmt.Errorf("Bad access log maximum age %s", ac.MaxAge)
+	}
+	if ac.MaxFiles < 0 {
+		return fmt.Errorf("Bad access log maximum files %d", ac.MaxFiles)
+	}
+	if ac.FileMode != "" {
+		if _, err := strconv.ParseUint(ac.FileMode, 8, 32); err != nil {
+			return fmt.Errorf("Bad access log file mode '%s'", ac.FileMode)
+		}
+	}
+	_, err := accessLogFields(ac)
+	return err
+}
+
+// configure starts writing the access log as configured, closing the file
+// written before, if any
+func (al *accessLog) configure(ac *AccessLogConfig) error {
+	fields, err := accessLogFields(ac)
+	if err != nil {
+		return err
+	}
+	var w io.WriteCloser
+	switch ac.File {
+	case "":
+	case "-":
+		w = nopCloser{os.Stdout}
+	default:
+		if w, err = newRotatingWriter(ac); err != nil {
+			return err
+		}
+	}
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	if al.w != nil {
+		al.w.Close()
+	}
+	al.w = w
+	al.fields = fields
+	return nil
+}
+
+// write writes a record of the given fields, keeping only those configured
+func (al *accessLog) write(record map[string]interface{}) {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	if al.w == nil {
+		return
+	}
+	for f := range record {
+		if !al.fields[f] {
+			delete(record, f)
+		}
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		getBackendLogger().Printf("[ERROR] Cannot encode access log record: %v", err)
+		return
+	}
+	if _, err := al.w.Write(append(line, '\n')); err != nil {
+		getBackendLogger().Printf("[ERROR] Cannot write access log record: %v", err)
+	}
+}
+
+// enabled returns true if access log records are being written
+func (al *accessLog) enabled() bool {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	return al.w != nil
+}
+
+// nopCloser is a WriteCloser whose Close does nothing, for stdout
+type nopCloser struct {
+	io.Writer
+}
+
+// Close implements io.Closer.Close
+func (nopCloser) Close() error {
+	return nil
+}
+
+// rotatingWriter writes to a file, rotating it once it reaches a size or an
+// age: the file is renamed with the suffix .1, any file with the suffix .1
+// becomes .2 and so on, the oldest beyond the number kept is removed, and a
+// new file is started. The caller serialises writes
+type rotatingWriter struct {
+	path     string        // the file written
+	mode     os.FileMode   // the mode of files created
+	maxSize  int64         // size at which the file is rotated, or 0
+	maxAge   time.Duration // age at which the file is rotated, or 0
+	maxFiles int           // number of rotated files kept
+	file     *os.File      // the file open
+	size     int64         // bytes in the file
+	opened   time.Time     // when the file was opened
+}
+
+// newRotatingWriter opens a rotatingWriter for an access log configuration
+func newRotatingWriter(ac *AccessLogConfig) (*rotatingWriter, error) {
+	rw := &rotatingWriter{
+		path:     ac.File,
+		mode:     os.FileMode(0644),
+		maxSize:  ac.MaxSize,
+		maxAge:   ac.MaxAge,
+		maxFiles: ac.MaxFiles,
+	}
+	if ac.FileMode != "" {
+		mode, err := strconv.ParseUint(ac.FileMode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Bad access log file mode '%s'", ac.FileMode)
+		}
+		rw.mode = os.FileMode(mode)
+	}
+	if rw.maxFiles == 0 {
+		rw.maxFiles = defaultAccessLogFiles
+	}
+	if err := rw.open(); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+// open opens the file, appending to it if it exists
+func (rw *rotatingWriter) open() error {
+	file, err := os.OpenFile(rw.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, rw.mode)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rw.file = file
+	rw.size = fi.Size()
+	rw.opened = time.Now()
+	return nil
+}
+
+// rotate closes the file, shifts it and the files rotated before along, and
+// opens a new one
+func (rw *rotatingWriter) rotate() error {
+	rw.file.Close()
+	rw.file = nil
+	os.Remove(rw.path + "." + strconv.Itoa(rw.maxFiles))
+	for i := rw.maxFiles - 1; i >= 1; i-- {
+		os.Rename(rw.path+"."+strconv.Itoa(i), rw.path+"."+strconv.Itoa(i+1))
+	}
+	if err := os.Rename(rw.path, rw.path+".1"); err != nil {
+		return err
+	}
+	return rw.open()
+}
+
+// Write implements io.Writer.Write, rotating the file first if it is due
+func (rw *rotatingWriter) Write(p []byte) (int, error) {
+	if rw.file == nil {
+		// the last rotation failed, so try again
+		if err := rw.open(); err != nil {
+			return 0, err
+		}
+	}
+	if (rw.maxSize > 0 && rw.size > 0 && rw.size+int64(len(p)) > rw.maxSize) ||
+		(rw.maxAge > 0 && time.Since(rw.opened) >= rw.maxAge) {
+		if err := rw.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rw.file.Write(p)
+	rw.size += int64(n)
+	return n, err
+}
+
+// Close implements io.Closer.Close
+func (rw *rotatingWriter) Close() error {
+	if rw.file == nil {
+		return nil
+	}
+	return rw.file.Close()
+}
+
+// The name of each command in the access log
+var accessLogCommandNames = map[uint16]string{
+	NBD_CMD_READ:         "read",
+	NBD_CMD_WRITE:        "write",
+	NBD_CMD_DISC:         "disc",
+	NBD_CMD_FLUSH:        "flush",
+	NBD_CMD_TRIM:         "trim",
+	NBD_CMD_CACHE:        "cache",
+	NBD_CMD_WRITE_ZEROES: "writezeroes",
+	NBD_CMD_CLOSE:        "close",
+}
+
+// setCloseReason records why the connection is closing, unless a reason has
+// been recorded already
+func (c *Connection) setCloseReason(reason string) {
+	c.killMutex.Lock()
+	defer c.killMutex.Unlock()
+	if c.closeReason == "" {
+		c.closeReason = reason
+	}
+}
+
+// writeAccessLog writes the connection's record to the access log
+func (c *Connection) writeAccessLog() {
+	if !connectionAccessLog.enabled() {
+		return
+	}
+	c.killMutex.Lock()
+	reason := c.closeReason
+	c.killMutex.Unlock()
+	if reason == "" {
+		if atomic.LoadInt64(&c.disconnectReceived) != 0 {
+			reason = closeClientDisconnected
+		} else {
+			reason = closeConnectionLost
+		}
+	}
+	commands := make(map[string]int64)
+	for cmd := range c.commandCounts {
+		if n := atomic.LoadInt64(&c.commandCounts[cmd]); n > 0 {
+			name, ok := accessLogCommandNames[uint16(cmd)]
+			if !ok {
+				name = strconv.Itoa(cmd)
+			}
+			commands[name] = n
+		}
+	}
+	record := map[string]interface{}{
+		"connected":     c.connected.UTC().Format(time.RFC3339Nano),
+		"peer":          c.plainConn.RemoteAddr().String(),
+		"bytes_read":    atomic.LoadInt64(&c.bytesRead),
+		"bytes_written": atomic.LoadInt64(&c.bytesWritten),
+		"commands":      commands,
+		"duration":      time.Since(c.connected).Seconds(),
+		"reason":        reason,
+	}
+	if c.export != nil {
+		record["export"] = c.export.name
+	}
+	if tc, ok := c.tlsConn.(*tls.Conn); ok {
+		if certs := tc.ConnectionState().PeerCertificates; len(certs) > 0 {
+			record["tls_subject"] = certs[0].Subject.String()
+		}
+	}
+	connectionAccessLog.write(record)
+}
@@ -8,19 +8,57 @@
 package nbd
 
 import (
+	"fmt"
 	"github.com/traetox/goaio"
 	"golang.org/x/net/context"
+	"io"
 	"os"
+	"strconv"
 )
 
 // AioFileBackend implements Backend
+//
+// If asyncqueuedepth is set, writes without FUA are acknowledged once
+// submitted, with up to that many in flight (see asyncWriteQueue), and a flush
+// waits for them all to complete before syncing the file
 type AioFileBackend struct {
-	aio  *goaio.AIO
-	size uint64
+	aio   *goaio.AIO
+	size  uint64
+	queue *asyncWriteQueue // nil unless writes are asynchronous
+	sync  bool             // true if the file is opened with O_SYNC
+}
+
+// submitWrite starts writing b at offset, returning a function waiting for the write to complete
+func (afb *AioFileBackend) submitWrite(b []byte, offset int64) (func() error, error) {
+	if err := afb.aio.Wait(); err != nil {
+		return nil, err
+	}
+	requestId, err := afb.aio.WriteAt(b, offset)
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		n, err := afb.aio.WaitFor(requestId)
+		if err == nil && n != len(b) {
+			err = io.ErrShortWrite
+		}
+		return err
+	}, nil
 }
 
 // WriteAt implements Backend.WriteAt
 func (afb *AioFileBackend) WriteAt(ctx context.Context, b []byte, offset int64, fua bool) (int, error) {
+	if afb.queue != nil {
+		if !fua {
+			if err := afb.queue.write(ctx, b, offset, func(b []byte) (func() error, error) {
+				return afb.submitWrite(b, offset)
+			}); err != nil {
+				return 0, err
+			}
+			return len(b), nil
+		}
+		afb.queue.waitFor(len(b), offset)
+	}
 	if err := afb.aio.Wait(); err != nil {
 		return 0, err
 	}
@@ -42,6 +80,9 @@ func (afb *AioFileBackend) WriteAt(ctx context.Context, b []byte, offset int64,
 
 // ReadAt implements Backend.ReadAt
 func (afb *AioFileBackend) ReadAt(ctx context.Context, b []byte, offset int64) (int, error) {
+	if afb.queue != nil {
+		afb.queue.waitFor(len(b), offset)
+	}
 	if err := afb.aio.Wait(); err != nil {
 		return 0, err
 	}
@@ -63,12 +104,39 @@ func (afb *AioFileBackend) TrimAt(ctx context.Context, length int, offset int64)
 
 // Flush implements Backend.Flush
 func (afb *AioFileBackend) Flush(ctx context.Context) error {
+	if afb.queue != nil {
+		if err := afb.queue.drain(); err != nil {
+			return err
+		}
+	}
 	return afb.aio.Flush()
 }
 
+// Barrier implements Barrierer.Barrier
+//
+// A write to a file opened with O_SYNC is durable once complete, so waiting for
+// the writes in flight to complete orders them without syncing the file. Writes
+// to any other file may reach the disk in any order, so need a full flush
+func (afb *AioFileBackend) Barrier(ctx context.Context) error {
+	if !afb.sync {
+		return afb.Flush(ctx)
+	}
+	if afb.queue != nil {
+		return afb.queue.drain()
+	}
+	return nil
+}
+
 // Close implements Backend.Close
 func (afb *AioFileBackend) Close(ctx context.Context) error {
-	return afb.aio.Close()
+	var err error
+	if afb.queue != nil {
+		err = afb.queue.drain()
+	}
+	if cerr := afb.aio.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
 }
 
 // Size implements Backend.Size
@@ -77,13 +145,23 @@ func (afb *AioFileBackend) Geometry(ctx context.Context) (uint64, uint64, uint64
 }
 
 // Size implements Backend.HasFua
+//
+// Writes are only asynchronous if a queue depth is set, in which case FUA and
+// flush must be sent for a client to know when they are durable
 func (afb *AioFileBackend) HasFua(ctx context.Context) bool {
-	return false
+	return afb.queue != nil
 }
 
 // Size implements Backend.HasFua
 func (afb *AioFileBackend) HasFlush(ctx context.Context) bool {
-	return false
+	return afb.queue != nil
+}
+
+// MultiConn implements MultiConner.MultiConn. A write acknowledged before it
+// completes would not be read through another connection's descriptor, so
+// only synchronous writes are consistent across connections
+func (afb *AioFileBackend) MultiConn(ctx context.Context) bool {
+	return afb.queue == nil
 }
 
 // Generate a new aio backend
@@ -92,11 +170,22 @@ func NewAioFileBackend(ctx context.Context, ec *ExportConfig) (Backend, error) {
 	if ec.ReadOnly {
 		perms = os.O_RDONLY
 	}
-	if s, err := isTrue(ec.DriverParameters["sync"]); err != nil {
+	sync, err := isTrue(ec.DriverParameters["sync"])
+	if err != nil {
 		return nil, err
-	} else if s {
+	} else if sync {
 		perms |= os.O_SYNC
 	}
+	var queue *asyncWriteQueue
+	if d := ec.DriverParameters["asyncqueuedepth"]; d != "" && !ec.ReadOnly {
+		depth, err := strconv.Atoi(d)
+		if err != nil || depth < 0 {
+			return nil, fmt.Errorf("Bad async queue depth '%s'", d)
+		}
+		if depth > 0 {
+			queue = newAsyncWriteQueue(depth)
+		}
+	}
 	aio, err := goaio.NewAIO(ec.DriverParameters["path"], perms, 0666)
 	if err != nil {
 		return nil, err
@@ -107,8 +196,10 @@ func NewAioFileBackend(ctx context.Context, ec *ExportConfig) (Backend, error) {
 		return nil, err
 	}
 	return &AioFileBackend{
-		aio:  aio,
-		size: uint64(stat.Size()),
+		aio:   aio,
+		size:  uint64(stat.Size()),
+		queue: queue,
+		sync:  sync,
 	}, nil
 }
 
@@ -0,0 +1,165 @@
+package nbd
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Number of locks over which an AlignBackend spreads its blocks
+const alignLockStripes = 64
+
+// AlignBackend implements Backend
+//
+// It wraps a backend which can only perform I/O aligned to a block size (for
+// instance one using O_DIRECT) so that it tolerates clients which do not
+// align their I/O. An unaligned read reads the aligned blocks surrounding it.
+// An unaligned write reads the blocks at either end of it, patches in the new
+// data and writes back whole blocks. Writes lock the blocks they touch for the
+// duration, so concurrent writes to the same block cannot lose each other's
+// updates. Unaligned trims are shrunk to the blocks they entirely cover
+type AlignBackend struct {
+	Backend
+	alignment uint64                       // block size the backend needs
+	size      uint64                       // size of the backend
+	locks     [alignLockStripes]sync.Mutex // locks for blocks, by block number modulo alignLockStripes
+}
+
+// aligned returns the aligned range enclosing length bytes at offset, clamped
+// to the size of the backend
+func (ab *AlignBackend) aligned(length int, offset int64) (int64, int) {
+	start := uint64(offset) &^ (ab.alignment - 1)
+	end := (uint64(offset) + uint64(length) + ab.alignment - 1) &^ (ab.alignment - 1)
+	if end > ab.size {
+		end = ab.size
+	}
+	return int64(start), int(end - start)
+}
+
+// isAligned returns true if length bytes at offset need no realignment
+func (ab *AlignBackend) isAligned(length int, offset int64) bool {
+	start, alignedLength := ab.aligned(length, offset)
+	return start == offset && alignedLength == length
+}
+
+// lock locks the blocks covered by length bytes at offset, returning a
+// function to unlock them. Locks are taken in a fixed order to avoid deadlock
+func (ab *AlignBackend) lock(length int, offset int64) func() {
+	first := uint64(offset) / ab.alignment
+	last := (uint64(offset) + uint64(length) + ab.alignment - 1) / ab.alignment
+	if last-first > alignLockStripes {
+		last = first + alignLockStripes
+	}
+	stripes := make([]int, 0, last-first)
+	for i := first; i < last; i++ {
+		stripes = append(stripes, int(i%alignLockStripes))
+	}
+	sort.Ints(stripes)
+	for _, s := range stripes {
+		ab.locks[s].Lock()
+	}
+	return func() {
+		for _, s := range stripes {
+			ab.locks[s].Unlock()
+		}
+	}
+}
+
+// ReadAt implements Backend.ReadAt
+func (ab *AlignBackend) ReadAt(ctx context.Context, b []byte, offset int64) (int, error) {
+	if ab.isAligned(len(b), offset) {
+		return ab.Backend.ReadAt(ctx, b, offset)
+	}
+	start, length := ab.aligned(len(b), offset)
+	buf := make([]byte, length)
+	if _, err := ab.Backend.ReadAt(ctx, buf, start); err != nil {
+		return 0, err
+	}
+	return copy(b, buf[offset-start:]), nil
+}
+
+// WriteAt implements Backend.WriteAt
+func (ab *AlignBackend) WriteAt(ctx context.Context, b []byte, offset int64, fua bool) (int, error) {
+	// aligned writes take the locks too, lest they land between the read
+	// and write of an unaligned write to the same block
+	unlock := ab.lock(len(b), offset)
+	defer unlock()
+	if ab.isAligned(len(b), offset) {
+		return ab.Backend.WriteAt(ctx, b, offset, fua)
+	}
+	start, length := ab.aligned(len(b), offset)
+	buf := make([]byte, length)
+	// only the blocks at either end need reading, as the rest is overwritten
+	firstEnd := int64(ab.alignment)
+	if firstEnd > int64(length) {
+		firstEnd = int64(length)
+	}
+	if offset > start || int64(len(b)) < firstEnd {
+		if _, err := ab.Backend.ReadAt(ctx, buf[:firstEnd], start); err != nil {
+			return 0, err
+		}
+	}
+	lastStart := (int64(length) - 1) &^ int64(ab.alignment-1)
+	if lastStart >= firstEnd && offset+int64(len(b)) < start+int64(length) {
+		if _, err := ab.Backend.ReadAt(ctx, buf[lastStart:], start+lastStart); err != nil {
+			return 0, err
+		}
+	}
+	copy(buf[offset-start:], b)
+	if _, err := ab.Backend.WriteAt(ctx, buf, start, fua); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// TrimAt implements Backend.TrimAt
+func (ab *AlignBackend) TrimAt(ctx context.Context, length int, offset int64) (int, error) {
+	start := (uint64(offset) + ab.alignment - 1) &^ (ab.alignment - 1)
+	end := (uint64(offset) + uint64(length)) &^ (ab.alignment - 1)
+	if end > start {
+		if _, err := ab.Backend.TrimAt(ctx, int(end-start), int64(start)); err != nil {
+			return 0, err
+		}
+	}
+	return length, nil
+}
+
+// Geometry implements Backend.Geometry
+//
+// As any I/O is accepted, the minimum block size is 1. The preferred block size
+// is at least the alignment, as smaller writes are read-modify-writes
+func (ab *AlignBackend) Geometry(ctx context.Context) (uint64, uint64, uint64, uint64, error) {
+	size, _, preferred, maximum, err := ab.Backend.Geometry(ctx)
+	if preferred < ab.alignment {
+		preferred = ab.alignment
+	}
+	return size, 1, preferred, maximum, err
+}
+
+// IOHints implements IOHinter.IOHints
+func (ab *AlignBackend) IOHints(ctx context.Context) IOHints {
+	return backendIOHints(ctx, ab.Backend)
+}
+
+// newAlignBackend wraps a backend in an AlignBackend if the export configures alignbuffer
+func newAlignBackend(ctx context.Context, ec *ExportConfig, backend Backend) (Backend, error) {
+	alignParam := ec.DriverParameters["alignbuffer"]
+	if alignParam == "" {
+		return backend, nil
+	}
+	alignment, err := strconv.ParseUint(alignParam, 10, 64)
+	if err != nil || alignment == 0 || alignment&(alignment-1) != 0 {
+		return nil, fmt.Errorf("Bad alignment '%s'", alignParam)
+	}
+	size, _, _, _, err := backend.Geometry(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &AlignBackend{
+		Backend:   backend,
+		alignment: alignment,
+		size:      size,
+	}, nil
+}
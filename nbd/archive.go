@@ -0,0 +1,337 @@
+package nbd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"container/list"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Size of the blocks in which ArchiveBackend caches the data of a compressed member
+const archiveCacheBlockSize = 64 * 1024
+
+// Default number of blocks of a compressed member's data to cache
+var DefaultArchiveCacheBlocks = 256
+
+// ArchiveBackend implements Backend
+//
+// It serves a single member of a ZIP or (uncompressed) TAR archive read-only,
+// without extracting it. The data of a TAR member, or of a ZIP member that is
+// stored rather than compressed, is contiguous within the archive, so reads are
+// served straight from the archive file. A compressed ZIP member can only be
+// decompressed from its start, so its data is cached in blocks as it is
+// decompressed; a read behind the furthest point decompressed that misses the
+// cache decompresses the member again from its start. The blocks cached are
+// charged to the cache memory budget shared by every export
+type ArchiveBackend struct {
+	file   *os.File
+	size   uint64
+	offset int64 // offset of the member's data within the archive, if contiguous
+
+	// for a compressed member
+	member      *zip.File               // the member
+	stream      io.ReadCloser           // decompresses the member, or nil if not yet opened
+	streamPos   int64                   // how far stream has decompressed
+	cache       map[int64]*list.Element // cached blocks, by index
+	lru         *list.List              // cached blocks, most recently used first
+	cacheBlocks int                     // maximum number of blocks cached
+	uncharged   int64                   // bytes added to the cache (less those evicted) not yet charged to the memory budget
+	mutex       sync.Mutex              // protects stream, streamPos, cache, lru and uncharged
+}
+
+// archiveBlock is a block of a compressed member's data held in the cache
+type archiveBlock struct {
+	index int64
+	data  []byte
+}
+
+// WriteAt implements Backend.WriteAt
+func (ab *ArchiveBackend) WriteAt(ctx context.Context, b []byte, offset int64, fua bool) (int, error) {
+	return 0, syscall.EPERM
+}
+
+// ReadAt implements Backend.ReadAt
+func (ab *ArchiveBackend) ReadAt(ctx context.Context, b []byte, offset int64) (int, error) {
+	if offset < 0 || uint64(offset) >= ab.size {
+		return 0, io.EOF
+	}
+	// never read past the member into the rest of the archive
+	var err error
+	if uint64(offset)+uint64(len(b)) > ab.size {
+		b = b[:ab.size-uint64(offset)]
+		err = io.EOF
+	}
+	if ab.member == nil {
+		n, rerr := ab.file.ReadAt(b, ab.offset+offset)
+		if rerr != nil {
+			return n, rerr
+		}
+		return n, err
+	}
+	ab.mutex.Lock()
+	defer ab.unlock()
+	for n := 0; n < len(b); {
+		pos := offset + int64(n)
+		block, rerr := ab.block(pos / archiveCacheBlockSize)
+		if rerr != nil {
+			return n, rerr
+		}
+		within := int(pos % archiveCacheBlockSize)
+		if within >= len(block) {
+			return n, io.ErrUnexpectedEOF
+		}
+		n += copy(b[n:], block[within:])
+	}
+	return len(b), err
+}
+
+// block returns block i of a compressed member's data, from the cache if it
+// is held there, otherwise by decompressing up to it. Call with the mutex held
+func (ab *ArchiveBackend) block(i int64) ([]byte, error) {
+	if e, ok := ab.cache[i]; ok {
+		ab.lru.MoveToFront(e)
+		return e.Value.(*archiveBlock).data, nil
+	}
+	start := i * archiveCacheBlockSize
+	if ab.stream == nil || ab.streamPos > start {
+		if ab.stream != nil {
+			ab.stream.Close()
+		}
+		stream, err := ab.member.Open()
+		if err != nil {
+			return nil, err
+		}
+		ab.stream = stream
+		ab.streamPos = 0
+	}
+	// cache each block decompressed on the way, as it costs nothing more
+	for {
+		index := ab.streamPos / archiveCacheBlockSize
+		data := make([]byte, archiveCacheBlockSize)
+		n, err := io.ReadFull(ab.stream, data)
+		if err == io.ErrUnexpectedEOF || (err == io.EOF && n == 0) {
+			err = nil
+		}
+		if err != nil {
+			ab.stream.Close()
+			ab.stream = nil
+			return nil, err
+		}
+		if n == 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		ab.streamPos += int64(n)
+		ab.cacheBlock(index, data[:n])
+		if index == i {
+			return data[:n], nil
+		}
+	}
+}
+
+// cacheBlock adds a block to the cache, evicting the least recently used if
+// the cache is full. Call with the mutex held
+func (ab *ArchiveBackend) cacheBlock(i int64, data []byte) {
+	if e, ok := ab.cache[i]; ok {
+		ab.lru.MoveToFront(e)
+		return
+	}
+	if ab.lru.Len() >= ab.cacheBlocks {
+		oldest := ab.lru.Back()
+		ab.lru.Remove(oldest)
+		delete(ab.cache, oldest.Value.(*archiveBlock).index)
+		ab.uncharged -= int64(len(oldest.Value.(*archiveBlock).data))
+	}
+	ab.cache[i] = ab.lru.PushFront(&archiveBlock{index: i, data: data})
+	ab.uncharged += int64(len(data))
+}
+
+// unlock releases the mutex, then charges the memory budget for the blocks
+// added to and evicted from the cache whilst it was held
+func (ab *ArchiveBackend) unlock() {
+	n := ab.uncharged
+	ab.uncharged = 0
+	ab.mutex.Unlock()
+	cacheMemory.charge(ab, n)
+}
+
+// evictOldest implements budgetedCache.evictOldest
+func (ab *ArchiveBackend) evictOldest() int64 {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+	oldest := ab.lru.Back()
+	if oldest == nil {
+		return 0
+	}
+	ab.lru.Remove(oldest)
+	delete(ab.cache, oldest.Value.(*archiveBlock).index)
+	return int64(len(oldest.Value.(*archiveBlock).data))
+}
+
+// TrimAt implements Backend.TrimAt
+func (ab *ArchiveBackend) TrimAt(ctx context.Context, length int, offset int64) (int, error) {
+	return 0, syscall.EPERM
+}
+
+// Flush implements Backend.Flush
+func (ab *ArchiveBackend) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Close implements Backend.Close
+func (ab *ArchiveBackend) Close(ctx context.Context) error {
+	cacheMemory.forget(ab)
+	if ab.stream != nil {
+		ab.stream.Close()
+	}
+	return ab.file.Close()
+}
+
+// Geometry implements Backend.Geometry
+func (ab *ArchiveBackend) Geometry(ctx context.Context) (uint64, uint64, uint64, uint64, error) {
+	return ab.size, 1, 32 * 1024, 128 * 1024 * 1024, nil
+}
+
+// HasFua implements Backend.HasFua
+func (ab *ArchiveBackend) HasFua(ctx context.Context) bool {
+	return false
+}
+
+// HasFlush implements Backend.HasFlush
+func (ab *ArchiveBackend) HasFlush(ctx context.Context) bool {
+	return false
+}
+
+// openZipMember finds a member of a ZIP archive
+func (ab *ArchiveBackend) openZipMember(zr *zip.Reader, name string) error {
+	for _, f := range zr.File {
+		if f.Name != name {
+			continue
+		}
+		if strings.HasSuffix(f.Name, "/") {
+			return fmt.Errorf("Archive member %s is a directory", name)
+		}
+		ab.size = f.UncompressedSize64
+		if f.Method == zip.Store {
+			offset, err := f.DataOffset()
+			if err != nil {
+				return err
+			}
+			ab.offset = offset
+		} else {
+			ab.member = f
+		}
+		return nil
+	}
+	return fmt.Errorf("No member %s in archive", name)
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.n += int64(n)
+	return n, err
+}
+
+// openTarMember finds a member of a TAR archive. Once tar.Reader has read a
+// member's header, the archive has been read up to the member's data, which
+// is contiguous unless the member is sparse
+func (ab *ArchiveBackend) openTarMember(name string) error {
+	cr := &countingReader{r: ab.file}
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("No member %s in archive", name)
+		} else if err != nil {
+			return fmt.Errorf("Cannot read archive: %v", err)
+		}
+		if path.Clean(hdr.Name) != path.Clean(name) {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return fmt.Errorf("Archive member %s is not a regular file", name)
+		}
+		for k := range hdr.PAXRecords {
+			if strings.HasPrefix(k, "GNU.sparse.") {
+				return fmt.Errorf("Archive member %s is sparse", name)
+			}
+		}
+		ab.size = uint64(hdr.Size)
+		ab.offset = cr.n
+		return nil
+	}
+}
+
+// Generate a new archive backend
+func NewArchiveBackend(ctx context.Context, ec *ExportConfig) (Backend, error) {
+	if !ec.ReadOnly {
+		return nil, errors.New("Archive exports must be read-only")
+	}
+	name := ec.DriverParameters["member"]
+	if name == "" {
+		return nil, errors.New("Archive exports need a member")
+	}
+	ab := &ArchiveBackend{
+		cache:       make(map[int64]*list.Element),
+		lru:         list.New(),
+		cacheBlocks: DefaultArchiveCacheBlocks,
+	}
+	if cb := ec.DriverParameters["cacheblocks"]; cb != "" {
+		n, err := strconv.Atoi(cb)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("Bad number of cache blocks '%s'", cb)
+		}
+		ab.cacheBlocks = n
+	}
+	file, err := os.Open(ec.DriverParameters["path"])
+	if err != nil {
+		return nil, err
+	}
+	ab.file = file
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	format := ec.DriverParameters["format"]
+	var zr *zip.Reader
+	if format == "" || format == "zip" {
+		zr, err = zip.NewReader(file, info.Size())
+		if err != nil && format == "zip" {
+			file.Close()
+			return nil, fmt.Errorf("Cannot read archive: %v", err)
+		}
+	}
+	switch {
+	case zr != nil:
+		err = ab.openZipMember(zr, name)
+	case format == "" || format == "tar":
+		err = ab.openTarMember(name)
+	default:
+		err = fmt.Errorf("Unknown archive format '%s'", format)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return ab, nil
+}
+
+// Register our backend
+func init() {
+	RegisterBackend("archive", NewArchiveBackend)
+}
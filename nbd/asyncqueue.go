@@ -0,0 +1,121 @@
+package nbd
+
+import (
+	"golang.org/x/net/context"
+	"sync"
+)
+
+// asyncWrite is a write submitted to an asyncWriteQueue and not yet completed
+type asyncWrite struct {
+	offset int64
+	length int
+}
+
+// asyncWriteQueue bounds the writes a backend has in flight asynchronously.
+//
+// A write holds a slot from submission until it completes, so when the backend
+// cannot keep up and every slot is taken, further writes (and so the dispatch
+// loop issuing them) block until one is free, rather than queueing without
+// limit. Each write's data is copied, so at most depth writes' worth of memory
+// is held however far the client runs ahead.
+//
+// As a write is acknowledged before it completes, its error (if any) cannot be
+// returned to it; the first such error is instead returned by the next drain,
+// i.e. the next flush, which is when a client learns its writes are durable
+type asyncWriteQueue struct {
+	slots          chan struct{}            // one entry per write in flight
+	mutex          sync.Mutex               // protects the below
+	cond           *sync.Cond               // signalled as each write completes
+	pending        map[*asyncWrite]struct{} // writes in flight
+	err            error                    // first error since the last drain
+	maxOutstanding int                      // high water mark of writes in flight
+}
+
+// newAsyncWriteQueue returns a queue allowing depth writes in flight
+func newAsyncWriteQueue(depth int) *asyncWriteQueue {
+	q := &asyncWriteQueue{
+		slots:   make(chan struct{}, depth),
+		pending: make(map[*asyncWrite]struct{}),
+	}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+// write submits a copy of b for writing at offset, waiting for a slot first,
+// and for any overlapping write in flight to complete so that writes land in the
+// order they were acknowledged. submit starts the write and returns a function
+// waiting for it to complete, which is called in the background. An error is
+// returned only if no slot could be had or the write could not be submitted
+func (q *asyncWriteQueue) write(ctx context.Context, b []byte, offset int64, submit func(b []byte) (func() error, error)) error {
+	select {
+	case q.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	data := make([]byte, len(b))
+	copy(data, b)
+	w := &asyncWrite{offset: offset, length: len(b)}
+	q.mutex.Lock()
+	for q.overlaps(w.length, w.offset) {
+		q.cond.Wait()
+	}
+	q.pending[w] = struct{}{}
+	if len(q.pending) > q.maxOutstanding {
+		q.maxOutstanding = len(q.pending)
+	}
+	q.mutex.Unlock()
+	wait, err := submit(data)
+	if err != nil {
+		q.complete(w, nil)
+		return err
+	}
+	go func() {
+		q.complete(w, wait())
+	}()
+	return nil
+}
+
+// complete records that the write w has completed with error err, freeing its slot
+func (q *asyncWriteQueue) complete(w *asyncWrite, err error) {
+	q.mutex.Lock()
+	delete(q.pending, w)
+	if err != nil && q.err == nil {
+		q.err = err
+	}
+	q.cond.Broadcast()
+	q.mutex.Unlock()
+	<-q.slots
+}
+
+// overlaps returns true if a write in flight overlaps length bytes at offset. Call with the mutex held
+func (q *asyncWriteQueue) overlaps(length int, offset int64) bool {
+	for w := range q.pending {
+		if w.offset < offset+int64(length) && offset < w.offset+int64(w.length) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitFor waits until no write in flight overlaps length bytes at offset, so a
+// read of them sees every write already acknowledged
+func (q *asyncWriteQueue) waitFor(length int, offset int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for q.overlaps(length, offset) {
+		q.cond.Wait()
+	}
+}
+
+// drain waits until every write in flight has completed, and returns the first
+// error since the last drain
+func (q *asyncWriteQueue) drain() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for len(q.pending) > 0 {
+		q.cond.Wait()
+	}
+	err := q.err
+	q.err = nil
+	return err
+}
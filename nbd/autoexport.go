@@ -0,0 +1,100 @@
+package nbd
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// expandAutoExports returns the exports configured, with each export setting
+// autoexport (a glob, e.g. /images/*.raw) replaced by an export of each file
+// matching it, and records the files each glob matched in matched.
+//
+// Each is configured as the export but for serving the file, and is named after
+// the file's name, prefixed by the export's name if it has one. A match that is
+// not a regular file or block device is skipped, as is one whose name is taken
+// by another export, with a warning; exports configured explicitly take
+// precedence over those matched
+func expandAutoExports(exports []ExportConfig, matched map[string][]string) ([]ExportConfig, error) {
+	names := make(map[string]bool)
+	for _, ec := range exports {
+		if ec.DriverParameters["autoexport"] == "" {
+			names[ec.Name] = true
+		}
+	}
+	var expanded []ExportConfig
+	for _, ec := range exports {
+		pattern := ec.DriverParameters["autoexport"]
+		if pattern == "" {
+			expanded = append(expanded, ec)
+			continue
+		}
+		switch strings.ToLower(ec.Driver) {
+		case "file", "aiofile":
+		default:
+			return nil, fmt.Errorf("Export %s: autoexport needs files to serve, so the file or aiofile driver", ec.Name)
+		}
+		if ec.DriverParameters["path"] != "" {
+			return nil, fmt.Errorf("Export %s: autoexport cannot be combined with a path", ec.Name)
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Export %s: bad autoexport glob '%s'", ec.Name, pattern)
+		}
+		matched[pattern] = files
+		for _, file := range files {
+			aec := ec
+			aec.Name = ec.Name + filepath.Base(file)
+			if info, err := os.Stat(file); err != nil {
+				getBackendLogger().Printf("[WARN] Export %s not created, as %s cannot be examined: %v", aec.Name, file, err)
+				continue
+			} else if mode := info.Mode(); !mode.IsRegular() && (mode&os.ModeDevice == 0 || mode&os.ModeCharDevice != 0) {
+				getBackendLogger().Printf("[WARN] Export %s not created, as %s is neither a regular file nor a block device", aec.Name, file)
+				continue
+			}
+			if names[aec.Name] {
+				getBackendLogger().Printf("[WARN] Export %s not created for %s, as another export has the name", aec.Name, file)
+				continue
+			}
+			names[aec.Name] = true
+			aec.DriverParameters = make(DriverParametersConfig, len(ec.DriverParameters))
+			for k, v := range ec.DriverParameters {
+				aec.DriverParameters[k] = v
+			}
+			delete(aec.DriverParameters, "autoexport")
+			aec.DriverParameters["path"] = file
+			expanded = append(expanded, aec)
+		}
+	}
+	return expanded, nil
+}
+
+// watchAutoExports checks every interval, until ctx is done, whether the files
+// matching any autoexport glob have changed since they were matched, and if so
+// signals on reload that the configuration should be reloaded to match
+func watchAutoExports(ctx context.Context, logger *log.Logger, matched map[string][]string, interval time.Duration, reload chan<- struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for pattern, files := range matched {
+			if now, _ := filepath.Glob(pattern); !reflect.DeepEqual(now, files) {
+				logger.Printf("[INFO] Files matching autoexport glob %s have changed", pattern)
+				select {
+				case reload <- struct{}{}:
+				default:
+				}
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,31 @@
+// +build linux
+
+package nbd
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// setBacklog sets the length of the queue of pending connections on a
+// listening socket. Linux allows listen(2) to be called again on a socket
+// which is already listening, which changes its backlog. The kernel caps
+// the backlog at net.core.somaxconn
+func setBacklog(li net.Listener, backlog int) error {
+	sc, ok := li.(syscall.Conn)
+	if !ok {
+		return errors.New("Listener does not expose its socket")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var lerr error
+	if err := rc.Control(func(fd uintptr) {
+		lerr = syscall.Listen(int(fd), backlog)
+	}); err != nil {
+		return err
+	}
+	return lerr
+}
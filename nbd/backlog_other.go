@@ -0,0 +1,13 @@
+// +build !linux
+
+package nbd
+
+import (
+	"errors"
+	"net"
+)
+
+// setBacklog sets the length of the queue of pending connections on a listening socket
+func setBacklog(li net.Listener, backlog int) error {
+	return errors.New("Setting the listen backlog is only supported on Linux")
+}
@@ -0,0 +1,160 @@
+package nbd
+
+import (
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// States recorded in a clean shutdown marker
+const (
+	cleanMarkerClean = "clean\n"
+	cleanMarkerDirty = "dirty\n"
+)
+
+// Suffix appended to the path of an export's file to give its clean shutdown marker
+const cleanMarkerSuffix = ".clean"
+
+// Clean shutdown markers open by file backends, by path, so that connections
+// to an export share one, along with the exports found not to have been shut
+// down cleanly when their markers were first read by this process. Markers are
+// only read once per process, as they are dirty whilst their export is open
+var (
+	cleanMarkers       = make(map[string]*cleanMarker)
+	cleanMarkerChecked = make(map[string]bool)
+	uncleanExports     = make(map[string]string) // marker paths, by export name
+	cleanMarkersMutex  sync.Mutex                // protects the above
+)
+
+func init() {
+	expvar.Publish("nbd_unclean_exports", expvar.Func(func() interface{} {
+		cleanMarkersMutex.Lock()
+		defer cleanMarkersMutex.Unlock()
+		exports := make(map[string]string, len(uncleanExports))
+		for name, path := range uncleanExports {
+			exports[name] = path
+		}
+		return exports
+	}))
+}
+
+// cleanMarker records whether the file of an export was closed cleanly, much
+// as a filesystem's dirty bit does. It is marked dirty when the file is first
+// opened, and clean once the last backend using the file has synced and closed
+// it. A marker found dirty when opened means the server stopped without closing
+// the export, e.g. because it crashed, so writes may have been lost
+type cleanMarker struct {
+	path  string // path of the marker
+	refs  int    // number of backends using the marker (protected by cleanMarkersMutex)
+	clean bool   // false if any backend using the marker did not close cleanly
+}
+
+// hasCleanMarker returns true if an export's file keeps a clean shutdown marker.
+// Read-only exports are never written to, so have none
+func hasCleanMarker(ec *ExportConfig) (bool, error) {
+	marker, err := isTrue(ec.DriverParameters["cleanmarker"])
+	return marker && !ec.ReadOnly, err
+}
+
+// checkCleanMarker reads the clean shutdown marker at path unless already read
+// by this process, recording and logging the export if it was not shut down
+// cleanly. A marker which does not exist has not yet been kept, so says nothing.
+// Call with cleanMarkersMutex held
+func checkCleanMarker(logger *log.Logger, name string, path string) error {
+	if cleanMarkerChecked[path] {
+		return nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		cleanMarkerChecked[path] = true
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Cannot read clean shutdown marker: %v", err)
+	}
+	switch string(b) {
+	case cleanMarkerClean:
+	case cleanMarkerDirty:
+		logger.Printf("[WARN] Export %s was not shut down cleanly (marker %s), so writes may have been lost; clients should check its filesystem", name, path)
+		uncleanExports[name] = path
+	default:
+		return fmt.Errorf("%s is not a clean shutdown marker", path)
+	}
+	cleanMarkerChecked[path] = true
+	return nil
+}
+
+// cleanMarkerPath returns the absolute path of the clean shutdown marker of an export
+func cleanMarkerPath(ec *ExportConfig) (string, error) {
+	return filepath.Abs(ec.DriverParameters["path"] + cleanMarkerSuffix)
+}
+
+// reportUncleanExports reads the clean shutdown markers of each export keeping
+// one, so that any not shut down cleanly are reported before they are opened
+func reportUncleanExports(logger *log.Logger, c *Config) {
+	cleanMarkersMutex.Lock()
+	defer cleanMarkersMutex.Unlock()
+	for _, s := range c.Servers {
+		for i := range s.Exports {
+			ec := &s.Exports[i]
+			if marker, err := hasCleanMarker(ec); err != nil || !marker || strings.ToLower(ec.Driver) != "file" {
+				continue
+			}
+			path, err := cleanMarkerPath(ec)
+			if err == nil {
+				err = checkCleanMarker(logger, ec.Name, path)
+			}
+			if err != nil {
+				logger.Printf("[WARN] Export %s: %v", ec.Name, err)
+			}
+		}
+	}
+}
+
+// acquireCleanMarker marks the clean shutdown marker of an export dirty, or
+// returns it if already in use. It must be released with releaseCleanMarker
+func acquireCleanMarker(ec *ExportConfig) (*cleanMarker, error) {
+	path, err := cleanMarkerPath(ec)
+	if err != nil {
+		return nil, err
+	}
+	cleanMarkersMutex.Lock()
+	defer cleanMarkersMutex.Unlock()
+	if cm, ok := cleanMarkers[path]; ok {
+		cm.refs++
+		return cm, nil
+	}
+	if err := checkCleanMarker(getBackendLogger(), ec.Name, path); err != nil {
+		return nil, err
+	}
+	if err := writeFileSync(path, []byte(cleanMarkerDirty)); err != nil {
+		return nil, fmt.Errorf("Cannot write clean shutdown marker: %v", err)
+	}
+	cm := &cleanMarker{path: path, refs: 1, clean: true}
+	cleanMarkers[path] = cm
+	return cm, nil
+}
+
+// releaseCleanMarker releases a marker acquired with acquireCleanMarker, which
+// is marked clean once unused, provided every backend using it closed cleanly
+func releaseCleanMarker(cm *cleanMarker, clean bool) error {
+	cleanMarkersMutex.Lock()
+	defer cleanMarkersMutex.Unlock()
+	cm.clean = cm.clean && clean
+	cm.refs--
+	if cm.refs > 0 {
+		return nil
+	}
+	delete(cleanMarkers, cm.path)
+	if !cm.clean {
+		return nil
+	}
+	if err := writeFileSync(cm.path, []byte(cleanMarkerClean)); err != nil {
+		return fmt.Errorf("Cannot write clean shutdown marker: %v", err)
+	}
+	return nil
+}
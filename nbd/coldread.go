@@ -0,0 +1,154 @@
+package nbd
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Default granularity at which ColdReadBackend tracks blocks
+const defaultColdReadBlockSize = 64 * 1024
+
+// ColdReadBackend implements Backend
+//
+// It wraps another backend to simulate a cold storage tier: the first read
+// touching a block which has not been read before is delayed, as if the data
+// had to be fetched from a slow tier, and subsequent reads of it are served at
+// the speed of the underlying backend. A read touching several cold blocks is
+// delayed once, as a tier would fetch them together. Touched blocks are
+// tracked in a bitmap. Writes pass straight through, and optionally mark the
+// blocks written as warm.
+//
+// This is intended for testing clients against tiered or lazily fetched
+// storage, and is enabled by setting coldreaddelay on any export
+type ColdReadBackend struct {
+	Backend
+	delay       time.Duration // delay for a read touching a cold block
+	blockSize   uint64        // granularity of the bitmap
+	warmOnWrite bool          // true if written blocks become warm
+	warm        []uint64      // bitmap of warm blocks
+	warmMutex   sync.Mutex    // protects warm
+}
+
+// blocks returns the range of blocks covered by length bytes at offset
+func (cb *ColdReadBackend) blocks(length int, offset int64) (uint64, uint64) {
+	if length <= 0 {
+		return 0, 0
+	}
+	return uint64(offset) / cb.blockSize, (uint64(offset) + uint64(length) + cb.blockSize - 1) / cb.blockSize
+}
+
+// isCold returns true if any block in the range [first, last) is cold
+func (cb *ColdReadBackend) isCold(first, last uint64) bool {
+	cb.warmMutex.Lock()
+	defer cb.warmMutex.Unlock()
+	for i := first; i < last; i++ {
+		if cb.warm[i/64]&(1<<(i%64)) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// setWarm marks the blocks in the range [first, last) as warm
+func (cb *ColdReadBackend) setWarm(first, last uint64) {
+	cb.warmMutex.Lock()
+	defer cb.warmMutex.Unlock()
+	for i := first; i < last; i++ {
+		cb.warm[i/64] |= 1 << (i % 64)
+	}
+}
+
+// fetch simulates fetching the blocks covered by length bytes at offset from
+// the cold tier, if any of them are cold
+func (cb *ColdReadBackend) fetch(ctx context.Context, length int, offset int64) error {
+	first, last := cb.blocks(length, offset)
+	if !cb.isCold(first, last) {
+		return nil
+	}
+	select {
+	case <-time.After(cb.delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	cb.setWarm(first, last)
+	return nil
+}
+
+// ReadAt implements Backend.ReadAt
+func (cb *ColdReadBackend) ReadAt(ctx context.Context, b []byte, offset int64) (int, error) {
+	if err := cb.fetch(ctx, len(b), offset); err != nil {
+		return 0, err
+	}
+	return cb.Backend.ReadAt(ctx, b, offset)
+}
+
+// WriteAt implements Backend.WriteAt
+func (cb *ColdReadBackend) WriteAt(ctx context.Context, b []byte, offset int64, fua bool) (int, error) {
+	n, err := cb.Backend.WriteAt(ctx, b, offset, fua)
+	if err == nil && cb.warmOnWrite {
+		// only blocks entirely written are warm, as the rest of a
+		// partially written block would still need fetching
+		first := (uint64(offset) + cb.blockSize - 1) / cb.blockSize
+		last := (uint64(offset) + uint64(n)) / cb.blockSize
+		if first < last {
+			cb.setWarm(first, last)
+		}
+	}
+	return n, err
+}
+
+// Cache implements Cacher.Cache
+//
+// Prefetching a cold block incurs the delay once, then leaves it warm
+func (cb *ColdReadBackend) Cache(ctx context.Context, length int, offset int64) (int, error) {
+	if err := cb.fetch(ctx, length, offset); err != nil {
+		return 0, err
+	}
+	if cacher, ok := cb.Backend.(Cacher); ok {
+		return cacher.Cache(ctx, length, offset)
+	}
+	return length, nil
+}
+
+// IOHints implements IOHinter.IOHints
+func (cb *ColdReadBackend) IOHints(ctx context.Context) IOHints {
+	return backendIOHints(ctx, cb.Backend)
+}
+
+// newColdReadBackend wraps a backend in a ColdReadBackend if the export
+// configures a cold read delay
+func newColdReadBackend(ctx context.Context, ec *ExportConfig, backend Backend) (Backend, error) {
+	delayParam := ec.DriverParameters["coldreaddelay"]
+	if delayParam == "" {
+		return backend, nil
+	}
+	delay, err := time.ParseDuration(delayParam)
+	if err != nil {
+		return nil, fmt.Errorf("Bad cold read delay: %v", err)
+	}
+	blockSize := uint64(defaultColdReadBlockSize)
+	if bs := ec.DriverParameters["coldreadblocksize"]; bs != "" {
+		if blockSize, err = strconv.ParseUint(bs, 10, 64); err != nil || blockSize == 0 {
+			return nil, fmt.Errorf("Bad cold read block size '%s'", bs)
+		}
+	}
+	warmOnWrite, err := isTrue(ec.DriverParameters["coldreadwarmonwrite"])
+	if err != nil {
+		return nil, err
+	}
+	size, _, _, _, err := backend.Geometry(ctx)
+	if err != nil {
+		return nil, err
+	}
+	numBlocks := (size + blockSize - 1) / blockSize
+	return &ColdReadBackend{
+		Backend:     backend,
+		delay:       delay,
+		blockSize:   blockSize,
+		warmOnWrite: warmOnWrite,
+		warm:        make([]uint64, (numBlocks+63)/64),
+	}, nil
+}
@@ -0,0 +1,75 @@
+package nbd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The commands an export's allowcommands and denycommands may list, by name
+var commandNames = map[string]uint16{
+	"read":        NBD_CMD_READ,
+	"write":       NBD_CMD_WRITE,
+	"flush":       NBD_CMD_FLUSH,
+	"trim":        NBD_CMD_TRIM,
+	"cache":       NBD_CMD_CACHE,
+	"writezeroes": NBD_CMD_WRITE_ZEROES,
+	"close":       NBD_CMD_CLOSE,
+}
+
+// commandMask is a set of commands, with a bit set for each by command number
+type commandMask uint32
+
+// has returns true if the set includes the command
+func (m commandMask) has(cmd uint16) bool {
+	return cmd < 32 && m&(1<<cmd) != 0
+}
+
+// parseCommandList parses a comma separated list of command names into a set
+func parseCommandList(list string) (commandMask, error) {
+	var m commandMask
+	for _, name := range strings.Split(list, ",") {
+		cmd, ok := commandNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return 0, fmt.Errorf("Bad command '%s'", name)
+		}
+		m |= 1 << cmd
+	}
+	return m, nil
+}
+
+// exportDeniedCommands returns the commands an export denies: those not in its
+// allowcommands, if set, and those in its denycommands. NBD_CMD_DISC cannot be
+// denied, as a client must always be able to disconnect
+func exportDeniedCommands(ec *ExportConfig) (commandMask, error) {
+	allowParam, denyParam := ec.DriverParameters["allowcommands"], ec.DriverParameters["denycommands"]
+	var denied commandMask
+	if allowParam != "" {
+		allowed, err := parseCommandList(allowParam)
+		if err != nil {
+			return 0, err
+		}
+		for _, cmd := range commandNames {
+			if !allowed.has(cmd) {
+				denied |= 1 << cmd
+			}
+		}
+	}
+	if denyParam != "" {
+		d, err := parseCommandList(denyParam)
+		if err != nil {
+			return 0, err
+		}
+		denied |= d
+	}
+	return denied, nil
+}
+
+// deniedCommandError returns the NBD error replied to a command the export
+// denies: NBD_EPERM for one that would write, as for a read-only export, and
+// NBD_EINVAL for any other, as for a command not advertised
+func deniedCommandError(cmd uint16) uint32 {
+	if CmdTypeMap[int(cmd)]&CMDT_CHECK_NOT_READ_ONLY != 0 {
+		return NBD_EPERM
+	}
+	return NBD_EINVAL
+}
@@ -22,6 +22,7 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
 /* Example configuration:
@@ -54,7 +55,7 @@ logging:
 // Location of the config file on disk; overriden by flags
 var configFile = flag.String("c", "/etc/gonbdserver.conf", "Path to YAML config file")
 var pidFile = flag.String("p", "/var/run/gonbdserver.pid", "Path to PID file")
-var sendSignal = flag.String("s", "", "Send signal to daemon (either \"stop\" or \"reload\")")
+var sendSignal = flag.String("s", "", "Send signal to daemon (\"stop\", \"reload\", \"quiesce\" or \"resume\")")
 var foreground = flag.Bool("f", false, "Run in foreground (not as daemon)")
 var pprof = flag.Bool("pprof", false, "Run pprof")
 
@@ -67,20 +68,39 @@ type Control struct {
 	quit chan struct{}
 }
 
-// Config holds the config that applies to all servers (currently just logging), and an array of server configs
+// Config holds the config that applies to all servers, and an array of server configs
 type Config struct {
-	Servers []ServerConfig // array of server configs
-	Logging LogConfig      // Configuration for logging
+	Servers          []ServerConfig      // array of server configs
+	Logging          LogConfig           // Configuration for logging
+	AccessLog        AccessLogConfig     // Configuration for the access log
+	MaxConnections   int                 // maximum concurrent connections across all servers (0 for unlimited)
+	MaxExports       int                 // maximum number of exports across all servers (0 for unlimited)
+	MaxCacheMemory   int64               // maximum bytes held by the caches of all exports together (0 for unlimited)
+	AgentCheck       string              // TCP address on which to serve HAProxy agent checks, if any
+	AutoExportRescan time.Duration       // how often to check for files matching autoexport globs changing (0 to check only on reload)
+	ShutdownTimeout  time.Duration       // maximum time connections wait on shutdown for the commands in flight (0 for the default)
+	autoExports      map[string][]string // the files each autoexport glob matched
 }
 
 // ServerConfig holds the config that applies to each server (i.e. listener)
 type ServerConfig struct {
-	Protocol        string         // protocol it should listen on (in net.Conn form)
-	Address         string         // address to listen on
-	DefaultExport   string         // name of default export
-	Exports         []ExportConfig // array of configurations of exported items
-	Tls             TlsConfig      // TLS configuration
-	DisableNoZeroes bool           // Disable NoZereos extension
+	Protocol              string         // protocol it should listen on (in net.Conn form)
+	Address               string         // address to listen on
+	DefaultExport         string         // name of default export
+	Exports               []ExportConfig // array of configurations of exported items
+	Tls                   TlsConfig      // TLS configuration
+	DisableNoZeroes       bool           // Disable NoZereos extension
+	Backlog               int            // listen backlog (0 for the default)
+	Acceptors             int            // number of goroutines accepting connections (0 for the default)
+	NegotiationTimeout    time.Duration  // maximum total time to complete negotiation (0 for the default)
+	MaxOptions            int            // maximum number of options processed in negotiation (0 for the default)
+	OnStartTlsUnavailable string         // what to do when a client requests TLS that is not configured: unsup (the default) or close
+	Strict                bool           // reject clients setting reserved fields, rather than ignoring them
+	CheckFraming          bool           // check each write's payload is followed by a request, rather than data
+	ConnRate              float64        // maximum rate of new connections per second (0 for no limit)
+	ConnBurst             int            // number of new connections allowed in a burst above connrate (0 for the default)
+	OnConnRateExceeded    string         // what to do with connections beyond the rate: delay (the default) or close
+	VerboseErrors         bool           // send clients the cause of an export being unavailable, rather than only logging it
 }
 
 // ExportConfig holds the config for one exported item
@@ -94,18 +114,30 @@ type ExportConfig struct {
 	MinimumBlockSize   uint64                 // minimum block size
 	PreferredBlockSize uint64                 // preferred block size
 	MaximumBlockSize   uint64                 // maximum block size
+	Labels             map[string]string      // arbitrary labels for organising exports
+	IoPrio             IoPrioConfig           // I/O priority of the backend's I/O (Linux only)
 	DriverParameters   DriverParametersConfig `yaml:",inline"` // driver parameters. These are an arbitrary map. Inline means they go aside teh foregoing
 }
 
 // TlsConfig has the configuration for TLS
 type TlsConfig struct {
-	KeyFile    string // path to TLS key file
-	CertFile   string // path to TLS cert file
-	ServerName string // server name
-	CaCertFile string // path to certificate file
-	ClientAuth string // client authentication strategy
-	MinVersion string // minimum TLS version
-	MaxVersion string // maximum TLS version
+	KeyFile            string        // path to TLS key file
+	CertFile           string        // path to TLS cert file
+	ServerName         string        // server name
+	CaCertFile         string        // path to certificate file
+	ClientAuth         string        // client authentication strategy
+	MinVersion         string        // minimum TLS version
+	MaxVersion         string        // maximum TLS version
+	CrlFile            string        // path to a CRL file to check client certificates against
+	OcspServer         string        // URL of an OCSP responder to check client certificates against, or "aia"
+	RevocationFailOpen bool          // accept client certificates whose revocation status cannot be determined
+	HandshakeTimeout   time.Duration // maximum time to complete the TLS handshake after STARTTLS
+}
+
+// IoPrioConfig has the configuration for the I/O priority of an export
+type IoPrioConfig struct {
+	Class string // I/O scheduling class: none, realtime, best-effort or idle
+	Level int    // priority level within the class, from 0 (highest) to 7
 }
 
 // DriverConfig is an arbitrary map of other parameters in string format
@@ -256,13 +288,25 @@ func (s *SyslogWriter) Write(p []byte) (n int, err error) {
 
 // ParseConfig parses the YAML configuration provided
 func ParseConfig() (*Config, error) {
-	if buf, err := ioutil.ReadFile(*configFile); err != nil {
+	return parseConfigFile(*configFile)
+}
+
+// parseConfigFile parses the YAML configuration file at path
+func parseConfigFile(path string) (*Config, error) {
+	if buf, err := ioutil.ReadFile(path); err != nil {
 		return nil, err
 	} else {
-		c := &Config{}
+		c := &Config{autoExports: make(map[string][]string)}
 		if err := yaml.Unmarshal(buf, c); err != nil {
 			return nil, err
 		}
+		if c.AutoExportRescan < 0 {
+			return nil, fmt.Errorf("Bad autoexport rescan interval %s", c.AutoExportRescan)
+		}
+		if c.ShutdownTimeout < 0 {
+			return nil, fmt.Errorf("Bad shutdown timeout %s", c.ShutdownTimeout)
+		}
+		exports := 0
 		for i, _ := range c.Servers {
 			if c.Servers[i].Protocol == "" {
 				c.Servers[i].Protocol = "tcp"
@@ -270,11 +314,73 @@ func ParseConfig() (*Config, error) {
 			if c.Servers[i].Protocol == "tcp" && c.Servers[i].Address == "" {
 				c.Servers[i].Protocol = fmt.Sprintf("0.0.0.0:%d", NBD_DEFAULT_PORT)
 			}
+			if c.Servers[i].Exports, err = expandAutoExports(c.Servers[i].Exports, c.autoExports); err != nil {
+				return nil, err
+			}
+			if c.Servers[i].Exports, err = expandPartitions(c.Servers[i].Exports); err != nil {
+				return nil, err
+			}
+			for j := range c.Servers[i].Exports {
+				if err := validateLabels(&c.Servers[i].Exports[j]); err != nil {
+					return nil, err
+				}
+				if err := validateBlockSizes(&c.Servers[i].Exports[j]); err != nil {
+					return nil, err
+				}
+				if _, err := exportMaxConnections(&c.Servers[i].Exports[j]); err != nil {
+					return nil, fmt.Errorf("Export %s: %v", c.Servers[i].Exports[j].Name, err)
+				}
+				if _, err := exportOpenFailureReply(&c.Servers[i].Exports[j]); err != nil {
+					return nil, fmt.Errorf("Export %s: %v", c.Servers[i].Exports[j].Name, err)
+				}
+				if _, err := exportDeniedCommands(&c.Servers[i].Exports[j]); err != nil {
+					return nil, fmt.Errorf("Export %s: %v", c.Servers[i].Exports[j].Name, err)
+				}
+				if _, _, err := exportMultiConn(&c.Servers[i].Exports[j]); err != nil {
+					return nil, fmt.Errorf("Export %s: %v", c.Servers[i].Exports[j].Name, err)
+				}
+			}
+			exports += len(c.Servers[i].Exports)
+		}
+		if err := validateAccessLog(&c.AccessLog); err != nil {
+			return nil, err
+		}
+		if c.MaxCacheMemory < 0 {
+			return nil, fmt.Errorf("Bad maximum cache memory %d", c.MaxCacheMemory)
+		}
+		if c.MaxExports > 0 && exports > c.MaxExports {
+			return nil, fmt.Errorf("Configuration has %d exports, exceeding the maximum of %d", exports, c.MaxExports)
 		}
 		return c, nil
 	}
 }
 
+// validateBlockSizes checks the block sizes configured for an export are
+// consistent. Each may be left unset (zero) to use the backend's. The minimum
+// and preferred block sizes must be powers of two, the maximum a multiple of
+// both, and they must be in order
+func validateBlockSizes(ec *ExportConfig) error {
+	minimum, preferred, maximum := ec.MinimumBlockSize, ec.PreferredBlockSize, ec.MaximumBlockSize
+	if minimum&(minimum-1) != 0 {
+		return fmt.Errorf("Export %s minimum block size %d is not a power of two", ec.Name, minimum)
+	}
+	if preferred&(preferred-1) != 0 {
+		return fmt.Errorf("Export %s preferred block size %d is not a power of two", ec.Name, preferred)
+	}
+	if maximum > 0xffffffff {
+		return fmt.Errorf("Export %s maximum block size %d is too large", ec.Name, maximum)
+	}
+	if minimum != 0 && preferred != 0 && minimum > preferred {
+		return fmt.Errorf("Export %s minimum block size %d exceeds its preferred block size %d", ec.Name, minimum, preferred)
+	}
+	for _, bs := range []uint64{minimum, preferred} {
+		if bs != 0 && maximum != 0 && (maximum < bs || maximum%bs != 0) {
+			return fmt.Errorf("Export %s maximum block size %d is not a multiple of its block size %d", ec.Name, maximum, bs)
+		}
+	}
+	return nil
+}
+
 // Startserver starts a single server.
 //
 // A parent context is given in which the listener runs, as well as a session context in which the sessions (connections) themselves run.
@@ -359,10 +465,16 @@ func RunConfig(control *Control) {
 	term := make(chan os.Signal, 1)
 	hup := make(chan os.Signal, 1)
 	usr1 := make(chan os.Signal, 1)
+	usr2 := make(chan os.Signal, 1)
+	tstp := make(chan os.Signal, 1)
+	cont := make(chan os.Signal, 1)
 	defer close(intr)
 	defer close(term)
 	defer close(hup)
 	defer close(usr1)
+	defer close(usr2)
+	defer close(tstp)
+	defer close(cont)
 	if control == nil {
 		signal.Notify(intr, os.Interrupt)
 		signal.Notify(term, syscall.SIGTERM)
@@ -370,6 +482,9 @@ func RunConfig(control *Control) {
 	}
 
 	signal.Notify(usr1, syscall.SIGUSR1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	signal.Notify(tstp, syscall.SIGTSTP)
+	signal.Notify(cont, syscall.SIGCONT)
 	go func() {
 		for {
 			select {
@@ -382,6 +497,24 @@ func RunConfig(control *Control) {
 				logger.Println("[INFO] GC() done")
 				debug.FreeOSMemory()
 				logger.Println("[INFO] FreeOsMemory() done")
+			case _, ok := <-usr2:
+				if !ok {
+					return
+				}
+				logger.Println("[INFO] Confirming pending failovers")
+				ConfirmFailovers()
+			case _, ok := <-tstp:
+				if !ok {
+					return
+				}
+				logger.Println("[INFO] Quiescing; new connections will be rejected")
+				Quiesce()
+			case _, ok := <-cont:
+				if !ok {
+					return
+				}
+				logger.Println("[INFO] Resuming; new connections will be accepted")
+				Resume()
 			}
 		}
 	}()
@@ -389,12 +522,13 @@ func RunConfig(control *Control) {
 	for {
 		var wg sync.WaitGroup
 		configCtx, configCancelFunc := context.WithCancel(ctx)
+		rescan := make(chan struct{}, 1)
 		if c, err := ParseConfig(); err != nil {
-			logger.Println("[ERROR] Cannot parse configuration file: %v", err)
+			logger.Printf("[ERROR] Cannot parse configuration file: %v", err)
 			return
 		} else {
 			if nlogger, nlogCloser, err := c.GetLogger(); err != nil {
-				logger.Println("[ERROR] Could not load logger: %v", err)
+				logger.Printf("[ERROR] Could not load logger: %v", err)
 			} else {
 				if logCloser != nil {
 					logCloser.Close()
@@ -402,11 +536,29 @@ func RunConfig(control *Control) {
 				logger = nlogger
 				logCloser = nlogCloser
 			}
+			setBackendLogger(logger)
+			if err := connectionAccessLog.configure(&c.AccessLog); err != nil {
+				logger.Printf("[ERROR] Could not open access log: %v", err)
+			}
 			logger.Printf("[INFO] Loaded configuration. Available backends: %s.", strings.Join(GetBackendNames(), ", "))
+			setMaxConnections(c.MaxConnections)
+			cacheMemory.setLimit(c.MaxCacheMemory)
+			setShutdownTimeout(c.ShutdownTimeout)
+			setCopyExports(c)
+			forgetRemovedExports()
+			reportUncleanExports(logger, c)
+			if c.AgentCheck != "" {
+				if err := runAgentCheck(configCtx, logger, c.AgentCheck); err != nil {
+					logger.Printf("[ERROR] Cannot serve agent checks on %s: %v", c.AgentCheck, err)
+				}
+			}
+			if c.AutoExportRescan > 0 && len(c.autoExports) > 0 {
+				go watchAutoExports(configCtx, logger, c.autoExports, c.AutoExportRescan, rescan)
+			}
 			for _, s := range c.Servers {
 				s := s // localise loop variable
+				wg.Add(1)
 				go func() {
-					wg.Add(1)
 					StartServer(configCtx, ctx, &sessionWaitGroup, logger, s)
 					wg.Done()
 				}()
@@ -429,6 +581,10 @@ func RunConfig(control *Control) {
 				logger.Println("[INFO] Reload signal received; reloading configuration which will be effective for new connections")
 				configCancelFunc() // kill the listeners but not the sessions
 				wg.Wait()
+			case <-rescan:
+				logger.Println("[INFO] Autoexport files changed; reloading configuration which will be effective for new connections")
+				configCancelFunc() // kill the listeners but not the sessions
+				wg.Wait()
 			}
 		}
 	}
@@ -449,6 +605,8 @@ func Run(control *Control) {
 
 	daemon.AddFlag(daemon.StringFlag(sendSignal, "stop"), syscall.SIGTERM)
 	daemon.AddFlag(daemon.StringFlag(sendSignal, "reload"), syscall.SIGHUP)
+	daemon.AddFlag(daemon.StringFlag(sendSignal, "quiesce"), syscall.SIGTSTP)
+	daemon.AddFlag(daemon.StringFlag(sendSignal, "resume"), syscall.SIGCONT)
 
 	if daemon.WasReborn() {
 		if val := os.Getenv(ENV_CONFFILE); val != "" {
@@ -1,24 +1,38 @@
 package nbd
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/tls"
 	"encoding/binary"
 	"errors"
+	"expvar"
 	"fmt"
 	"golang.org/x/net/context"
+	"hash/crc32"
 	"io"
 	"log"
+	"math"
 	"net"
+	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 // Default number of workers
 var DefaultWorkers = 5
 
+// Default largest payload accepted or returned by a single command
+var DefaultMaxPayload uint64 = 128 * 1024 * 1024
+
+// Default largest NBD_REPLY_TYPE_OFFSET_DATA chunk in a structured read reply
+var DefaultMaxChunkSize uint64 = 4 * 1024 * 1024
+
 // Map of configuration text to TLS versions
 var tlsVersionMap = map[string]uint16{
 	"ssl3.0": tls.VersionSSL30,
@@ -36,11 +50,35 @@ var tlsClientAuthMap = map[string]tls.ClientAuthType{
 	"requireverify": tls.RequireAndVerifyClientCert,
 }
 
+// Default maximum time to complete the TLS handshake after acknowledging NBD_OPT_STARTTLS
+var DefaultTlsHandshakeTimeout = 5 * time.Second
+
+// Default maximum total time to complete negotiation, however actively the client haggles
+var DefaultNegotiationTimeout = 30 * time.Second
+
+// Default maximum number of options processed in a negotiation
+var DefaultMaxOptions = 256
+
 // ConnectionParameters holds parameters for each inbound connection
 type ConnectionParameters struct {
-	ConnectionTimeout time.Duration // maximum time to complete negotiation
+	ConnectionTimeout   time.Duration // maximum time to wait for the client during negotiation
+	NegotiationTimeout  time.Duration // maximum total time to complete negotiation
+	MaxOptions          int           // maximum number of options processed in negotiation
+	TlsHandshakeTimeout time.Duration // maximum time to complete the TLS handshake after STARTTLS
 }
 
+// Connection states. A connection moves through these in order, and may move
+// to connClosing from any of them
+const (
+	connHandshaking  int32 = iota // sending the header and reading the client flags
+	connNegotiating               // processing options
+	connTransmitting              // serving commands
+	connClosing                   // tearing down
+)
+
+// Names of the connection states, for logging
+var connStateNames = []string{"handshaking", "negotiating", "transmitting", "closing"}
+
 // Connection holds the details for each connection
 type Connection struct {
 	params             *ConnectionParameters // parameters
@@ -57,6 +95,25 @@ type Connection struct {
 	name               string                // the name of the connection for logging purposes
 	disconnectReceived int64                 // nonzero if disconnect has been received
 	numInflight        int64                 // number of inflight requests
+	writeChecksum      bool                  // true if the client negotiated NBD_OPT_X_WRITE_CHECKSUM
+	structuredReplies  bool                  // true if the client negotiated NBD_OPT_STRUCTURED_REPLY (or NBD_OPT_EXTENDED_HEADERS)
+	extendedHeaders    bool                  // true if the client negotiated NBD_OPT_EXTENDED_HEADERS, so requests and replies have 64 bit lengths
+	allocationContext  string                // the export for which the client selected base:allocation, if any
+	blockStatus        bool                  // true if command 7 is NBD_CMD_BLOCK_STATUS rather than NBD_CMD_CLOSE
+	exportSlot         *string               // the name of the export whose connection slot we hold, if any
+	stats              *expvar.Map           // the counters of the export, once negotiated
+	state              int32                 // the connection's state (see connHandshaking), accessed atomically
+	draining           int32                 // nonzero once the connection is being closed gracefully, accessed atomically
+	midRequest         int32                 // nonzero whilst the receiver is reading a request past its header, accessed atomically
+	shutdown           <-chan struct{}       // closed once the server is shutting down
+	removed            chan struct{}         // closed once the export is removed, to close the connection gracefully
+	linger             time.Duration         // how long to wait for the commands in flight once the export is removed, set before removed is closed
+	closed             chan struct{}         // closed once the connection has closed
+	graceful           bool                  // whether the connection closed gracefully once the export was removed, set before closed is closed
+	connected          time.Time             // when the connection was accepted
+	bytesRead          int64                 // bytes read by the client, accessed atomically
+	bytesWritten       int64                 // bytes written or zeroed by the client, accessed atomically
+	commandCounts      [32]int64             // commands received by command number, accessed atomically
 
 	memBlockCh         chan []byte // channel of memory blocks that are free
 	memBlocksMaximum   int64       // maximum blocks that may be allocated
@@ -64,9 +121,10 @@ type Connection struct {
 	memBlocksFreeLWM   int         // smallest number of blocks free over period
 	memBlocksMutex     sync.Mutex  // protects memBlocksAllocated and memBlocksFreeLWM
 
-	killCh    chan struct{} // closed by workers to indicate a hard close is required
-	killed    bool          // true if killCh closed already
-	killMutex sync.Mutex    // protects killed
+	killCh      chan struct{} // closed by workers to indicate a hard close is required
+	killed      bool          // true if killCh closed already
+	closeReason string        // why the connection is closing, for the access log
+	killMutex   sync.Mutex    // protects killed and closeReason
 }
 
 // Backend is an interface implemented by the various backend drivers
@@ -81,39 +139,183 @@ type Backend interface {
 	HasFlush(ctx context.Context) bool                                          // does the driver support flush?
 }
 
+// Cacher is an optional interface implemented by backends that can prefetch data
+// in response to NBD_CMD_CACHE
+type Cacher interface {
+	Cache(ctx context.Context, length int, offset int64) (int, error) // prefetch length bytes at offset
+}
+
+// Barrierer is an optional interface implemented by backends that can order
+// writes without making them durable, e.g. a journaled or log-structured store.
+// Barrier returns once every write completed before it is ordered ahead of every
+// write after it, so that after a crash the writes that survive are a prefix of
+// those made; unlike Flush, it need not make any of them durable
+type Barrierer interface {
+	Barrier(ctx context.Context) error // order the writes completed so far ahead of those to come
+}
+
+// VectoredReader is an optional interface implemented by backends that can read
+// into several buffers with one operation, e.g. with preadv
+type VectoredReader interface {
+	ReadAtv(ctx context.Context, bufs [][]byte, offset int64) (int, error) // read to bufs in turn from offset
+}
+
+// VectoredWriter is an optional interface implemented by backends that can write
+// several buffers with one operation, e.g. with pwritev
+type VectoredWriter interface {
+	WriteAtv(ctx context.Context, bufs [][]byte, offset int64, fua bool) (int, error) // write bufs in turn at offset, with force unit access optional
+}
+
+// HolePuncher is an optional interface implemented by backends that can zero a
+// range by deallocating it, e.g. by punching a hole in a sparse file, so that
+// NBD_CMD_WRITE_ZEROES need not write zeroes unless the client sets
+// NBD_CMD_FLAG_NO_HOLE. PunchHoleAt returns errPunchHoleUnsupported if the
+// backend's storage turns out not to support holes, for zeroes to be written instead
+type HolePuncher interface {
+	PunchHoleAt(ctx context.Context, length int, offset int64, fua bool) (int, error) // deallocate length bytes at offset, with force unit access optional
+}
+
+// MultiConner is an optional interface implemented by backends that are
+// consistent across connections even though each opens its own: a write
+// completed through one is read through the others, and a flush through one
+// makes durable the writes completed through all of them, as for a file whose
+// descriptors share the page cache. Such backends advertise
+// NBD_FLAG_CAN_MULTI_CONN, so clients may spread their commands over several
+// connections
+type MultiConner interface {
+	MultiConn(ctx context.Context) bool // are backends opened separately for the export consistent?
+}
+
+// Zeroer is an optional interface implemented by backends that can zero a range
+// without writing zeroes and keep it allocated, e.g. with
+// fallocate(FALLOC_FL_ZERO_RANGE), so that NBD_CMD_WRITE_ZEROES is fast even
+// with NBD_CMD_FLAG_NO_HOLE. ZeroAt returns errZeroUnsupported if the backend's
+// storage turns out not to support it, for zeroes to be written instead
+type Zeroer interface {
+	ZeroAt(ctx context.Context, length int, offset int64, fua bool) (int, error) // zero length bytes at offset, with force unit access optional
+}
+
+// Extent is a range of a backend, as reported by an ExtentLister
+type Extent struct {
+	Length uint64 // length of the range in bytes
+	Hole   bool   // true if the range is not allocated
+	Zero   bool   // true if the range reads as zeroes
+}
+
+// ExtentLister is an optional interface implemented by backends that can report
+// which ranges of their storage are allocated, for NBD_CMD_BLOCK_STATUS. Extents
+// returns the extents in order from offset, which may cover less than length
+// bytes (but not more). A backend without it is reported as allocated throughout
+type ExtentLister interface {
+	Extents(ctx context.Context, length int, offset int64) ([]Extent, error) // the extents of length bytes at offset
+}
+
+// errPunchHoleUnsupported is returned by a HolePuncher whose storage does not support holes
+var errPunchHoleUnsupported = errors.New("Punching holes is not supported")
+
+// errZeroUnsupported is returned by a Zeroer whose storage cannot zero a range
+var errZeroUnsupported = errors.New("Zeroing ranges is not supported")
+
+// IOHints describes the I/O at which a backend performs best, beyond its block sizes
+type IOHints struct {
+	ReadSize  uint64 // size of the reads performing best, or 0 if none
+	WriteSize uint64 // size of the writes performing best, or 0 if none
+	Alignment uint64 // I/O should not straddle multiples of this, or 0 if none
+
+	Device *DeviceHints // characteristics of the device behind the backend, or nil if unknown
+}
+
+// DeviceHints describes the device behind a backend, for clients that tune their
+// queue depth and scheduling to suit
+type DeviceHints struct {
+	Rotational  bool          // true if the device is rotational, so seeks are slow
+	SeekLatency time.Duration // approximate time to seek, or 0 if unknown
+	QueueDepth  uint16        // number of commands in flight at which the device performs best, or 0 if unknown
+}
+
+// IOHinter is an optional interface implemented by backends that know the I/O
+// sizes and alignment at which they perform best, e.g. a stripe's width
+type IOHinter interface {
+	IOHints(ctx context.Context) IOHints // hints for I/O to the backend
+}
+
 // BackendMap is a map between backends and the generator function for them
 var BackendMap map[string]func(ctx context.Context, e *ExportConfig) (Backend, error) = make(map[string]func(ctx context.Context, e *ExportConfig) (Backend, error))
 
 // Details of an export
 type Export struct {
-	size               uint64 // size in bytes
-	minimumBlockSize   uint64 // minimum block size
-	preferredBlockSize uint64 // preferred block size
-	maximumBlockSize   uint64 // maximum block size
-	memoryBlockSize    uint64 // block size for memory chunks
-	exportFlags        uint16 // export flags in NBD format
-	name               string // name of the export
-	description        string // description of the export
-	readonly           bool   // true if read only
-	workers            int    // number of workers
-	tlsonly            bool   // true if only to be served over tls
+	size               uint64        // size in bytes
+	minimumBlockSize   uint64        // minimum block size
+	preferredBlockSize uint64        // preferred block size
+	maximumBlockSize   uint64        // maximum block size
+	memoryBlockSize    uint64        // block size for memory chunks
+	exportFlags        uint16        // export flags in NBD format
+	name               string        // name of the export
+	description        string        // description of the export
+	readonly           bool          // true if read only
+	workers            int           // number of workers
+	tlsonly            bool          // true if only to be served over tls
+	reconnectGrace     time.Duration // how long the backend is kept open for a client to reconnect
+	maxPayload         uint64        // largest payload accepted or returned by a single command
+	maxChunkSize       uint64        // largest data chunk in a structured read reply
+	chunkAlign         uint64        // alignment of the boundaries between chunks in a structured read reply
+	detectZeros        bool          // true to send data read as zeroes as holes in a structured read reply
+	disconnectOnError  bool          // true to close the connection on a backend error rather than reply with it
+	commandTimeout     time.Duration // how long the backend has to complete a command before it is failed, or 0 for no limit
+	barrier            Barrierer     // satisfies flushes with a barrier rather than a full flush, or nil
+	flushHealth        *flushHealth  // whether the export's last flush failed
+	rejectWritesUnsafe bool          // true to fail writes while the export's last flush has failed
+	ioHints            IOHints       // how to split I/O to the backend
+	deviceHints        *DeviceHints  // the device hints advertised, or nil if none
+	deniedCommands     commandMask   // the commands the export refuses
 }
 
 // Request is an internal structure for propagating requests through the channels
 type Request struct {
-	nbdReq  nbdRequest // the request in nbd format
-	nbdRep  nbdReply   // the reply in nbd format
-	length  uint64     // the checked length
-	offset  uint64     // the checked offset
-	reqData [][]byte   // request data (e.g. for a write)
-	repData [][]byte   // reply data (e.g. for a read)
-	flags   uint64     // our internal flag structure characterizing the request
+	nbdReq     nbdRequest  // the request in nbd format
+	nbdRep     nbdReply    // the reply in nbd format
+	length     uint64      // the checked length
+	offset     uint64      // the checked offset
+	reqData    [][]byte    // request data (e.g. for a write)
+	repData    [][]byte    // reply data (e.g. for a read)
+	flags      uint64      // our internal flag structure characterizing the request
+	checksum   uint32      // the checksum sent with the request data, if NBD_OPT_X_WRITE_CHECKSUM is in use
+	readErrors []readError // the ranges of a read that failed, in order, if it is replied to with structured replies
+	holes      []readHole  // the holes in a read, in order, if it is replied to with structured replies
+
+	blockStatus bool                         // true if the request is NBD_CMD_BLOCK_STATUS
+	extents     []nbdExtendedBlockDescriptor // the reply to NBD_CMD_BLOCK_STATUS
+}
+
+// readError is a range of a read that failed, reported to the client in an
+// NBD_REPLY_TYPE_ERROR_OFFSET chunk
+type readError struct {
+	offset uint64 // offset of the range
+	length uint64 // length of the range
+	err    uint32 // the NBD error
+}
+
+// readHole is a range of a read that reads as zeroes, reported to the client in
+// an NBD_REPLY_TYPE_OFFSET_HOLE chunk rather than sent as data
+type readHole struct {
+	offset uint64 // offset of the range
+	length uint64 // length of the range
 }
 
+// Smallest hole in a read replied to with an NBD_REPLY_TYPE_OFFSET_HOLE chunk.
+// Smaller holes are sent as data, as the chunk would save little
+const minimumReadHole = 4096
+
 // newConection returns a new Connection object
 func newConnection(listener *Listener, logger *log.Logger, conn net.Conn) (*Connection, error) {
 	params := &ConnectionParameters{
-		ConnectionTimeout: time.Second * 5,
+		ConnectionTimeout:   time.Second * 5,
+		NegotiationTimeout:  listener.negotiationTimeout,
+		MaxOptions:          listener.maxOptions,
+		TlsHandshakeTimeout: listener.tls.HandshakeTimeout,
+	}
+	if params.TlsHandshakeTimeout <= 0 {
+		params.TlsHandshakeTimeout = DefaultTlsHandshakeTimeout
 	}
 	c := &Connection{
 		plainConn: conn,
@@ -126,8 +328,29 @@ func newConnection(listener *Listener, logger *log.Logger, conn net.Conn) (*Conn
 
 // NbdError translates an error returned by golang into an NBD error
 //
-// This function could do with some serious work!
+// Errors that wrap a system errno are mapped to the equivalent NBD error
+// where one exists; anything else is reported as an I/O error
 func NbdError(err error) uint32 {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	if errno, ok := err.(syscall.Errno); ok {
+		switch errno {
+		case syscall.EPERM:
+			return NBD_EPERM
+		case syscall.ENOMEM:
+			return NBD_ENOMEM
+		case syscall.EINVAL:
+			return NBD_EINVAL
+		case syscall.ENOSPC:
+			return NBD_ENOSPC
+		case syscall.EOVERFLOW:
+			return NBD_EOVERFLOW
+		}
+	}
 	return NBD_EIO
 }
 
@@ -271,12 +494,36 @@ func (c *Connection) ReturnMemory(ctx context.Context) {
 func (c *Connection) Receive(ctx context.Context) {
 	defer func() {
 		c.logger.Printf("[INFO] Receiver exiting for %s", c.name)
-		c.Kill(ctx)
+		// when closing gracefully, the commands received are still served
+		if atomic.LoadInt32(&c.draining) == 0 {
+			c.Kill(ctx)
+		}
+		atomic.StoreInt32(&c.midRequest, 0)
 		c.wg.Done()
 	}()
+	// reading commands during negotiation would misread options or the
+	// bytes following the final one as commands
+	if state := atomic.LoadInt32(&c.state); state != connTransmitting {
+		c.logger.Printf("[ERROR] Client %s cannot receive commands whilst %s", c.name, connStateNames[state])
+		return
+	}
+	// checking framing means peeking at the next request, so needs a buffer
+	var r io.Reader = c.conn
+	var br *bufio.Reader
+	if c.listener.checkFraming {
+		br = bufio.NewReader(c.conn)
+		r = br
+	}
+	var lastWrite *nbdRequest // the last request with a payload, if the one before this
 	for {
+		atomic.StoreInt32(&c.midRequest, 0)
 		req := Request{}
-		if err := binary.Read(c.conn, binary.BigEndian, &req.nbdReq); err != nil {
+		length, err := c.readRequestHeader(r, &req.nbdReq)
+		if err != nil {
+			if atomic.LoadInt32(&c.draining) != 0 {
+				c.logger.Printf("[INFO] Client %s no longer being read from, as the connection is closing", c.name)
+				return
+			}
 			if nerr, ok := err.(net.Error); ok {
 				if nerr.Timeout() {
 					c.logger.Printf("[INFO] Client %s timeout, closing connection", c.name)
@@ -287,18 +534,32 @@ func (c *Connection) Receive(ctx context.Context) {
 				// Don't report this - we closed it
 				return
 			}
-			if err == io.EOF {
+			if c.export.reconnectGrace > 0 {
+				// this may be a transient network failure, so do not treat it as an error
+				c.logger.Printf("[INFO] Client %s disconnected (%s), keeping export open for %s for it to reconnect", c.name, err, c.export.reconnectGrace)
+			} else if err == io.EOF {
 				c.logger.Printf("[WARN] Client %s closed connection abruptly", c.name)
 			} else {
 				c.logger.Printf("[ERROR] Client %s could not read request: %s", c.name, err)
 			}
 			return
 		}
+		// a connection closing gracefully waits for this request too
+		atomic.StoreInt32(&c.midRequest, 1)
 
-		if req.nbdReq.NbdRequestMagic != NBD_REQUEST_MAGIC {
-			c.logger.Printf("[ERROR] Client %s had bad magic number in request", c.name)
+		magic := uint32(NBD_REQUEST_MAGIC)
+		if c.extendedHeaders {
+			magic = NBD_EXTENDED_REQUEST_MAGIC
+		}
+		if req.nbdReq.NbdRequestMagic != magic {
+			if lastWrite != nil {
+				c.logger.Printf("[ERROR] Client %s had bad magic number in request following write (off=%08x,len=%08x): protocol desync, as its payload was probably not of the length declared", c.name, lastWrite.NbdOffset, lastWrite.NbdLength)
+			} else {
+				c.logger.Printf("[ERROR] Client %s had bad magic number in request", c.name)
+			}
 			return
 		}
+		lastWrite = nil
 
 		req.nbdRep = nbdReply{
 			NbdReplyMagic: NBD_REPLY_MAGIC,
@@ -308,10 +569,16 @@ func (c *Connection) Receive(ctx context.Context) {
 
 		cmd := req.nbdReq.NbdCommandType
 		var ok bool
-		if req.flags, ok = CmdTypeMap[int(cmd)]; !ok {
+		if cmd == NBD_CMD_BLOCK_STATUS && c.blockStatus {
+			req.blockStatus = true
+			req.flags = CMDT_CHECK_LENGTH_OFFSET
+		} else if req.flags, ok = CmdTypeMap[int(cmd)]; !ok {
 			c.logger.Printf("[ERROR] Client %s unknown command %d", c.name, cmd)
 			return
 		}
+		if int(cmd) < len(c.commandCounts) {
+			atomic.AddInt64(&c.commandCounts[cmd], 1)
+		}
 
 		if req.flags&CMDT_SET_DISCONNECT_RECEIVED != 0 {
 			// we process this here as commands may otherwise be processed out
@@ -320,59 +587,100 @@ func (c *Connection) Receive(ctx context.Context) {
 			atomic.StoreInt64(&c.disconnectReceived, 1)
 		}
 
+		if atomic.LoadInt32(&c.draining) != 0 && cmd != NBD_CMD_DISC {
+			// the server is shutting down, so the command is not run, but the
+			// client is told so rather than left waiting for a reply
+			c.logger.Printf("[INFO] Client %s sent command cmd=%d whilst the connection is closing, refusing it", c.name, cmd)
+			req.length = length
+			if !c.rejectRequest(ctx, r, req, NBD_ESHUTDOWN) {
+				return
+			}
+			continue
+		}
+
 		if req.flags&CMDT_CHECK_LENGTH_OFFSET != 0 {
-			req.length = uint64(req.nbdReq.NbdLength)
+			req.length = length
 			req.offset = req.nbdReq.NbdOffset
-			if req.length <= 0 || req.length+req.offset > c.export.size {
-				c.logger.Printf("[ERROR] Client %s gave bad offset or length", c.name)
-				return
+			if nbdError := validateRange(cmd, req.offset, req.length, c.export.size); nbdError != 0 {
+				c.logger.Printf("[WARN] Client %s sent command beyond the end of the export cmd=%d (off=%08x,len=%08x,size=%08x)", c.name, cmd, req.offset, req.length, c.export.size)
+				if !c.rejectRequest(ctx, r, req, nbdError) {
+					return
+				}
+				continue
+			}
+			if req.flags&(CMDT_REQ_PAYLOAD|CMDT_REP_PAYLOAD) != 0 && req.length > c.export.maxPayload {
+				// reject this before allocating memory for it
+				c.logger.Printf("[WARN] Client %s sent command with oversized payload cmd=%d (len=%08x,max=%08x)", c.name, cmd, req.length, c.export.maxPayload)
+				if !c.rejectRequest(ctx, r, req, NBD_EOVERFLOW) {
+					return
+				}
+				continue
+			}
+			if cmd == NBD_CMD_READ && c.structuredReplies && req.nbdReq.NbdCommandFlags&NBD_CMD_FLAG_DF != 0 &&
+				req.length > 65536 && (req.length > c.export.maxChunkSize || req.length > c.export.maximumBlockSize) {
+				// the reply may not be fragmented, but is too large for one
+				// chunk, and the spec allows refusing reads over 64K for this
+				c.logger.Printf("[WARN] Client %s sent unfragmentable read too large for one chunk (len=%08x,maxchunk=%08x,maxbs=%08x)", c.name, req.length, c.export.maxChunkSize, c.export.maximumBlockSize)
+				if !c.rejectRequest(ctx, r, req, NBD_EOVERFLOW) {
+					return
+				}
+				continue
 			}
-			if req.length&(c.export.minimumBlockSize-1) != 0 || req.offset&(c.export.minimumBlockSize-1) != 0 || req.length > c.export.maximumBlockSize {
+			// the maximum block size bounds the data a command transfers, so
+			// trims, zeroes and block status queries may exceed it
+			bounded := req.flags&(CMDT_REQ_PAYLOAD|CMDT_REP_PAYLOAD) != 0 || cmd == NBD_CMD_CACHE
+			if req.length&(c.export.minimumBlockSize-1) != 0 || req.offset&(c.export.minimumBlockSize-1) != 0 || (bounded && req.length > c.export.maximumBlockSize) {
 				c.logger.Printf("[ERROR] Client %s gave offset or length outside blocksize paramaters cmd=%d (len=%08x,off=%08x,minbs=%08x,maxbs=%08x)", c.name, req.nbdReq.NbdCommandType, req.length, req.offset, c.export.minimumBlockSize, c.export.maximumBlockSize)
 				return
 			}
 		}
 
-		if req.flags&CMDT_REQ_PAYLOAD != 0 {
-			if req.reqData = c.GetMemory(ctx, req.length); req.reqData == nil {
-				// error already logged
+		if req.blockStatus && req.length == 0 {
+			c.logger.Printf("[WARN] Client %s sent block status query of zero length", c.name)
+			if !c.rejectRequest(ctx, r, req, NBD_EINVAL) {
 				return
 			}
-			if req.length <= 0 {
-				c.logger.Printf("[ERROR] Client %s gave bad length", c.name)
+			continue
+		}
+
+		if c.export.deniedCommands.has(cmd) && !req.blockStatus {
+			// refuse it before allocating memory for it
+			c.logger.Printf("[WARN] Client %s sent command the export denies cmd=%d", c.name, cmd)
+			if !c.rejectRequest(ctx, r, req, deniedCommandError(cmd)) {
 				return
 			}
-			length := req.length
-			for i := 0; length > 0; i++ {
-				blocklen := c.export.memoryBlockSize
-				if blocklen > length {
-					blocklen = length
-				}
-				n, err := io.ReadFull(c.conn, req.reqData[i][:blocklen])
-				if err != nil {
-					if isClosedErr(err) {
-						// Don't report this - we closed it
-						return
-					}
+			continue
+		}
 
-					c.logger.Printf("[ERROR] Client %s cannot read data to write: %s", c.name, err)
+		if req.flags&CMDT_REQ_PAYLOAD != 0 {
+			if req.reqData = c.GetMemory(ctx, req.length); req.reqData == nil {
+				// error already logged
+				return
+			}
+			if c.writeChecksum {
+				if err := binary.Read(r, binary.BigEndian, &req.checksum); err != nil {
+					c.FreeMemory(ctx, req.reqData)
+					c.logger.Printf("[ERROR] Client %s cannot read write checksum: %s", c.name, err)
 					return
 				}
-
-				if uint64(n) != blocklen {
-					c.logger.Printf("[ERROR] Client %s cannot read all data to write: %d != %d", c.name, n, blocklen)
+			}
+			// the request is only passed on once the whole payload has been
+			// read, so a connection failing mid-payload never reaches the backend
+			if err := c.readPayload(r, req.reqData, req.length); err != nil {
+				c.FreeMemory(ctx, req.reqData)
+				if isClosedErr(err) || atomic.LoadInt32(&c.draining) != 0 {
+					// Don't report this - we closed it
 					return
-
 				}
-				length -= blocklen
+				c.logger.Printf("[ERROR] Client %s cannot read data to write (%d bytes expected), discarding request: %s", c.name, req.length, err)
+				return
 			}
-
-		} else if req.flags&CMDT_REQ_FAKE_PAYLOAD != 0 {
-			if req.reqData = c.GetMemory(ctx, req.length); req.reqData == nil {
-				// error printed already
+			lastWrite = &req.nbdReq
+			if br != nil && !c.nextRequestFramed(br) {
+				c.FreeMemory(ctx, req.reqData)
+				c.logger.Printf("[ERROR] Client %s sent write (off=%08x,len=%08x) not followed by a request: protocol desync, as its payload was probably not of the length declared, discarding request", c.name, req.offset, req.length)
 				return
 			}
-			c.ZeroMemory(ctx, req.reqData)
 		}
 
 		if req.flags&CMDT_REP_PAYLOAD != 0 {
@@ -383,20 +691,29 @@ func (c *Connection) Receive(ctx context.Context) {
 		}
 
 		atomic.AddInt64(&c.numInflight, 1) // one more in flight
+		ch := c.rxCh
 		if req.flags&CMDT_CHECK_NOT_READ_ONLY != 0 && c.export.readonly {
 			req.nbdRep.NbdError = NBD_EPERM
-			select {
-			case c.txCh <- req:
-			case <-ctx.Done():
-				return
-			}
-		} else {
-			select {
-			case c.rxCh <- req:
-			case <-ctx.Done():
-				return
-			}
+			ch = c.txCh
+		} else if req.flags&CMDT_REQ_PAYLOAD != 0 && c.writeChecksum && payloadChecksum(req.reqData, req.length, c.export.memoryBlockSize) != req.checksum {
+			c.logger.Printf("[WARN] Client %s sent write with bad checksum (off=%08x,len=%08x), not applying", c.name, req.offset, req.length)
+			req.nbdRep.NbdError = NBD_EIO
+			ch = c.txCh
+		} else if cmd == NBD_CMD_FLUSH && c.export.readonly {
+			// the spec has a flush of a read-only export succeed, and
+			// as nothing can have been written there is nothing to do
+			ch = c.txCh
+		} else if req.flags&CMDT_CHECK_LENGTH_OFFSET != 0 && req.length == 0 {
+			// a zero length command has nothing to do, so reply at once
+			// without troubling the backend
+			ch = c.txCh
+		}
+		select {
+		case ch <- req:
+		case <-ctx.Done():
+			return
 		}
+		atomic.StoreInt32(&c.midRequest, 0)
 		// if we've recieved a disconnect, just sit waiting for the
 		// context to indicate we've done
 		if atomic.LoadInt64(&c.disconnectReceived) > 0 {
@@ -408,6 +725,110 @@ func (c *Connection) Receive(ctx context.Context) {
 	}
 }
 
+// validateRange returns the NBD error for a command whose range does not lie
+// within an export of the given size, or 0 if it does. A write or write zeroes
+// beyond the end gets NBD_ENOSPC, and any other command NBD_EINVAL, as the
+// spec has them
+func validateRange(cmd uint16, offset uint64, length uint64, size uint64) uint32 {
+	if offset <= size && length <= size-offset {
+		return 0
+	}
+	switch cmd {
+	case NBD_CMD_WRITE, NBD_CMD_WRITE_ZEROES:
+		return NBD_ENOSPC
+	}
+	return NBD_EINVAL
+}
+
+// rejectRequest replies to a request at once with an NBD error, without it
+// reaching the backend, discarding any payload so we stay in sync with the
+// client. It returns false if the connection has failed
+func (c *Connection) rejectRequest(ctx context.Context, r io.Reader, req Request, nbdError uint32) bool {
+	if req.flags&CMDT_REQ_PAYLOAD != 0 {
+		if req.length > math.MaxUint32 {
+			// only an extended header declares so long a payload, and reading
+			// gigabytes to reject them is not worth keeping the connection for
+			c.logger.Printf("[ERROR] Client %s sent rejected command with a payload too long to skip (len=%08x)", c.name, req.length)
+			return false
+		}
+		if err := skip(r, uint32(req.length)); err != nil {
+			if !isClosedErr(err) {
+				c.logger.Printf("[ERROR] Client %s cannot read payload of rejected command: %s", c.name, err)
+			}
+			return false
+		}
+		if c.writeChecksum {
+			if err := skip(r, 4); err != nil {
+				if !isClosedErr(err) {
+					c.logger.Printf("[ERROR] Client %s cannot read write checksum of rejected command: %s", c.name, err)
+				}
+				return false
+			}
+		}
+	}
+	req.nbdRep.NbdError = nbdError
+	atomic.AddInt64(&c.numInflight, 1) // one more in flight
+	select {
+	case c.txCh <- req:
+	case <-ctx.Done():
+		return false
+	}
+	return true
+}
+
+// readPayload reads a request payload of the given length from r into mem
+func (c *Connection) readPayload(r io.Reader, mem [][]byte, length uint64) error {
+	for i := 0; length > 0; i++ {
+		blocklen := c.export.memoryBlockSize
+		if blocklen > length {
+			blocklen = length
+		}
+		if _, err := io.ReadFull(r, mem[i][:blocklen]); err != nil {
+			return err
+		}
+		length -= blocklen
+	}
+	return nil
+}
+
+// How long to wait for the request following a write when checking framing
+const framingCheckWait = 10 * time.Millisecond
+
+// nextRequestFramed peeks at the data following a write's payload, returning
+// false if it is not the magic number starting a request, i.e. the client sent
+// a payload of other than the length declared. If no request follows within
+// framingCheckWait (as the client awaits the reply first), it cannot be
+// checked in time, so true is returned and it is checked as it is read
+func (c *Connection) nextRequestFramed(br *bufio.Reader) bool {
+	c.conn.SetReadDeadline(time.Now().Add(framingCheckWait))
+	magic, err := br.Peek(4)
+	c.conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return true
+	}
+	if c.extendedHeaders {
+		return binary.BigEndian.Uint32(magic) == NBD_EXTENDED_REQUEST_MAGIC
+	}
+	return binary.BigEndian.Uint32(magic) == NBD_REQUEST_MAGIC
+}
+
+// crc32cTable is the table for the CRC32C checksums used by NBD_OPT_X_WRITE_CHECKSUM
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// payloadChecksum returns the CRC32C of a payload of the given length held in mem
+func payloadChecksum(mem [][]byte, length uint64, memoryBlockSize uint64) uint32 {
+	var crc uint32
+	for i := 0; length > 0; i++ {
+		blocklen := memoryBlockSize
+		if blocklen > length {
+			blocklen = length
+		}
+		crc = crc32.Update(crc, crc32cTable, mem[i][:blocklen])
+		length -= blocklen
+	}
+	return crc
+}
+
 // checkpoint is an internal debugging routine
 func checkpoint(t *time.Time) time.Duration {
 	t1 := time.Now()
@@ -440,80 +861,144 @@ func (c *Connection) Dispatch(ctx context.Context, n int) {
 
 			addr := req.offset
 			length := req.length
+			watchdog := c.startWatchdog(ctx, req)
 			switch req.nbdReq.NbdCommandType {
 			case NBD_CMD_READ:
-				for i := 0; length > 0; i++ {
-					blocklen := c.export.memoryBlockSize
-					if blocklen > length {
-						blocklen = length
-					}
-					n, err := c.backend.ReadAt(ctx, req.repData[i][:blocklen], int64(addr))
-					if err != nil {
-						c.ZeroMemory(ctx, req.repData[i:])
-						c.logger.Printf("[WARN] Client %s got read I/O error: %s", c.name, err)
-						req.nbdRep.NbdError = NbdError(err)
-						break
-					} else if uint64(n) != blocklen {
-						c.ZeroMemory(ctx, req.repData[i:])
-						c.logger.Printf("[WARN] Client %s got incomplete read (%d != %d) at offset %d", c.name, n, length, addr)
-						req.nbdRep.NbdError = NBD_EIO
-						break
+				var n uint64
+				var err error
+				if vr, ok := c.backend.(VectoredReader); ok {
+					n, err = vectoredIO(req.repData, c.export.memoryBlockSize, addr, length, c.export.ioHints.ReadSize, c.export.ioHints.Alignment,
+						func(bufs [][]byte, offset uint64) (int, error) {
+							return vr.ReadAtv(ctx, bufs, int64(offset))
+						})
+				} else {
+					n, err = chunkedIO(req.repData, c.export.memoryBlockSize, addr, length, c.export.ioHints.ReadSize, c.export.ioHints.Alignment, false,
+						func(b []byte, offset uint64) (int, error) {
+							return c.backend.ReadAt(ctx, b, int64(offset))
+						})
+				}
+				// with NBD_CMD_FLAG_DF the reply must be a single chunk, so it
+				// cannot carry the data that can be read around an error
+				df := req.nbdReq.NbdCommandFlags&NBD_CMD_FLAG_DF != 0
+				if (err != nil || n != length) && c.structuredReplies && !df {
+					// reply with what can be read, and where the rest failed
+					c.readRanges(ctx, &req)
+				} else if err != nil {
+					c.ZeroMemory(ctx, req.repData)
+					c.logger.Printf("[WARN] Client %s got read I/O error: %s", c.name, err)
+					req.nbdRep.NbdError = c.backendError(ctx, err)
+				} else if n != length {
+					c.ZeroMemory(ctx, req.repData)
+					c.logger.Printf("[WARN] Client %s got incomplete read (%d != %d) at offset %d", c.name, n, length, addr)
+					req.nbdRep.NbdError = c.backendError(ctx, syscall.EIO)
+				} else {
+					c.stats.Add("bytes_read", int64(length))
+					atomic.AddInt64(&c.bytesRead, int64(length))
+					if c.structuredReplies {
+						req.holes = c.readHoles(ctx, addr, length)
+						if c.export.detectZeros {
+							req.holes = c.zeroHoles(&req, req.holes)
+						}
+						if df && !(len(req.holes) == 1 && req.holes[0].length == length) {
+							// only a hole covering the whole read is one chunk
+							req.holes = nil
+						}
 					}
-					addr += blocklen
-					length -= blocklen
 				}
 			case NBD_CMD_WRITE, NBD_CMD_WRITE_ZEROES:
-				for i := 0; length > 0; i++ {
-					blocklen := c.export.memoryBlockSize
-					if blocklen > length {
-						blocklen = length
-					}
-					n, err := c.backend.WriteAt(ctx, req.reqData[i][:blocklen], int64(addr), fua)
-					if err != nil {
-						c.logger.Printf("[WARN] Client %s got write I/O error: %s", c.name, err)
-						req.nbdRep.NbdError = NbdError(err)
-						break
-					} else if uint64(n) != blocklen {
-						c.logger.Printf("[WARN] Client %s got incomplete write (%d != %d) at offset %d", c.name, n, length, addr)
-						req.nbdRep.NbdError = NBD_EIO
+				if err := c.flushFailure(); err != nil {
+					req.nbdRep.NbdError = NbdError(err)
+					break
+				}
+				var n uint64
+				var err error
+				if req.nbdReq.NbdCommandType == NBD_CMD_WRITE_ZEROES {
+					if n, err = c.zero(ctx, addr, length, req.nbdReq.NbdCommandFlags, fua); err == errSlowZero {
+						req.nbdRep.NbdError = NBD_ENOTSUP
 						break
 					}
-					addr += blocklen
-					length -= blocklen
+				} else {
+					n, err = c.writeMemory(ctx, req.reqData, addr, length, fua)
+				}
+				if err != nil {
+					c.logger.Printf("[WARN] Client %s got write I/O error: %s", c.name, err)
+					req.nbdRep.NbdError = c.backendError(ctx, err)
+				} else if n != length {
+					c.logger.Printf("[WARN] Client %s got incomplete write (%d != %d) at offset %d", c.name, n, length, addr)
+					req.nbdRep.NbdError = c.backendError(ctx, syscall.EIO)
+				} else if req.nbdReq.NbdCommandType == NBD_CMD_WRITE {
+					c.stats.Add("bytes_written", int64(length))
+					atomic.AddInt64(&c.bytesWritten, int64(length))
+				} else {
+					c.stats.Add("bytes_zeroed", int64(length))
+					atomic.AddInt64(&c.bytesWritten, int64(length))
 				}
 			case NBD_CMD_FLUSH:
-				if err := c.backend.Flush(ctx); err != nil {
+				var err error
+				if c.export.barrier != nil {
+					err = c.export.barrier.Barrier(ctx)
+				} else {
+					err = c.backend.Flush(ctx)
+				}
+				c.export.flushHealth.record(c.export.name, err)
+				if err != nil {
 					c.logger.Printf("[WARN] Client %s got flush I/O error: %s", c.name, err)
-					req.nbdRep.NbdError = NbdError(err)
+					c.stats.Add("flush_errors", 1)
+					req.nbdRep.NbdError = c.backendError(ctx, err)
 					break
 				}
 			case NBD_CMD_TRIM:
-				for i := 0; length > 0; i++ {
+				if err := c.flushFailure(); err != nil {
+					req.nbdRep.NbdError = NbdError(err)
+					break
+				}
+				for length > 0 {
 					blocklen := c.export.memoryBlockSize
 					if blocklen > length {
 						blocklen = length
 					}
-					n, err := c.backend.TrimAt(ctx, int(req.length), int64(addr))
+					n, err := c.backend.TrimAt(ctx, int(blocklen), int64(addr))
 					if err != nil {
-						c.ZeroMemory(ctx, req.repData[i:])
 						c.logger.Printf("[WARN] Client %s got trim I/O error: %s", c.name, err)
-						req.nbdRep.NbdError = NbdError(err)
+						req.nbdRep.NbdError = c.backendError(ctx, err)
 						break
 					} else if uint64(n) != blocklen {
-						c.ZeroMemory(ctx, req.repData[i:])
 						c.logger.Printf("[WARN] Client %s got incomplete trim (%d != %d) at offset %d", c.name, n, length, addr)
-						req.nbdRep.NbdError = NBD_EIO
+						req.nbdRep.NbdError = c.backendError(ctx, syscall.EIO)
 						break
 					}
 					addr += blocklen
 					length -= blocklen
 				}
+			case NBD_CMD_CACHE:
+				cacher, ok := c.backend.(Cacher)
+				if !ok {
+					// we did not advertise NBD_FLAG_SEND_CACHE
+					req.nbdRep.NbdError = NBD_EINVAL
+					break
+				}
+				if n, err := cacher.Cache(ctx, int(length), int64(addr)); err != nil {
+					c.logger.Printf("[WARN] Client %s got cache I/O error: %s", c.name, err)
+					req.nbdRep.NbdError = c.backendError(ctx, err)
+				} else if uint64(n) != length {
+					c.logger.Printf("[WARN] Client %s got incomplete cache (%d != %d) at offset %d", c.name, n, length, addr)
+					req.nbdRep.NbdError = c.backendError(ctx, syscall.EIO)
+				}
 			case NBD_CMD_DISC:
 				c.waitForInflight(ctx, 1) // this request is itself in flight, so 1 is permissible
 				c.backend.Flush(ctx)
 				c.logger.Printf("[INFO] Client %s requested disconnect", c.name)
 				return
 			case NBD_CMD_CLOSE:
+				if req.blockStatus {
+					// NBD_CMD_BLOCK_STATUS, which shares the number
+					var err error
+					if req.extents, err = c.allocationExtents(ctx, addr, length, req.nbdReq.NbdCommandFlags&NBD_CMD_FLAG_REQ_ONE != 0); err != nil {
+						c.logger.Printf("[WARN] Client %s got block status I/O error: %s", c.name, err)
+						req.nbdRep.NbdError = c.backendError(ctx, err)
+					}
+					break
+				}
 				c.waitForInflight(ctx, 1) // this request is itself in flight, so 1 is permissible
 				c.backend.Flush(ctx)
 				c.logger.Printf("[INFO] Client %s requested close", c.name)
@@ -528,6 +1013,17 @@ func (c *Connection) Dispatch(ctx context.Context, n int) {
 				c.logger.Printf("[ERROR] Client %s sent unknown command %d", c.name, req.nbdReq.NbdCommandType)
 				return
 			}
+			if !watchdog.stop() {
+				// the watchdog has failed the command already
+				c.logger.Printf("[INFO] Client %s command %d at offset %d completed after failing on timeout", c.name, req.nbdReq.NbdCommandType, req.offset)
+				if req.repData != nil {
+					c.FreeMemory(ctx, req.repData)
+				}
+				if req.reqData != nil {
+					c.FreeMemory(ctx, req.reqData)
+				}
+				continue
+			}
 			select {
 			case c.txCh <- req:
 			case <-ctx.Done():
@@ -537,85 +1033,695 @@ func (c *Connection) Dispatch(ctx context.Context, n int) {
 	}
 }
 
-func (c *Connection) waitForInflight(ctx context.Context, limit int64) {
-	c.logger.Printf("[INFO] Client %s waiting for inflight requests prior to disconnect", c.name)
-	for {
-		if atomic.LoadInt64(&c.numInflight) <= limit {
-			return
+// readHoles returns the holes in length bytes read at offset, if the backend
+// can report them, so that they need not be sent as data. A hole must read as
+// zeroes, and be at least minimumReadHole bytes. Within the read, a hole is
+// trimmed to start and end on the export's chunk alignment, so that the data
+// around it falls in aligned chunks too. Failing to find the holes is no
+// error, as the data has been read anyway
+func (c *Connection) readHoles(ctx context.Context, offset uint64, length uint64) []readHole {
+	el, ok := c.backend.(ExtentLister)
+	if !ok {
+		return nil
+	}
+	extents, err := el.Extents(ctx, int(length), int64(offset))
+	if err != nil {
+		return nil
+	}
+	var holes []readHole
+	pos := offset
+	for _, e := range extents {
+		if e.Length > offset+length-pos {
+			e.Length = offset + length - pos
+		}
+		if e.Zero {
+			if h := c.alignHole(pos, pos+e.Length, offset, offset+length); h.length >= minimumReadHole {
+				holes = append(holes, h)
+			}
+		}
+		if pos += e.Length; pos == offset+length {
+			break
 		}
-		// this is pretty nasty in that it would be nicer to wait on
-		// a channel or use a (non-existent) waitgroup with timer.
-		// however it's only one atomic read every 10ms and this
-		// will hardly ever occur
-		time.Sleep(10 * time.Millisecond)
 	}
+	return holes
 }
 
-// Transmit is the goroutine run to transmit the processed requests (now replies)
-func (c *Connection) Transmit(ctx context.Context) {
-	defer func() {
-		c.logger.Printf("[INFO] Transmitter exiting for %s", c.name)
-		c.Kill(ctx)
-		c.wg.Done()
-	}()
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case req, ok := <-c.txCh:
-			if !ok {
-				return
+// zeroHoles returns the holes in a read, adding to the holes the backend
+// reported the runs of the data read that are all zeroes, so that they need
+// not be sent either. The data is checked a chunk alignment at a time, each
+// check stopping at the first non-zero byte, and what the backend reported as
+// holes is not checked at all
+func (c *Connection) zeroHoles(req *Request, holes []readHole) []readHole {
+	zero := c.zeroBlock()
+	align := c.export.chunkAlign
+	end := req.offset + req.length
+	var found []readHole
+	var run readHole // the run of zeroes ending at pos
+	for pos := req.offset; pos < end; {
+		var next uint64
+		isZero := true
+		if len(holes) > 0 && pos == holes[0].offset {
+			next = holes[0].offset + holes[0].length
+			holes = holes[1:]
+		} else {
+			if next = (pos/align + 1) * align; next > end {
+				next = end
 			}
-			if err := binary.Write(c.conn, binary.BigEndian, req.nbdRep); err != nil {
-				c.logger.Printf("[ERROR] Client %s cannot write reply", c.name)
-				return
+			if len(holes) > 0 && next > holes[0].offset {
+				next = holes[0].offset
 			}
-			if req.flags&CMDT_REP_PAYLOAD != 0 && req.repData != nil {
-				length := req.length
-				for i := 0; length > 0; i++ {
-					blocklen := c.export.memoryBlockSize
-					if blocklen > length {
-						blocklen = length
-					}
-					if n, err := c.conn.Write(req.repData[i][:blocklen]); err != nil || uint64(n) != blocklen {
-						c.logger.Printf("[ERROR] Client %s cannot write reply", c.name)
-						return
-					}
-					length -= blocklen
+			for _, b := range memorySegments(req.repData, c.export.memoryBlockSize, pos-req.offset, next-pos) {
+				if !bytes.Equal(b, zero[:len(b)]) {
+					isZero = false
+					break
 				}
 			}
-			if req.repData != nil {
-				c.FreeMemory(ctx, req.repData)
+		}
+		if isZero {
+			if run.length == 0 {
+				run.offset = pos
 			}
-			if req.reqData != nil {
-				c.FreeMemory(ctx, req.reqData)
+			run.length += next - pos
+		} else {
+			if run.length >= minimumReadHole {
+				found = append(found, run)
 			}
-			// TODO: with structured replies, only do this if the 'DONE' bit is set.
-			atomic.AddInt64(&c.numInflight, -1) // one less in flight
+			run = readHole{}
 		}
+		pos = next
+	}
+	if run.length >= minimumReadHole {
+		found = append(found, run)
 	}
+	return found
 }
 
-// Serve negotiates, then starts all the goroutines for processing a connection, then waits for them to be ended
-func (c *Connection) Serve(parentCtx context.Context) {
-	ctx, cancelFunc := context.WithCancel(parentCtx)
-
-	c.rxCh = make(chan Request, 1024)
-	c.txCh = make(chan Request, 1024)
-	c.killCh = make(chan struct{})
-
-	c.conn = c.plainConn
-	c.name = c.plainConn.RemoteAddr().String()
-	if c.name == "" {
-		c.name = "[unknown]"
+// alignHole returns the hole from start to end within a read from readStart
+// to readEnd, with the ends of it that are not the ends of the read moved
+// inwards to the export's chunk alignment, or an empty hole if none is left
+func (c *Connection) alignHole(start uint64, end uint64, readStart uint64, readEnd uint64) readHole {
+	align := c.export.chunkAlign
+	if start != readStart {
+		start = (start + align - 1) / align * align
+	}
+	if end != readEnd {
+		end -= end % align
 	}
+	if end <= start {
+		return readHole{}
+	}
+	return readHole{offset: start, length: end - start}
+}
 
-	defer func() {
-		if c.backend != nil {
-			c.backend.Close(ctx)
+// readRanges reads a command again range by range after a read of the whole
+// failed, so that a structured reply can carry the data that can be read and
+// an error for each range that cannot, rather than failing the whole read.
+// Ranges are the export's preferred block size, and a range read short is
+// failed from where the read stopped. Adjacent failed ranges are merged
+func (c *Connection) readRanges(ctx context.Context, req *Request) {
+	rangeSize := c.export.preferredBlockSize
+	if c.export.ioHints.ReadSize != 0 && c.export.ioHints.ReadSize < rangeSize {
+		rangeSize = c.export.ioHints.ReadSize
+	}
+	b := make([]byte, rangeSize)
+	req.readErrors = nil
+	for pos := uint64(0); pos < req.length; {
+		n := chunkLength(req.offset, pos, req.length, rangeSize, c.export.ioHints.Alignment)
+		done, err := c.backend.ReadAt(ctx, b[:n], int64(req.offset+pos))
+		if done < 0 || uint64(done) > n {
+			done = 0
 		}
-		if c.tlsConn != nil {
-			c.tlsConn.Close()
+		copyMemory(b[:done], req.repData, c.export.memoryBlockSize, pos, false)
+		if uint64(done) < n {
+			if err == nil {
+				err = syscall.EIO
+			}
+			c.logger.Printf("[WARN] Client %s got read I/O error on %d bytes at offset %d: %s", c.name, n-uint64(done), req.offset+pos+uint64(done), err)
+			re := readError{offset: req.offset + pos + uint64(done), length: n - uint64(done), err: c.backendError(ctx, err)}
+			if last := len(req.readErrors) - 1; last >= 0 && req.readErrors[last].offset+req.readErrors[last].length == re.offset && req.readErrors[last].err == re.err {
+				req.readErrors[last].length += re.length
+			} else {
+				req.readErrors = append(req.readErrors, re)
+			}
+		}
+		pos += n
+	}
+	if len(req.readErrors) > 0 {
+		req.nbdRep.NbdError = req.readErrors[0].err
+	} else {
+		c.stats.Add("bytes_read", int64(req.length))
+		atomic.AddInt64(&c.bytesRead, int64(req.length))
+	}
+}
+
+// readRequestHeader reads the header of a request, returning its length. Once
+// extended headers are negotiated, the header read is an extended one, whose
+// length may not fit the request's (which is then only logged)
+func (c *Connection) readRequestHeader(r io.Reader, nbdReq *nbdRequest) (uint64, error) {
+	if !c.extendedHeaders {
+		if err := binary.Read(r, binary.BigEndian, nbdReq); err != nil {
+			return 0, err
+		}
+		return uint64(nbdReq.NbdLength), nil
+	}
+	var ext nbdExtendedRequest
+	if err := binary.Read(r, binary.BigEndian, &ext); err != nil {
+		return 0, err
+	}
+	*nbdReq = nbdRequest{
+		NbdRequestMagic: ext.NbdRequestMagic,
+		NbdCommandFlags: ext.NbdCommandFlags,
+		NbdCommandType:  ext.NbdCommandType,
+		NbdHandle:       ext.NbdHandle,
+		NbdOffset:       ext.NbdOffset,
+		NbdLength:       uint32(ext.NbdLength),
+	}
+	return ext.NbdLength, nil
+}
+
+// writeMemory writes length bytes from mem at offset to the backend, in the
+// chunks its I/O hints ask for
+func (c *Connection) writeMemory(ctx context.Context, mem [][]byte, offset uint64, length uint64, fua bool) (uint64, error) {
+	if vw, ok := c.backend.(VectoredWriter); ok {
+		return vectoredIO(mem, c.export.memoryBlockSize, offset, length, c.export.ioHints.WriteSize, c.export.ioHints.Alignment,
+			func(bufs [][]byte, offset uint64) (int, error) {
+				return vw.WriteAtv(ctx, bufs, int64(offset), fua)
+			})
+	}
+	return chunkedIO(mem, c.export.memoryBlockSize, offset, length, c.export.ioHints.WriteSize, c.export.ioHints.Alignment, true,
+		func(b []byte, offset uint64) (int, error) {
+			return c.backend.WriteAt(ctx, b, int64(offset), fua)
+		})
+}
+
+// errSlowZero is returned by zero for an NBD_CMD_FLAG_FAST_ZERO request that
+// could only be satisfied by writing zeroes
+var errSlowZero = errors.New("Zeroes would have to be written")
+
+// zero zeroes length bytes at offset for an NBD_CMD_WRITE_ZEROES with the given
+// command flags. It punches a hole if the client allows it, else zeroes the
+// range in place, and only if the backend can do neither writes zeroes; with
+// NBD_CMD_FLAG_FAST_ZERO, the client would rather do that itself, so it
+// returns errSlowZero without touching the range
+func (c *Connection) zero(ctx context.Context, offset uint64, length uint64, flags uint16, fua bool) (uint64, error) {
+	if flags&NBD_CMD_FLAG_NO_HOLE == 0 {
+		// the client does not need the range to stay allocated
+		if n, punched, err := c.punchHole(ctx, offset, length, fua); punched {
+			return n, err
+		}
+	}
+	if n, zeroed, err := c.zeroRange(ctx, offset, length, fua); zeroed {
+		return n, err
+	}
+	if flags&NBD_CMD_FLAG_FAST_ZERO != 0 {
+		return 0, errSlowZero
+	}
+	return c.writeZeroes(ctx, offset, length, fua)
+}
+
+// Blocks of zeroes, by memory block size, shared by every connection writing
+// zeroes to a backend that cannot zero without writing, as nothing writes to them
+var (
+	zeroBlocks      = make(map[uint64][]byte)
+	zeroBlocksMutex sync.Mutex
+)
+
+// zeroBlock returns a memory block of zeroes, shared by every export with the
+// same memory block size, which must not be written to
+func (c *Connection) zeroBlock() []byte {
+	size := c.export.memoryBlockSize
+	zeroBlocksMutex.Lock()
+	defer zeroBlocksMutex.Unlock()
+	block, ok := zeroBlocks[size]
+	if !ok {
+		block = make([]byte, size)
+		zeroBlocks[size] = block
+	}
+	return block
+}
+
+// zeroMemory returns memory blocks holding up to the export's maximum payload
+// of zeroes, which must not be written to. They are all the same block, so
+// however long the range written, nothing is allocated for it
+func (c *Connection) zeroMemory() [][]byte {
+	size := c.export.memoryBlockSize
+	block := c.zeroBlock()
+	mem := make([][]byte, (c.export.maxPayload+size-1)/size)
+	for i := range mem {
+		mem[i] = block
+	}
+	return mem
+}
+
+// writeZeroes writes length bytes of zeroes at offset, for an
+// NBD_CMD_WRITE_ZEROES the backend could not satisfy without writing. It is
+// written up to a maximum payload at a time from shared blocks of zeroes
+func (c *Connection) writeZeroes(ctx context.Context, offset uint64, length uint64, fua bool) (uint64, error) {
+	zeroes := c.zeroMemory()
+	window := uint64(len(zeroes)) * c.export.memoryBlockSize
+	var done uint64
+	for done < length {
+		n := length - done
+		if n > window {
+			n = window
+		}
+		written, err := c.writeMemory(ctx, zeroes, offset+done, n, fua)
+		done += written
+		if err != nil || written != n {
+			return done, err
+		}
+	}
+	return done, nil
+}
+
+// punchHole zeroes length bytes at offset by deallocating them, returning false
+// if the backend cannot, so zeroes must be written instead
+func (c *Connection) punchHole(ctx context.Context, offset uint64, length uint64, fua bool) (uint64, bool, error) {
+	hp, ok := c.backend.(HolePuncher)
+	if !ok {
+		return 0, false, nil
+	}
+	n, err := hp.PunchHoleAt(ctx, int(length), int64(offset), fua)
+	if err == errPunchHoleUnsupported {
+		return 0, false, nil
+	}
+	return uint64(n), true, err
+}
+
+// zeroRange zeroes length bytes at offset without writing zeroes, keeping them
+// allocated, returning false if the backend cannot, so that zeroes must be
+// written instead
+func (c *Connection) zeroRange(ctx context.Context, offset uint64, length uint64, fua bool) (uint64, bool, error) {
+	z, ok := c.backend.(Zeroer)
+	if !ok {
+		return 0, false, nil
+	}
+	n, err := z.ZeroAt(ctx, int(length), int64(offset), fua)
+	if err == errZeroUnsupported {
+		return 0, false, nil
+	}
+	return uint64(n), true, err
+}
+
+// flushFailure returns the error from the export's last flush if it failed and
+// the export rejects writes until a flush succeeds, as writes acknowledged now
+// might be lost with those the flush could not make durable
+func (c *Connection) flushFailure() error {
+	if !c.export.rejectWritesUnsafe {
+		return nil
+	}
+	return c.export.flushHealth.failed()
+}
+
+// backendError returns the NBD error for an error from the backend. If the
+// export is configured to disconnect on error, or the backend has failed and
+// asked for its connections to be closed, the connection is killed instead
+func (c *Connection) backendError(ctx context.Context, err error) uint32 {
+	if bfe, ok := err.(*BackendFailedError); ok && bfe.Close {
+		c.logger.Printf("[ERROR] Client %s closing connection as backend failed: %v", c.name, err)
+		c.setCloseReason(closeBackendFailed)
+		c.Kill(ctx)
+	} else if c.export.disconnectOnError {
+		c.logger.Printf("[ERROR] Client %s closing connection on backend error: %v", c.name, err)
+		c.setCloseReason(closeBackendFailed)
+		c.Kill(ctx)
+	}
+	return NbdError(err)
+}
+
+// Default maximum time a connection closing gracefully as the server shuts
+// down waits for the commands it has received to be replied to
+var DefaultShutdownTimeout = 10 * time.Second
+
+// shutdownTimeout is the maximum time a connection closing gracefully waits,
+// or 0 for DefaultShutdownTimeout, accessed atomically
+var shutdownTimeout int64
+
+// setShutdownTimeout sets the maximum time a connection closing gracefully
+// waits (0 for the default)
+func setShutdownTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&shutdownTimeout, int64(timeout))
+}
+
+// getShutdownTimeout returns the maximum time a connection closing gracefully
+// as the server shuts down waits
+func getShutdownTimeout() time.Duration {
+	if limit := time.Duration(atomic.LoadInt64(&shutdownTimeout)); limit != 0 {
+		return limit
+	}
+	return DefaultShutdownTimeout
+}
+
+// closeGracefully prepares to close the connection at a command boundary when
+// the server shuts down or its export is removed, rather than in the middle of
+// a reply. Commands received from now on are refused with NBD_ESHUTDOWN, and
+// once every command received before has been replied to, the backend is
+// flushed, so that the client's next read sees a clean EOF after its last
+// reply. It gives up waiting after limit, or if the connection fails
+// meanwhile, returning false if it did
+func (c *Connection) closeGracefully(ctx context.Context, limit time.Duration) bool {
+	atomic.StoreInt32(&c.draining, 1)
+	timeout := time.After(limit)
+	for atomic.LoadInt32(&c.midRequest) != 0 || atomic.LoadInt64(&c.numInflight) > 0 {
+		select {
+		case <-c.killCh:
+			return false
+		case <-timeout:
+			c.logger.Printf("[WARN] Client %s has %d commands in flight after %s, closing connection", c.name, atomic.LoadInt64(&c.numInflight), limit)
+			return false
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if err := c.backend.Flush(ctx); err != nil {
+		c.logger.Printf("[WARN] Client %s: flush on closing failed: %v", c.name, err)
+	}
+	c.logger.Printf("[INFO] Client %s closed gracefully", c.name)
+	return true
+}
+
+// shuttingDown returns true once the server is shutting down
+func (c *Connection) shuttingDown() bool {
+	select {
+	case <-c.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Connection) waitForInflight(ctx context.Context, limit int64) {
+	c.logger.Printf("[INFO] Client %s waiting for inflight requests prior to disconnect", c.name)
+	for {
+		if atomic.LoadInt64(&c.numInflight) <= limit {
+			return
+		}
+		// this is pretty nasty in that it would be nicer to wait on
+		// a channel or use a (non-existent) waitgroup with timer.
+		// however it's only one atomic read every 10ms and this
+		// will hardly ever occur
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Size of the buffer in which Transmit batches replies
+const transmitBufferSize = 64 * 1024
+
+// Transmit is the goroutine run to transmit the processed requests (now replies)
+//
+// Replies are written to a buffer, which is flushed whenever no further reply is
+// ready to send. Replies completing together, as small reads often do under
+// concurrent dispatch, thus go out in one write, whilst a lone reply is sent at
+// once. Each reply is written whole, so its bytes are contiguous on the wire
+func (c *Connection) Transmit(ctx context.Context) {
+	defer func() {
+		c.logger.Printf("[INFO] Transmitter exiting for %s", c.name)
+		c.Kill(ctx)
+		c.wg.Done()
+	}()
+	w := bufio.NewWriterSize(c.conn, transmitBufferSize)
+	var buffered int64 // replies written since the last flush
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case req, ok := <-c.txCh:
+			if !ok {
+				return
+			}
+			if c.structuredReplies && req.nbdReq.NbdCommandType == NBD_CMD_READ {
+				if err := c.writeStructuredRead(w, &req); err != nil {
+					c.logger.Printf("[ERROR] Client %s cannot write reply", c.name)
+					return
+				}
+			} else if req.blockStatus {
+				if err := c.writeStructuredBlockStatus(w, &req); err != nil {
+					c.logger.Printf("[ERROR] Client %s cannot write reply", c.name)
+					return
+				}
+			} else if c.extendedHeaders {
+				if err := c.writeStructuredDone(w, &req); err != nil {
+					c.logger.Printf("[ERROR] Client %s cannot write reply", c.name)
+					return
+				}
+			} else if err := binary.Write(w, binary.BigEndian, req.nbdRep); err != nil {
+				c.logger.Printf("[ERROR] Client %s cannot write reply", c.name)
+				return
+			} else if req.flags&CMDT_REP_PAYLOAD != 0 && req.repData != nil {
+				length := req.length
+				for i := 0; length > 0; i++ {
+					blocklen := c.export.memoryBlockSize
+					if blocklen > length {
+						blocklen = length
+					}
+					if n, err := w.Write(req.repData[i][:blocklen]); err != nil || uint64(n) != blocklen {
+						c.logger.Printf("[ERROR] Client %s cannot write reply", c.name)
+						return
+					}
+					length -= blocklen
+				}
+			}
+			if req.repData != nil {
+				c.FreeMemory(ctx, req.repData)
+			}
+			if req.reqData != nil {
+				c.FreeMemory(ctx, req.reqData)
+			}
+			buffered++
+			if len(c.txCh) > 0 {
+				continue
+			}
+			if err := w.Flush(); err != nil {
+				c.logger.Printf("[ERROR] Client %s cannot write reply", c.name)
+				return
+			}
+			// a reply is only no longer in flight once it has been flushed, so
+			// that waitForInflight does not return with replies still buffered.
+			// Every chunk of a structured reply is written together, so it is
+			// no longer in flight once the chunk with the 'DONE' bit is flushed
+			atomic.AddInt64(&c.numInflight, -buffered)
+			buffered = 0
+		}
+	}
+}
+
+// writeStructuredRead writes the reply to a read as structured reply chunks:
+// the data read in NBD_REPLY_TYPE_OFFSET_DATA chunks, and an
+// NBD_REPLY_TYPE_ERROR_OFFSET chunk for each range that could not be read, in
+// order of offset; or a single NBD_REPLY_TYPE_ERROR chunk if the read failed as
+// a whole. The last chunk has NBD_REPLY_FLAG_DONE set
+func (c *Connection) writeStructuredRead(w io.Writer, req *Request) error {
+	if req.nbdRep.NbdError != 0 && len(req.readErrors) == 0 {
+		return c.writeStructuredError(w, req, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_ERROR, req.nbdRep.NbdError, "", nil)
+	}
+	if req.length == 0 {
+		return c.writeStructuredChunk(w, req, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_NONE, 0)
+	}
+	if len(req.holes) > 0 {
+		return c.writeStructuredSparseRead(w, req)
+	}
+	var pos uint64
+	for i := 0; i <= len(req.readErrors); i++ {
+		end := req.length
+		if i < len(req.readErrors) {
+			end = req.readErrors[i].offset - req.offset
+		}
+		if end > pos {
+			if err := c.writeStructuredData(w, req, pos, end); err != nil {
+				return err
+			}
+		}
+		if i == len(req.readErrors) {
+			break
+		}
+		re := req.readErrors[i]
+		pos = re.offset + re.length - req.offset
+		var flags uint16
+		if pos == req.length {
+			flags = NBD_REPLY_FLAG_DONE
+		}
+		offset := re.offset
+		if err := c.writeStructuredError(w, req, flags, NBD_REPLY_TYPE_ERROR_OFFSET, re.err, fmt.Sprintf("Cannot read %d bytes", re.length), &offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeStructuredDone writes the reply to a command without a reply payload
+// as a single structured reply chunk, NBD_REPLY_TYPE_NONE or, if the command
+// failed, NBD_REPLY_TYPE_ERROR. Once extended headers are negotiated, every
+// reply is structured
+func (c *Connection) writeStructuredDone(w io.Writer, req *Request) error {
+	if req.nbdRep.NbdError != 0 {
+		return c.writeStructuredError(w, req, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_ERROR, req.nbdRep.NbdError, "", nil)
+	}
+	return c.writeStructuredChunk(w, req, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_NONE, 0)
+}
+
+// writeStructuredSparseRead writes the reply to a read with holes: the data
+// read in NBD_REPLY_TYPE_OFFSET_DATA chunks, and an NBD_REPLY_TYPE_OFFSET_HOLE
+// chunk for each hole, in order of offset. The last chunk has
+// NBD_REPLY_FLAG_DONE set
+func (c *Connection) writeStructuredSparseRead(w io.Writer, req *Request) error {
+	var pos uint64
+	for i := 0; i <= len(req.holes); i++ {
+		end := req.length
+		if i < len(req.holes) {
+			end = req.holes[i].offset - req.offset
+		}
+		if end > pos {
+			if err := c.writeStructuredData(w, req, pos, end); err != nil {
+				return err
+			}
+		}
+		if i == len(req.holes) {
+			break
+		}
+		h := req.holes[i]
+		pos = h.offset + h.length - req.offset
+		var flags uint16
+		if pos == req.length {
+			flags = NBD_REPLY_FLAG_DONE
+		}
+		if err := c.writeStructuredChunk(w, req, flags, NBD_REPLY_TYPE_OFFSET_HOLE, 8+4); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, struct {
+			NbdOffset   uint64
+			NbdHoleSize uint32
+		}{h.offset, uint32(h.length)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeStructuredData writes the data read from pos to end within a read in
+// NBD_REPLY_TYPE_OFFSET_DATA chunks of at most the export's maximum chunk size,
+// so that the client can process a large read as it arrives. Chunks are split
+// at offsets that are multiples of the export's chunk alignment. The last
+// chunk ends the reply if end is the end of the read. With NBD_CMD_FLAG_DF the
+// data must be a single chunk, so reads too long for one are refused when they
+// are received, unless the spec requires them to be sent regardless
+func (c *Connection) writeStructuredData(w io.Writer, req *Request, pos uint64, end uint64) error {
+	df := req.nbdReq.NbdCommandFlags&NBD_CMD_FLAG_DF != 0
+	for pos < end {
+		next := end
+		if !df && end-pos > c.export.maxChunkSize {
+			// the alignment is at most the maximum, so this is beyond pos
+			next = req.offset + pos + c.export.maxChunkSize
+			next -= next%c.export.chunkAlign + req.offset
+		}
+		var flags uint16
+		if next == req.length {
+			flags = NBD_REPLY_FLAG_DONE
+		}
+		if err := c.writeStructuredChunk(w, req, flags, NBD_REPLY_TYPE_OFFSET_DATA, 8+uint32(next-pos)); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, req.offset+pos); err != nil {
+			return err
+		}
+		// the chunk is written straight from the memory blocks read into
+		for _, b := range memorySegments(req.repData, c.export.memoryBlockSize, pos, next-pos) {
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		}
+		pos = next
+	}
+	return nil
+}
+
+// writeStructuredChunk writes the header of a structured reply chunk to a
+// request, to be followed by length bytes of payload. Once extended headers
+// are negotiated, this is an extended header, carrying the request's offset
+func (c *Connection) writeStructuredChunk(w io.Writer, req *Request, flags uint16, replyType uint16, length uint32) error {
+	if c.extendedHeaders {
+		return binary.Write(w, binary.BigEndian, nbdExtendedReply{
+			NbdReplyMagic: NBD_EXTENDED_REPLY_MAGIC,
+			NbdReplyFlags: flags,
+			NbdReplyType:  replyType,
+			NbdHandle:     req.nbdReq.NbdHandle,
+			NbdOffset:     req.nbdReq.NbdOffset,
+			NbdLength:     uint64(length),
+		})
+	}
+	return binary.Write(w, binary.BigEndian, nbdStructuredReply{
+		NbdReplyMagic: NBD_STRUCTURED_REPLY_MAGIC,
+		NbdReplyFlags: flags,
+		NbdReplyType:  replyType,
+		NbdHandle:     req.nbdReq.NbdHandle,
+		NbdLength:     length,
+	})
+}
+
+// writeStructuredError writes a structured reply error chunk with a message,
+// and for NBD_REPLY_TYPE_ERROR_OFFSET the offset at which the error occurred
+func (c *Connection) writeStructuredError(w io.Writer, req *Request, flags uint16, replyType uint16, nbdError uint32, message string, offset *uint64) error {
+	length := 4 + 2 + uint32(len(message))
+	if offset != nil {
+		length += 8
+	}
+	if err := c.writeStructuredChunk(w, req, flags, replyType, length); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, struct {
+		NbdError         uint32
+		NbdMessageLength uint16
+	}{nbdError, uint16(len(message))}); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, message); err != nil {
+		return err
+	}
+	if offset != nil {
+		return binary.Write(w, binary.BigEndian, *offset)
+	}
+	return nil
+}
+
+// transition moves the connection from one state to the next, returning an
+// error if it is not in the state expected
+func (c *Connection) transition(from int32, to int32) error {
+	if !atomic.CompareAndSwapInt32(&c.state, from, to) {
+		return fmt.Errorf("Connection cannot move from %s to %s as it is %s", connStateNames[from], connStateNames[to], connStateNames[atomic.LoadInt32(&c.state)])
+	}
+	return nil
+}
+
+// Serve negotiates, then starts all the goroutines for processing a connection, then waits for them to be ended
+//
+// The connection's goroutines run on a context of their own rather than on
+// parentCtx, so that when parentCtx is done (as the server shuts down) the
+// connection can be closed gracefully
+func (c *Connection) Serve(parentCtx context.Context) {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+
+	c.rxCh = make(chan Request, 1024)
+	c.txCh = make(chan Request, 1024)
+	c.killCh = make(chan struct{})
+	c.shutdown = parentCtx.Done()
+	c.removed = make(chan struct{})
+	c.closed = make(chan struct{})
+
+	c.conn = c.plainConn
+	c.connected = time.Now()
+	c.name = c.plainConn.RemoteAddr().String()
+	if c.name == "" {
+		c.name = "[unknown]"
+	}
+
+	registerConnection(c)
+	defer func() {
+		unregisterConnection(c)
+		atomic.StoreInt32(&c.state, connClosing)
+		if c.backend != nil {
+			releaseBackend(ctx, c.backend)
+		}
+		c.releaseExportSlot()
+		if c.tlsConn != nil {
+			c.tlsConn.Close()
 		}
 		c.plainConn.Close()
 		cancelFunc()
@@ -637,13 +1743,26 @@ func (c *Connection) Serve(parentCtx context.Context) {
 			}
 			close(c.memBlockCh)
 		}
+		c.writeAccessLog()
 		c.logger.Printf("[INFO] Closed connection from %s", c.name)
+		close(c.closed)
 	}()
 
 	if err := c.Negotiate(ctx); err != nil {
 		c.logger.Printf("[INFO] Negotiation failed with %s: %v", c.name, err)
+		c.setCloseReason(closeNegotiationFailed)
+		expvarNegotiations.Add("failed", 1)
+		return
+	}
+	expvarNegotiations.Add("succeeded", 1)
+	if !registerExportSession(c) {
+		c.logger.Printf("[INFO] Closing connection from %s as export %s has been removed", c.name, c.export.name)
+		c.setCloseReason(closeExportRemoved)
 		return
 	}
+	defer unregisterExportSession(c)
+	c.stats = exportExpvar(c.export.name)
+	c.stats.Add("connections", 1)
 
 	c.memBlocksMaximum = int64(((c.export.maximumBlockSize + c.export.memoryBlockSize - 1) / c.export.memoryBlockSize) * 2)
 	c.memBlockCh = make(chan []byte, c.memBlocksMaximum+1)
@@ -672,8 +1791,14 @@ func (c *Connection) Serve(parentCtx context.Context) {
 	select {
 	case <-c.killCh:
 		c.logger.Printf("[INFO] Worker forced close for %s", c.name)
-	case <-ctx.Done():
-		c.logger.Printf("[INFO] Parent forced close for %s", c.name)
+	case <-parentCtx.Done():
+		c.logger.Printf("[INFO] Parent closing %s gracefully", c.name)
+		c.setCloseReason(closeServerShutdown)
+		c.closeGracefully(ctx, getShutdownTimeout())
+	case <-c.removed:
+		c.logger.Printf("[INFO] Export removed, closing %s gracefully", c.name)
+		c.setCloseReason(closeExportRemoved)
+		c.graceful = c.closeGracefully(ctx, c.linger)
 	}
 }
 
@@ -695,9 +1820,47 @@ func skip(r io.Reader, n uint32) error {
 	return nil
 }
 
+// isKnownOption returns true if optId is an option the negotiation loop
+// handles. Others are rejected with NBD_REP_ERR_UNSUP, and negotiation continues
+func isKnownOption(optId uint32) bool {
+	switch optId {
+	case NBD_OPT_EXPORT_NAME, NBD_OPT_INFO, NBD_OPT_GO, NBD_OPT_LIST, NBD_OPT_STARTTLS,
+		NBD_OPT_STRUCTURED_REPLY, NBD_OPT_EXTENDED_HEADERS, NBD_OPT_X_WRITE_CHECKSUM, NBD_OPT_LIST_META_CONTEXT, NBD_OPT_SET_META_CONTEXT, NBD_OPT_ABORT:
+		return true
+	}
+	return false
+}
+
+// zeroPadLength returns the number of bytes of zero padding to send after the reply
+// to option optId, given the flags sent by the client.
+//
+// Only the reply to NBD_OPT_EXPORT_NAME carries padding, and then only if the client
+// did not set NBD_FLAG_C_NO_ZEROES. Replies to NBD_OPT_GO and NBD_OPT_INFO never do
+func zeroPadLength(clientFlags uint32, optId uint32) int {
+	if optId != NBD_OPT_EXPORT_NAME || clientFlags&NBD_FLAG_C_NO_ZEROES != 0 {
+		return 0
+	}
+	return NBD_EXPORT_NAME_PAD_LENGTH
+}
+
+// negotiationReadDeadline returns the deadline for the next wait for the client
+// during negotiation, which is never later than the negotiation deadline
+func (c *Connection) negotiationReadDeadline(negotiationDeadline time.Time) time.Time {
+	deadline := time.Now().Add(c.params.ConnectionTimeout)
+	if deadline.After(negotiationDeadline) {
+		return negotiationDeadline
+	}
+	return deadline
+}
+
 // Negotiate negotiates a connection
 func (c *Connection) Negotiate(ctx context.Context) error {
-	c.conn.SetDeadline(time.Now().Add(c.params.ConnectionTimeout))
+	// Each wait for the client is bounded by the connection timeout, and the
+	// negotiation as a whole by the negotiation timeout, so a client can
+	// neither stall nor drip-feed options to hold the connection open
+	negotiationDeadline := time.Now().Add(c.params.NegotiationTimeout)
+	deadline := c.negotiationReadDeadline(negotiationDeadline)
+	c.conn.SetDeadline(deadline)
 
 	// We send a newstyle header
 	nsh := nbdNewStyleHeader{
@@ -720,25 +1883,64 @@ func (c *Connection) Negotiate(ctx context.Context) error {
 	if err := binary.Read(c.conn, binary.BigEndian, &clf); err != nil {
 		return errors.New("Cannot read client flags")
 	}
+	if c.listener.strict {
+		// a client must not set flags we did not advertise, and there is
+		// no way to tell it so other than to disconnect
+		known := uint32(NBD_FLAG_C_FIXED_NEWSTYLE)
+		if !c.listener.disableNoZeroes {
+			known |= NBD_FLAG_C_NO_ZEROES
+		}
+		if clf.NbdClientFlags&^known != 0 {
+			c.logger.Printf("[WARN] Aborting negotiation with %s: client flags %08x set reserved bits", c.name, clf.NbdClientFlags)
+			return fmt.Errorf("Client flags %08x set reserved bits", clf.NbdClientFlags)
+		}
+	}
+	if err := c.transition(connHandshaking, connNegotiating); err != nil {
+		return err
+	}
 
 	done := false
+	options := 0
 	// now we get options
 	for !done {
+		deadline = c.negotiationReadDeadline(negotiationDeadline)
+		c.conn.SetDeadline(deadline)
 		var opt nbdClientOpt
 		if err := binary.Read(c.conn, binary.BigEndian, &opt); err != nil {
+			if !time.Now().Before(negotiationDeadline) {
+				c.logger.Printf("[WARN] Aborting negotiation with %s: not complete after %v", c.name, c.params.NegotiationTimeout)
+				return fmt.Errorf("Negotiation not complete after %v", c.params.NegotiationTimeout)
+			}
 			return errors.New("Cannot read option (perhaps client dropped the connection)")
 		}
+		if options++; options > c.params.MaxOptions {
+			c.logger.Printf("[WARN] Aborting negotiation with %s: more than %d options sent", c.name, c.params.MaxOptions)
+			return fmt.Errorf("More than %d options sent", c.params.MaxOptions)
+		}
 		if opt.NbdOptMagic != NBD_OPTS_MAGIC {
 			return errors.New("Bad option magic")
 		}
-		if opt.NbdOptLen > 65536 {
+		if opt.NbdOptLen > 65536 && isKnownOption(opt.NbdOptId) {
 			return errors.New("Option is too long")
 		}
+		if c.shuttingDown() && opt.NbdOptId != NBD_OPT_ABORT {
+			// no export is served once the server is shutting down, so every
+			// option but an abort is refused, leaving the client to abort
+			if err := skip(c.conn, opt.NbdOptLen); err != nil {
+				return err
+			}
+			if err := c.writeOptError(opt.NbdOptId, NBD_REP_ERR_SHUTDOWN, "Server is shutting down"); err != nil {
+				return err
+			}
+			continue
+		}
 		switch opt.NbdOptId {
 		case NBD_OPT_EXPORT_NAME, NBD_OPT_INFO, NBD_OPT_GO:
 			var name []byte
 
 			clientSupportsBlockSizeConstraints := false
+			// the info types requested, in the order requested, each once
+			var requestedInfo []uint16
 
 			if opt.NbdOptId == NBD_OPT_EXPORT_NAME {
 				name = make([]byte, opt.NbdOptLen)
@@ -754,7 +1956,7 @@ func (c *Connection) Negotiate(ctx context.Context) error {
 				if err := binary.Read(c.conn, binary.BigEndian, &nameLength); err != nil {
 					return errors.New("Bad export name length")
 				}
-				if nameLength > 4096 {
+				if nameLength > NBD_MAX_STRING_LENGTH {
 					return errors.New("Name is too long")
 				}
 				name = make([]byte, nameLength)
@@ -774,16 +1976,28 @@ func (c *Connection) Negotiate(ctx context.Context) error {
 					if err := binary.Read(c.conn, binary.BigEndian, &infoElement); err != nil {
 						return errors.New("Bad number of info elements")
 					}
-					switch infoElement {
-					case NBD_INFO_BLOCK_SIZE:
+					if infoElement == NBD_INFO_BLOCK_SIZE {
 						clientSupportsBlockSizeConstraints = true
 					}
+					requested := false
+					for _, r := range requestedInfo {
+						requested = requested || r == infoElement
+					}
+					if !requested {
+						requestedInfo = append(requestedInfo, infoElement)
+					}
 				}
 				l := 2 + 2*uint32(numInfoElements) + 4 + uint32(nameLength)
 				if opt.NbdOptLen > l {
 					if err := skip(c.conn, opt.NbdOptLen-l); err != nil {
 						return err
 					}
+					if c.listener.strict {
+						if err := c.writeOptError(opt.NbdOptId, NBD_REP_ERR_INVALID, "Option has %d bytes of trailing data", opt.NbdOptLen-l); err != nil {
+							return err
+						}
+						break
+					}
 				} else if opt.NbdOptLen < l {
 					return errors.New("Option length too short")
 				}
@@ -803,42 +2017,78 @@ func (c *Connection) Negotiate(ctx context.Context) error {
 					}
 					return errors.New("Attempt to connect to TLS-only connection without TLS")
 				}
-				or := nbdOptReply{
-					NbdOptReplyMagic:  NBD_REP_MAGIC,
-					NbdOptId:          opt.NbdOptId,
-					NbdOptReplyType:   NBD_REP_ERR_UNKNOWN,
-					NbdOptReplyLength: 0,
-				}
-				if err == nil {
-					or.NbdOptReplyType = NBD_REP_ERR_TLS_REQD
+				if err != nil {
+					err = c.writeOptError(opt.NbdOptId, NBD_REP_ERR_UNKNOWN, "Export '%s' not found", string(name))
+				} else {
+					err = c.writeOptError(opt.NbdOptId, NBD_REP_ERR_TLS_REQD, "TLS is required for export '%s'", string(name))
 				}
-				if err := binary.Write(c.conn, binary.BigEndian, or); err != nil {
-					return errors.New("Cannot send info error")
+				if err != nil {
+					return err
 				}
 				break
 			}
 
-			// Now we know we are going to go with the export for sure
-			// any failure beyond here and we are going to drop the
-			// connection (assuming we aren't doing NBD_OPT_INFO)
-			export, err := c.connectExport(ctx, ec)
+			// A connection entering transmission takes one of the
+			// export's connection slots, which it holds until it closes.
+			// NBD_OPT_INFO does not need one
+			if opt.NbdOptId != NBD_OPT_INFO {
+				max, err := exportMaxConnections(ec)
+				if err != nil {
+					return err
+				}
+				if !acquireExportConnection(ec.Name, max) {
+					c.logger.Printf("[WARN] Rejecting client %s for %s as the export's limit of %d connections has been reached", c.name, ec.Name, max)
+					if opt.NbdOptId == NBD_OPT_EXPORT_NAME {
+						return fmt.Errorf("Export %s has too many connections", ec.Name)
+					}
+					if err := c.writeOptError(opt.NbdOptId, NBD_REP_ERR_POLICY, "Export '%s' has reached its limit of %d connections", string(name), max); err != nil {
+						return err
+					}
+					break
+				}
+				exportName := ec.Name
+				c.exportSlot = &exportName
+			}
+
+			// Now we know we are going to go with the export for sure
+			// any failure beyond here and we are going to drop the
+			// connection (assuming we aren't doing NBD_OPT_INFO)
+			export, err := c.connectExport(ctx, ec)
 			if err != nil {
+				c.releaseExportSlot()
 				if opt.NbdOptId == NBD_OPT_EXPORT_NAME {
 					return err
 				}
-				c.logger.Printf("[INFO] Could not connect client %s to %s: %v", c.name, string(name), err)
-				or := nbdOptReply{
-					NbdOptReplyMagic:  NBD_REP_MAGIC,
-					NbdOptId:          opt.NbdOptId,
-					NbdOptReplyType:   NBD_REP_ERR_UNKNOWN,
-					NbdOptReplyLength: 0,
+				if err := c.writeExportUnavailable(opt.NbdOptId, ec, string(name), err); err != nil {
+					return err
 				}
-				if err := binary.Write(c.conn, binary.BigEndian, or); err != nil {
-					return errors.New("Cannot send info error")
+				break
+			}
+
+			// A client that has not asked for the block size constraints
+			// is assuming a minimum block size of 1, so it must not enter
+			// transmission on an export that needs a larger one. The error
+			// tells it to retry, requesting NBD_INFO_BLOCK_SIZE
+			if opt.NbdOptId == NBD_OPT_GO && export.minimumBlockSize > 1 && !clientSupportsBlockSizeConstraints {
+				c.logger.Printf("[INFO] Client %s did not request block size constraints for %s", c.name, string(name))
+				releaseBackend(ctx, c.backend)
+				c.backend = nil
+				c.releaseExportSlot()
+				if err := c.writeOptError(opt.NbdOptId, NBD_REP_ERR_BLOCK_SIZE_REQD, "Export '%s' has a minimum block size of %d, so NBD_INFO_BLOCK_SIZE must be requested", string(name), export.minimumBlockSize); err != nil {
+					return err
 				}
 				break
 			}
 
+			// command 7 is NBD_CMD_BLOCK_STATUS once base:allocation is
+			// selected, rather than NBD_CMD_CLOSE
+			blockStatus := c.allocationContext == ec.Name
+
+			// only reads replied to with structured replies can be fragmented
+			if c.structuredReplies {
+				export.exportFlags |= NBD_FLAG_SEND_DF
+			}
+
 			// for the reply
 			name = []byte(export.name)
 			description := []byte(export.description)
@@ -872,96 +2122,82 @@ func (c *Connection) Negotiate(ctx context.Context) error {
 					return errors.New("Cannot write info export pt2")
 				}
 
-				// Send NBD_INFO_NAME
-				or = nbdOptReply{
-					NbdOptReplyMagic:  NBD_REP_MAGIC,
-					NbdOptId:          opt.NbdOptId,
-					NbdOptReplyType:   NBD_REP_INFO,
-					NbdOptReplyLength: uint32(2 + len(name)),
-				}
-				if err := binary.Write(c.conn, binary.BigEndian, or); err != nil {
-					return errors.New("Cannot write info name pt1")
-				}
-				if err := binary.Write(c.conn, binary.BigEndian, uint16(NBD_INFO_NAME)); err != nil {
-					return errors.New("Cannot write name id")
-				}
-				if err := binary.Write(c.conn, binary.BigEndian, name); err != nil {
-					return errors.New("Cannot write name")
-				}
-
-				// Send NBD_INFO_DESCRIPTION
-				or = nbdOptReply{
-					NbdOptReplyMagic:  NBD_REP_MAGIC,
-					NbdOptId:          opt.NbdOptId,
-					NbdOptReplyType:   NBD_REP_INFO,
-					NbdOptReplyLength: uint32(2 + len(description)),
-				}
-				if err := binary.Write(c.conn, binary.BigEndian, or); err != nil {
-					return errors.New("Cannot write info description pt1")
-				}
-				if err := binary.Write(c.conn, binary.BigEndian, uint16(NBD_INFO_DESCRIPTION)); err != nil {
-					return errors.New("Cannot write description id")
-				}
-				if err := binary.Write(c.conn, binary.BigEndian, description); err != nil {
-					return errors.New("Cannot write description")
-				}
-
-				// Send NBD_INFO_BLOCK_SIZE
-				or = nbdOptReply{
-					NbdOptReplyMagic:  NBD_REP_MAGIC,
-					NbdOptId:          opt.NbdOptId,
-					NbdOptReplyType:   NBD_REP_INFO,
-					NbdOptReplyLength: 14,
+				// Send the info types requested in the order requested,
+				// skipping those we do not support. NBD_INFO_BLOCK_SIZE is
+				// sent even if not requested, as a client must honour it
+				// if it can
+				if !clientSupportsBlockSizeConstraints {
+					requestedInfo = append(requestedInfo, NBD_INFO_BLOCK_SIZE)
 				}
-				if err := binary.Write(c.conn, binary.BigEndian, or); err != nil {
-					return errors.New("Cannot write info block size pt1")
-				}
-				ir2 := nbdInfoBlockSize{
-					NbdInfoType:           NBD_INFO_BLOCK_SIZE,
-					NbdMinimumBlockSize:   uint32(export.minimumBlockSize),
-					NbdPreferredBlockSize: uint32(export.preferredBlockSize),
-					NbdMaximumBlockSize:   uint32(export.maximumBlockSize),
-				}
-				if err := binary.Write(c.conn, binary.BigEndian, ir2); err != nil {
-					return errors.New("Cannot write info block size pt2")
-				}
-
-				replyType := NBD_REP_ACK
-
-				if export.minimumBlockSize > 1 && !clientSupportsBlockSizeConstraints {
-					replyType = NBD_REP_ERR_BLOCK_SIZE_REQD
+				for _, infoType := range requestedInfo {
+					switch infoType {
+					case NBD_INFO_NAME:
+						// so a client connecting to the default export
+						// learns its canonical name
+						if err := c.writeInfoString(opt.NbdOptId, NBD_INFO_NAME, name); err != nil {
+							return err
+						}
+					case NBD_INFO_DESCRIPTION:
+						if len(description) > 0 {
+							if err := c.writeInfoString(opt.NbdOptId, NBD_INFO_DESCRIPTION, description); err != nil {
+								return err
+							}
+						}
+					case NBD_INFO_BLOCK_SIZE:
+						if err := c.writeInfoBlockSize(opt.NbdOptId, export); err != nil {
+							return err
+						}
+					case NBD_INFO_X_DEVICE_HINTS:
+						if export.deviceHints != nil {
+							if err := c.writeInfoDeviceHints(opt.NbdOptId, export.deviceHints); err != nil {
+								return err
+							}
+						}
+					}
 				}
 
-				// Send ACK or error
+				// Send ACK
 				or = nbdOptReply{
 					NbdOptReplyMagic:  NBD_REP_MAGIC,
 					NbdOptId:          opt.NbdOptId,
-					NbdOptReplyType:   replyType,
+					NbdOptReplyType:   NBD_REP_ACK,
 					NbdOptReplyLength: 0,
 				}
 				if err := binary.Write(c.conn, binary.BigEndian, or); err != nil {
 					return errors.New("Cannot info ack")
 				}
-				if opt.NbdOptId == NBD_OPT_INFO || or.NbdOptReplyType&NBD_REP_FLAG_ERROR != 0 {
+				if opt.NbdOptId == NBD_OPT_INFO {
 					// Disassociate the backend as we are not closing
-					c.backend.Close(ctx)
+					releaseBackend(ctx, c.backend)
 					c.backend = nil
 					break
 				}
 			}
 
-			if clf.NbdClientFlags&NBD_FLAG_C_NO_ZEROES == 0 && opt.NbdOptId == NBD_OPT_EXPORT_NAME {
-				// send 124 bytes of zeroes.
-				zeroes := make([]byte, 124, 124)
+			if pad := zeroPadLength(clf.NbdClientFlags, opt.NbdOptId); pad > 0 {
+				zeroes := make([]byte, pad)
 				if err := binary.Write(c.conn, binary.BigEndian, zeroes); err != nil {
 					return errors.New("Cannot write zeroes")
 				}
 			}
 			c.export = export
+			c.blockStatus = blockStatus
 			done = true
 
 		case NBD_OPT_LIST:
+			if opt.NbdOptLen != 0 {
+				if err := skip(c.conn, opt.NbdOptLen); err != nil {
+					return err
+				}
+				if err := c.writeOptError(opt.NbdOptId, NBD_REP_ERR_INVALID, "List option takes no payload"); err != nil {
+					return err
+				}
+				break
+			}
 			for _, e := range c.listener.exports {
+				if isExportRemoved(e.Name) {
+					continue
+				}
 				name := []byte(e.Name)
 				or := nbdOptReply{
 					NbdOptReplyMagic:  NBD_REP_MAGIC,
@@ -990,20 +2226,28 @@ func (c *Connection) Negotiate(ctx context.Context) error {
 				return errors.New("Cannot send list ack")
 			}
 		case NBD_OPT_STARTTLS:
-			if c.listener.tlsconfig == nil || c.tlsConn != nil {
+			if opt.NbdOptLen != 0 {
+				if err := skip(c.conn, opt.NbdOptLen); err != nil {
+					return err
+				}
+				if err := c.writeOptError(opt.NbdOptId, NBD_REP_ERR_INVALID, "STARTTLS option takes no payload"); err != nil {
+					return err
+				}
+			} else if c.listener.tlsconfig == nil && c.listener.closeOnNoTls {
+				// a client wanting TLS may otherwise carry on in plaintext,
+				// so close the connection rather than allow the downgrade
+				return fmt.Errorf("Client %s requested TLS, which is not configured on this server", c.name)
+			} else if c.listener.tlsconfig == nil || c.tlsConn != nil {
 				// say it's unsuppported
 				c.logger.Printf("[INFO] Rejecting upgrade of connection with %s to TLS", c.name)
-				or := nbdOptReply{
-					NbdOptReplyMagic:  NBD_REP_MAGIC,
-					NbdOptId:          opt.NbdOptId,
-					NbdOptReplyType:   NBD_REP_ERR_UNSUP,
-					NbdOptReplyLength: 0,
+				var err error
+				if c.tlsConn != nil {
+					err = c.writeOptError(opt.NbdOptId, NBD_REP_ERR_INVALID, "TLS is already negotiated")
+				} else {
+					err = c.writeOptError(opt.NbdOptId, NBD_REP_ERR_UNSUP, "TLS is not configured on this server")
 				}
-				if c.tlsConn != nil { // TLS is already negotiated
-					or.NbdOptReplyType = NBD_REP_ERR_INVALID
-				}
-				if err := binary.Write(c.conn, binary.BigEndian, or); err != nil {
-					return errors.New("Cannot reply to unsupported TLS option")
+				if err != nil {
+					return err
 				}
 			} else {
 				or := nbdOptReply{
@@ -1020,12 +2264,33 @@ func (c *Connection) Negotiate(ctx context.Context) error {
 				tls := tls.Server(c.conn, c.listener.tlsconfig)
 				c.tlsConn = tls
 				c.conn = tls
-				// explicitly handshake so we get an error here if there is an issue
+				// explicitly handshake so we get an error here if there is an issue,
+				// and do not let a slow or stuck client hold a half-upgraded connection
+				tls.SetDeadline(time.Now().Add(c.params.TlsHandshakeTimeout))
 				if err := tls.Handshake(); err != nil {
+					c.logger.Printf("[WARN] TLS handshake with %s failed: %v", c.name, err)
 					return fmt.Errorf("TLS handshake failed: %s", err)
 				}
+				tls.SetDeadline(deadline)
+			}
+		case NBD_OPT_STRUCTURED_REPLY:
+			if opt.NbdOptLen != 0 {
+				if err := skip(c.conn, opt.NbdOptLen); err != nil {
+					return err
+				}
+				if err := c.writeOptError(opt.NbdOptId, NBD_REP_ERR_INVALID, "Structured reply option takes no payload"); err != nil {
+					return err
+				}
+				break
+			}
+			if c.extendedHeaders {
+				// extended headers imply structured replies, and the client must
+				// not fall back from them
+				if err := c.writeOptError(opt.NbdOptId, NBD_REP_ERR_EXT_HEADER_REQD, "Extended headers have been negotiated"); err != nil {
+					return err
+				}
+				break
 			}
-		case NBD_OPT_ABORT:
 			or := nbdOptReply{
 				NbdOptReplyMagic:  NBD_REP_MAGIC,
 				NbdOptId:          opt.NbdOptId,
@@ -1033,33 +2298,251 @@ func (c *Connection) Negotiate(ctx context.Context) error {
 				NbdOptReplyLength: 0,
 			}
 			if err := binary.Write(c.conn, binary.BigEndian, or); err != nil {
-				return errors.New("Cannot send abort ack")
+				return errors.New("Cannot reply to structured reply option")
 			}
-			return errors.New("Connection aborted by client")
-		default:
-			// eat the option
+			c.structuredReplies = true
+		case NBD_OPT_EXTENDED_HEADERS:
+			if opt.NbdOptLen != 0 {
+				if err := skip(c.conn, opt.NbdOptLen); err != nil {
+					return err
+				}
+				if err := c.writeOptError(opt.NbdOptId, NBD_REP_ERR_INVALID, "Extended headers option takes no payload"); err != nil {
+					return err
+				}
+				break
+			}
+			or := nbdOptReply{
+				NbdOptReplyMagic:  NBD_REP_MAGIC,
+				NbdOptId:          opt.NbdOptId,
+				NbdOptReplyType:   NBD_REP_ACK,
+				NbdOptReplyLength: 0,
+			}
+			if err := binary.Write(c.conn, binary.BigEndian, or); err != nil {
+				return errors.New("Cannot reply to extended headers option")
+			}
+			c.extendedHeaders = true
+			c.structuredReplies = true
+		case NBD_OPT_X_WRITE_CHECKSUM:
+			if opt.NbdOptLen != 0 {
+				if err := skip(c.conn, opt.NbdOptLen); err != nil {
+					return err
+				}
+				if err := c.writeOptError(opt.NbdOptId, NBD_REP_ERR_INVALID, "Write checksum option takes no payload"); err != nil {
+					return err
+				}
+				break
+			}
+			or := nbdOptReply{
+				NbdOptReplyMagic:  NBD_REP_MAGIC,
+				NbdOptId:          opt.NbdOptId,
+				NbdOptReplyType:   NBD_REP_ACK,
+				NbdOptReplyLength: 0,
+			}
+			if err := binary.Write(c.conn, binary.BigEndian, or); err != nil {
+				return errors.New("Cannot reply to write checksum option")
+			}
+			c.writeChecksum = true
+		case NBD_OPT_LIST_META_CONTEXT, NBD_OPT_SET_META_CONTEXT:
+			payload := make([]byte, opt.NbdOptLen)
+			if _, err := io.ReadFull(c.conn, payload); err != nil {
+				return err
+			}
+			if opt.NbdOptId == NBD_OPT_SET_META_CONTEXT {
+				// even an option that fails replaces the selection
+				c.allocationContext = ""
+			}
+			var err error
+			if name, queries, perr := parseMetaContextOption(payload); perr != nil {
+				c.logger.Printf("[INFO] Client %s sent bad meta context option: %v", c.name, perr)
+				err = c.writeOptError(opt.NbdOptId, NBD_REP_ERR_INVALID, "%v", perr)
+			} else if opt.NbdOptId == NBD_OPT_SET_META_CONTEXT && !c.structuredReplies {
+				// meta contexts can only be used with structured replies
+				err = c.writeOptError(opt.NbdOptId, NBD_REP_ERR_INVALID, "Meta contexts need structured replies, which have not been negotiated")
+			} else {
+				if name == "" {
+					name = c.listener.defaultExport
+				}
+				if ec, gerr := c.getExportConfig(ctx, name); gerr != nil {
+					err = c.writeOptError(opt.NbdOptId, NBD_REP_ERR_UNKNOWN, "Export '%s' not found", name)
+				} else {
+					err = c.replyMetaContexts(opt.NbdOptId, ec.Name, queries)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		case NBD_OPT_ABORT:
+			// any payload is ignored, but must be drained for the ack to be read
 			if err := skip(c.conn, opt.NbdOptLen); err != nil {
 				return err
 			}
-			// say it's unsuppported
 			or := nbdOptReply{
 				NbdOptReplyMagic:  NBD_REP_MAGIC,
 				NbdOptId:          opt.NbdOptId,
-				NbdOptReplyType:   NBD_REP_ERR_UNSUP,
+				NbdOptReplyType:   NBD_REP_ACK,
 				NbdOptReplyLength: 0,
 			}
 			if err := binary.Write(c.conn, binary.BigEndian, or); err != nil {
-				return errors.New("Cannot reply to unsupported option")
+				return errors.New("Cannot send abort ack")
+			}
+			return errors.New("Connection aborted by client")
+		default:
+			// eat the option, whatever its length (it is bounded by the
+			// negotiation deadline), so we stay in step with the client
+			if err := skip(c.conn, opt.NbdOptLen); err != nil {
+				return err
+			}
+			// say it's unsuppported
+			if err := c.writeOptError(opt.NbdOptId, NBD_REP_ERR_UNSUP, "Option %d is not supported", opt.NbdOptId); err != nil {
+				return err
 			}
 		}
 	}
 
 	c.conn.SetDeadline(time.Time{})
+	// Writes to the connection are unbuffered, so every byte of the export
+	// details (and any padding) has been handed to the transport by now, and
+	// nothing has been read past the final option. The first command may
+	// already be waiting, and is read by Receive
+	return c.transition(connNegotiating, connTransmitting)
+}
+
+// writeInfoString writes an NBD_REP_INFO reply to option optId carrying an info
+// block of the given type whose content is a string (e.g. NBD_INFO_NAME). The
+// string is not terminated; its length is carried by the reply length
+func (c *Connection) writeInfoString(optId uint32, infoType uint16, s []byte) error {
+	if len(s) > NBD_MAX_STRING_LENGTH {
+		return fmt.Errorf("Info string type %d is too long", infoType)
+	}
+	or := nbdOptReply{
+		NbdOptReplyMagic:  NBD_REP_MAGIC,
+		NbdOptId:          optId,
+		NbdOptReplyType:   NBD_REP_INFO,
+		NbdOptReplyLength: uint32(2 + len(s)),
+	}
+	if err := binary.Write(c.conn, binary.BigEndian, or); err != nil {
+		return fmt.Errorf("Cannot write info type %d header", infoType)
+	}
+	if err := binary.Write(c.conn, binary.BigEndian, infoType); err != nil {
+		return fmt.Errorf("Cannot write info type %d", infoType)
+	}
+	if _, err := c.conn.Write(s); err != nil {
+		return fmt.Errorf("Cannot write info type %d content", infoType)
+	}
+	return nil
+}
+
+// writeInfoBlockSize writes an NBD_REP_INFO reply to option optId carrying the
+// NBD_INFO_BLOCK_SIZE block of the export
+func (c *Connection) writeInfoBlockSize(optId uint32, export *Export) error {
+	or := nbdOptReply{
+		NbdOptReplyMagic:  NBD_REP_MAGIC,
+		NbdOptId:          optId,
+		NbdOptReplyType:   NBD_REP_INFO,
+		NbdOptReplyLength: 14,
+	}
+	if err := binary.Write(c.conn, binary.BigEndian, or); err != nil {
+		return errors.New("Cannot write info block size pt1")
+	}
+	ir := nbdInfoBlockSize{
+		NbdInfoType:           NBD_INFO_BLOCK_SIZE,
+		NbdMinimumBlockSize:   uint32(export.minimumBlockSize),
+		NbdPreferredBlockSize: uint32(export.preferredBlockSize),
+		NbdMaximumBlockSize:   uint32(export.maximumBlockSize),
+	}
+	if err := binary.Write(c.conn, binary.BigEndian, ir); err != nil {
+		return errors.New("Cannot write info block size pt2")
+	}
+	return nil
+}
+
+// writeInfoDeviceHints writes an NBD_REP_INFO reply to option optId carrying the
+// NBD_INFO_X_DEVICE_HINTS block of the export
+func (c *Connection) writeInfoDeviceHints(optId uint32, hints *DeviceHints) error {
+	or := nbdOptReply{
+		NbdOptReplyMagic:  NBD_REP_MAGIC,
+		NbdOptId:          optId,
+		NbdOptReplyType:   NBD_REP_INFO,
+		NbdOptReplyLength: 10,
+	}
+	if err := binary.Write(c.conn, binary.BigEndian, or); err != nil {
+		return errors.New("Cannot write info device hints pt1")
+	}
+	ir := nbdInfoXDeviceHints{
+		NbdInfoType:    NBD_INFO_X_DEVICE_HINTS,
+		NbdSeekLatency: uint32(hints.SeekLatency / time.Microsecond),
+		NbdQueueDepth:  hints.QueueDepth,
+	}
+	if hints.Rotational {
+		ir.NbdDeviceFlags |= NBD_X_DEVICE_ROTATIONAL
+	}
+	if err := binary.Write(c.conn, binary.BigEndian, ir); err != nil {
+		return errors.New("Cannot write info device hints pt2")
+	}
+	return nil
+}
+
+// writeOptError writes an error reply of the given type to option optId,
+// carrying a human readable message to help the client's user diagnose the
+// failure. The message is not terminated; its length is carried by the reply
+// length, and it is truncated if too long
+func (c *Connection) writeOptError(optId uint32, replyType uint32, format string, v ...interface{}) error {
+	msg := []byte(fmt.Sprintf(format, v...))
+	if len(msg) > NBD_MAX_STRING_LENGTH {
+		msg = msg[:NBD_MAX_STRING_LENGTH]
+	}
+	or := nbdOptReply{
+		NbdOptReplyMagic:  NBD_REP_MAGIC,
+		NbdOptId:          optId,
+		NbdOptReplyType:   replyType,
+		NbdOptReplyLength: uint32(len(msg)),
+	}
+	if err := binary.Write(c.conn, binary.BigEndian, or); err != nil {
+		return fmt.Errorf("Cannot send error reply to option %d", optId)
+	}
+	if _, err := c.conn.Write(msg); err != nil {
+		return fmt.Errorf("Cannot send error message for option %d", optId)
+	}
 	return nil
 }
 
+// exportOpenFailureReply returns the error reply type with which an export
+// configures a client be told it cannot be connected to, e.g. because its
+// backend cannot be opened: NBD_REP_ERR_UNKNOWN (the default) or
+// NBD_REP_ERR_POLICY
+func exportOpenFailureReply(ec *ExportConfig) (uint32, error) {
+	switch action := ec.DriverParameters["onopenfailure"]; action {
+	case "", "unknown":
+		return NBD_REP_ERR_UNKNOWN, nil
+	case "policy":
+		return NBD_REP_ERR_POLICY, nil
+	default:
+		return 0, fmt.Errorf("Bad open failure action '%s'", action)
+	}
+}
+
+// writeExportUnavailable replies to option optId that the export ec (requested
+// as name) cannot be connected to because of err, e.g. as its backend cannot be
+// opened. The cause is logged, but only sent to the client if the server sets
+// verboseerrors, as it may reveal details of the server's storage
+func (c *Connection) writeExportUnavailable(optId uint32, ec *ExportConfig, name string, err error) error {
+	c.logger.Printf("[ERROR] Could not connect client %s to %s: %v", c.name, name, err)
+	replyType, rerr := exportOpenFailureReply(ec)
+	if rerr != nil {
+		// checked when the configuration was loaded
+		replyType = NBD_REP_ERR_UNKNOWN
+	}
+	if c.listener.verboseErrors {
+		return c.writeOptError(optId, replyType, "Export '%s' is unavailable: %v", name, err)
+	}
+	return c.writeOptError(optId, replyType, "Export '%s' is unavailable", name)
+}
+
 // getExport generates an export for a given name
 func (c *Connection) getExportConfig(ctx context.Context, name string) (*ExportConfig, error) {
+	if isExportRemoved(name) {
+		return nil, errors.New("No such export")
+	}
 	for _, ec := range c.listener.exports {
 		if ec.Name == name {
 			return &ec, nil
@@ -1080,78 +2563,296 @@ func roundUpToNextPowerOfTwo(x uint64) uint64 {
 	return 0 // won't fit in uint64 :-(
 }
 
+// exportReadOnly returns true if an export is served read-only over a
+// connection, which it is if configured read-only, or if it is configured
+// plaintextreadonly and the connection is not using TLS
+func exportReadOnly(ec *ExportConfig, tls bool) (bool, error) {
+	if ec.ReadOnly {
+		return true, nil
+	}
+	plaintextReadOnly, err := isTrue(ec.DriverParameters["plaintextreadonly"])
+	return plaintextReadOnly && !tls, err
+}
+
+// computeTransmissionFlags works out the transmission flags to advertise for an export,
+// from the capabilities of its backend, any flags forced in its configuration, and
+// whether the connection is using TLS
+func computeTransmissionFlags(ctx context.Context, ec *ExportConfig, backend Backend, tls bool) (uint16, error) {
+	forceFlush, forceNoFlush, err := isTrueFalse(ec.DriverParameters["flush"])
+	if err != nil {
+		return 0, err
+	}
+	forceFua, forceNoFua, err := isTrueFalse(ec.DriverParameters["fua"])
+	if err != nil {
+		return 0, err
+	}
+	readonly, err := exportReadOnly(ec, tls)
+	if err != nil {
+		return 0, err
+	}
+	denied, err := exportDeniedCommands(ec)
+	if err != nil {
+		return 0, err
+	}
+	if denied.has(NBD_CMD_WRITE) && denied.has(NBD_CMD_WRITE_ZEROES) && denied.has(NBD_CMD_TRIM) {
+		// nothing can be written
+		readonly = true
+	}
+	flags := uint16(NBD_FLAG_HAS_FLAGS)
+	if !denied.has(NBD_CMD_WRITE_ZEROES) {
+		flags |= NBD_FLAG_SEND_WRITE_ZEROES
+	}
+	forceMultiConn, forceNoMultiConn, err := exportMultiConn(ec)
+	if err != nil {
+		return 0, err
+	}
+	if !forceNoMultiConn && (forceMultiConn || readonly || isSharedBackend(backend) || backendMultiConn(ctx, backend)) {
+		// nothing written on one connection can be missed on another
+		flags |= NBD_FLAG_CAN_MULTI_CONN
+	}
+	if readonly {
+		// nothing can be written, so there is nothing to flush
+		flags |= NBD_FLAG_READ_ONLY
+	} else {
+		if (backend.HasFua(ctx) || forceFua) && !forceNoFua {
+			flags |= NBD_FLAG_SEND_FUA
+		}
+		if (backend.HasFlush(ctx) || forceFlush) && !forceNoFlush && !denied.has(NBD_CMD_FLUSH) {
+			flags |= NBD_FLAG_SEND_FLUSH
+		}
+		if canFastZero(backend) && !denied.has(NBD_CMD_WRITE_ZEROES) {
+			flags |= NBD_FLAG_SEND_FAST_ZERO
+		}
+		if !denied.has(NBD_CMD_TRIM) {
+			flags |= NBD_FLAG_SEND_TRIM
+		}
+	}
+	if _, ok := backend.(Cacher); ok && !denied.has(NBD_CMD_CACHE) {
+		flags |= NBD_FLAG_SEND_CACHE
+	}
+	return flags, nil
+}
+
+// canFastZero returns true if a backend can zero a range without writing
+// zeroes, at least until its storage turns out not to support it
+func canFastZero(backend Backend) bool {
+	_, punches := backend.(HolePuncher)
+	_, zeroes := backend.(Zeroer)
+	return punches || zeroes
+}
+
+// backendMultiConn returns true if a backend declares itself consistent across
+// connections
+func backendMultiConn(ctx context.Context, backend Backend) bool {
+	mc, ok := backend.(MultiConner)
+	return ok && mc.MultiConn(ctx)
+}
+
+// exportBarrier returns the Barrierer with which to satisfy flushes to an
+// export, if it sets flushbarrier and its backend supports barriers, or else nil
+// so that flushes are full flushes
+func exportBarrier(ec *ExportConfig, backend Backend) (Barrierer, error) {
+	flushBarrier, err := isTrue(ec.DriverParameters["flushbarrier"])
+	if err != nil || !flushBarrier {
+		return nil, err
+	}
+	barrier, ok := backend.(Barrierer)
+	if !ok {
+		getBackendLogger().Printf("[WARN] Export %s cannot satisfy flushes with barriers as its backend does not support them, so flushes will be full flushes", ec.Name)
+		return nil, nil
+	}
+	return barrier, nil
+}
+
+// releaseExportSlot releases the export connection slot the connection holds, if any
+func (c *Connection) releaseExportSlot() {
+	if c.exportSlot != nil {
+		releaseExportConnection(*c.exportSlot)
+		c.exportSlot = nil
+	}
+}
+
 // connectExport generates an export for a given name, and connects to it using the chosen backend
 func (c *Connection) connectExport(ctx context.Context, ec *ExportConfig) (*Export, error) {
-	forceFlush, forceNoFlush, err := isTrueFalse(ec.DriverParameters["flush"])
+	backend, err := acquireBackend(ctx, ec)
 	if err != nil {
 		return nil, err
 	}
-	forceFua, forceNoFua, err := isTrueFalse(ec.DriverParameters["fua"])
+	size, minimumBlockSize, preferredBlockSize, maximumBlockSize, err := backend.Geometry(ctx)
 	if err != nil {
+		releaseBackend(ctx, backend)
 		return nil, err
 	}
-	if backendgen, ok := BackendMap[strings.ToLower(ec.Driver)]; !ok {
+	flags, err := computeTransmissionFlags(ctx, ec, backend, c.tlsConn != nil)
+	if err != nil {
+		releaseBackend(ctx, backend)
+		return nil, err
+	}
+	grace, err := reconnectGrace(ec)
+	if err != nil {
+		releaseBackend(ctx, backend)
+		return nil, err
+	}
+	maxPayload := DefaultMaxPayload
+	if mp := ec.DriverParameters["maxpayload"]; mp != "" {
+		if maxPayload, err = strconv.ParseUint(mp, 10, 32); err != nil || maxPayload == 0 {
+			releaseBackend(ctx, backend)
+			return nil, fmt.Errorf("Bad maximum payload '%s'", mp)
+		}
+	}
+	maxChunkSize := DefaultMaxChunkSize
+	if mc := ec.DriverParameters["maxchunksize"]; mc != "" {
+		// the chunk length carries the offset too
+		if maxChunkSize, err = strconv.ParseUint(mc, 10, 32); err != nil || maxChunkSize == 0 || maxChunkSize > math.MaxUint32-8 {
+			releaseBackend(ctx, backend)
+			return nil, fmt.Errorf("Bad maximum chunk size '%s'", mc)
+		}
+	}
+	var chunkAlign uint64
+	if ca := ec.DriverParameters["chunkalign"]; ca != "" {
+		if chunkAlign, err = strconv.ParseUint(ca, 10, 32); err != nil || chunkAlign == 0 || chunkAlign > maxChunkSize {
+			releaseBackend(ctx, backend)
+			return nil, fmt.Errorf("Bad chunk alignment '%s'", ca)
+		}
+	}
+	detectZeros, err := isTrue(ec.DriverParameters["detectzeros"])
+	if err != nil {
+		releaseBackend(ctx, backend)
+		return nil, err
+	}
+	timeout, err := commandTimeout(ec)
+	if err != nil {
+		releaseBackend(ctx, backend)
+		return nil, err
+	}
+	disconnectOnError := false
+	switch onError := ec.DriverParameters["onerror"]; onError {
+	case "", "reply":
+	case "disconnect":
+		disconnectOnError = true
+	default:
+		releaseBackend(ctx, backend)
+		return nil, fmt.Errorf("Bad error behaviour '%s'", onError)
+	}
+	hints := backendIOHints(ctx, backend)
+	deviceHints, err := exportDeviceHints(ec, hints.Device)
+	if err != nil {
+		releaseBackend(ctx, backend)
+		return nil, err
+	}
+	barrier, err := exportBarrier(ec, backend)
+	if err != nil {
+		releaseBackend(ctx, backend)
+		return nil, err
+	}
+	denied, err := exportDeniedCommands(ec)
+	if err != nil {
+		releaseBackend(ctx, backend)
+		return nil, err
+	}
+	rejectWritesUnsafe := false
+	switch onFlushFailure := ec.DriverParameters["onflushfailure"]; onFlushFailure {
+	case "", "continue":
+	case "rejectwrites":
+		rejectWritesUnsafe = true
+	default:
+		releaseBackend(ctx, backend)
+		return nil, fmt.Errorf("Bad flush failure action '%s'", onFlushFailure)
+	}
+	if c.backend != nil {
+		releaseBackend(ctx, c.backend)
+	}
+	c.backend = backend
+	if ec.MinimumBlockSize != 0 {
+		minimumBlockSize = ec.MinimumBlockSize
+	}
+	if ec.PreferredBlockSize != 0 {
+		preferredBlockSize = ec.PreferredBlockSize
+	} else if hints.Alignment != 0 {
+		// prefer the largest power of two dividing the alignment, so
+		// that I/O aligned to it never straddles the alignment
+		if p := hints.Alignment & -hints.Alignment; p > preferredBlockSize {
+			preferredBlockSize = p
+		}
+	}
+	if ec.MaximumBlockSize != 0 {
+		maximumBlockSize = ec.MaximumBlockSize
+	}
+	if minimumBlockSize == 0 {
+		minimumBlockSize = 1
+	}
+	minimumBlockSize = roundUpToNextPowerOfTwo(minimumBlockSize)
+	preferredBlockSize = roundUpToNextPowerOfTwo(preferredBlockSize)
+	// ensure preferredBlockSize is a multiple of the minimum block size
+	preferredBlockSize = preferredBlockSize & ^(minimumBlockSize - 1)
+	if preferredBlockSize < minimumBlockSize {
+		preferredBlockSize = minimumBlockSize
+	}
+	// ensure maximumBlockSize is a multiple of preferredBlockSize
+	maximumBlockSize = maximumBlockSize & ^(preferredBlockSize - 1)
+	if maximumBlockSize < preferredBlockSize {
+		maximumBlockSize = preferredBlockSize
+	}
+	if chunkAlign == 0 {
+		chunkAlign = preferredBlockSize
+		if chunkAlign > maxChunkSize {
+			chunkAlign = maxChunkSize
+		}
+	}
+	size = size & ^(minimumBlockSize - 1)
+	return &Export{
+		size:               size,
+		exportFlags:        flags,
+		name:               ec.Name,
+		readonly:           flags&NBD_FLAG_READ_ONLY != 0,
+		workers:            ec.Workers,
+		tlsonly:            ec.TlsOnly,
+		description:        ec.Description,
+		minimumBlockSize:   minimumBlockSize,
+		preferredBlockSize: preferredBlockSize,
+		maximumBlockSize:   maximumBlockSize,
+		memoryBlockSize:    preferredBlockSize,
+		reconnectGrace:     grace,
+		maxPayload:         maxPayload,
+		maxChunkSize:       maxChunkSize,
+		chunkAlign:         chunkAlign,
+		detectZeros:        detectZeros,
+		disconnectOnError:  disconnectOnError,
+		commandTimeout:     timeout,
+		barrier:            barrier,
+		flushHealth:        exportFlushHealth(ec.Name),
+		rejectWritesUnsafe: rejectWritesUnsafe,
+		ioHints:            hints,
+		deviceHints:        deviceHints,
+		deniedCommands:     denied,
+	}, nil
+}
+
+// openBackend opens the backend for an export using the driver named in its configuration,
+// and applies any decorators it configures. If the export opens lazily, the backend
+// is only opened on first use
+func openBackend(ctx context.Context, ec *ExportConfig) (Backend, error) {
+	backendgen, ok := BackendMap[strings.ToLower(ec.Driver)]
+	if !ok {
 		return nil, fmt.Errorf("No such driver %s", ec.Driver)
-	} else {
-		if backend, err := backendgen(ctx, ec); err != nil {
+	}
+	bec, err := overlayBaseConfig(ec)
+	if err != nil {
+		return nil, err
+	}
+	open := func(ctx context.Context) (Backend, error) {
+		backend, err := backendgen(ctx, bec)
+		if err != nil {
 			return nil, err
-		} else {
-			size, minimumBlockSize, preferredBlockSize, maximumBlockSize, err := backend.Geometry(ctx)
-			if err != nil {
-				backend.Close(ctx)
-				return nil, err
-			}
-			if c.backend != nil {
-				c.backend.Close(ctx)
-			}
-			c.backend = backend
-			if ec.MinimumBlockSize != 0 {
-				minimumBlockSize = ec.MinimumBlockSize
-			}
-			if ec.PreferredBlockSize != 0 {
-				preferredBlockSize = ec.PreferredBlockSize
-			}
-			if ec.MaximumBlockSize != 0 {
-				maximumBlockSize = ec.MaximumBlockSize
-			}
-			if minimumBlockSize == 0 {
-				minimumBlockSize = 1
-			}
-			minimumBlockSize = roundUpToNextPowerOfTwo(minimumBlockSize)
-			preferredBlockSize = roundUpToNextPowerOfTwo(preferredBlockSize)
-			// ensure preferredBlockSize is a multiple of the minimum block size
-			preferredBlockSize = preferredBlockSize & ^(minimumBlockSize - 1)
-			if preferredBlockSize < minimumBlockSize {
-				preferredBlockSize = minimumBlockSize
-			}
-			// ensure maximumBlockSize is a multiple of preferredBlockSize
-			maximumBlockSize = maximumBlockSize & ^(preferredBlockSize - 1)
-			if maximumBlockSize < preferredBlockSize {
-				maximumBlockSize = preferredBlockSize
-			}
-			flags := uint16(NBD_FLAG_HAS_FLAGS | NBD_FLAG_SEND_WRITE_ZEROES | NBD_FLAG_SEND_CLOSE)
-			if (backend.HasFua(ctx) || forceFua) && !forceNoFua {
-				flags |= NBD_FLAG_SEND_FUA
-			}
-			if (backend.HasFlush(ctx) || forceFlush) && !forceNoFlush {
-				flags |= NBD_FLAG_SEND_FLUSH
-			}
-			size = size & ^(minimumBlockSize - 1)
-			return &Export{
-				size:               size,
-				exportFlags:        flags,
-				name:               ec.Name,
-				readonly:           ec.ReadOnly,
-				workers:            ec.Workers,
-				tlsonly:            ec.TlsOnly,
-				description:        ec.Description,
-				minimumBlockSize:   minimumBlockSize,
-				preferredBlockSize: preferredBlockSize,
-				maximumBlockSize:   maximumBlockSize,
-				memoryBlockSize:    preferredBlockSize,
-			}, nil
 		}
+		return decorate(ctx, ec, backend)
+	}
+	if lazy, err := isTrue(ec.DriverParameters["lazyopen"]); err != nil {
+		return nil, err
+	} else if lazy {
+		return newLazyBackend(ec, open)
 	}
+	return open(ctx)
 }
 
 func RegisterBackend(name string, generator func(ctx context.Context, e *ExportConfig) (Backend, error)) {
@@ -0,0 +1,91 @@
+package nbd
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// Interval at which Convert reports its progress
+var convertProgressInterval = 5 * time.Second
+
+// parseConvertSpec parses the source or destination of a conversion, either
+// driver:path for the named driver's backend at path, or the name of an export
+// in the configuration file
+func parseConvertSpec(spec string) (*ExportConfig, error) {
+	if i := strings.Index(spec, ":"); i >= 0 {
+		driver, path := strings.ToLower(spec[:i]), spec[i+1:]
+		if _, ok := BackendMap[driver]; !ok {
+			return nil, fmt.Errorf("No such driver %s", driver)
+		}
+		if path == "" {
+			return nil, fmt.Errorf("Bad image '%s'", spec)
+		}
+		return &ExportConfig{
+			Name:             spec,
+			Driver:           driver,
+			DriverParameters: DriverParametersConfig{"path": path},
+		}, nil
+	}
+	c, err := ParseConfig()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse configuration file: %v", err)
+	}
+	for _, s := range c.Servers {
+		for _, e := range s.Exports {
+			if e.Name == spec {
+				return &e, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("No such export %s", spec)
+}
+
+// Convert copies the contents of the backend from to the backend to, without
+// serving either, e.g. to convert an image from one driver's format to
+// another's. Each is given as for parseConvertSpec, and they must be the same
+// size. Progress is reported to out as the conversion runs. It returns true if
+// the conversion completed.
+//
+// If the conversion fails, the offset it failed at is reported, and the
+// destination is reported as incomplete: only the data below that offset was
+// copied, and nothing written may have been made durable
+func Convert(ctx context.Context, out io.Writer, from string, to string) bool {
+	src, err := parseConvertSpec(from)
+	if err != nil {
+		fmt.Fprintf(out, "Bad source: %v\n", err)
+		return false
+	}
+	dst, err := parseConvertSpec(to)
+	if err != nil {
+		fmt.Fprintf(out, "Bad destination: %v\n", err)
+		return false
+	}
+	src.ReadOnly = true
+	j, err := startCopy(ctx, log.New(out, "", 0), *src, *dst, true)
+	if err != nil {
+		fmt.Fprintf(out, "Cannot convert %s to %s: %v\n", src.Name, dst.Name, err)
+		return false
+	}
+	ticker := time.NewTicker(convertProgressInterval)
+	defer ticker.Stop()
+	for done := false; !done; {
+		select {
+		case <-ticker.C:
+			if copied, size := j.Progress(); size > 0 {
+				fmt.Fprintf(out, "Converted %d of %d bytes (%d%%)\n", copied, size, 100*copied/size)
+			}
+		case <-j.Done():
+			done = true
+		}
+	}
+	if err := j.Wait(); err != nil {
+		copied, size := j.Progress()
+		fmt.Fprintf(out, "Conversion failed, so %s is incomplete (%d of %d bytes copied): %v\n", dst.Name, copied, size, err)
+		return false
+	}
+	return true
+}
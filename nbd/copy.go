@@ -0,0 +1,341 @@
+package nbd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Size of each chunk copied by a CopyJob
+var CopyChunkSize uint64 = 1024 * 1024
+
+// CopyJob is a server-side copy of the contents of one export to another
+//
+// The copy runs in its own goroutine. Its progress can be polled, and it can be
+// cancelled. If it fails, Progress reports how far it got, i.e. everything below
+// the offset returned was copied successfully. Chunks of the source reading as
+// zeroes are deallocated in the destination if it can punch holes, rather than
+// written, so a sparse source stays sparse.
+//
+// The backends are acquired as connections acquire them, so a backend shared
+// between the connections to an export (e.g. with reconnectgrace) is shared
+// with the copy too, and the copy's writes update or drop what a read cache
+// holds for them
+type CopyJob struct {
+	src        ExportConfig       // the source export
+	dst        ExportConfig       // the destination export
+	logger     *log.Logger        // a logger
+	size       uint64             // number of bytes to copy
+	copied     uint64             // number of bytes copied so far (atomic)
+	done       chan struct{}      // closed when the copy has finished
+	err        error              // the error the copy finished with
+	errMutex   sync.Mutex         // protects err
+	cancelFunc context.CancelFunc // cancels the copy
+}
+
+// StartCopy starts copying the contents of the export src to the export dst.
+//
+// For the copy to be consistent, nothing may write to the source, so src must be
+// a read-only export. The destination must be at least as large as the source
+func StartCopy(parentCtx context.Context, logger *log.Logger, src ExportConfig, dst ExportConfig) (*CopyJob, error) {
+	return startCopy(parentCtx, logger, src, dst, false)
+}
+
+// startCopy starts a copy as StartCopy does, but if exactSize is set, the
+// destination must be the same size as the source
+func startCopy(parentCtx context.Context, logger *log.Logger, src ExportConfig, dst ExportConfig, exactSize bool) (*CopyJob, error) {
+	if !src.ReadOnly {
+		return nil, fmt.Errorf("Source export %s must be read-only to be copied", src.Name)
+	}
+	if dst.ReadOnly {
+		return nil, fmt.Errorf("Destination export %s is read-only", dst.Name)
+	}
+
+	ctx, cancelFunc := context.WithCancel(parentCtx)
+	srcBackend, err := acquireBackend(ctx, &src)
+	if err != nil {
+		cancelFunc()
+		return nil, fmt.Errorf("Cannot open source export %s: %v", src.Name, err)
+	}
+	dstBackend, err := acquireBackend(ctx, &dst)
+	if err != nil {
+		releaseBackend(ctx, srcBackend)
+		cancelFunc()
+		return nil, fmt.Errorf("Cannot open destination export %s: %v", dst.Name, err)
+	}
+	srcSize, srcMinimumBlockSize, _, _, err := srcBackend.Geometry(ctx)
+	if err == nil {
+		var dstSize, dstMinimumBlockSize uint64
+		dstSize, dstMinimumBlockSize, _, _, err = dstBackend.Geometry(ctx)
+		if err == nil && dstSize < srcSize {
+			err = fmt.Errorf("Destination export %s (%d bytes) is smaller than source export %s (%d bytes)", dst.Name, dstSize, src.Name, srcSize)
+		} else if err == nil && exactSize && dstSize != srcSize {
+			err = fmt.Errorf("Destination export %s (%d bytes) is larger than source export %s (%d bytes)", dst.Name, dstSize, src.Name, srcSize)
+		}
+		if err == nil && (CopyChunkSize%roundUpToNextPowerOfTwo(srcMinimumBlockSize) != 0 || CopyChunkSize%roundUpToNextPowerOfTwo(dstMinimumBlockSize) != 0) {
+			err = errors.New("Copy chunk size is not a multiple of the block size")
+		}
+	}
+	if err != nil {
+		releaseBackend(ctx, srcBackend)
+		releaseBackend(ctx, dstBackend)
+		cancelFunc()
+		return nil, err
+	}
+
+	j := &CopyJob{
+		src:        src,
+		dst:        dst,
+		logger:     logger,
+		size:       srcSize,
+		done:       make(chan struct{}),
+		cancelFunc: cancelFunc,
+	}
+	go j.run(ctx, srcBackend, dstBackend)
+	return j, nil
+}
+
+// run is the goroutine that performs the copy
+func (j *CopyJob) run(ctx context.Context, srcBackend Backend, dstBackend Backend) {
+	var err error
+	defer func() {
+		releaseBackend(ctx, srcBackend)
+		releaseBackend(ctx, dstBackend)
+		j.cancelFunc()
+		j.errMutex.Lock()
+		j.err = err
+		j.errMutex.Unlock()
+		if err != nil {
+			j.logger.Printf("[ERROR] Copy of %s to %s failed after %d bytes: %v", j.src.Name, j.dst.Name, atomic.LoadUint64(&j.copied), err)
+		} else {
+			j.logger.Printf("[INFO] Copy of %s to %s completed (%d bytes)", j.src.Name, j.dst.Name, j.size)
+		}
+		close(j.done)
+	}()
+
+	j.logger.Printf("[INFO] Copying %s to %s (%d bytes)", j.src.Name, j.dst.Name, j.size)
+	buf := make([]byte, CopyChunkSize)
+	for offset := uint64(0); offset < j.size; {
+		select {
+		case <-ctx.Done():
+			err = errors.New("Copy cancelled")
+			return
+		default:
+		}
+		length := CopyChunkSize
+		if length > j.size-offset {
+			length = j.size - offset
+		}
+		var n int
+		if n, err = srcBackend.ReadAt(ctx, buf[:length], int64(offset)); err != nil {
+			err = fmt.Errorf("read error at offset %d: %v", offset, err)
+			return
+		} else if uint64(n) != length {
+			err = fmt.Errorf("short read at offset %d", offset)
+			return
+		}
+		if holes, ok := dstBackend.(HolePuncher); ok && isZeroes(buf[:length]) {
+			// deallocate rather than write zeroes, keeping the destination sparse
+			if n, err = holes.PunchHoleAt(ctx, int(length), int64(offset), false); err == errPunchHoleUnsupported {
+				n, err = dstBackend.WriteAt(ctx, buf[:length], int64(offset), false)
+			}
+		} else {
+			n, err = dstBackend.WriteAt(ctx, buf[:length], int64(offset), false)
+		}
+		if err != nil {
+			err = fmt.Errorf("write error at offset %d: %v", offset, err)
+			return
+		} else if uint64(n) != length {
+			err = fmt.Errorf("short write at offset %d", offset)
+			return
+		}
+		offset += length
+		atomic.StoreUint64(&j.copied, offset)
+	}
+	if err = dstBackend.Flush(ctx); err != nil {
+		// nothing written can be relied upon
+		atomic.StoreUint64(&j.copied, 0)
+		err = fmt.Errorf("flush error: %v", err)
+	}
+}
+
+// Progress returns the number of bytes copied successfully so far, and the total number of bytes to copy
+func (j *CopyJob) Progress() (uint64, uint64) {
+	return atomic.LoadUint64(&j.copied), j.size
+}
+
+// Cancel cancels the copy
+func (j *CopyJob) Cancel() {
+	j.cancelFunc()
+}
+
+// Done returns a channel that is closed when the copy has finished
+func (j *CopyJob) Done() <-chan struct{} {
+	return j.done
+}
+
+// Wait waits for the copy to finish, and returns the error (if any) that it finished with
+func (j *CopyJob) Wait() error {
+	<-j.done
+	j.errMutex.Lock()
+	defer j.errMutex.Unlock()
+	return j.err
+}
+
+// CopyStatus reports the state of a copy job started through the copy API
+type CopyStatus struct {
+	Id          int64  `json:"id"`              // identifies the job
+	Source      string `json:"source"`          // name of the source export
+	Destination string `json:"destination"`     // name of the destination export
+	Copied      uint64 `json:"copied"`          // bytes copied successfully, so far or before the copy failed
+	Size        uint64 `json:"size"`            // bytes to copy
+	Done        bool   `json:"done"`            // whether the copy has finished
+	Error       string `json:"error,omitempty"` // why the copy failed, once it has
+}
+
+// status returns the state of the copy as the job with the given id
+func (j *CopyJob) status(id int64) CopyStatus {
+	copied, size := j.Progress()
+	cs := CopyStatus{
+		Id:          id,
+		Source:      j.src.Name,
+		Destination: j.dst.Name,
+		Copied:      copied,
+		Size:        size,
+	}
+	select {
+	case <-j.done:
+		cs.Done = true
+		if err := j.Wait(); err != nil {
+			cs.Error = err.Error()
+		}
+	default:
+	}
+	return cs
+}
+
+// Copy jobs started through the copy API, by id, and the exports they may copy
+// between, which are those of the configuration being served
+var (
+	copyJobs      = make(map[int64]*CopyJob)
+	copyJobsId    int64
+	copyExports   = make(map[string]ExportConfig)
+	copyJobsMutex sync.Mutex // protects the above
+)
+
+func init() {
+	http.HandleFunc("/debug/copy", serveCopyJobs)
+}
+
+// setCopyExports sets the exports the copy API may copy between to those of
+// the configuration being served, so that copies share their backends with
+// the connections to them
+func setCopyExports(c *Config) {
+	copyJobsMutex.Lock()
+	defer copyJobsMutex.Unlock()
+	copyExports = make(map[string]ExportConfig)
+	for _, s := range c.Servers {
+		for _, e := range s.Exports {
+			if _, ok := copyExports[e.Name]; !ok {
+				copyExports[e.Name] = e
+			}
+		}
+	}
+}
+
+// serveCopyJobs serves the copy API. A POST with src and dst starts copying the
+// export src to the export dst, a GET with an id reports the job's status (or
+// without one, every job's), and a DELETE with an id cancels the job, or if it
+// has finished, forgets it. Each replies with the status of the job(s) as JSON
+func serveCopyJobs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var id int64
+	if r.Method != "POST" && q.Get("id") != "" {
+		var err error
+		if id, err = strconv.ParseInt(q.Get("id"), 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("Bad copy job id '%s'", q.Get("id")), http.StatusBadRequest)
+			return
+		}
+	}
+	copyJobsMutex.Lock()
+	j, ok := copyJobs[id]
+	copyJobsMutex.Unlock()
+	if id != 0 && !ok {
+		http.Error(w, fmt.Sprintf("No such copy job %d", id), http.StatusNotFound)
+		return
+	}
+
+	var reply interface{}
+	switch {
+	case r.Method == "POST":
+		copyJobsMutex.Lock()
+		src, srcOk := copyExports[q.Get("src")]
+		dst, dstOk := copyExports[q.Get("dst")]
+		copyJobsMutex.Unlock()
+		if !srcOk {
+			http.Error(w, fmt.Sprintf("No such export %s", q.Get("src")), http.StatusNotFound)
+			return
+		}
+		if !dstOk {
+			http.Error(w, fmt.Sprintf("No such export %s", q.Get("dst")), http.StatusNotFound)
+			return
+		}
+		j, err := StartCopy(context.Background(), getBackendLogger(), src, dst)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		copyJobsMutex.Lock()
+		copyJobsId++
+		id = copyJobsId
+		copyJobs[id] = j
+		copyJobsMutex.Unlock()
+		reply = j.status(id)
+	case r.Method == "GET" && id != 0:
+		reply = j.status(id)
+	case r.Method == "GET":
+		statuses := []CopyStatus{}
+		copyJobsMutex.Lock()
+		for id, j := range copyJobs {
+			statuses = append(statuses, j.status(id))
+		}
+		copyJobsMutex.Unlock()
+		sort.Slice(statuses, func(i, k int) bool { return statuses[i].Id < statuses[k].Id })
+		reply = statuses
+	case r.Method == "DELETE" && id != 0:
+		cs := j.status(id)
+		if cs.Done {
+			copyJobsMutex.Lock()
+			delete(copyJobs, id)
+			copyJobsMutex.Unlock()
+		} else {
+			j.Cancel()
+		}
+		reply = cs
+	case r.Method == "DELETE":
+		http.Error(w, "No copy job id", http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, fmt.Sprintf("Bad copy request %s", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+// isZeroes returns true if b is all zeroes
+func isZeroes(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
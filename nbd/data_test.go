@@ -79,7 +79,7 @@ func genTestCertificate() (key, cert string) {
 
 	template.DNSNames = append(template.DNSNames, host)
 	template.IsCA = true
-	template.KeyUsage |= x509.KeyUsageCertSign
+	template.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
 
 	derBytes, err := x509.CreateCertificate(
 		rand.Reader, &template, &template, publicKey(priv), priv)
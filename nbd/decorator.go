@@ -0,0 +1,62 @@
+package nbd
+
+import (
+	"golang.org/x/net/context"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// A decorator wraps a backend to add behaviour to it, driven by the export's
+// configuration. If the export does not ask for the behaviour, the decorator
+// returns the backend unchanged.
+type decorator func(ctx context.Context, ec *ExportConfig, backend Backend) (Backend, error)
+
+// backendLogger holds the logger for decorators reporting events that are not
+// tied to a connection, such as a failover
+var backendLogger atomic.Value
+
+func init() {
+	setBackendLogger(log.New(os.Stderr, "gonbdserver:", log.LstdFlags))
+}
+
+// setBackendLogger sets the logger used by decorators
+func setBackendLogger(logger *log.Logger) {
+	backendLogger.Store(logger)
+}
+
+// getBackendLogger returns the logger used by decorators
+func getBackendLogger() *log.Logger {
+	return backendLogger.Load().(*log.Logger)
+}
+
+// decorators lists the decorators applied to each backend opened, innermost first
+var decorators = []decorator{
+	newSizeProviderBackend,
+	newSliceBackend,
+	newAlignBackend,
+	newReadRetryBackend,
+	newFailoverBackend,
+	newIoPrioBackend,
+	newWorkerPoolBackend,
+	newColdReadBackend,
+	newOverlayBackend,
+	newInterceptBackend,
+	newReadCacheBackend,
+	newSyncIntervalBackend,
+	newTraceBackend,
+}
+
+// decorate applies each decorator in turn to a newly opened backend. On error
+// the backend is closed
+func decorate(ctx context.Context, ec *ExportConfig, backend Backend) (Backend, error) {
+	for _, d := range decorators {
+		b, err := d(ctx, ec, backend)
+		if err != nil {
+			backend.Close(ctx)
+			return nil, err
+		}
+		backend = b
+	}
+	return backend, nil
+}
@@ -0,0 +1,444 @@
+package nbd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default size of the blocks deduplicated by a DedupBackend
+const DefaultDedupBlockSize = 4096
+
+// Length of an entry in a DedupBackend's map journal: the block index, the
+// hash of its content, and a CRC of both
+const dedupRecordLength = 8 + sha256.Size + 4
+
+// Dedup stores open in this process. Two backends using the same store would
+// each have their own map, and corrupt it
+var (
+	dedupStores      = make(map[string]bool)
+	dedupStoresMutex sync.Mutex
+)
+
+// dedupHash is the hash identifying a block's content
+type dedupHash [sha256.Size]byte
+
+// the hash recorded for a block with no stored content (i.e. reading as zeroes)
+var dedupZeroHash dedupHash
+
+// DedupBackend implements Backend
+//
+// It deduplicates the export's content at a fixed block size. Each block
+// written is hashed with SHA-256 and stored once, in a file named by its hash
+// in a content-addressed store; a map from block index to hash resolves reads.
+// Blocks of zeroes are not stored at all. Each unique block is reference
+// counted, and blocks which are no longer referenced (through overwrite or
+// trim) are deleted.
+//
+// The map is persisted as a journal of changes, compacted on open. It is kept
+// crash-consistent by ordering: a block's content is synced before any journal
+// entry referring to it is written, and unreferenced blocks are only deleted once
+// the journal entries removing the references to them have been synced (which
+// happens on flush or FUA). Reference counts are recomputed from the map on open,
+// when any blocks left unreferenced by a crash are deleted
+type DedupBackend struct {
+	dir       string               // the directory holding the map and the content store
+	size      uint64               // the export's logical size
+	blockSize uint64               // the deduplication block size
+	journal   *os.File             // the map journal, open for append
+	blocks    map[uint64]dedupHash // block index to content hash, for blocks with content
+	refs      map[dedupHash]int    // number of references to each stored block
+	unrefd    map[dedupHash]bool   // stored blocks whose reference count has dropped to zero
+	mutex     sync.RWMutex
+}
+
+// blockPath returns the path of the content of a block in the store
+func (db *DedupBackend) blockPath(h dedupHash) string {
+	s := hex.EncodeToString(h[:])
+	return filepath.Join(db.dir, "blocks", s[:2], s)
+}
+
+// readBlock reads the content of a block into b, which is blockSize long
+func (db *DedupBackend) readBlock(index uint64, b []byte) error {
+	h, ok := db.blocks[index]
+	if !ok {
+		for i := range b {
+			b[i] = 0
+		}
+		return nil
+	}
+	f, err := os.Open(db.blockPath(h))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.ReadFull(f, b)
+	return err
+}
+
+// storeBlock stores the content of a block, if not already stored, and returns its hash
+func (db *DedupBackend) storeBlock(b []byte) (dedupHash, error) {
+	h := dedupHash(sha256.Sum256(b))
+	if _, ok := db.refs[h]; ok {
+		// already stored (perhaps awaiting deletion, but now referenced again)
+		return h, nil
+	}
+	p := db.blockPath(h)
+	if err := writeFileSync(p, b); err != nil {
+		return h, err
+	}
+	db.refs[h] = 0
+	return h, nil
+}
+
+// writeFileSync atomically writes a file, and syncs it and its directory
+func writeFileSync(p string, b []byte) error {
+	tmp := p + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(p))
+}
+
+// syncDir syncs a directory, making the creation, deletion or renaming of its entries durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// encodeDedupRecord returns the journal entry mapping a block index to a hash
+func encodeDedupRecord(index uint64, h dedupHash) []byte {
+	r := make([]byte, dedupRecordLength)
+	binary.BigEndian.PutUint64(r, index)
+	copy(r[8:], h[:])
+	binary.BigEndian.PutUint32(r[8+sha256.Size:], crc32.ChecksumIEEE(r[:8+sha256.Size]))
+	return r
+}
+
+// setBlock points a block index at a hash, journalling the change. The hash's
+// content must already be stored
+func (db *DedupBackend) setBlock(index uint64, h dedupHash) error {
+	old, ok := db.blocks[index]
+	if ok && old == h {
+		return nil
+	}
+	if !ok && h == dedupZeroHash {
+		return nil
+	}
+	if _, err := db.journal.Write(encodeDedupRecord(index, h)); err != nil {
+		return err
+	}
+	if h == dedupZeroHash {
+		delete(db.blocks, index)
+	} else {
+		db.blocks[index] = h
+		db.refs[h]++
+		delete(db.unrefd, h)
+	}
+	if ok {
+		db.refs[old]--
+		if db.refs[old] == 0 {
+			db.unrefd[old] = true
+		}
+	}
+	return nil
+}
+
+// sync makes the journal durable, then deletes the blocks it no longer references
+func (db *DedupBackend) sync() error {
+	if err := db.journal.Sync(); err != nil {
+		return err
+	}
+	for h := range db.unrefd {
+		if err := os.Remove(db.blockPath(h)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(db.refs, h)
+		delete(db.unrefd, h)
+	}
+	return nil
+}
+
+// WriteAt implements Backend.WriteAt
+func (db *DedupBackend) WriteAt(ctx context.Context, b []byte, offset int64, fua bool) (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if offset < 0 || uint64(offset)+uint64(len(b)) > db.size {
+		return 0, errors.New("Write beyond end of export")
+	}
+	block := make([]byte, db.blockSize)
+	zero := make([]byte, db.blockSize)
+	n := 0
+	for n < len(b) {
+		addr := uint64(offset) + uint64(n)
+		index := addr / db.blockSize
+		start := addr % db.blockSize
+		length := db.blockSize - start
+		if length > uint64(len(b)-n) {
+			length = uint64(len(b) - n)
+		}
+		if length != db.blockSize {
+			// partial block, so read-modify-write
+			if err := db.readBlock(index, block); err != nil {
+				return n, err
+			}
+		}
+		copy(block[start:start+length], b[n:])
+		h := dedupZeroHash
+		if !bytes.Equal(block, zero) {
+			var err error
+			if h, err = db.storeBlock(block); err != nil {
+				return n, err
+			}
+		}
+		if err := db.setBlock(index, h); err != nil {
+			return n, err
+		}
+		n += int(length)
+	}
+	if fua {
+		if err := db.sync(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// ReadAt implements Backend.ReadAt
+func (db *DedupBackend) ReadAt(ctx context.Context, b []byte, offset int64) (int, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if offset < 0 || uint64(offset)+uint64(len(b)) > db.size {
+		return 0, errors.New("Read beyond end of export")
+	}
+	block := make([]byte, db.blockSize)
+	n := 0
+	for n < len(b) {
+		addr := uint64(offset) + uint64(n)
+		start := addr % db.blockSize
+		if err := db.readBlock(addr/db.blockSize, block); err != nil {
+			return n, err
+		}
+		n += copy(b[n:], block[start:])
+	}
+	return n, nil
+}
+
+// TrimAt implements Backend.TrimAt
+//
+// Blocks wholly within the range trimmed are unmapped, so read as zeroes; the
+// remainder of the range is left unchanged
+func (db *DedupBackend) TrimAt(ctx context.Context, length int, offset int64) (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	first := (uint64(offset) + db.blockSize - 1) / db.blockSize
+	end := (uint64(offset) + uint64(length)) / db.blockSize
+	for index := first; index < end; index++ {
+		if err := db.setBlock(index, dedupZeroHash); err != nil {
+			return 0, err
+		}
+	}
+	return length, nil
+}
+
+// Flush implements Backend.Flush
+func (db *DedupBackend) Flush(ctx context.Context) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.sync()
+}
+
+// Close implements Backend.Close
+func (db *DedupBackend) Close(ctx context.Context) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	err := db.sync()
+	if cerr := db.journal.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	dedupStoresMutex.Lock()
+	delete(dedupStores, db.dir)
+	dedupStoresMutex.Unlock()
+	return err
+}
+
+// Geometry implements Backend.Geometry
+func (db *DedupBackend) Geometry(ctx context.Context) (uint64, uint64, uint64, uint64, error) {
+	return db.size, 1, db.blockSize, 32 * 1024 * 1024, nil
+}
+
+// HasFua implements Backend.HasFua
+func (db *DedupBackend) HasFua(ctx context.Context) bool {
+	return true
+}
+
+// HasFlush implements Backend.HasFlush
+func (db *DedupBackend) HasFlush(ctx context.Context) bool {
+	return true
+}
+
+// load replays the map journal, ignoring any entry torn by a crash, and
+// recomputes the reference counts
+func (db *DedupBackend) load(p string) error {
+	data, err := ioutil.ReadFile(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for len(data) >= dedupRecordLength {
+		r := data[:dedupRecordLength]
+		data = data[dedupRecordLength:]
+		if crc32.ChecksumIEEE(r[:8+sha256.Size]) != binary.BigEndian.Uint32(r[8+sha256.Size:]) {
+			break
+		}
+		var h dedupHash
+		copy(h[:], r[8:])
+		index := binary.BigEndian.Uint64(r)
+		if h == dedupZeroHash {
+			delete(db.blocks, index)
+		} else {
+			db.blocks[index] = h
+		}
+	}
+	for _, h := range db.blocks {
+		db.refs[h]++
+	}
+	return nil
+}
+
+// compact rewrites the map journal to contain only current mappings, and opens it for append
+func (db *DedupBackend) compact(p string) error {
+	buf := make([]byte, 0, len(db.blocks)*dedupRecordLength)
+	for index, h := range db.blocks {
+		buf = append(buf, encodeDedupRecord(index, h)...)
+	}
+	if err := writeFileSync(p, buf); err != nil {
+		return err
+	}
+	journal, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	db.journal = journal
+	return nil
+}
+
+// collect deletes stored blocks which are not referenced by the map, and any
+// temporary files, left behind by a crash
+func (db *DedupBackend) collect() error {
+	return filepath.Walk(filepath.Join(db.dir, "blocks"), func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if h, err := hex.DecodeString(info.Name()); err == nil && len(h) == sha256.Size {
+			var hash dedupHash
+			copy(hash[:], h)
+			if db.refs[hash] > 0 {
+				return nil
+			}
+		}
+		return os.Remove(p)
+	})
+}
+
+// Generate a new dedup backend
+func NewDedupBackend(ctx context.Context, ec *ExportConfig) (Backend, error) {
+	if ec.DriverParameters["path"] == "" {
+		return nil, errors.New("Dedup exports need a path")
+	}
+	dir, err := filepath.Abs(ec.DriverParameters["path"])
+	if err != nil {
+		return nil, err
+	}
+	size, err := strconv.ParseUint(ec.DriverParameters["size"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Bad size '%s'", ec.DriverParameters["size"])
+	}
+	blockSize := uint64(DefaultDedupBlockSize)
+	if bsParam := ec.DriverParameters["dedupblocksize"]; bsParam != "" {
+		if blockSize, err = strconv.ParseUint(bsParam, 10, 64); err != nil || blockSize == 0 || blockSize&(blockSize-1) != 0 {
+			return nil, fmt.Errorf("Bad dedup block size '%s'", bsParam)
+		}
+	}
+
+	dedupStoresMutex.Lock()
+	defer dedupStoresMutex.Unlock()
+	if dedupStores[dir] {
+		return nil, fmt.Errorf("Dedup store %s is already open; set reconnectgrace to share it between connections", dir)
+	}
+
+	for i := 0; i < 256; i++ {
+		if err := os.MkdirAll(filepath.Join(dir, "blocks", fmt.Sprintf("%02x", i)), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	db := &DedupBackend{
+		dir:       dir,
+		size:      size,
+		blockSize: blockSize,
+		blocks:    make(map[uint64]dedupHash),
+		refs:      make(map[dedupHash]int),
+		unrefd:    make(map[dedupHash]bool),
+	}
+	// the block size is recorded so reopening with a different one (which would
+	// misinterpret the map) is detected
+	bsPath := filepath.Join(dir, "blocksize")
+	if b, err := ioutil.ReadFile(bsPath); err == nil {
+		if strings.TrimSpace(string(b)) != strconv.FormatUint(blockSize, 10) {
+			return nil, fmt.Errorf("Dedup store %s has block size %s, not %d", dir, strings.TrimSpace(string(b)), blockSize)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	} else if err := writeFileSync(bsPath, []byte(strconv.FormatUint(blockSize, 10)+"\n")); err != nil {
+		return nil, err
+	}
+	mapPath := filepath.Join(dir, "map")
+	if err := db.load(mapPath); err != nil {
+		return nil, err
+	}
+	if err := db.compact(mapPath); err != nil {
+		return nil, err
+	}
+	if err := db.collect(); err != nil {
+		db.journal.Close()
+		return nil, err
+	}
+	dedupStores[dir] = true
+	return db, nil
+}
+
+// Register our backend
+func init() {
+	RegisterBackend("dedup", NewDedupBackend)
+}
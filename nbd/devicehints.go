@@ -0,0 +1,43 @@
+package nbd
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// exportDeviceHints returns the device hints an export advertises: those of its
+// backend's device, if known, with any of rotational, seeklatency and queuedepth
+// the export configures in their place. It returns nil if there are none
+func exportDeviceHints(ec *ExportConfig, device *DeviceHints) (*DeviceHints, error) {
+	rotationalParam, latencyParam, depthParam := ec.DriverParameters["rotational"], ec.DriverParameters["seeklatency"], ec.DriverParameters["queuedepth"]
+	if rotationalParam == "" && latencyParam == "" && depthParam == "" {
+		return device, nil
+	}
+	hints := DeviceHints{}
+	if device != nil {
+		hints = *device
+	}
+	if rotationalParam != "" {
+		rotational, err := isTrue(rotationalParam)
+		if err != nil {
+			return nil, err
+		}
+		hints.Rotational = rotational
+	}
+	if latencyParam != "" {
+		latency, err := time.ParseDuration(latencyParam)
+		if err != nil || latency < 0 || latency/time.Microsecond > 0xffffffff {
+			return nil, fmt.Errorf("Bad seek latency '%s'", latencyParam)
+		}
+		hints.SeekLatency = latency
+	}
+	if depthParam != "" {
+		depth, err := strconv.ParseUint(depthParam, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Bad queue depth '%s'", depthParam)
+		}
+		hints.QueueDepth = uint16(depth)
+	}
+	return &hints, nil
+}
@@ -0,0 +1,260 @@
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Default granularity at which dirty blocks are tracked
+const DefaultDirtyBlockSize = 64 * 1024
+
+// Dirty bitmap file format: a header of the magic, the generation, the block
+// size and the size of the tracked file (each 8 bytes, big endian), followed by
+// one bit per block, least significant bit first
+const (
+	dirtyBitmapMagic        = "GNBDDIRT"
+	dirtyBitmapHeaderLength = 32
+)
+
+// DirtyExtent is a range of a file written since a checkpoint
+type DirtyExtent struct {
+	Offset uint64
+	Length uint64
+}
+
+// Open dirty bitmaps, by path, so every connection to an export shares one.
+// A checkpoint may also find them here
+var (
+	dirtyBitmaps      = make(map[string]*dirtyBitmap)
+	dirtyBitmapsMutex sync.Mutex
+)
+
+// dirtyBitmap persistently records which blocks of a file have been written
+// since the last checkpoint, so that the file can be synchronised elsewhere
+// incrementally.
+//
+// Before a write is made, the bits for the blocks it touches are set and made
+// durable, so that after a crash every block that might have been written is
+// known to be dirty. A block is only marked once per generation, so only the
+// first write to it after a checkpoint pays for this. A checkpoint snapshots
+// and clears the bitmap, atomically replacing the file with one of the next
+// generation; writes in flight complete first, so each lands in exactly one
+// generation
+type dirtyBitmap struct {
+	path       string       // path of the bitmap file
+	refs       int          // number of backends using the bitmap (protected by dirtyBitmapsMutex)
+	inflight   sync.RWMutex // held for reading by writes, and for writing by checkpoints
+	mutex      sync.Mutex   // protects the following
+	file       *os.File     // the bitmap file
+	blockSize  uint64       // granularity of the bitmap
+	size       uint64       // size of the tracked file
+	generation uint64       // generation of the bitmap, incremented by each checkpoint
+	bits       []byte       // the bitmap
+}
+
+// encode returns the content of the bitmap file for a generation and bitmap
+func (db *dirtyBitmap) encode(generation uint64, bits []byte) []byte {
+	b := make([]byte, dirtyBitmapHeaderLength, dirtyBitmapHeaderLength+len(bits))
+	copy(b, dirtyBitmapMagic)
+	binary.BigEndian.PutUint64(b[8:], generation)
+	binary.BigEndian.PutUint64(b[16:], db.blockSize)
+	binary.BigEndian.PutUint64(b[24:], db.size)
+	return append(b, bits...)
+}
+
+// save atomically replaces the bitmap file with the given generation and
+// bitmap, and reopens it. Call with the mutex held
+func (db *dirtyBitmap) save(generation uint64, bits []byte) error {
+	if err := writeFileSync(db.path, db.encode(generation, bits)); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(db.path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if db.file != nil {
+		db.file.Close()
+	}
+	db.file = file
+	return nil
+}
+
+// load reads the bitmap file, creating it if it does not exist. A block size
+// or size of zero is taken from an existing file
+func (db *dirtyBitmap) load() error {
+	b, err := ioutil.ReadFile(db.path)
+	if os.IsNotExist(err) {
+		if db.blockSize == 0 {
+			return fmt.Errorf("Dirty bitmap %s does not exist", db.path)
+		}
+		// we cannot know what was written before the bitmap was
+		// created, so every block is dirty
+		db.generation = 1
+		db.bits = bytes.Repeat([]byte{0xff}, int((db.size+db.blockSize-1)/db.blockSize+7)/8)
+		return db.save(db.generation, db.bits)
+	} else if err != nil {
+		return err
+	}
+	if len(b) < dirtyBitmapHeaderLength || string(b[:8]) != dirtyBitmapMagic {
+		return fmt.Errorf("%s is not a dirty bitmap", db.path)
+	}
+	blockSize := binary.BigEndian.Uint64(b[16:])
+	size := binary.BigEndian.Uint64(b[24:])
+	if db.blockSize == 0 {
+		db.blockSize, db.size = blockSize, size
+	}
+	if blockSize != db.blockSize || size != db.size {
+		return fmt.Errorf("Dirty bitmap %s tracks %d bytes in blocks of %d, not %d bytes in blocks of %d", db.path, size, blockSize, db.size, db.blockSize)
+	}
+	numBlocks := (db.size + db.blockSize - 1) / db.blockSize
+	if uint64(len(b)-dirtyBitmapHeaderLength) != (numBlocks+7)/8 {
+		return fmt.Errorf("Dirty bitmap %s has a bad length", db.path)
+	}
+	db.generation = binary.BigEndian.Uint64(b[8:])
+	db.bits = b[dirtyBitmapHeaderLength:]
+	db.file, err = os.OpenFile(db.path, os.O_RDWR, 0644)
+	return err
+}
+
+// mark marks the blocks covered by length bytes at offset dirty, making the
+// change durable before returning
+func (db *dirtyBitmap) mark(length int, offset int64) error {
+	if length <= 0 {
+		return nil
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	first := uint64(offset) / db.blockSize
+	last := (uint64(offset) + uint64(length) + db.blockSize - 1) / db.blockSize
+	lo, hi := -1, -1
+	for i := first; i < last; i++ {
+		if db.bits[i/8]&(1<<(i%8)) == 0 {
+			db.bits[i/8] |= 1 << (i % 8)
+			if lo < 0 {
+				lo = int(i / 8)
+			}
+			hi = int(i/8) + 1
+		}
+	}
+	if lo < 0 {
+		return nil
+	}
+	if _, err := db.file.WriteAt(db.bits[lo:hi], int64(dirtyBitmapHeaderLength+lo)); err != nil {
+		return err
+	}
+	return db.file.Sync()
+}
+
+// track performs a write of length bytes at offset with f, having first marked
+// the blocks it covers dirty
+func (db *dirtyBitmap) track(length int, offset int64, f func() (int, error)) (int, error) {
+	db.inflight.RLock()
+	defer db.inflight.RUnlock()
+	if err := db.mark(length, offset); err != nil {
+		return 0, fmt.Errorf("Cannot mark blocks dirty: %v", err)
+	}
+	return f()
+}
+
+// checkpoint clears the bitmap, starting the next generation, and returns the
+// generation ended and the extents it dirtied
+func (db *dirtyBitmap) checkpoint() (uint64, []DirtyExtent, error) {
+	db.inflight.Lock()
+	defer db.inflight.Unlock()
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	bits := make([]byte, len(db.bits))
+	if err := db.save(db.generation+1, bits); err != nil {
+		return 0, nil, err
+	}
+	var extents []DirtyExtent
+	numBlocks := (db.size + db.blockSize - 1) / db.blockSize
+	for i := uint64(0); i < numBlocks; i++ {
+		if db.bits[i/8]&(1<<(i%8)) == 0 {
+			continue
+		}
+		end := (i + 1) * db.blockSize
+		if end > db.size {
+			end = db.size
+		}
+		if n := len(extents); n > 0 && extents[n-1].Offset+extents[n-1].Length == i*db.blockSize {
+			extents[n-1].Length = end - extents[n-1].Offset
+		} else {
+			extents = append(extents, DirtyExtent{Offset: i * db.blockSize, Length: end - i*db.blockSize})
+		}
+	}
+	generation := db.generation
+	db.generation++
+	db.bits = bits
+	return generation, extents, nil
+}
+
+// acquireDirtyBitmap opens the dirty bitmap at path tracking a file of the
+// given size, or returns it if already open. A block size or size of zero is
+// taken from an existing bitmap. It must be released with releaseDirtyBitmap
+func acquireDirtyBitmap(path string, blockSize uint64, size uint64) (*dirtyBitmap, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	dirtyBitmapsMutex.Lock()
+	defer dirtyBitmapsMutex.Unlock()
+	if db, ok := dirtyBitmaps[path]; ok {
+		if (blockSize != 0 && db.blockSize != blockSize) || (size != 0 && db.size != size) {
+			return nil, fmt.Errorf("Dirty bitmap %s is already open with a different block size or size", path)
+		}
+		db.refs++
+		return db, nil
+	}
+	db := &dirtyBitmap{
+		path:      path,
+		refs:      1,
+		blockSize: blockSize,
+		size:      size,
+	}
+	if err := db.load(); err != nil {
+		if db.file != nil {
+			db.file.Close()
+		}
+		return nil, err
+	}
+	dirtyBitmaps[path] = db
+	return db, nil
+}
+
+// releaseDirtyBitmap releases a bitmap acquired with acquireDirtyBitmap,
+// closing it once unused
+func releaseDirtyBitmap(db *dirtyBitmap) error {
+	dirtyBitmapsMutex.Lock()
+	defer dirtyBitmapsMutex.Unlock()
+	db.refs--
+	if db.refs > 0 {
+		return nil
+	}
+	delete(dirtyBitmaps, db.path)
+	return db.file.Close()
+}
+
+// CheckpointDirtyBitmap checkpoints the dirty bitmap at path, whether or not
+// an export using it is open. It returns the generation of the bitmap before
+// the checkpoint, and the extents written during that generation, which is
+// every extent of the file for the first generation of a new bitmap. Once the
+// checkpoint returns, those extents are no longer recorded, so the caller must
+// not lose them
+func CheckpointDirtyBitmap(path string) (uint64, []DirtyExtent, error) {
+	if path == "" {
+		return 0, nil, errors.New("No dirty bitmap path")
+	}
+	db, err := acquireDirtyBitmap(path, 0, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer releaseDirtyBitmap(db)
+	return db.checkpoint()
+}
@@ -0,0 +1,50 @@
+package nbd
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+)
+
+// Runtime state published with expvar, and so served as JSON at /debug/vars
+// by the HTTP server started with -pprof. Each counter is updated atomically,
+// so the values are consistent under concurrency, though a snapshot of several
+// may straddle an update
+var (
+	expvarConnections            = expvar.NewInt("nbd_connections_total")        // connections accepted
+	expvarConnectionsRejected    = expvar.NewInt("nbd_connections_rejected")     // connections refused by the server-wide limit or rate limit, or as quiesced
+	expvarConnectionsRateLimited = expvar.NewMap("nbd_connections_rate_limited") // connections delayed or closed by a listener's rate limit, by action
+	expvarNegotiations           = expvar.NewMap("nbd_negotiations")             // negotiations, by outcome
+	expvarExports                = expvar.NewMap("nbd_exports")                  // per-export counters, by export name
+	expvarExportsMutex           sync.Mutex                                      // serialises creating per-export counters
+)
+
+func init() {
+	expvar.Publish("nbd_quiesced", expvar.Func(func() interface{} {
+		return IsQuiesced()
+	}))
+	expvar.Publish("nbd_connections_active", expvar.Func(func() interface{} {
+		return atomic.LoadInt64(&activeConnections)
+	}))
+	expvar.Publish("nbd_export_connections", expvar.Func(func() interface{} {
+		exportConnectionsMutex.Lock()
+		defer exportConnectionsMutex.Unlock()
+		connections := make(map[string]int, len(exportConnections))
+		for name, n := range exportConnections {
+			connections[name] = n
+		}
+		return connections
+	}))
+}
+
+// exportExpvar returns the counters of the named export, creating them if need be
+func exportExpvar(name string) *expvar.Map {
+	expvarExportsMutex.Lock()
+	defer expvarExportsMutex.Unlock()
+	if v := expvarExports.Get(name); v != nil {
+		return v.(*expvar.Map)
+	}
+	m := new(expvar.Map).Init()
+	expvarExports.Set(name, m)
+	return m
+}
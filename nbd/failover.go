@@ -0,0 +1,289 @@
+package nbd
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default number of consecutive errors from a primary backend triggering failover
+const DefaultFailoverThreshold = 3
+
+// Open FailoverBackends, so pending manual failovers can be confirmed
+var (
+	failoverBackends      = make(map[*FailoverBackend]bool)
+	failoverBackendsMutex sync.Mutex
+)
+
+// FailoverBackend implements Backend
+//
+// It serves an export from a primary backend, failing over to a standby
+// backend if the primary fails. The standby is expected to be kept in sync
+// with the primary by other means. The primary is deemed to have failed after
+// a number of consecutive errors, from commands or from periodic health probes.
+// Failover may be automatic, in which case the command which triggered it is
+// retried on the standby, or may need confirming (see ConfirmFailovers), to
+// avoid flapping. There is no automatic failback
+type FailoverBackend struct {
+	name      string        // the name of the export, for logging
+	primary   Backend       // the primary backend
+	standby   Backend       // the standby backend
+	threshold int           // consecutive errors triggering failover
+	manual    bool          // true if failover must be confirmed
+	stop      chan struct{} // closed to stop the health probe
+	mutex     sync.Mutex    // protects the following
+	active    Backend       // the backend currently serving I/O
+	errors    int           // consecutive errors from the primary
+	pending   bool          // true if failover is awaiting confirmation
+}
+
+// failOver switches to the standby. Call with the mutex held
+func (fb *FailoverBackend) failOver(reason string) {
+	fb.active = fb.standby
+	fb.pending = false
+	getBackendLogger().Printf("[ERROR] Export %s failed over to standby backend: %s", fb.name, reason)
+}
+
+// primaryFailed records an error from the primary, failing over (or
+// requesting confirmation to) if the threshold is reached. It returns true
+// if the standby is now active
+func (fb *FailoverBackend) primaryFailed(err error) bool {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	if fb.active != fb.primary {
+		return true
+	}
+	fb.errors++
+	if fb.errors < fb.threshold {
+		return false
+	}
+	reason := fmt.Sprintf("%d consecutive errors from primary, the last being: %v", fb.errors, err)
+	if !fb.manual {
+		fb.failOver(reason)
+		return true
+	}
+	if !fb.pending {
+		fb.pending = true
+		getBackendLogger().Printf("[ERROR] Export %s primary backend has failed (%s); send SIGUSR2 to confirm failover to standby", fb.name, reason)
+	}
+	return false
+}
+
+// do performs an operation on the active backend, tracking the health of the
+// primary, and retrying on the standby if it fails over
+func (fb *FailoverBackend) do(f func(b Backend) error) error {
+	fb.mutex.Lock()
+	active := fb.active
+	fb.mutex.Unlock()
+	err := f(active)
+	if active != fb.primary {
+		return err
+	}
+	if err == nil {
+		fb.mutex.Lock()
+		fb.errors = 0
+		fb.mutex.Unlock()
+		return nil
+	}
+	if fb.primaryFailed(err) {
+		return f(fb.standby)
+	}
+	return err
+}
+
+// confirm performs a failover awaiting confirmation
+func (fb *FailoverBackend) confirm() {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	if fb.pending {
+		fb.failOver("confirmed")
+	}
+}
+
+// probe is the goroutine periodically checking the primary can be read from
+func (fb *FailoverBackend) probe(ctx context.Context, interval time.Duration) {
+	size, _, _, _, _ := fb.primary.Geometry(ctx)
+	b := make([]byte, 512)
+	if size < uint64(len(b)) {
+		b = b[:size]
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-fb.stop:
+			return
+		case <-ticker.C:
+			fb.mutex.Lock()
+			primaryActive := fb.active == fb.primary
+			fb.mutex.Unlock()
+			if !primaryActive {
+				return
+			}
+			if _, err := fb.primary.ReadAt(ctx, b, 0); err != nil {
+				fb.primaryFailed(fmt.Errorf("health probe failed: %v", err))
+			}
+		}
+	}
+}
+
+// WriteAt implements Backend.WriteAt
+func (fb *FailoverBackend) WriteAt(ctx context.Context, b []byte, offset int64, fua bool) (n int, err error) {
+	err = fb.do(func(backend Backend) error {
+		n, err = backend.WriteAt(ctx, b, offset, fua)
+		return err
+	})
+	return
+}
+
+// ReadAt implements Backend.ReadAt
+func (fb *FailoverBackend) ReadAt(ctx context.Context, b []byte, offset int64) (n int, err error) {
+	err = fb.do(func(backend Backend) error {
+		n, err = backend.ReadAt(ctx, b, offset)
+		return err
+	})
+	return
+}
+
+// TrimAt implements Backend.TrimAt
+func (fb *FailoverBackend) TrimAt(ctx context.Context, length int, offset int64) (n int, err error) {
+	err = fb.do(func(backend Backend) error {
+		n, err = backend.TrimAt(ctx, length, offset)
+		return err
+	})
+	return
+}
+
+// Flush implements Backend.Flush
+func (fb *FailoverBackend) Flush(ctx context.Context) error {
+	return fb.do(func(backend Backend) error {
+		return backend.Flush(ctx)
+	})
+}
+
+// Close implements Backend.Close
+func (fb *FailoverBackend) Close(ctx context.Context) error {
+	close(fb.stop)
+	failoverBackendsMutex.Lock()
+	delete(failoverBackends, fb)
+	failoverBackendsMutex.Unlock()
+	err := fb.primary.Close(ctx)
+	if serr := fb.standby.Close(ctx); serr != nil && err == nil {
+		err = serr
+	}
+	return err
+}
+
+// Geometry implements Backend.Geometry
+func (fb *FailoverBackend) Geometry(ctx context.Context) (uint64, uint64, uint64, uint64, error) {
+	return fb.primary.Geometry(ctx)
+}
+
+// HasFua implements Backend.HasFua
+func (fb *FailoverBackend) HasFua(ctx context.Context) bool {
+	return fb.primary.HasFua(ctx) && fb.standby.HasFua(ctx)
+}
+
+// HasFlush implements Backend.HasFlush
+func (fb *FailoverBackend) HasFlush(ctx context.Context) bool {
+	return fb.primary.HasFlush(ctx) && fb.standby.HasFlush(ctx)
+}
+
+// IOHints implements IOHinter.IOHints
+func (fb *FailoverBackend) IOHints(ctx context.Context) IOHints {
+	return backendIOHints(ctx, fb.primary)
+}
+
+// ConfirmFailovers confirms every failover awaiting confirmation, so those
+// exports switch to their standby backends
+func ConfirmFailovers() {
+	failoverBackendsMutex.Lock()
+	defer failoverBackendsMutex.Unlock()
+	for fb := range failoverBackends {
+		fb.confirm()
+	}
+}
+
+// standbyExportConfig returns the configuration for an export's standby
+// backend, taken from its driver parameters prefixed 'standby'
+func standbyExportConfig(ec *ExportConfig) *ExportConfig {
+	sec := *ec
+	sec.DriverParameters = make(DriverParametersConfig)
+	for k, v := range ec.DriverParameters {
+		if strings.HasPrefix(k, "standby") && k != "standbydriver" {
+			sec.DriverParameters[strings.TrimPrefix(k, "standby")] = v
+		}
+	}
+	sec.Driver = ec.DriverParameters["standbydriver"]
+	return &sec
+}
+
+// newFailoverBackend wraps a backend in a FailoverBackend if the export configures a standby
+func newFailoverBackend(ctx context.Context, ec *ExportConfig, backend Backend) (Backend, error) {
+	if ec.DriverParameters["standbydriver"] == "" {
+		return backend, nil
+	}
+	manual := false
+	switch mode := ec.DriverParameters["failover"]; mode {
+	case "", "auto":
+	case "manual":
+		manual = true
+	default:
+		return nil, fmt.Errorf("Bad failover mode '%s'", mode)
+	}
+	threshold := DefaultFailoverThreshold
+	if t := ec.DriverParameters["failoverthreshold"]; t != "" {
+		var err error
+		if threshold, err = strconv.Atoi(t); err != nil || threshold < 1 {
+			return nil, fmt.Errorf("Bad failover threshold '%s'", t)
+		}
+	}
+	var probeInterval time.Duration
+	if p := ec.DriverParameters["failoverprobe"]; p != "" {
+		var err error
+		if probeInterval, err = time.ParseDuration(p); err != nil || probeInterval <= 0 {
+			return nil, fmt.Errorf("Bad failover probe interval '%s'", p)
+		}
+	}
+
+	sec := standbyExportConfig(ec)
+	standbygen, ok := BackendMap[strings.ToLower(sec.Driver)]
+	if !ok {
+		return nil, fmt.Errorf("No such standby driver %s", sec.Driver)
+	}
+	standby, err := standbygen(ctx, sec)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open standby backend: %v", err)
+	}
+	size, _, _, _, err := backend.Geometry(ctx)
+	if err == nil {
+		var standbySize uint64
+		if standbySize, _, _, _, err = standby.Geometry(ctx); err == nil && standbySize != size {
+			err = fmt.Errorf("Standby backend size %d differs from primary size %d", standbySize, size)
+		}
+	}
+	if err != nil {
+		standby.Close(ctx)
+		return nil, err
+	}
+
+	fb := &FailoverBackend{
+		name:      ec.Name,
+		primary:   backend,
+		standby:   standby,
+		threshold: threshold,
+		manual:    manual,
+		stop:      make(chan struct{}),
+		active:    backend,
+	}
+	failoverBackendsMutex.Lock()
+	failoverBackends[fb] = true
+	failoverBackendsMutex.Unlock()
+	if probeInterval > 0 {
+		go fb.probe(context.Background(), probeInterval)
+	}
+	return fb, nil
+}
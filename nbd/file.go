@@ -1,47 +1,289 @@
 package nbd
 
 import (
+	"errors"
+	"fmt"
 	"golang.org/x/net/context"
+	"io"
 	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// Default interval between checks that a file backend's file is still in place
+const DefaultFileCheckInterval = time.Second
+
+// Minimum length of a read after which a file backend with dropcache set
+// drops the data read from the page cache, so that small reads do not each
+// pay for a system call
+const dropCacheMinimumRead = 128 * 1024
+
+// BackendFailedError is returned by a backend that can no longer serve its
+// export, e.g. because its storage has been removed underneath it. If Close is
+// set, connections using the backend are closed rather than just failing the
+// command
+type BackendFailedError struct {
+	Reason string
+	Close  bool
+}
+
+func (e *BackendFailedError) Error() string {
+	return "Backend failed: " + e.Reason
+}
+
 // FileBackend implements Backend
 type FileBackend struct {
-	file *os.File
-	size uint64
+	file     *os.File // the file, through which writes are made
+	readFile *os.File // the descriptor reads are made through: file, unless splitfd is set
+	size     uint64
+
+	// for detecting the file being deleted, replaced or truncated underneath us
+	path          string        // the path the file was opened with
+	info          os.FileInfo   // the file as opened, or nil if not checked
+	checkInterval time.Duration // how often to stat the file
+	closeOnFail   bool          // close connections rather than failing commands
+	lastCheck     time.Time     // when the file was last checked
+	failed        error         // set once the file has been found to be missing
+	checkMutex    sync.Mutex    // protects lastCheck and failed
+
+	dirty *dirtyBitmap // tracks blocks written since the last checkpoint, or nil
+
+	rangeFua bool // make FUA writes durable by syncing just the range written
+
+	dropCache bool // drop data read from the page cache, for streaming workloads
+
+	noHoles     int32 // nonzero once the file is found not to support holes, accessed atomically
+	noZeroRange int32 // nonzero once the file is found not to support zeroing ranges, accessed atomically
+
+	marker *cleanMarker // records whether the file was closed cleanly, or nil
+
+	device *DeviceHints // characteristics of the device holding the file, or nil if unknown
+
+	grows bool // true if writes may extend the file beyond its size as opened
+}
+
+// fail records why the file has gone, and returns the error to return from now on
+func (fb *FileBackend) fail(format string, args ...interface{}) error {
+	if fb.failed == nil {
+		fb.failed = &BackendFailedError{
+			Reason: fmt.Sprintf("%s %s", fb.path, fmt.Sprintf(format, args...)),
+			Close:  fb.closeOnFail,
+		}
+		atomic.AddInt64(&failedBackends, 1)
+	}
+	return fb.failed
+}
+
+// check returns an error if the file has been deleted, replaced or truncated.
+// As this needs system calls, it is only checked every checkInterval
+func (fb *FileBackend) check() error {
+	if fb.info == nil {
+		return nil
+	}
+	fb.checkMutex.Lock()
+	defer fb.checkMutex.Unlock()
+	if fb.failed != nil || time.Since(fb.lastCheck) < fb.checkInterval {
+		return fb.failed
+	}
+	fb.lastCheck = time.Now()
+	if info, err := fb.file.Stat(); err != nil {
+		return fb.fail("cannot be checked: %v", err)
+	} else if uint64(info.Size()) < fb.size {
+		return fb.fail("has been truncated from %d to %d bytes", fb.size, info.Size())
+	}
+	if info, err := os.Stat(fb.path); os.IsNotExist(err) {
+		return fb.fail("has been deleted")
+	} else if err == nil && !os.SameFile(info, fb.info) {
+		return fb.fail("has been replaced")
+	}
+	return nil
 }
 
 // WriteAt implements Backend.WriteAt
 func (fb *FileBackend) WriteAt(ctx context.Context, b []byte, offset int64, fua bool) (int, error) {
-	n, err := fb.file.WriteAt(b, offset)
+	return fb.write(len(b), offset, fua, func() (int, error) {
+		return fb.file.WriteAt(b, offset)
+	})
+}
+
+// WriteAtv implements VectoredWriter.WriteAtv
+func (fb *FileBackend) WriteAtv(ctx context.Context, bufs [][]byte, offset int64, fua bool) (int, error) {
+	return fb.write(buffersLength(bufs), offset, fua, func() (int, error) {
+		return pwritev(fb.file, bufs, offset)
+	})
+}
+
+// write performs a write of length bytes at offset with f, tracking the
+// blocks written and making the write durable if fua is set
+func (fb *FileBackend) write(length int, offset int64, fua bool, f func() (int, error)) (int, error) {
+	if err := fb.check(); err != nil {
+		return 0, err
+	}
+	if fb.info != nil && !fb.grows && uint64(offset)+uint64(length) > fb.size {
+		// the export is larger than the file (e.g. a size provider reports
+		// more than it holds), so fail rather than silently extend the file
+		return 0, syscall.ENOSPC
+	}
+	var n int
+	var err error
+	if fb.dirty != nil {
+		n, err = fb.dirty.track(length, offset, f)
+	} else {
+		n, err = f()
+	}
 	if err != nil || !fua {
 		return n, err
 	}
-	err = fb.file.Sync()
+	// syncing a range does not commit metadata, so a write extending
+	// the file needs a full sync for its data to be found after a crash
+	if fb.rangeFua && uint64(offset)+uint64(length) <= fb.size {
+		err = syncRange(fb.file, offset, int64(length))
+	} else {
+		err = fb.file.Sync()
+	}
 	if err != nil {
 		return 0, err
 	}
 	return n, err
 }
 
+// PunchHoleAt implements HolePuncher.PunchHoleAt
+func (fb *FileBackend) PunchHoleAt(ctx context.Context, length int, offset int64, fua bool) (int, error) {
+	if atomic.LoadInt32(&fb.noHoles) != 0 {
+		return 0, errPunchHoleUnsupported
+	}
+	return fb.write(length, offset, fua, func() (int, error) {
+		if err := punchHole(fb.file, offset, int64(length)); err != nil {
+			if err == errPunchHoleUnsupported {
+				atomic.StoreInt32(&fb.noHoles, 1)
+			}
+			return 0, err
+		}
+		return length, nil
+	})
+}
+
+// ZeroAt implements Zeroer.ZeroAt
+func (fb *FileBackend) ZeroAt(ctx context.Context, length int, offset int64, fua bool) (int, error) {
+	if atomic.LoadInt32(&fb.noZeroRange) != 0 {
+		return 0, errZeroUnsupported
+	}
+	return fb.write(length, offset, fua, func() (int, error) {
+		if err := zeroRange(fb.file, offset, int64(length)); err != nil {
+			if err == errZeroUnsupported {
+				atomic.StoreInt32(&fb.noZeroRange, 1)
+			}
+			return 0, err
+		}
+		return length, nil
+	})
+}
+
+// Extents implements ExtentLister.Extents
+//
+// We find the file's holes with lseek, where the platform and filesystem
+// allow; a file without holes is allocated throughout
+func (fb *FileBackend) Extents(ctx context.Context, length int, offset int64) ([]Extent, error) {
+	if err := fb.check(); err != nil {
+		return nil, err
+	}
+	return fileExtents(fb.readFile, offset, int64(length))
+}
+
 // ReadAt implements Backend.ReadAt
 func (fb *FileBackend) ReadAt(ctx context.Context, b []byte, offset int64) (int, error) {
-	return fb.file.ReadAt(b, offset)
+	return fb.read(len(b), offset, func() (int, error) {
+		return fb.readFile.ReadAt(b, offset)
+	})
+}
+
+// ReadAtv implements VectoredReader.ReadAtv
+func (fb *FileBackend) ReadAtv(ctx context.Context, bufs [][]byte, offset int64) (int, error) {
+	return fb.read(buffersLength(bufs), offset, func() (int, error) {
+		return preadv(fb.readFile, bufs, offset)
+	})
+}
+
+// read performs a read of length bytes at offset with f
+func (fb *FileBackend) read(length int, offset int64, f func() (int, error)) (int, error) {
+	if err := fb.check(); err != nil {
+		return 0, err
+	}
+	n, err := f()
+	if fb.dropCache && n >= dropCacheMinimumRead {
+		// this is only advice, so failing to take it is no error
+		dropCache(fb.readFile, offset, int64(n))
+	}
+	if err == io.EOF && fb.info != nil && uint64(offset)+uint64(length) <= fb.size {
+		// the read lies within the export, so the file must have
+		// been truncated; don't return the missing data as zeroes
+		fb.checkMutex.Lock()
+		defer fb.checkMutex.Unlock()
+		return n, fb.fail("has been truncated (end of file reached reading %d bytes at offset %d)", length, offset)
+	}
+	return n, err
 }
 
 // TrimAt implements Backend.TrimAt
+//
+// We punch a hole in the file, so the range is deallocated and block status
+// reports it as a hole. Trim is only advisory, so where the filesystem does not
+// support holes, it does nothing
 func (fb *FileBackend) TrimAt(ctx context.Context, length int, offset int64) (int, error) {
+	if _, err := fb.PunchHoleAt(ctx, length, offset, false); err != nil && err != errPunchHoleUnsupported {
+		return 0, err
+	}
 	return length, nil
 }
 
 // Flush implements Backend.Flush
 func (fb *FileBackend) Flush(ctx context.Context) error {
-	return nil
+	return fb.check()
 }
 
 // Close implements Backend.Close
 func (fb *FileBackend) Close(ctx context.Context) error {
-	return fb.file.Close()
+	var serr error
+	if fb.marker != nil {
+		// the file is only clean once everything written is durable
+		serr = fb.file.Sync()
+	}
+	err := fb.closeFiles()
+	fb.checkMutex.Lock()
+	failed := fb.failed != nil
+	fb.checkMutex.Unlock()
+	if failed {
+		atomic.AddInt64(&failedBackends, -1)
+	}
+	if fb.marker != nil {
+		clean := serr == nil && err == nil && !failed
+		if merr := releaseCleanMarker(fb.marker, clean); merr != nil && err == nil {
+			err = merr
+		}
+		if serr != nil && err == nil {
+			err = serr
+		}
+	}
+	if fb.dirty != nil {
+		if derr := releaseDirtyBitmap(fb.dirty); derr != nil && err == nil {
+			err = derr
+		}
+	}
+	return err
+}
+
+// closeFiles closes the file, and the separate descriptor for reads if there is one
+func (fb *FileBackend) closeFiles() error {
+	err := fb.file.Close()
+	if fb.readFile != fb.file {
+		if rerr := fb.readFile.Close(); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return err
 }
 
 // Size implements Backend.Size
@@ -59,6 +301,17 @@ func (fb *FileBackend) HasFlush(ctx context.Context) bool {
 	return true
 }
 
+// MultiConn implements MultiConner.MultiConn. Every descriptor on the file
+// shares the page cache, and a sync through one syncs the file
+func (fb *FileBackend) MultiConn(ctx context.Context) bool {
+	return true
+}
+
+// IOHints implements IOHinter.IOHints
+func (fb *FileBackend) IOHints(ctx context.Context) IOHints {
+	return IOHints{Device: fb.device}
+}
+
 // Generate a new file backend
 func NewFileBackend(ctx context.Context, ec *ExportConfig) (Backend, error) {
 	perms := os.O_RDWR
@@ -70,6 +323,72 @@ func NewFileBackend(ctx context.Context, ec *ExportConfig) (Backend, error) {
 	} else if s {
 		perms |= os.O_SYNC
 	}
+	checkInterval := DefaultFileCheckInterval
+	if ci := ec.DriverParameters["checkinterval"]; ci != "" {
+		var err error
+		if checkInterval, err = time.ParseDuration(ci); err != nil || checkInterval < 0 {
+			return nil, fmt.Errorf("Bad check interval '%s'", ci)
+		}
+	}
+	closeOnFail := false
+	switch onFail := ec.DriverParameters["onfilefailure"]; onFail {
+	case "", "error":
+	case "close":
+		closeOnFail = true
+	default:
+		return nil, fmt.Errorf("Bad file failure action '%s'", onFail)
+	}
+	rangeFua := false
+	switch fuaMode := ec.DriverParameters["fuamode"]; fuaMode {
+	case "", "full":
+	case "range":
+		if haveSyncRange {
+			rangeFua = true
+		} else {
+			getBackendLogger().Printf("[WARN] Export %s cannot sync ranges on this platform, so FUA writes will sync the whole file", ec.Name)
+		}
+	default:
+		return nil, fmt.Errorf("Bad FUA mode '%s'", fuaMode)
+	}
+	access := ec.DriverParameters["access"]
+	switch access {
+	case "", "normal", "sequential", "random":
+		if access != "" && !haveFadvise {
+			getBackendLogger().Printf("[WARN] Export %s cannot advise the kernel of its access pattern on this platform", ec.Name)
+			access = ""
+		}
+	default:
+		return nil, fmt.Errorf("Bad access pattern '%s'", access)
+	}
+	dropCache, err := isTrue(ec.DriverParameters["dropcache"])
+	if err != nil {
+		return nil, err
+	}
+	splitFd, err := isTrue(ec.DriverParameters["splitfd"])
+	if err != nil {
+		return nil, err
+	}
+	splitFd = splitFd && !ec.ReadOnly
+	readPerms := os.O_RDONLY
+	for _, direct := range []struct {
+		param string
+		perms *int
+	}{
+		{"readdirect", &readPerms},
+		{"writedirect", &perms},
+	} {
+		if d, err := isTrue(ec.DriverParameters[direct.param]); err != nil {
+			return nil, err
+		} else if d {
+			if !splitFd {
+				return nil, fmt.Errorf("%s needs a separate descriptor for reads and writes, so splitfd", direct.param)
+			}
+			if oDirect == 0 {
+				return nil, errors.New("O_DIRECT is not supported on this platform")
+			}
+			*direct.perms |= oDirect
+		}
+	}
 	file, err := os.OpenFile(ec.DriverParameters["path"], perms, 0666)
 	if err != nil {
 		return nil, err
@@ -79,10 +398,78 @@ func NewFileBackend(ctx context.Context, ec *ExportConfig) (Backend, error) {
 		file.Close()
 		return nil, err
 	}
-	return &FileBackend{
-		file: file,
-		size: uint64(stat.Size()),
-	}, nil
+	readFile := file
+	if splitFd {
+		// reads must see the writes, so must be of the same inode
+		if readFile, err = os.OpenFile(ec.DriverParameters["path"], readPerms, 0); err != nil {
+			file.Close()
+			return nil, err
+		}
+		if rstat, err := readFile.Stat(); err != nil || !os.SameFile(stat, rstat) {
+			readFile.Close()
+			file.Close()
+			if err == nil {
+				err = fmt.Errorf("%s was replaced while being opened", ec.DriverParameters["path"])
+			}
+			return nil, err
+		}
+	}
+	fb := &FileBackend{
+		file:          file,
+		readFile:      readFile,
+		size:          uint64(stat.Size()),
+		path:          ec.DriverParameters["path"],
+		checkInterval: checkInterval,
+		closeOnFail:   closeOnFail,
+		lastCheck:     time.Now(),
+		rangeFua:      rangeFua,
+		dropCache:     dropCache,
+		device:        fileDeviceHints(stat),
+	}
+	if stat.Mode().IsRegular() {
+		// a block device cannot be truncated, and its size is not reported by stat
+		fb.info = stat
+	}
+	if access != "" {
+		if err := adviseAccess(readFile, access); err != nil {
+			fb.closeFiles()
+			return nil, err
+		}
+	}
+	if dirtyPath := ec.DriverParameters["dirtybitmap"]; dirtyPath != "" {
+		if ec.DriverParameters["phantomsize"] != "" {
+			fb.closeFiles()
+			return nil, errors.New("A dirty bitmap cannot track a phantom file")
+		}
+		blockSize := uint64(DefaultDirtyBlockSize)
+		if bs := ec.DriverParameters["dirtyblocksize"]; bs != "" {
+			if blockSize, err = strconv.ParseUint(bs, 10, 64); err != nil || blockSize == 0 {
+				fb.closeFiles()
+				return nil, fmt.Errorf("Bad dirty block size '%s'", bs)
+			}
+		}
+		if fb.dirty, err = acquireDirtyBitmap(dirtyPath, blockSize, fb.size); err != nil {
+			fb.closeFiles()
+			return nil, err
+		}
+	}
+	if marker, err := hasCleanMarker(ec); err != nil {
+		fb.Close(ctx)
+		return nil, err
+	} else if marker {
+		if fb.marker, err = acquireCleanMarker(ec); err != nil {
+			fb.Close(ctx)
+			return nil, err
+		}
+	}
+	if phantomSize := ec.DriverParameters["phantomsize"]; phantomSize != "" {
+		pb, err := newPhantomFileBackend(fb, phantomSize)
+		if err != nil && fb.marker != nil {
+			releaseCleanMarker(fb.marker, true)
+		}
+		return pb, err
+	}
+	return fb, nil
 }
 
 // Register our backend
@@ -0,0 +1,289 @@
+// +build linux
+
+package nbd
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// posix_fadvise advice values
+const (
+	FADV_NORMAL     = 0
+	FADV_RANDOM     = 1
+	FADV_SEQUENTIAL = 2
+	FADV_WILLNEED   = 3
+	FADV_DONTNEED   = 4
+)
+
+// accessAdvice is the posix_fadvise advice for each access pattern that may be configured
+var accessAdvice = map[string]int{
+	"normal":     FADV_NORMAL,
+	"sequential": FADV_SEQUENTIAL,
+	"random":     FADV_RANDOM,
+}
+
+// fallocate flags
+const (
+	FALLOC_FL_KEEP_SIZE  = 1
+	FALLOC_FL_PUNCH_HOLE = 2
+	FALLOC_FL_ZERO_RANGE = 0x10
+)
+
+// lseek whence values finding data and holes
+const (
+	SEEK_DATA = 3
+	SEEK_HOLE = 4
+)
+
+// sync_file_range flags
+const (
+	SYNC_FILE_RANGE_WAIT_BEFORE = 1
+	SYNC_FILE_RANGE_WRITE       = 2
+	SYNC_FILE_RANGE_WAIT_AFTER  = 4
+)
+
+// Maximum number of buffers passed to a single preadv or pwritev (IOV_MAX)
+const iovMax = 1024
+
+// Number of bits in a long, for splitting preadv and pwritev offsets
+const longBits = 32 << (^uintptr(0) >> 63)
+
+// haveFadvise is true as we can advise the kernel how a file will be accessed
+const haveFadvise = true
+
+// haveSyncRange is true as we can sync a range of a file with sync_file_range
+const haveSyncRange = true
+
+// oDirect is the flag opening a file for direct I/O, bypassing the page cache
+const oDirect = syscall.O_DIRECT
+
+// fadvise calls posix_fadvise on a file descriptor
+func fadvise(fd uintptr, offset int64, length int64, advice int) error {
+	if _, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, fd, uintptr(offset), uintptr(length), uintptr(advice), 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// adviseAccess advises the kernel that a file will be accessed with the given
+// pattern, so it can tune readahead to suit
+func adviseAccess(file *os.File, access string) error {
+	return fadvise(file.Fd(), 0, 0, accessAdvice[access])
+}
+
+// dropCache advises the kernel that a range of a file that has been read will
+// not be needed again, so it can drop it from the page cache
+func dropCache(file *os.File, offset int64, length int64) error {
+	return fadvise(file.Fd(), offset, length, FADV_DONTNEED)
+}
+
+// Cache implements Cacher.Cache
+//
+// We ask the kernel to read the range into the page cache
+func (fb *FileBackend) Cache(ctx context.Context, length int, offset int64) (int, error) {
+	if err := fadvise(fb.readFile.Fd(), offset, int64(length), FADV_WILLNEED); err != nil {
+		return 0, err
+	}
+	return length, nil
+}
+
+// Cache implements Cacher.Cache
+//
+// Just the part within the backing file is read, as the rest is not stored
+func (pfb *PhantomFileBackend) Cache(ctx context.Context, length int, offset int64) (int, error) {
+	if backed := pfb.backed(length, offset); backed > 0 {
+		if _, err := pfb.FileBackend.Cache(ctx, backed, offset); err != nil {
+			return 0, err
+		}
+	}
+	return length, nil
+}
+
+// punchHole deallocates a range of a file, which then reads as zeroes, returning
+// errPunchHoleUnsupported if its filesystem (or the file, e.g. a block device) cannot
+func punchHole(file *os.File, offset int64, length int64) error {
+	err := syscall.Fallocate(int(file.Fd()), FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE, offset, length)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENODEV {
+		return errPunchHoleUnsupported
+	}
+	if err != nil {
+		return os.NewSyscallError("fallocate", err)
+	}
+	return nil
+}
+
+// zeroRange zeroes a range of a file, keeping it allocated, returning
+// errZeroUnsupported if its filesystem (or the file, e.g. a block device) cannot
+func zeroRange(file *os.File, offset int64, length int64) error {
+	err := syscall.Fallocate(int(file.Fd()), FALLOC_FL_ZERO_RANGE|FALLOC_FL_KEEP_SIZE, offset, length)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENODEV {
+		return errZeroUnsupported
+	}
+	if err != nil {
+		return os.NewSyscallError("fallocate", err)
+	}
+	return nil
+}
+
+// fileExtents returns the extents of a range of a file, finding its holes with
+// lseek. A range whose filesystem (or the file, e.g. a block device) cannot
+// report holes is allocated throughout. The file's offset is moved, which only
+// matters to reads and writes that do not give their own offset
+func fileExtents(file *os.File, offset int64, length int64) ([]Extent, error) {
+	var extents []Extent
+	fd := int(file.Fd())
+	for end := offset + length; offset < end; {
+		data, err := syscall.Seek(fd, offset, SEEK_DATA)
+		if err == syscall.ENXIO {
+			// no data beyond offset
+			data = end
+		} else if err == syscall.EINVAL || err == syscall.EOPNOTSUPP {
+			return append(extents, Extent{Length: uint64(end - offset)}), nil
+		} else if err != nil {
+			return nil, os.NewSyscallError("lseek", err)
+		}
+		if data > offset {
+			if data > end {
+				data = end
+			}
+			extents = append(extents, Extent{Length: uint64(data - offset), Hole: true, Zero: true})
+			offset = data
+			continue
+		}
+		hole, err := syscall.Seek(fd, offset, SEEK_HOLE)
+		if err != nil {
+			return nil, os.NewSyscallError("lseek", err)
+		}
+		if hole > end || hole <= offset {
+			// the file has changed beneath us, so report the rest as data
+			hole = end
+		}
+		extents = append(extents, Extent{Length: uint64(hole - offset)})
+		offset = hole
+	}
+	return extents, nil
+}
+
+// syncRange writes out the dirty pages of a range of a file and waits for
+// them to reach the device. Unlike fsync, this does not commit the file's
+// metadata, nor flush the device's volatile write cache
+func syncRange(file *os.File, offset int64, length int64) error {
+	return syscall.SyncFileRange(int(file.Fd()), offset, length, SYNC_FILE_RANGE_WAIT_BEFORE|SYNC_FILE_RANGE_WRITE|SYNC_FILE_RANGE_WAIT_AFTER)
+}
+
+// preadv reads into bufs in turn from offset of a file with preadv, returning
+// io.EOF if the end of file is reached before they are filled
+func preadv(file *os.File, bufs [][]byte, offset int64) (int, error) {
+	return fileIOv(file, syscall.SYS_PREADV, "preadv", bufs, offset)
+}
+
+// pwritev writes bufs in turn at offset of a file with pwritev
+func pwritev(file *os.File, bufs [][]byte, offset int64) (int, error) {
+	return fileIOv(file, syscall.SYS_PWRITEV, "pwritev", bufs, offset)
+}
+
+// fileIOv transfers bufs at offset of a file with the preadv or pwritev system
+// call trap, passing at most iovMax buffers at a time and carrying on after a
+// short transfer until all are done
+func fileIOv(file *os.File, trap uintptr, name string, bufs [][]byte, offset int64) (int, error) {
+	// we consume bufs as we go, so must not modify the caller's
+	bufs = advanceBuffers(append([][]byte(nil), bufs...), 0)
+	iov := make([]syscall.Iovec, 0, iovMax)
+	done := 0
+	for len(bufs) > 0 {
+		iov = iov[:0]
+		for _, b := range bufs {
+			if len(iov) == iovMax {
+				break
+			}
+			v := syscall.Iovec{}
+			if len(b) > 0 {
+				v.Base = &b[0]
+			}
+			v.SetLen(len(b))
+			iov = append(iov, v)
+		}
+		r, _, errno := syscall.Syscall6(trap, file.Fd(), uintptr(unsafe.Pointer(&iov[0])), uintptr(len(iov)),
+			uintptr(offset), uintptr(offset>>(longBits/2)>>(longBits/2)), 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return done, os.NewSyscallError(name, errno)
+		}
+		if r == 0 {
+			if trap == syscall.SYS_PREADV {
+				return done, io.EOF
+			}
+			return done, io.ErrShortWrite
+		}
+		done += int(r)
+		offset += int64(r)
+		bufs = advanceBuffers(bufs, int(r))
+	}
+	return done, nil
+}
+
+// advanceBuffers drops the first n bytes from bufs, along with any buffers left empty
+func advanceBuffers(bufs [][]byte, n int) [][]byte {
+	for len(bufs) > 0 && n >= len(bufs[0]) {
+		n -= len(bufs[0])
+		bufs = bufs[1:]
+	}
+	if n > 0 {
+		bufs[0] = bufs[0][n:]
+	}
+	return bufs
+}
+
+// fileDeviceHints returns the characteristics of the block device holding a file
+// (or of the file, if it is a block device itself) as sysfs reports them, or nil
+// if the file is not on a block device
+func fileDeviceHints(info os.FileInfo) *DeviceHints {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	dev := uint64(stat.Dev)
+	if info.Mode()&os.ModeDevice != 0 && info.Mode()&os.ModeCharDevice == 0 {
+		dev = uint64(stat.Rdev)
+	}
+	major := (dev&0x00000000000fff00)>>8 | (dev&0xfffff00000000000)>>32
+	minor := dev&0x00000000000000ff | (dev&0x00000ffffff00000)>>12
+	dir, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", major, minor))
+	if err != nil {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(dir, "queue")); err != nil {
+		// a partition, whose queue is its disk's
+		dir = filepath.Dir(dir)
+	}
+	rotational, err := sysfsValue(filepath.Join(dir, "queue", "rotational"))
+	if err != nil {
+		return nil
+	}
+	hints := &DeviceHints{Rotational: rotational == 1}
+	// only SCSI devices report their queue depth
+	if depth, err := sysfsValue(filepath.Join(dir, "device", "queue_depth")); err == nil && depth <= 0xffff {
+		hints.QueueDepth = uint16(depth)
+	}
+	return hints
+}
+
+// sysfsValue reads a sysfs attribute holding a number
+func sysfsValue(path string) (uint64, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
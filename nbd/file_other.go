@@ -0,0 +1,82 @@
+// +build !linux
+
+package nbd
+
+import (
+	"os"
+)
+
+// haveFadvise is false as we cannot advise the kernel how a file will be accessed on this platform
+const haveFadvise = false
+
+// haveSyncRange is false as we cannot sync a range of a file on this platform
+const haveSyncRange = false
+
+// oDirect is zero as O_DIRECT is not supported on this platform
+const oDirect = 0
+
+// fileDeviceHints returns nil, as we cannot find out about the device holding a
+// file on this platform
+func fileDeviceHints(info os.FileInfo) *DeviceHints {
+	return nil
+}
+
+// adviseAccess does nothing, as there is no posix_fadvise on this platform
+func adviseAccess(file *os.File, access string) error {
+	return nil
+}
+
+// dropCache does nothing, as there is no posix_fadvise on this platform
+func dropCache(file *os.File, offset int64, length int64) error {
+	return nil
+}
+
+// punchHole returns errPunchHoleUnsupported, as we cannot punch holes on this platform
+func punchHole(file *os.File, offset int64, length int64) error {
+	return errPunchHoleUnsupported
+}
+
+// zeroRange returns errZeroUnsupported, as we cannot zero ranges on this platform
+func zeroRange(file *os.File, offset int64, length int64) error {
+	return errZeroUnsupported
+}
+
+// fileExtents reports a range of a file as allocated throughout, as we cannot
+// find its holes on this platform
+func fileExtents(file *os.File, offset int64, length int64) ([]Extent, error) {
+	return []Extent{{Length: uint64(length)}}, nil
+}
+
+// syncRange syncs the whole file, as we cannot sync a range of it on this platform
+func syncRange(file *os.File, offset int64, length int64) error {
+	return file.Sync()
+}
+
+// preadv reads into bufs in turn from offset of a file, one at a time as we have
+// no preadv on this platform, returning io.EOF if the end of file is reached
+// before they are filled
+func preadv(file *os.File, bufs [][]byte, offset int64) (int, error) {
+	done := 0
+	for _, b := range bufs {
+		n, err := file.ReadAt(b, offset+int64(done))
+		done += n
+		if err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
+
+// pwritev writes bufs in turn at offset of a file, one at a time as we have no
+// pwritev on this platform
+func pwritev(file *os.File, bufs [][]byte, offset int64) (int, error) {
+	done := 0
+	for _, b := range bufs {
+		n, err := file.WriteAt(b, offset+int64(done))
+		done += n
+		if err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
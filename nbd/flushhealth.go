@@ -0,0 +1,57 @@
+package nbd
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// flushHealth records whether an export's last flush failed. A failed flush
+// may have lost writes from any connection to the export (e.g. the kernel may
+// drop dirty pages it could not write back), so this is shared by them all
+type flushHealth struct {
+	mutex sync.Mutex // protects err
+	err   error      // error from the last flush, or nil if it succeeded
+}
+
+// Flush health by export name. Like the export's counters, this survives the
+// connections to it
+var (
+	flushHealths      = make(map[string]*flushHealth)
+	flushHealthsMutex sync.Mutex
+	unhealthyExports  int64 // exports whose last flush failed, accessed atomically
+)
+
+// exportFlushHealth returns the flush health of the named export
+func exportFlushHealth(name string) *flushHealth {
+	flushHealthsMutex.Lock()
+	defer flushHealthsMutex.Unlock()
+	if fh, ok := flushHealths[name]; ok {
+		return fh
+	}
+	fh := &flushHealth{}
+	flushHealths[name] = fh
+	return fh
+}
+
+// failed returns the error from the export's last flush, or nil if it succeeded
+func (fh *flushHealth) failed() error {
+	fh.mutex.Lock()
+	defer fh.mutex.Unlock()
+	return fh.err
+}
+
+// record records the result of a flush of the named export, logging as it
+// becomes unhealthy or recovers
+func (fh *flushHealth) record(name string, err error) {
+	fh.mutex.Lock()
+	defer fh.mutex.Unlock()
+	switch {
+	case err != nil && fh.err == nil:
+		atomic.AddInt64(&unhealthyExports, 1)
+		getBackendLogger().Printf("[ERROR] Export %s is unhealthy as a flush failed, so writes since the last successful flush may be lost: %v", name, err)
+	case err == nil && fh.err != nil:
+		atomic.AddInt64(&unhealthyExports, -1)
+		getBackendLogger().Printf("[INFO] Export %s is healthy again as a flush succeeded", name)
+	}
+	fh.err = err
+}
@@ -0,0 +1,130 @@
+package nbd
+
+import (
+	"golang.org/x/net/context"
+)
+
+// backendIOHints returns the I/O hints of a backend, or no hints if it has none
+func backendIOHints(ctx context.Context, backend Backend) IOHints {
+	if hinter, ok := backend.(IOHinter); ok {
+		return hinter.IOHints(ctx)
+	}
+	return IOHints{}
+}
+
+// chunkedIO performs the I/O for a command of length bytes at offset, whose
+// data is held in memory blocks mem of memoryBlockSize bytes each, by calling
+// f for each chunk. A chunk is at most chunkSize bytes (or a memory block, if
+// zero), and does not straddle a multiple of alignment (if not zero). A chunk
+// spanning more than one memory block is gathered into a scratch buffer before
+// a write, or scattered from one after a read.
+//
+// It returns the number of bytes transferred, stopping at the first error or
+// short transfer
+func chunkedIO(mem [][]byte, memoryBlockSize uint64, offset uint64, length uint64, chunkSize uint64, alignment uint64, write bool, f func(b []byte, offset uint64) (int, error)) (uint64, error) {
+	if chunkSize == 0 {
+		chunkSize = memoryBlockSize
+	}
+	var pos uint64
+	for pos < length {
+		n := chunkLength(offset, pos, length, chunkSize, alignment)
+		block, within := pos/memoryBlockSize, pos%memoryBlockSize
+		var b []byte
+		scratch := within+n > memoryBlockSize
+		if !scratch {
+			b = mem[block][within : within+n]
+		} else {
+			b = make([]byte, n)
+			if write {
+				copyMemory(b, mem, memoryBlockSize, pos, true)
+			}
+		}
+		done, err := f(b, offset+pos)
+		if err != nil {
+			return pos, err
+		}
+		if uint64(done) != n {
+			return pos + uint64(done), nil
+		}
+		if scratch && !write {
+			copyMemory(b, mem, memoryBlockSize, pos, false)
+		}
+		pos += n
+	}
+	return pos, nil
+}
+
+// vectoredIO performs the I/O for a command as chunkedIO does, but passes
+// each chunk to f as the slices of the memory blocks holding it, so a chunk
+// spanning several memory blocks needs no scratch buffer. A chunk is at most
+// chunkSize bytes (or the whole command, if zero)
+func vectoredIO(mem [][]byte, memoryBlockSize uint64, offset uint64, length uint64, chunkSize uint64, alignment uint64, f func(bufs [][]byte, offset uint64) (int, error)) (uint64, error) {
+	if chunkSize == 0 {
+		chunkSize = length
+	}
+	var pos uint64
+	for pos < length {
+		n := chunkLength(offset, pos, length, chunkSize, alignment)
+		done, err := f(memorySegments(mem, memoryBlockSize, pos, n), offset+pos)
+		if err != nil {
+			return pos, err
+		}
+		if uint64(done) != n {
+			return pos + uint64(done), nil
+		}
+		pos += n
+	}
+	return pos, nil
+}
+
+// chunkLength returns the length of the chunk at pos of a command of length
+// bytes at offset, as described for chunkedIO
+func chunkLength(offset uint64, pos uint64, length uint64, chunkSize uint64, alignment uint64) uint64 {
+	n := chunkSize
+	if n > length-pos {
+		n = length - pos
+	}
+	if alignment != 0 {
+		if toBoundary := alignment - (offset+pos)%alignment; n > toBoundary {
+			n = toBoundary
+		}
+	}
+	return n
+}
+
+// memorySegments returns the slices of memory blocks mem holding the n bytes starting at pos
+func memorySegments(mem [][]byte, memoryBlockSize uint64, pos uint64, n uint64) [][]byte {
+	var bufs [][]byte
+	for end := pos + n; pos < end; {
+		block, within := pos/memoryBlockSize, pos%memoryBlockSize
+		l := memoryBlockSize - within
+		if l > end-pos {
+			l = end - pos
+		}
+		bufs = append(bufs, mem[block][within:within+l])
+		pos += l
+	}
+	return bufs
+}
+
+// buffersLength returns the total length of bufs
+func buffersLength(bufs [][]byte) int {
+	n := 0
+	for _, b := range bufs {
+		n += len(b)
+	}
+	return n
+}
+
+// copyMemory copies between b and the bytes of memory blocks mem starting at
+// pos, into b if toBuffer is set and out of it otherwise
+func copyMemory(b []byte, mem [][]byte, memoryBlockSize uint64, pos uint64, toBuffer bool) {
+	for copied := 0; copied < len(b); {
+		block, within := (pos+uint64(copied))/memoryBlockSize, (pos+uint64(copied))%memoryBlockSize
+		if toBuffer {
+			copied += copy(b[copied:], mem[block][within:])
+		} else {
+			copied += copy(mem[block][within:], b[copied:])
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package nbd
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"strings"
+)
+
+// WriteInterceptor is invoked on the data of each write to an export before
+// it reaches the backend, e.g. to scan or transform it.
+//
+// InterceptWrite returns the data to write in place of b, which must be of the
+// same length; it may modify b in place and return it, or return b unchanged to
+// pass the write through. To reject the write it returns an error instead,
+// which the client receives as an NBD error (a syscall.Errno is mapped as for
+// backend errors, so returning syscall.EPERM sends NBD_EPERM)
+type WriteInterceptor interface {
+	InterceptWrite(ctx context.Context, b []byte, offset int64) ([]byte, error)
+}
+
+// WriteInterceptorFunc is an ordinary function used as a WriteInterceptor
+type WriteInterceptorFunc func(ctx context.Context, b []byte, offset int64) ([]byte, error)
+
+// InterceptWrite implements WriteInterceptor.InterceptWrite
+func (f WriteInterceptorFunc) InterceptWrite(ctx context.Context, b []byte, offset int64) ([]byte, error) {
+	return f(ctx, b, offset)
+}
+
+// WriteInterceptorMap is a map of write interceptors by name, each entry
+// creating an interceptor for an export
+var WriteInterceptorMap = map[string]func(ctx context.Context, ec *ExportConfig) (WriteInterceptor, error){
+	"passthrough": func(ctx context.Context, ec *ExportConfig) (WriteInterceptor, error) {
+		return WriteInterceptorFunc(func(ctx context.Context, b []byte, offset int64) ([]byte, error) {
+			return b, nil
+		}), nil
+	},
+}
+
+// RegisterWriteInterceptor registers a write interceptor which exports may
+// name in their writeinterceptors parameter
+func RegisterWriteInterceptor(name string, generator func(ctx context.Context, ec *ExportConfig) (WriteInterceptor, error)) {
+	WriteInterceptorMap[name] = generator
+}
+
+// interceptor is a write interceptor in an InterceptBackend's pipeline
+type interceptor struct {
+	name string
+	WriteInterceptor
+}
+
+// InterceptBackend implements Backend
+//
+// It passes the data of each write through a pipeline of write interceptors,
+// in the order configured, before writing the result. The first interceptor to
+// reject a write stops it, and its error is returned
+type InterceptBackend struct {
+	Backend
+	interceptors []interceptor
+}
+
+// WriteAt implements Backend.WriteAt
+func (ib *InterceptBackend) WriteAt(ctx context.Context, b []byte, offset int64, fua bool) (int, error) {
+	length := len(b)
+	for _, i := range ib.interceptors {
+		var err error
+		if b, err = i.InterceptWrite(ctx, b, offset); err != nil {
+			return 0, err
+		}
+		if len(b) != length {
+			return 0, fmt.Errorf("Write interceptor %s changed the length of a write from %d to %d", i.name, length, len(b))
+		}
+	}
+	return ib.Backend.WriteAt(ctx, b, offset, fua)
+}
+
+// IOHints implements IOHinter.IOHints
+func (ib *InterceptBackend) IOHints(ctx context.Context) IOHints {
+	return backendIOHints(ctx, ib.Backend)
+}
+
+// newInterceptBackend wraps a backend in an InterceptBackend if the export
+// configures writeinterceptors, a comma separated list of interceptor names
+func newInterceptBackend(ctx context.Context, ec *ExportConfig, backend Backend) (Backend, error) {
+	names := ec.DriverParameters["writeinterceptors"]
+	if names == "" {
+		return backend, nil
+	}
+	ib := &InterceptBackend{Backend: backend}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		generator, ok := WriteInterceptorMap[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("No such write interceptor %s", name)
+		}
+		wi, err := generator(ctx, ec)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot create write interceptor %s: %v", name, err)
+		}
+		ib.interceptors = append(ib.interceptors, interceptor{name: name, WriteInterceptor: wi})
+	}
+	return ib, nil
+}
@@ -0,0 +1,162 @@
+package nbd
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"runtime"
+	"strings"
+)
+
+// I/O scheduling classes, as used by ioprio_set(2)
+const (
+	IOPRIO_CLASS_NONE = 0
+	IOPRIO_CLASS_RT   = 1
+	IOPRIO_CLASS_BE   = 2
+	IOPRIO_CLASS_IDLE = 3
+)
+
+// Map of configuration text to I/O scheduling classes
+var ioPrioClassMap = map[string]int{
+	"none":        IOPRIO_CLASS_NONE,
+	"realtime":    IOPRIO_CLASS_RT,
+	"rt":          IOPRIO_CLASS_RT,
+	"best-effort": IOPRIO_CLASS_BE,
+	"be":          IOPRIO_CLASS_BE,
+	"idle":        IOPRIO_CLASS_IDLE,
+}
+
+// IoPrioBackend implements Backend
+//
+// It wraps another backend so that all its I/O is performed on a pool of
+// goroutines, each locked to an OS thread whose I/O priority has been set.
+// The kernel tracks I/O priority per thread, so this is the only way to
+// classify the I/O of one export without affecting the rest of the server
+type IoPrioBackend struct {
+	Backend
+	work chan func() // I/O to be performed by the pool
+}
+
+// ioPrioCacherBackend is an IoPrioBackend wrapping a backend that is also a Cacher
+type ioPrioCacherBackend struct {
+	*IoPrioBackend
+}
+
+// run runs f on one of the pool's threads and waits for it to complete
+func (ib *IoPrioBackend) run(ctx context.Context, f func()) error {
+	done := make(chan struct{})
+	select {
+	case ib.work <- func() { f(); close(done) }:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-done
+	return nil
+}
+
+// WriteAt implements Backend.WriteAt
+func (ib *IoPrioBackend) WriteAt(ctx context.Context, b []byte, offset int64, fua bool) (n int, err error) {
+	if rerr := ib.run(ctx, func() { n, err = ib.Backend.WriteAt(ctx, b, offset, fua) }); rerr != nil {
+		return 0, rerr
+	}
+	return
+}
+
+// ReadAt implements Backend.ReadAt
+func (ib *IoPrioBackend) ReadAt(ctx context.Context, b []byte, offset int64) (n int, err error) {
+	if rerr := ib.run(ctx, func() { n, err = ib.Backend.ReadAt(ctx, b, offset) }); rerr != nil {
+		return 0, rerr
+	}
+	return
+}
+
+// TrimAt implements Backend.TrimAt
+func (ib *IoPrioBackend) TrimAt(ctx context.Context, length int, offset int64) (n int, err error) {
+	if rerr := ib.run(ctx, func() { n, err = ib.Backend.TrimAt(ctx, length, offset) }); rerr != nil {
+		return 0, rerr
+	}
+	return
+}
+
+// Flush implements Backend.Flush
+func (ib *IoPrioBackend) Flush(ctx context.Context) (err error) {
+	if rerr := ib.run(ctx, func() { err = ib.Backend.Flush(ctx) }); rerr != nil {
+		return rerr
+	}
+	return
+}
+
+// Close implements Backend.Close
+func (ib *IoPrioBackend) Close(ctx context.Context) error {
+	err := ib.Backend.Close(ctx)
+	close(ib.work) // the pool's threads exit
+	return err
+}
+
+// IOHints implements IOHinter.IOHints
+func (ib *IoPrioBackend) IOHints(ctx context.Context) IOHints {
+	return backendIOHints(ctx, ib.Backend)
+}
+
+// Cache implements Cacher.Cache
+func (icb *ioPrioCacherBackend) Cache(ctx context.Context, length int, offset int64) (n int, err error) {
+	if rerr := icb.run(ctx, func() { n, err = icb.Backend.(Cacher).Cache(ctx, length, offset) }); rerr != nil {
+		return 0, rerr
+	}
+	return
+}
+
+// ioPrioWorker is a goroutine performing I/O for an IoPrioBackend at the given priority.
+//
+// It is locked to its OS thread and never unlocks it, so the thread (with its
+// altered priority) is discarded when the goroutine exits
+func ioPrioWorker(work chan func(), class int, level int, started chan error) {
+	runtime.LockOSThread()
+	if err := setIoPrio(class, level); err != nil {
+		started <- err
+		return
+	}
+	started <- nil
+	for f := range work {
+		f()
+	}
+}
+
+// newIoPrioBackend wraps a backend in an IoPrioBackend if the export configures an I/O priority
+func newIoPrioBackend(ctx context.Context, ec *ExportConfig, backend Backend) (Backend, error) {
+	if ec.IoPrio.Class == "" {
+		return backend, nil
+	}
+	class, ok := ioPrioClassMap[strings.ToLower(ec.IoPrio.Class)]
+	if !ok {
+		return nil, fmt.Errorf("Unknown I/O priority class '%s'", ec.IoPrio.Class)
+	}
+	if ec.IoPrio.Level < 0 || ec.IoPrio.Level > 7 {
+		return nil, fmt.Errorf("I/O priority level %d is not between 0 and 7", ec.IoPrio.Level)
+	}
+	threads := ec.Workers
+	if threads < 1 {
+		threads = DefaultWorkers
+	}
+	ib := &IoPrioBackend{
+		Backend: backend,
+		work:    make(chan func()),
+	}
+	started := make(chan error)
+	for i := 0; i < threads; i++ {
+		go ioPrioWorker(ib.work, class, ec.IoPrio.Level, started)
+	}
+	var err error
+	for i := 0; i < threads; i++ {
+		if serr := <-started; serr != nil && err == nil {
+			err = fmt.Errorf("Cannot set I/O priority: %v", serr)
+		}
+	}
+	if err != nil {
+		close(ib.work) // stop the threads that did start
+		return nil, err
+	}
+	if _, isCacher := backend.(Cacher); isCacher {
+		return &ioPrioCacherBackend{ib}, nil
+	}
+	return ib, nil
+}
@@ -0,0 +1,22 @@
+// +build linux
+
+package nbd
+
+import (
+	"syscall"
+)
+
+// ioprio_set(2) parameters
+const (
+	IOPRIO_WHO_PROCESS = 1
+	IOPRIO_CLASS_SHIFT = 13
+)
+
+// setIoPrio sets the I/O priority of the calling thread
+func setIoPrio(class int, level int) error {
+	// with IOPRIO_WHO_PROCESS, zero means the calling thread
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, IOPRIO_WHO_PROCESS, 0, uintptr(class<<IOPRIO_CLASS_SHIFT|level)); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package nbd
+
+import (
+	"errors"
+)
+
+// setIoPrio sets the I/O priority of the calling thread
+func setIoPrio(class int, level int) error {
+	return errors.New("I/O priorities are only supported on Linux")
+}
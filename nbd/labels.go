@@ -0,0 +1,71 @@
+package nbd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Valid label keys. These follow the rules for metric label names, so that
+// labels can be exported as metric labels unchanged
+var labelKeyRegexp = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// Maximum length of a label key
+const maxLabelKeyLength = 63
+
+// validateLabels checks the label keys of an export are valid
+func validateLabels(ec *ExportConfig) error {
+	for k := range ec.Labels {
+		if len(k) > maxLabelKeyLength || !labelKeyRegexp.MatchString(k) {
+			return fmt.Errorf("Export %s has invalid label key '%s'", ec.Name, k)
+		}
+		if strings.HasPrefix(k, "__") {
+			return fmt.Errorf("Export %s has reserved label key '%s'", ec.Name, k)
+		}
+	}
+	return nil
+}
+
+// ParseLabelSelector parses a selector of the form "key=value,key=value" into a map.
+// An empty selector matches every export
+func ParseLabelSelector(selector string) (map[string]string, error) {
+	m := make(map[string]string)
+	if selector == "" {
+		return m, nil
+	}
+	for _, term := range strings.Split(selector, ",") {
+		kv := strings.SplitN(term, "=", 2)
+		if len(kv) != 2 || !labelKeyRegexp.MatchString(kv[0]) {
+			return nil, fmt.Errorf("Bad label selector term '%s'", term)
+		}
+		if _, ok := m[kv[0]]; ok {
+			return nil, fmt.Errorf("Label %s appears more than once in selector", kv[0])
+		}
+		m[kv[0]] = kv[1]
+	}
+	return m, nil
+}
+
+// MatchesLabels returns true if the export has every label in the selector
+func (ec *ExportConfig) MatchesLabels(selector map[string]string) bool {
+	for k, v := range selector {
+		if lv, ok := ec.Labels[k]; !ok || lv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// ExportsMatchingLabels returns the configuration of every export, across all
+// servers, matching the selector
+func (c *Config) ExportsMatchingLabels(selector map[string]string) []ExportConfig {
+	exports := []ExportConfig{}
+	for _, s := range c.Servers {
+		for _, e := range s.Exports {
+			if e.MatchesLabels(selector) {
+				exports = append(exports, e)
+			}
+		}
+	}
+	return exports
+}
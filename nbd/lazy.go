@@ -0,0 +1,133 @@
+package nbd
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"strconv"
+	"sync"
+)
+
+// errLazyClosed is returned by a LazyBackend closed before it was opened
+var errLazyClosed = errors.New("Backend closed before being opened")
+
+// LazyBackend implements Backend
+//
+// It defers opening the real backend until the first command that needs it,
+// so that negotiation is not delayed by a backend that is expensive to open,
+// and clients that never issue I/O do not hold its resources. As the backend
+// has not been opened during negotiation, its geometry comes from the export's
+// configuration, and it is assumed to support flush and FUA. If the open
+// fails, the command that triggered it (and all later ones) fail
+type LazyBackend struct {
+	open    func(ctx context.Context) (Backend, error) // opens the real backend
+	size    uint64                                     // configured size
+	once    sync.Once                                  // ensures we open the backend only once
+	backend Backend                                    // the real backend, once opened
+	err     error                                      // the error from opening the real backend
+}
+
+// get returns the real backend, opening it if necessary
+func (lb *LazyBackend) get(ctx context.Context) (Backend, error) {
+	lb.once.Do(func() {
+		backend, err := lb.open(ctx)
+		if err != nil {
+			lb.err = fmt.Errorf("Cannot open backend: %v", err)
+			return
+		}
+		size, _, _, _, err := backend.Geometry(ctx)
+		if err == nil && size < lb.size {
+			err = fmt.Errorf("Backend size %d is smaller than the configured size %d", size, lb.size)
+		}
+		if err != nil {
+			backend.Close(ctx)
+			lb.err = err
+			return
+		}
+		lb.backend = backend
+	})
+	return lb.backend, lb.err
+}
+
+// WriteAt implements Backend.WriteAt
+func (lb *LazyBackend) WriteAt(ctx context.Context, b []byte, offset int64, fua bool) (int, error) {
+	backend, err := lb.get(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return backend.WriteAt(ctx, b, offset, fua)
+}
+
+// ReadAt implements Backend.ReadAt
+func (lb *LazyBackend) ReadAt(ctx context.Context, b []byte, offset int64) (int, error) {
+	backend, err := lb.get(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return backend.ReadAt(ctx, b, offset)
+}
+
+// TrimAt implements Backend.TrimAt
+func (lb *LazyBackend) TrimAt(ctx context.Context, length int, offset int64) (int, error) {
+	backend, err := lb.get(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return backend.TrimAt(ctx, length, offset)
+}
+
+// Flush implements Backend.Flush
+func (lb *LazyBackend) Flush(ctx context.Context) error {
+	backend, err := lb.get(ctx)
+	if err != nil {
+		return err
+	}
+	return backend.Flush(ctx)
+}
+
+// Close implements Backend.Close
+func (lb *LazyBackend) Close(ctx context.Context) error {
+	// prevent an open after we are closed
+	lb.once.Do(func() {
+		lb.err = errLazyClosed
+	})
+	if lb.backend != nil {
+		return lb.backend.Close(ctx)
+	}
+	return nil
+}
+
+// Geometry implements Backend.Geometry
+//
+// The block sizes returned are the defaults; configure the export's block sizes
+// if the real backend needs others
+func (lb *LazyBackend) Geometry(ctx context.Context) (uint64, uint64, uint64, uint64, error) {
+	return lb.size, 1, 32 * 1024, 32 * 1024 * 1024, nil
+}
+
+// HasFua implements Backend.HasFua
+func (lb *LazyBackend) HasFua(ctx context.Context) bool {
+	return true
+}
+
+// HasFlush implements Backend.HasFlush
+func (lb *LazyBackend) HasFlush(ctx context.Context) bool {
+	return true
+}
+
+// newLazyBackend returns a LazyBackend which will open a backend with open,
+// taking its size from the export's configuration
+func newLazyBackend(ec *ExportConfig, open func(ctx context.Context) (Backend, error)) (Backend, error) {
+	sizeParam := ec.DriverParameters["size"]
+	if sizeParam == "" {
+		return nil, fmt.Errorf("Export %s opens lazily so must have its size configured", ec.Name)
+	}
+	size, err := strconv.ParseUint(sizeParam, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Bad size '%s'", sizeParam)
+	}
+	return &LazyBackend{
+		open: open,
+		size: size,
+	}, nil
+}
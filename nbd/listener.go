@@ -8,23 +8,130 @@ import (
 	"golang.org/x/net/context"
 	"io/ioutil"
 	"log"
+	"math"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Default number of goroutines accepting connections on each listener
+const DefaultAcceptors = 1
+
 // A single listener on a given net.Conn address
 type Listener struct {
-	logger          *log.Logger    // a logger
-	protocol        string         // the protocol we are listening on
-	addr            string         // the address
-	exports         []ExportConfig // a list of export configurations associated
-	defaultExport   string         // name of default export
-	tls             TlsConfig      // the TLS configuration
-	tlsconfig       *tls.Config    // the TLS configuration
-	disableNoZeroes bool           // disable the 'no zeroes' extension
+	logger             *log.Logger      // a logger
+	protocol           string           // the protocol we are listening on
+	addr               string           // the address
+	exports            []ExportConfig   // a list of export configurations associated
+	defaultExport      string           // name of default export
+	tls                TlsConfig        // the TLS configuration
+	tlsconfig          *tls.Config      // the TLS configuration
+	disableNoZeroes    bool             // disable the 'no zeroes' extension
+	backlog            int              // listen backlog, or 0 for the default
+	acceptors          int              // number of goroutines accepting connections
+	negotiationTimeout time.Duration    // maximum total time to complete negotiation
+	maxOptions         int              // maximum number of options processed in negotiation
+	closeOnNoTls       bool             // close connections requesting TLS when it is not configured
+	strict             bool             // reject clients setting reserved fields
+	checkFraming       bool             // check each write's payload is followed by a request
+	connRate           *connRateLimiter // limits the rate of new connections, or nil for no limit
+	closeOverConnRate  bool             // close connections beyond the rate rather than delaying them
+	verboseErrors      bool             // send clients the cause of an export being unavailable
+}
+
+// Server-wide connection accounting. This is shared by all listeners and
+// survives configuration reloads, as sessions do
+var (
+	activeConnections int64 // number of connections currently open
+	maxConnections    int64 // maximum number of connections, or 0 for no limit
+)
+
+// setMaxConnections sets the server-wide connection limit
+func setMaxConnections(max int) {
+	atomic.StoreInt64(&maxConnections, int64(max))
+}
+
+// acquireConnection claims a server-wide connection slot, returning false if none are available
+func acquireConnection() bool {
+	n := atomic.AddInt64(&activeConnections, 1)
+	if max := atomic.LoadInt64(&maxConnections); max > 0 && n > max {
+		atomic.AddInt64(&activeConnections, -1)
+		return false
+	}
+	return true
+}
+
+// releaseConnection releases a slot claimed by acquireConnection
+func releaseConnection() {
+	atomic.AddInt64(&activeConnections, -1)
+}
+
+// quiesced is nonzero whilst the server is quiesced, accessed atomically
+var quiesced int32
+
+// Quiesce puts the server into quiesce mode: listeners stay open, so their
+// addresses remain bound, but every new connection is closed as soon as it is
+// accepted. Connections already open carry on being served. This lets new load
+// be turned away before draining the server for maintenance. Quiesce mode
+// persists across configuration reloads until Resume is called
+func Quiesce() {
+	atomic.StoreInt32(&quiesced, 1)
+}
+
+// Resume takes the server out of quiesce mode, so new connections are served again
+func Resume() {
+	atomic.StoreInt32(&quiesced, 0)
+}
+
+// IsQuiesced returns true if the server is in quiesce mode
+func IsQuiesced() bool {
+	return atomic.LoadInt32(&quiesced) != 0
+}
+
+// Per-export connection accounting, by export name. Like the server-wide
+// count, this survives configuration reloads; the limit is taken from the
+// configuration in force when each connection negotiates
+var (
+	exportConnections      = make(map[string]int)
+	exportConnectionsMutex sync.Mutex
+)
+
+// exportMaxConnections returns the connection limit configured for an export, or zero if none
+func exportMaxConnections(ec *ExportConfig) (int, error) {
+	maxParam := ec.DriverParameters["maxconnections"]
+	if maxParam == "" {
+		return 0, nil
+	}
+	max, err := strconv.Atoi(maxParam)
+	if err != nil || max < 0 {
+		return 0, fmt.Errorf("Bad maximum connections '%s'", maxParam)
+	}
+	return max, nil
+}
+
+// acquireExportConnection claims a connection slot for an export with the
+// given limit (zero for no limit), returning false if none are available
+func acquireExportConnection(name string, max int) bool {
+	exportConnectionsMutex.Lock()
+	defer exportConnectionsMutex.Unlock()
+	if max > 0 && exportConnections[name] >= max {
+		return false
+	}
+	exportConnections[name]++
+	return true
+}
+
+// releaseExportConnection releases a slot claimed by acquireExportConnection
+func releaseExportConnection(name string) {
+	exportConnectionsMutex.Lock()
+	defer exportConnectionsMutex.Unlock()
+	if exportConnections[name]--; exportConnections[name] <= 0 {
+		delete(exportConnections, name)
+	}
 }
 
 // An listener type that does what we want
@@ -68,30 +175,86 @@ func (l *Listener) Listen(parentCtx context.Context, sessionParentCtx context.Co
 		return
 	}
 
-	l.logger.Printf("[INFO] Starting listening on %s", addr)
+	if l.backlog > 0 {
+		if err := setBacklog(nli, l.backlog); err != nil {
+			l.logger.Printf("[WARN] Could not set backlog of %d on %s: %v", l.backlog, addr, err)
+		}
+	}
+
+	l.logger.Printf("[INFO] Starting listening on %s with %d acceptor(s)", addr, l.acceptors)
+	var wg sync.WaitGroup
+	for i := 0; i < l.acceptors; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.accept(ctx, li, addr, sessionParentCtx, sessionWaitGroup)
+		}()
+	}
+	wg.Wait()
+}
+
+// accept accepts connections on a listener until ctx is done, starting a
+// session for each. Several may run concurrently on one listener, sharing the
+// server-wide connection limit
+func (l *Listener) accept(ctx context.Context, li DeadlineListener, addr string, sessionParentCtx context.Context, sessionWaitGroup *sync.WaitGroup) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
 		}
+		// when delaying connections beyond the rate, each waits in the
+		// backlog until it is due
+		delayed := false
+		if l.connRate != nil && !l.closeOverConnRate {
+			if wait := l.connRate.reserve(time.Now()); wait > 0 {
+				delayed = true
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
 		li.SetDeadline(time.Now().Add(time.Second))
 		if conn, err := li.Accept(); err != nil {
+			if l.connRate != nil && !l.closeOverConnRate {
+				l.connRate.cancel()
+			}
 			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
 				continue
 			}
 			l.logger.Printf("[ERROR] Error %s listening on %s", err, addr)
 		} else {
 			l.logger.Printf("[INFO] Connect to %s from %s", addr, conn.RemoteAddr())
-			if connection, err := newConnection(l, l.logger, conn); err != nil {
+			if delayed {
+				expvarConnectionsRateLimited.Add("delayed", 1)
+			}
+			if IsQuiesced() {
+				l.logger.Printf("[INFO] Rejecting connection to %s from %s as the server is quiesced", addr, conn.RemoteAddr())
+				expvarConnectionsRejected.Add(1)
+				conn.Close()
+			} else if l.connRate != nil && l.closeOverConnRate && !l.connRate.allow(time.Now()) {
+				l.logger.Printf("[WARN] Rejecting connection to %s from %s as the rate of new connections is over the limit", addr, conn.RemoteAddr())
+				expvarConnectionsRejected.Add(1)
+				expvarConnectionsRateLimited.Add("closed", 1)
+				conn.Close()
+			} else if !acquireConnection() {
+				l.logger.Printf("[WARN] Rejecting connection to %s from %s as the server-wide limit of %d connections has been reached", addr, conn.RemoteAddr(), atomic.LoadInt64(&maxConnections))
+				expvarConnectionsRejected.Add(1)
+				conn.Close()
+			} else if connection, err := newConnection(l, l.logger, conn); err != nil {
 				l.logger.Printf("[ERROR] Error %s establishing connection to %s from %s", err, addr, conn.RemoteAddr())
 				conn.Close()
+				releaseConnection()
 			} else {
+				expvarConnections.Add(1)
 				go func() {
 					// do not use our parent ctx as a context, as we don't want it to cancel when
 					// we reload config and cancel this listener
 					ctx, cancelFunc := context.WithCancel(sessionParentCtx)
 					defer cancelFunc()
+					defer releaseConnection()
 					sessionWaitGroup.Add(1)
 					connection.Serve(ctx)
 					sessionWaitGroup.Done()
@@ -99,7 +262,6 @@ func (l *Listener) Listen(parentCtx context.Context, sessionParentCtx context.Co
 			}
 		}
 	}
-
 }
 
 // make an appropriate TLS config
@@ -168,19 +330,83 @@ func (l *Listener) initTls() error {
 		MinVersion:   minVersion,
 		MaxVersion:   maxVersion,
 	}
+
+	if l.tls.CrlFile != "" || l.tls.OcspServer != "" {
+		rc, err := newRevocationChecker(l.logger, l.tls)
+		if err != nil {
+			return err
+		}
+		l.tlsconfig.VerifyPeerCertificate = rc.VerifyPeerCertificate
+	}
 	return nil
 }
 
 // NewListener returns a new listener object
 func NewListener(logger *log.Logger, s ServerConfig) (*Listener, error) {
 	l := &Listener{
-		logger:          logger,
-		protocol:        s.Protocol,
-		addr:            s.Address,
-		exports:         s.Exports,
-		defaultExport:   s.DefaultExport,
-		disableNoZeroes: s.DisableNoZeroes,
-		tls:             s.Tls,
+		logger:             logger,
+		protocol:           s.Protocol,
+		addr:               s.Address,
+		exports:            s.Exports,
+		defaultExport:      s.DefaultExport,
+		disableNoZeroes:    s.DisableNoZeroes,
+		tls:                s.Tls,
+		backlog:            s.Backlog,
+		acceptors:          s.Acceptors,
+		negotiationTimeout: s.NegotiationTimeout,
+		maxOptions:         s.MaxOptions,
+		strict:             s.Strict,
+		checkFraming:       s.CheckFraming,
+		verboseErrors:      s.VerboseErrors,
+	}
+	if l.backlog < 0 {
+		return nil, fmt.Errorf("Bad backlog %d", l.backlog)
+	}
+	if l.acceptors < 0 {
+		return nil, fmt.Errorf("Bad number of acceptors %d", l.acceptors)
+	} else if l.acceptors == 0 {
+		l.acceptors = DefaultAcceptors
+	}
+	if l.negotiationTimeout < 0 {
+		return nil, fmt.Errorf("Bad negotiation timeout %v", l.negotiationTimeout)
+	} else if l.negotiationTimeout == 0 {
+		l.negotiationTimeout = DefaultNegotiationTimeout
+	}
+	if l.maxOptions < 0 {
+		return nil, fmt.Errorf("Bad maximum number of options %d", l.maxOptions)
+	} else if l.maxOptions == 0 {
+		l.maxOptions = DefaultMaxOptions
+	}
+	if s.ConnRate < 0 {
+		return nil, fmt.Errorf("Bad connection rate %v", s.ConnRate)
+	}
+	if s.ConnBurst < 0 {
+		return nil, fmt.Errorf("Bad connection burst %d", s.ConnBurst)
+	}
+	if s.ConnRate > 0 {
+		burst := s.ConnBurst
+		if burst == 0 {
+			// a second's worth, and always at least one
+			burst = int(math.Ceil(s.ConnRate))
+		}
+		l.connRate = newConnRateLimiter(s.ConnRate, burst)
+	}
+	switch s.OnConnRateExceeded {
+	case "", "delay":
+	case "close":
+		if l.connRate == nil {
+			return nil, errors.New("Connection rate exceeded action 'close' needs a connection rate")
+		}
+		l.closeOverConnRate = true
+	default:
+		return nil, fmt.Errorf("Bad connection rate exceeded action '%s'", s.OnConnRateExceeded)
+	}
+	switch s.OnStartTlsUnavailable {
+	case "", "unsup":
+	case "close":
+		l.closeOnNoTls = true
+	default:
+		return nil, fmt.Errorf("Bad STARTTLS unavailable action '%s'", s.OnStartTlsUnavailable)
 	}
 	if err := l.initTls(); err != nil {
 		return nil, err
@@ -0,0 +1,121 @@
+package nbd
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/context"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Server-wide load, for external load balancers. Like the connection
+// accounting, this survives configuration reloads
+var (
+	liveConnections      = make(map[*Connection]struct{}) // connections being served
+	liveConnectionsMutex sync.Mutex                       // protects liveConnections
+	failedBackends       int64                            // backends open that have failed, accessed atomically
+)
+
+// LoadReport reports the load on the server, so that a load balancer can
+// weight it against others, or take it out of service
+type LoadReport struct {
+	Connections    int64  `json:"connections"`     // connections open
+	MaxConnections int64  `json:"max_connections"` // server-wide connection limit, or 0 for none
+	Inflight       int64  `json:"inflight"`        // commands received but not yet replied to
+	FailedBackends int64  `json:"failed_backends"` // backends open that have failed
+	Unhealthy      int64  `json:"unhealthy"`       // exports whose last flush failed
+	Quiesced       bool   `json:"quiesced"`        // whether new connections are rejected
+	Load           int64  `json:"load"`            // percentage of the connection limit in use
+	Status         string `json:"status"`          // up, drain (quiesced) or down (a backend has failed)
+}
+
+func init() {
+	http.HandleFunc("/debug/load", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(GetLoadReport())
+	})
+}
+
+// registerConnection adds a connection to those whose load is reported
+func registerConnection(c *Connection) {
+	liveConnectionsMutex.Lock()
+	defer liveConnectionsMutex.Unlock()
+	liveConnections[c] = struct{}{}
+}
+
+// unregisterConnection removes a connection added by registerConnection
+func unregisterConnection(c *Connection) {
+	liveConnectionsMutex.Lock()
+	defer liveConnectionsMutex.Unlock()
+	delete(liveConnections, c)
+}
+
+// GetLoadReport returns the current load on the server
+func GetLoadReport() LoadReport {
+	lr := LoadReport{
+		Connections:    atomic.LoadInt64(&activeConnections),
+		MaxConnections: atomic.LoadInt64(&maxConnections),
+		FailedBackends: atomic.LoadInt64(&failedBackends),
+		Unhealthy:      atomic.LoadInt64(&unhealthyExports),
+		Quiesced:       IsQuiesced(),
+		Status:         "up",
+	}
+	liveConnectionsMutex.Lock()
+	for c := range liveConnections {
+		lr.Inflight += atomic.LoadInt64(&c.numInflight)
+	}
+	liveConnectionsMutex.Unlock()
+	if lr.MaxConnections > 0 {
+		if lr.Load = 100 * lr.Connections / lr.MaxConnections; lr.Load > 100 {
+			lr.Load = 100
+		}
+	}
+	if lr.FailedBackends > 0 {
+		lr.Status = "down"
+	} else if lr.Quiesced {
+		lr.Status = "drain"
+	}
+	return lr
+}
+
+// agentCheckReply returns the reply to a HAProxy agent check: the status,
+// and while up the weight as the percentage of the connection limit free
+func (lr LoadReport) agentCheckReply() string {
+	if lr.Status != "up" {
+		return lr.Status + "\n"
+	}
+	return fmt.Sprintf("up %d%%\n", 100-lr.Load)
+}
+
+// runAgentCheck serves HAProxy agent checks on addr until ctx is done
+func runAgentCheck(ctx context.Context, logger *log.Logger, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	logger.Printf("[INFO] Serving agent checks on %s", ln.Addr())
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				select {
+				case <-ctx.Done():
+					logger.Printf("[INFO] Stopping serving agent checks on %s", ln.Addr())
+				default:
+					logger.Printf("[ERROR] Cannot accept agent check connection on %s: %v", ln.Addr(), err)
+				}
+				return
+			}
+			conn.Write([]byte(GetLoadReport().agentCheckReply()))
+			conn.Close()
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,116 @@
+package nbd
+
+import (
+	"expvar"
+	"sync"
+)
+
+// budgetedCache is a cache whose blocks are charged to the cache memory budget
+type budgetedCache interface {
+	// evictOldest evicts the cache's least recently used block, returning the
+	// number of bytes freed, or 0 if the cache is empty. It must not charge the
+	// budget for the bytes freed, as the budget accounts for them itself
+	evictOldest() int64
+}
+
+// memoryBudget bounds the memory held by the caches of every export together,
+// which would otherwise be bounded only by each cache's own limit.
+//
+// Each cache charges the budget for the blocks it adds, and credits it for
+// those it drops. Whilst the total is over the limit, blocks are evicted from
+// whichever cache holds the most memory, whatever its own limit, so that the
+// exports' shares are trimmed fairly rather than the cache that happened to
+// fill up last bearing the cost. Caches charge the budget without holding
+// their own locks, and the budget never holds its lock whilst evicting, so a
+// cache being charged can evict from another without deadlock
+type memoryBudget struct {
+	mutex     sync.Mutex              // protects the below
+	limit     int64                   // most bytes held by the caches together, or 0 for no limit
+	used      int64                   // bytes held by the caches together
+	usage     map[budgetedCache]int64 // bytes held by each cache
+	evictions int64                   // blocks evicted to bring the total within the limit
+}
+
+// The budget shared by the caches of every export. Like the connection
+// accounting, this survives configuration reloads, as caches do
+var cacheMemory = &memoryBudget{usage: make(map[budgetedCache]int64)}
+
+func init() {
+	expvar.Publish("nbd_cache_memory", expvar.Func(func() interface{} {
+		cacheMemory.mutex.Lock()
+		defer cacheMemory.mutex.Unlock()
+		return map[string]int64{
+			"used":      cacheMemory.used,
+			"limit":     cacheMemory.limit,
+			"evictions": cacheMemory.evictions,
+		}
+	}))
+}
+
+// setLimit sets the budget's limit in bytes (0 for none), evicting at once
+// if the caches together hold more
+func (mb *memoryBudget) setLimit(limit int64) {
+	mb.mutex.Lock()
+	mb.limit = limit
+	mb.mutex.Unlock()
+	mb.enforce()
+}
+
+// charge records that the cache c holds n more bytes (or fewer, if n is
+// negative), then evicts until the total is within the limit. Call without
+// holding c's lock
+func (mb *memoryBudget) charge(c budgetedCache, n int64) {
+	if n == 0 {
+		return
+	}
+	mb.mutex.Lock()
+	mb.usage[c] += n
+	mb.used += n
+	mb.mutex.Unlock()
+	mb.enforce()
+}
+
+// forget records that the cache c has been discarded, with all its blocks
+func (mb *memoryBudget) forget(c budgetedCache) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	mb.used -= mb.usage[c]
+	delete(mb.usage, c)
+}
+
+// enforce evicts blocks, one at a time from the cache holding the most
+// memory, until the total is within the limit
+func (mb *memoryBudget) enforce() {
+	for {
+		mb.mutex.Lock()
+		if mb.limit == 0 || mb.used <= mb.limit {
+			mb.mutex.Unlock()
+			return
+		}
+		var largest budgetedCache
+		for c, n := range mb.usage {
+			if largest == nil || n > mb.usage[largest] {
+				largest = c
+			}
+		}
+		mb.mutex.Unlock()
+		if largest == nil {
+			return
+		}
+		freed := largest.evictOldest()
+		mb.mutex.Lock()
+		if _, ok := mb.usage[largest]; ok {
+			mb.usage[largest] -= freed
+			mb.used -= freed
+		}
+		if freed > 0 {
+			mb.evictions++
+		}
+		mb.mutex.Unlock()
+		if freed == 0 {
+			// the cache is empty, but the usage it was charged says otherwise
+			// until its own charge catches up, so give up rather than spin
+			return
+		}
+	}
+}
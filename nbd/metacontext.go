@@ -0,0 +1,201 @@
+package nbd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"io"
+)
+
+// Maximum number of queries accepted in a single NBD_OPT_LIST_META_CONTEXT or
+// NBD_OPT_SET_META_CONTEXT option
+const maxMetaContextQueries = 128
+
+// The only meta context we support, and the id it is given when selected
+const (
+	metaContextBaseAllocation   = "base:allocation"
+	metaContextBaseAllocationId = 1
+)
+
+// Maximum number of descriptors in the reply to NBD_CMD_BLOCK_STATUS. A
+// heavily fragmented file has many more in a large range, so the reply
+// describes only the start of the range, from which the client carries on
+const maxBlockStatusDescriptors = 1024
+
+// readMetaContextString reads a length-prefixed string from the payload of a
+// meta context option, returning it and the rest of the payload
+func readMetaContextString(payload []byte, what string) (string, []byte, error) {
+	if len(payload) < 4 {
+		return "", nil, fmt.Errorf("Option too short for %s length", what)
+	}
+	l := binary.BigEndian.Uint32(payload)
+	payload = payload[4:]
+	if l > NBD_MAX_STRING_LENGTH {
+		return "", nil, fmt.Errorf("%s is too long", what)
+	}
+	if uint32(len(payload)) < l {
+		return "", nil, fmt.Errorf("Option too short for %s", what)
+	}
+	return string(payload[:l]), payload[l:], nil
+}
+
+// parseMetaContextOption parses the payload of an NBD_OPT_LIST_META_CONTEXT
+// or NBD_OPT_SET_META_CONTEXT option, returning the export name and the
+// queries. The payload is read in full before parsing, so the declared option
+// length bounds what is read from the client; the queries must account for
+// exactly that length, and there may be at most maxMetaContextQueries of them
+func parseMetaContextOption(payload []byte) (string, []string, error) {
+	name, payload, err := readMetaContextString(payload, "export name")
+	if err != nil {
+		return "", nil, err
+	}
+	if len(payload) < 4 {
+		return "", nil, errors.New("Option too short for number of queries")
+	}
+	numQueries := binary.BigEndian.Uint32(payload)
+	payload = payload[4:]
+	if numQueries > maxMetaContextQueries {
+		return "", nil, fmt.Errorf("Too many queries (%d)", numQueries)
+	}
+	queries := make([]string, numQueries)
+	for i := range queries {
+		if queries[i], payload, err = readMetaContextString(payload, "query"); err != nil {
+			return "", nil, err
+		}
+	}
+	if len(payload) != 0 {
+		return "", nil, fmt.Errorf("Option has %d bytes beyond its queries", len(payload))
+	}
+	return name, queries, nil
+}
+
+// matchesBaseAllocation returns true if the queries of an
+// NBD_OPT_LIST_META_CONTEXT or NBD_OPT_SET_META_CONTEXT option match
+// base:allocation. Listing with no queries, or with the query "base:", lists
+// every context of the namespace; selecting needs the context's full name
+func matchesBaseAllocation(optId uint32, queries []string) bool {
+	if optId == NBD_OPT_LIST_META_CONTEXT && len(queries) == 0 {
+		return true
+	}
+	for _, q := range queries {
+		if q == metaContextBaseAllocation || (optId == NBD_OPT_LIST_META_CONTEXT && q == "base:") {
+			return true
+		}
+	}
+	return false
+}
+
+// replyMetaContexts replies to an NBD_OPT_LIST_META_CONTEXT or
+// NBD_OPT_SET_META_CONTEXT option for the export named with an
+// NBD_REP_META_CONTEXT for base:allocation if the queries match it, then an
+// ack. Selecting it records it as selected for the export
+func (c *Connection) replyMetaContexts(optId uint32, exportName string, queries []string) error {
+	if matchesBaseAllocation(optId, queries) {
+		or := nbdOptReply{
+			NbdOptReplyMagic:  NBD_REP_MAGIC,
+			NbdOptId:          optId,
+			NbdOptReplyType:   NBD_REP_META_CONTEXT,
+			NbdOptReplyLength: uint32(4 + len(metaContextBaseAllocation)),
+		}
+		if err := binary.Write(c.conn, binary.BigEndian, or); err != nil {
+			return errors.New("Cannot reply to meta context option")
+		}
+		if err := binary.Write(c.conn, binary.BigEndian, uint32(metaContextBaseAllocationId)); err != nil {
+			return errors.New("Cannot reply to meta context option")
+		}
+		if _, err := c.conn.Write([]byte(metaContextBaseAllocation)); err != nil {
+			return errors.New("Cannot reply to meta context option")
+		}
+		if optId == NBD_OPT_SET_META_CONTEXT {
+			c.allocationContext = exportName
+		}
+	}
+	or := nbdOptReply{
+		NbdOptReplyMagic:  NBD_REP_MAGIC,
+		NbdOptId:          optId,
+		NbdOptReplyType:   NBD_REP_ACK,
+		NbdOptReplyLength: 0,
+	}
+	if err := binary.Write(c.conn, binary.BigEndian, or); err != nil {
+		return errors.New("Cannot reply to meta context option")
+	}
+	return nil
+}
+
+// allocationExtents returns the base:allocation block descriptors of length
+// bytes at offset, merging adjacent extents alike. They cover at least the
+// first byte, and with one set, there is only one descriptor. They are
+// returned in their extended form, as without extended headers no request is
+// long enough to need it
+func (c *Connection) allocationExtents(ctx context.Context, offset uint64, length uint64, one bool) ([]nbdExtendedBlockDescriptor, error) {
+	var extents []Extent
+	if el, ok := c.backend.(ExtentLister); ok {
+		var err error
+		if extents, err = el.Extents(ctx, int(length), int64(offset)); err != nil {
+			return nil, err
+		}
+	}
+	var descriptors []nbdExtendedBlockDescriptor
+	var covered uint64
+	for _, e := range extents {
+		if e.Length == 0 {
+			continue
+		}
+		if e.Length > length-covered {
+			e.Length = length - covered
+		}
+		var flags uint32
+		if e.Hole {
+			flags |= NBD_STATE_HOLE
+		}
+		if e.Zero {
+			flags |= NBD_STATE_ZERO
+		}
+		if n := len(descriptors); n > 0 && descriptors[n-1].NbdStatusFlags == uint64(flags) {
+			descriptors[n-1].NbdLength += e.Length
+		} else if (one && n == 1) || n == maxBlockStatusDescriptors {
+			break
+		} else {
+			descriptors = append(descriptors, nbdExtendedBlockDescriptor{NbdLength: e.Length, NbdStatusFlags: uint64(flags)})
+		}
+		if covered += e.Length; covered == length {
+			break
+		}
+	}
+	if len(descriptors) == 0 {
+		// all we know is that it can be read
+		descriptors = append(descriptors, nbdExtendedBlockDescriptor{NbdLength: length})
+	}
+	return descriptors, nil
+}
+
+// writeStructuredBlockStatus writes the reply to NBD_CMD_BLOCK_STATUS: an
+// NBD_REPLY_TYPE_BLOCK_STATUS chunk with the block descriptors for
+// base:allocation (NBD_REPLY_TYPE_BLOCK_STATUS_EXT with extended headers), or
+// an NBD_REPLY_TYPE_ERROR chunk if the query failed
+func (c *Connection) writeStructuredBlockStatus(w io.Writer, req *Request) error {
+	if req.nbdRep.NbdError != 0 {
+		return c.writeStructuredError(w, req, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_ERROR, req.nbdRep.NbdError, "", nil)
+	}
+	if c.extendedHeaders {
+		if err := c.writeStructuredChunk(w, req, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_BLOCK_STATUS_EXT, 8+16*uint32(len(req.extents))); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, []uint32{metaContextBaseAllocationId, uint32(len(req.extents))}); err != nil {
+			return err
+		}
+		return binary.Write(w, binary.BigEndian, req.extents)
+	}
+	descriptors := make([]nbdBlockDescriptor, len(req.extents))
+	for i, e := range req.extents {
+		descriptors[i] = nbdBlockDescriptor{NbdLength: uint32(e.NbdLength), NbdStatusFlags: uint32(e.NbdStatusFlags)}
+	}
+	if err := c.writeStructuredChunk(w, req, NBD_REPLY_FLAG_DONE, NBD_REPLY_TYPE_BLOCK_STATUS, 4+8*uint32(len(descriptors))); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(metaContextBaseAllocationId)); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, descriptors)
+}
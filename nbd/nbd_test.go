@@ -1,17 +1,39 @@
 package nbd
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"expvar"
 	"flag"
 	"fmt"
+	"golang.org/x/net/context"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
+	"log"
+	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"text/template"
 	"time"
@@ -21,19 +43,158 @@ const ConfigTemplate = `
 servers:
 - protocol: unix
   address: {{.TempDir}}/nbd.sock
+  defaultexport: foo
+{{if .Acceptors}}
+  acceptors: {{.Acceptors}}
+  backlog: 1024
+{{end}}
+{{if .MaxOptions}}
+  maxoptions: {{.MaxOptions}}
+{{end}}
+{{if .NegotiationTimeout}}
+  negotiationtimeout: {{.NegotiationTimeout}}
+{{end}}
+{{if .OnStartTlsUnavailable}}
+  onstarttlsunavailable: {{.OnStartTlsUnavailable}}
+{{end}}
+{{if .Strict}}
+  strict: true
+{{end}}
+{{if .CheckFraming}}
+  checkframing: true
+{{end}}
+{{if .ConnRate}}
+  connrate: {{.ConnRate}}
+  connburst: {{.ConnBurst}}
+  onconnrateexceeded: {{.OnConnRateExceeded}}
+{{end}}
+{{if .VerboseErrors}}
+  verboseerrors: true
+{{end}}
   exports:
   - name: foo
+    description: Test export
     driver: {{.Driver}}
     path: {{.TempDir}}/nbd.img
     workers: 20
+    labels:
+      team: db
+      tier: gold
 {{if .NoFlush}}
     flush: false
     fua: false
+{{end}}
+{{if .ReadOnly}}
+    readonly: true
+{{end}}
+{{if .SizeProvider}}
+    sizeprovider: {{.SizeProvider}}
+    sizettl: {{.SizeTtl}}
+{{end}}
+{{if .AllowCommands}}
+    allowcommands: {{.AllowCommands}}
+{{end}}
+{{if .DenyCommands}}
+    denycommands: {{.DenyCommands}}
+{{end}}
+{{if .MultiConn}}
+    multiconn: {{.MultiConn}}
+{{end}}
+{{if .PhantomSize}}
+    phantomsize: {{.PhantomSize}}
+{{end}}
+{{if .ReadCacheSize}}
+    readcachesize: {{.ReadCacheSize}}
+    readcachewritethrough: {{.ReadCacheWriteThrough}}
+{{end}}
+{{if .ReconnectGrace}}
+    reconnectgrace: {{.ReconnectGrace}}
+{{end}}
+{{if .MaxPayload}}
+    maxpayload: {{.MaxPayload}}
+{{end}}
+{{if .MaxChunkSize}}
+    maxchunksize: {{.MaxChunkSize}}
+    chunkalign: {{.ChunkAlign}}
+{{end}}
+{{if .DetectZeros}}
+    detectzeros: true
+{{end}}
+{{if .MinimumBlockSize}}
+    minimumblocksize: {{.MinimumBlockSize}}
+{{end}}
+{{if .MaximumBlockSize}}
+    maximumblocksize: {{.MaximumBlockSize}}
+{{end}}
+{{if .OnError}}
+    onerror: {{.OnError}}
+    badoffset: 65536
+{{end}}
+{{if .Failover}}
+    failover: {{.Failover}}
+    failoverthreshold: 1
+    badoffset: 65536
+    standbydriver: file
+    standbypath: {{.TempDir}}/standby.img
+{{end}}
+{{if .OnFileFailure}}
+    onfilefailure: {{.OnFileFailure}}
+{{end}}
+{{if .DirtyBitmap}}
+    dirtybitmap: {{.TempDir}}/nbd.dirty
+{{end}}
+{{if .MaxConnections}}
+    maxconnections: {{.MaxConnections}}
+{{end}}
+{{if .Interceptors}}
+    writeinterceptors: {{.Interceptors}}
+{{end}}
+{{if .TraceFile}}
+    tracefile: {{.TempDir}}/nbd.trace
+{{end}}
+{{if .CommandTimeout}}
+    commandtimeout: {{.CommandTimeout}}
+    coldreaddelay: 1s
+{{end}}
+{{if .PlaintextReadOnly}}
+    plaintextreadonly: true
+{{end}}
+{{if .FlushBarrier}}
+    flushbarrier: true
+{{end}}
+{{if .AsyncQueueDepth}}
+    asyncqueuedepth: {{.AsyncQueueDepth}}
+{{end}}
+{{if .OnFlushFailure}}
+    onflushfailure: {{.OnFlushFailure}}
+{{end}}
+{{if .OnOpenFailure}}
+    onopenfailure: {{.OnOpenFailure}}
+{{end}}
+{{if .EphemeralOverlay}}
+    ephemeraloverlay: true
+{{end}}
+{{if .LazySize}}
+    lazyopen: true
+    size: {{.LazySize}}
 {{end}}
   - name: bar
     driver: rbd
     readonly: false
     image: rbdbar
+    labels: {team: web}
+{{if .StripeReplicas}}
+{{range $i := .Upstreams}}
+  - name: up{{$i}}
+    driver: file
+    path: {{$.TempDir}}/up{{$i}}.img
+{{end}}
+  - name: stripe
+    driver: nbdstripe
+    urls: {{range $i := .Upstreams}}{{if $i}},{{end}}nbd+unix:///up{{$i}}?socket={{$.TempDir}}/nbd.sock{{end}}
+    stripechunk: 65536
+    replicas: {{.StripeReplicas}}
+{{end}}
 {{if .Tls}}
   tls:
     keyfile: {{.TempDir}}/server-key.pem
@@ -41,8 +202,22 @@ servers:
     cacertfile: {{.TempDir}}/client-cert.pem
     servername: localhost
     clientauth: requireverify
+{{if .Crl}}
+    crlfile: {{.TempDir}}/client.crl
+{{end}}
+{{end}}
+{{if .ServerMaxConnections}}
+maxconnections: {{.ServerMaxConnections}}
+{{end}}
+{{if .MaxExports}}
+maxexports: {{.MaxExports}}
 {{end}}
 logging:
+{{if .AccessLogFields}}
+accesslog:
+  file: {{.TempDir}}/access.log
+  fields: [{{.AccessLogFields}}]
+{{end}}
 `
 
 var longtests = flag.Bool("longtests", false, "enable long tests")
@@ -53,6 +228,55 @@ type TestConfig struct {
 	TempDir string
 	Driver  string
 	NoFlush bool
+	Crl     bool
+
+	ReconnectGrace     string
+	ReadCacheSize      string
+	MaxPayload         string
+	LazySize           string
+	MinimumBlockSize   string
+	MaximumBlockSize   string
+	OnFileFailure      string
+	StripeReplicas     string
+	Upstreams          []int
+	OnError            string
+	Failover           string
+	EphemeralOverlay   bool
+	Acceptors          string
+	DirtyBitmap        bool
+	MaxConnections     string // per export
+	Interceptors       string
+	TraceFile          bool
+	MaxOptions         string
+	NegotiationTimeout string
+	CommandTimeout     string
+	PlaintextReadOnly  bool
+	AsyncQueueDepth    string
+	FlushBarrier       bool
+	OnFlushFailure     string
+	OnOpenFailure      string
+	ReadOnly           bool
+	SizeProvider       string
+	SizeTtl            string
+	AllowCommands      string
+	DenyCommands       string
+	MultiConn          string
+	PhantomSize        string
+	MaxChunkSize       string
+	ChunkAlign         string
+	DetectZeros        bool
+
+	OnStartTlsUnavailable string
+	ReadCacheWriteThrough bool
+	Strict                bool
+	CheckFraming          bool
+	ConnRate              string
+	ConnBurst             string
+	OnConnRateExceeded    string
+	VerboseErrors         bool
+	AccessLogFields       string
+	ServerMaxConnections  string
+	MaxExports            string
 }
 
 type NbdInstance struct {
@@ -64,6 +288,9 @@ type NbdInstance struct {
 	tlsConn           net.Conn
 	conn              net.Conn
 	transmissionFlags uint16
+	exportSize        uint64
+	clientFlags       uint32   // client flags to send (defaults to FIXED_NEWSTYLE|NO_ZEROES)
+	infoOrder         []uint16 // info types received by the last GoWithInfo, in order
 	TestConfig
 }
 
@@ -99,6 +326,10 @@ func StartNbd(t *testing.T, tc TestConfig) *NbdInstance {
 		t.Fatalf("Could not write client key")
 	}
 
+	if ni.Crl {
+		ni.WriteCrl(t)
+	}
+
 	confFile := path.Join(ni.TempDir, "gonbdserver.conf")
 
 	tpl := template.Must(template.New("config").Parse(ConfigTemplate))
@@ -130,6 +361,35 @@ func StartNbd(t *testing.T, tc TestConfig) *NbdInstance {
 	return ni
 }
 
+// WriteCrl writes a CRL signed by the test CA revoking the test client certificate
+func (ni *NbdInstance) WriteCrl(t *testing.T) {
+	certBlock, _ := pem.Decode([]byte(testClientCert))
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		t.Fatalf("Could not parse client cert: %v", err)
+	}
+	keyBlock, _ := pem.Decode([]byte(testClientKey))
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		t.Fatalf("Could not parse client key: %v", err)
+	}
+	template := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: cert.SerialNumber, RevocationTime: time.Now()},
+		},
+	}
+	crl, err := x509.CreateRevocationList(rand.Reader, template, cert, key)
+	if err != nil {
+		t.Fatalf("Could not create CRL: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(ni.TempDir, "client.crl"), pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl}), 0644); err != nil {
+		t.Fatalf("Could not write CRL")
+	}
+}
+
 func (ni *NbdInstance) CloseConnection() {
 	// fmt.Fprintf(os.Stderr, ">>>> CloseConnection()\n")
 	ni.closedMutex.Lock()
@@ -216,6 +476,9 @@ func (ni *NbdInstance) Connect(t *testing.T) error {
 		return fmt.Errorf("Unexpected handshake flags")
 	}
 	var clientFlags uint32 = NBD_FLAG_C_FIXED_NEWSTYLE | NBD_FLAG_C_NO_ZEROES
+	if ni.clientFlags != 0 {
+		clientFlags = ni.clientFlags
+	}
 	if err = binary.Write(ni.conn, binary.BigEndian, clientFlags); err != nil {
 		return fmt.Errorf("Could not send client flags")
 	}
@@ -312,7 +575,11 @@ listloop:
 			return fmt.Errorf("List option reply type was unexpected")
 		}
 	}
-	if exports != 2 {
+	expectedExports := 2
+	if ni.StripeReplicas != "" {
+		expectedExports += len(ni.Upstreams) + 1
+	}
+	if exports != expectedExports {
 		return fmt.Errorf("Unexpected number of exports")
 	}
 
@@ -351,44 +618,57 @@ func (ni *NbdInstance) Abort(t *testing.T) error {
 }
 
 func (ni *NbdInstance) Go(t *testing.T) error {
-	var err error
+	_, err := ni.GoWithInfo(t, "foo", []uint16{NBD_INFO_BLOCK_SIZE})
+	return err
+}
 
-	export := "foo"
+// optReplyError is the error returned when the server replies to an option with an error
+type optReplyError uint32
+
+func (e optReplyError) Error() string {
+	return fmt.Sprintf("Option reply was error %x", uint32(e))
+}
+
+// GoWithInfo sends NBD_OPT_GO for the named export requesting the given info types,
+// and returns the content of each info block received other than NBD_INFO_EXPORT
+func (ni *NbdInstance) GoWithInfo(t *testing.T, export string, infoElements []uint16) (map[uint16][]byte, error) {
+	var err error
 
+	infos := make(map[uint16][]byte)
+	ni.infoOrder = nil
 	opt := nbdClientOpt{
 		NbdOptMagic: NBD_OPTS_MAGIC,
 		NbdOptId:    NBD_OPT_GO,
-		NbdOptLen:   uint32(2 + 2*1 + 4 + len(export)),
+		NbdOptLen:   uint32(2 + 2*len(infoElements) + 4 + len(export)),
 	}
 	if err = binary.Write(ni.conn, binary.BigEndian, opt); err != nil {
-		return fmt.Errorf("Could not send go option")
+		return nil, fmt.Errorf("Could not send go option")
 	}
 	var nameLength uint32 = uint32(len(export))
 	if err = binary.Write(ni.conn, binary.BigEndian, nameLength); err != nil {
-		return fmt.Errorf("Could not send go export length")
+		return nil, fmt.Errorf("Could not send go export length")
 	}
 	if err = binary.Write(ni.conn, binary.BigEndian, []byte(export)); err != nil {
-		return fmt.Errorf("Could not send go export name")
+		return nil, fmt.Errorf("Could not send go export name")
 	}
-	var numInfoElements uint16 = 1
+	var numInfoElements uint16 = uint16(len(infoElements))
 	if err = binary.Write(ni.conn, binary.BigEndian, numInfoElements); err != nil {
-		return fmt.Errorf("Could not send number of elements for go option")
+		return nil, fmt.Errorf("Could not send number of elements for go option")
 	}
-	var infoElement uint16 = NBD_INFO_BLOCK_SIZE
-	if err = binary.Write(ni.conn, binary.BigEndian, infoElement); err != nil {
-		return fmt.Errorf("Could not send go info element")
+	if err = binary.Write(ni.conn, binary.BigEndian, infoElements); err != nil {
+		return nil, fmt.Errorf("Could not send go info elements")
 	}
 infoloop:
 	for {
 		var optReply nbdOptReply
 		if err := binary.Read(ni.conn, binary.BigEndian, &optReply); err != nil {
-			return fmt.Errorf("Could not receive go option reply")
+			return nil, fmt.Errorf("Could not receive go option reply")
 		}
 		if optReply.NbdOptReplyMagic != NBD_REP_MAGIC {
-			return fmt.Errorf("Go option reply had wrong magic (%x)", optReply.NbdOptReplyMagic)
+			return nil, fmt.Errorf("Go option reply had wrong magic (%x)", optReply.NbdOptReplyMagic)
 		}
 		if optReply.NbdOptId != NBD_OPT_GO {
-			return fmt.Errorf("Go option reply had wrong id")
+			return nil, fmt.Errorf("Go option reply had wrong id")
 		}
 		switch optReply.NbdOptReplyType {
 		case NBD_REP_ACK:
@@ -396,42 +676,143 @@ infoloop:
 		case NBD_REP_INFO:
 			var infotype uint16
 			if err := binary.Read(ni.conn, binary.BigEndian, &infotype); err != nil {
-				return fmt.Errorf("Could not receive go option reply name length")
+				return nil, fmt.Errorf("Could not receive go option reply name length")
 			}
+			ni.infoOrder = append(ni.infoOrder, infotype)
 			switch infotype {
 			case NBD_INFO_EXPORT:
 				if optReply.NbdOptReplyLength != 12 {
-					return fmt.Errorf("Bad length in NBD_INFO_EXPORT")
+					return nil, fmt.Errorf("Bad length in NBD_INFO_EXPORT")
 				}
 				var exportSize uint64
 				var transmissionFlags uint16
 				if err := binary.Read(ni.conn, binary.BigEndian, &exportSize); err != nil {
-					return fmt.Errorf("Could not receive NBD_INFO_EXPORT export size")
+					return nil, fmt.Errorf("Could not receive NBD_INFO_EXPORT export size")
 				}
 				if err := binary.Read(ni.conn, binary.BigEndian, &transmissionFlags); err != nil {
-					return fmt.Errorf("Could not receive NBD_INFO_EXPORT transmission flags")
+					return nil, fmt.Errorf("Could not receive NBD_INFO_EXPORT transmission flags")
 				}
 				ni.transmissionFlags = transmissionFlags
+				ni.exportSize = exportSize
 				t.Logf("Transmission flags: FLUSH=%v, FUA=%v",
 					transmissionFlags&NBD_FLAG_SEND_FLUSH != 0,
 					transmissionFlags&NBD_FLAG_SEND_FUA != 0)
 			default:
-				t.Logf("Ignoring info type %d", infotype)
-				if optReply.NbdOptReplyLength > 2 {
-					junk := make([]byte, optReply.NbdOptReplyLength-2, optReply.NbdOptReplyLength-2)
-					if err := binary.Read(ni.conn, binary.BigEndian, &junk); err != nil {
-						return fmt.Errorf("Could not receive go option reply name junk")
-					}
+				info := make([]byte, optReply.NbdOptReplyLength-2, optReply.NbdOptReplyLength-2)
+				if err := binary.Read(ni.conn, binary.BigEndian, &info); err != nil {
+					return nil, fmt.Errorf("Could not receive go option reply info type %d", infotype)
 				}
+				infos[infotype] = info
 			}
 		default:
-			return fmt.Errorf("List option reply type was unexpected")
+			if optReply.NbdOptReplyType&NBD_REP_FLAG_ERROR != 0 {
+				if err := skip(ni.conn, optReply.NbdOptReplyLength); err != nil {
+					return nil, fmt.Errorf("Could not receive go option error")
+				}
+				return nil, optReplyError(optReply.NbdOptReplyType)
+			}
+			return nil, fmt.Errorf("List option reply type was unexpected")
 		}
 	}
 
+	return infos, nil
+}
+
+// ExportName sends NBD_OPT_EXPORT_NAME for the export foo, and reads the export details
+// that are sent in reply (but not any padding)
+func (ni *NbdInstance) ExportName(t *testing.T) error {
+	export := "foo"
+	opt := nbdClientOpt{
+		NbdOptMagic: NBD_OPTS_MAGIC,
+		NbdOptId:    NBD_OPT_EXPORT_NAME,
+		NbdOptLen:   uint32(len(export)),
+	}
+	if err := binary.Write(ni.conn, binary.BigEndian, opt); err != nil {
+		return fmt.Errorf("Could not send export name option")
+	}
+	if err := binary.Write(ni.conn, binary.BigEndian, []byte(export)); err != nil {
+		return fmt.Errorf("Could not send export name")
+	}
+	var ed nbdExportDetails
+	if err := binary.Read(ni.conn, binary.BigEndian, &ed); err != nil {
+		return fmt.Errorf("Could not receive export details")
+	}
+	ni.transmissionFlags = ed.NbdExportFlags
 	return nil
 }
 
+// Pending returns the number of bytes the server sends before going quiet
+func (ni *NbdInstance) Pending(t *testing.T) int {
+	ni.conn.SetDeadline(time.Now().Add(200 * time.Millisecond))
+	defer ni.conn.SetDeadline(time.Time{})
+	n, _ := io.Copy(ioutil.Discard, ni.conn)
+	return int(n)
+}
+
+// Command sends a command and waits for its reply, returning the reply and any data read
+//
+// This must only be used with one command in flight at a time
+func (ni *NbdInstance) Command(t *testing.T, cmdType uint16, flags uint16, offset uint64, length uint32, data []byte) (*nbdReply, []byte, error) {
+	cmd := nbdRequest{
+		NbdRequestMagic: NBD_REQUEST_MAGIC,
+		NbdCommandFlags: flags,
+		NbdCommandType:  cmdType,
+		NbdHandle:       getHandle(),
+		NbdOffset:       offset,
+		NbdLength:       length,
+	}
+	ni.conn.SetDeadline(time.Now().Add(time.Second))
+	defer ni.conn.SetDeadline(time.Time{})
+	if err := binary.Write(ni.conn, binary.BigEndian, cmd); err != nil {
+		return nil, nil, fmt.Errorf("Could not send command: %v", err)
+	}
+	if data != nil {
+		if _, err := ni.conn.Write(data); err != nil {
+			return nil, nil, fmt.Errorf("Could not send command data: %v", err)
+		}
+	}
+	var rep nbdReply
+	if err := binary.Read(ni.conn, binary.BigEndian, &rep); err != nil {
+		return nil, nil, fmt.Errorf("Could not receive reply: %v", err)
+	}
+	if rep.NbdReplyMagic != NBD_REPLY_MAGIC {
+		return nil, nil, fmt.Errorf("Reply had wrong magic (%x)", rep.NbdReplyMagic)
+	}
+	if rep.NbdHandle != cmd.NbdHandle {
+		return nil, nil, fmt.Errorf("Reply had wrong handle")
+	}
+	var repData []byte
+	if cmdType == NBD_CMD_READ && rep.NbdError == 0 {
+		repData = make([]byte, length)
+		if _, err := io.ReadFull(ni.conn, repData); err != nil {
+			return nil, nil, fmt.Errorf("Could not receive reply data: %v", err)
+		}
+	}
+	return &rep, repData, nil
+}
+
+// ConnectAndGo starts a server with the file driver, creates the backing file,
+// connects and negotiates the 'foo' export
+func ConnectAndGo(t *testing.T, tc TestConfig, size int64) *NbdInstance {
+	if tc.Driver == "" {
+		tc.Driver = "file"
+	}
+	ni := StartNbd(t, tc)
+	if err := ni.CreateFile(t, size); err != nil {
+		ni.Close()
+		t.Fatalf("Error on create file: %v", err)
+	}
+	if err := ni.Connect(t); err != nil {
+		ni.Close()
+		t.Fatalf("Error on connect: %v", err)
+	}
+	if err := ni.Go(t); err != nil {
+		ni.Close()
+		t.Fatalf("Error on go: %v", err)
+	}
+	return ni
+}
+
 func (ni *NbdInstance) CreateFile(t *testing.T, size int64) error {
 	filename := path.Join(ni.TempDir, "nbd.img")
 	if file, err := os.Create(filename); err != nil {
@@ -487,6 +868,96 @@ func TestConnectionTls(t *testing.T) {
 	doTestConnection(t, true)
 }
 
+func TestConnectionTlsRevoked(t *testing.T) {
+	ni := StartNbd(t, TestConfig{Tls: true, Crl: true})
+	defer ni.Close()
+
+	if err := ni.Connect(t); err == nil {
+		t.Logf("Connect with revoked client certificate succeeded")
+		t.Fail()
+	}
+}
+
+func TestCrlIssuer(t *testing.T) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+	ni := &NbdInstance{t: t, TestConfig: TestConfig{TempDir: TempDir}}
+	ni.WriteCrl(t)
+	crlFile := path.Join(TempDir, "client.crl")
+	certBlock, _ := pem.Decode([]byte(testClientCert))
+	ca, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		t.Fatalf("Could not parse client cert: %v", err)
+	}
+
+	// another CA, whose certificate has the serial the CRL revokes
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	otherTemplate := &x509.Certificate{
+		SerialNumber:          ca.SerialNumber,
+		Subject:               pkix.Name{CommonName: "other CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	otherDer, err := x509.CreateCertificate(rand.Reader, otherTemplate, otherTemplate, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %v", err)
+	}
+	other, err := x509.ParseCertificate(otherDer)
+	if err != nil {
+		t.Fatalf("Could not parse certificate: %v", err)
+	}
+
+	rc := &revocationChecker{logger: log.New(ioutil.Discard, "", 0), crlFile: crlFile, caCerts: []*x509.Certificate{ca}}
+	if err := rc.checkCrl(ca); err == nil || err == errUndetermined {
+		t.Errorf("Revoked certificate got %v", err)
+	}
+	if err := rc.checkCrl(other); err != nil {
+		t.Errorf("Certificate from another issuer with a revoked serial got %v", err)
+	}
+
+	// a CRL is only trusted if its issuer, a configured CA, signed it
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(2),
+		ThisUpdate:                time.Now(),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{{SerialNumber: ca.SerialNumber, RevocationTime: time.Now()}},
+	}, other, key)
+	if err != nil {
+		t.Fatalf("Could not create CRL: %v", err)
+	}
+	if err := ioutil.WriteFile(crlFile, crl, 0644); err != nil {
+		t.Fatalf("Could not write CRL")
+	}
+	for _, tc := range []struct {
+		name    string
+		caCerts []*x509.Certificate
+		ok      bool
+	}{
+		{"no CA", nil, false},
+		{"another CA", []*x509.Certificate{ca}, false},
+		{"issuing CA", []*x509.Certificate{ca, other}, true},
+	} {
+		rc := &revocationChecker{logger: log.New(ioutil.Discard, "", 0), crlFile: crlFile, caCerts: tc.caCerts}
+		if err := rc.reloadCrl(); (err == nil) != tc.ok {
+			t.Errorf("%s: loading CRL got %v", tc.name, err)
+		}
+		if err := rc.checkCrl(other); tc.ok && (err == nil || err == errUndetermined) {
+			t.Errorf("%s: revoked certificate got %v", tc.name, err)
+		} else if !tc.ok && err != errUndetermined {
+			t.Errorf("%s: certificate checked against untrusted CRL got %v", tc.name, err)
+		}
+	}
+}
+
 func doTestConnectionIntegrity(t *testing.T, transationLog []byte, tls bool, driver string) {
 	if _, ok := BackendMap[driver]; !ok {
 		t.Skip(fmt.Sprintf("Skipping test as driver %s not built", driver))
@@ -570,3 +1041,6010 @@ func TestAioConnectionIntegrityHugeTls(t *testing.T) {
 		doTestConnectionIntegrity(t, []byte(testHugeTransactionLog), true, "aiofile")
 	}
 }
+
+func TestZeroLengthCommands(t *testing.T) {
+	ni := ConnectAndGo(t, TestConfig{}, 1024*1024)
+	defer ni.Close()
+
+	for _, cmd := range []struct {
+		name    string
+		cmdType uint16
+		offset  uint64
+	}{
+		{"read", NBD_CMD_READ, 4096},
+		{"write", NBD_CMD_WRITE, 4096},
+		{"trim", NBD_CMD_TRIM, 4096},
+		{"read at end", NBD_CMD_READ, 1024 * 1024},
+	} {
+		rep, data, err := ni.Command(t, cmd.cmdType, 0, cmd.offset, 0, nil)
+		if err != nil {
+			t.Fatalf("Zero length %s failed: %v", cmd.name, err)
+		}
+		if rep.NbdError != 0 {
+			t.Errorf("Zero length %s returned error %d", cmd.name, rep.NbdError)
+		}
+		if len(data) != 0 {
+			t.Errorf("Zero length %s returned %d bytes", cmd.name, len(data))
+		}
+	}
+
+	// check the connection is still in sync
+	if rep, data, err := ni.Command(t, NBD_CMD_READ, 0, 0, 512, nil); err != nil {
+		t.Fatalf("Read after zero length commands failed: %v", err)
+	} else if rep.NbdError != 0 || len(data) != 512 {
+		t.Errorf("Read after zero length commands returned error %d and %d bytes", rep.NbdError, len(data))
+	}
+}
+
+func TestCacheFlag(t *testing.T) {
+	_, fileIsCacher := interface{}(&FileBackend{}).(Cacher)
+	for _, tc := range []struct {
+		driver   string
+		expected bool
+	}{
+		{"file", fileIsCacher},
+		{"aiofile", false},
+	} {
+		if _, ok := BackendMap[tc.driver]; !ok {
+			continue
+		}
+		ni := ConnectAndGo(t, TestConfig{Driver: tc.driver}, 1024*1024)
+		if set := ni.transmissionFlags&NBD_FLAG_SEND_CACHE != 0; set != tc.expected {
+			t.Errorf("Driver %s: NBD_FLAG_SEND_CACHE is %v, expected %v", tc.driver, set, tc.expected)
+		}
+		if tc.expected {
+			if rep, _, err := ni.Command(t, NBD_CMD_CACHE, 0, 0, 65536, nil); err != nil {
+				t.Errorf("Driver %s: cache failed: %v", tc.driver, err)
+			} else if rep.NbdError != 0 {
+				t.Errorf("Driver %s: cache returned error %d", tc.driver, rep.NbdError)
+			}
+		}
+		ni.Close()
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+
+	filename := path.Join(TempDir, "nbd.img")
+	contents := make([]byte, 1024*1024)
+	if _, err := rand.Read(contents); err != nil {
+		t.Fatalf("Could not generate file contents: %v", err)
+	}
+	if err := ioutil.WriteFile(filename, contents, 0644); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+
+	for _, readonly := range []bool{false, true} {
+		ec := &ExportConfig{
+			Name:             "foo",
+			Driver:           "file",
+			ReadOnly:         readonly,
+			DriverParameters: DriverParametersConfig{"path": filename},
+		}
+		var out bytes.Buffer
+		if !SelfTest(context.Background(), &out, ec) {
+			t.Errorf("Self test (readonly=%v) failed:\n%s", readonly, out.String())
+		}
+		if after, err := ioutil.ReadFile(filename); err != nil {
+			t.Fatalf("Could not read file: %v", err)
+		} else if !bytes.Equal(after, contents) {
+			t.Errorf("Self test (readonly=%v) did not restore the file contents", readonly)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+
+	// data followed by zeroes, converted over a destination full of junk
+	src, dst, small := path.Join(TempDir, "src.img"), path.Join(TempDir, "dst.img"), path.Join(TempDir, "small.img")
+	contents := make([]byte, 4*1024*1024)
+	if _, err := rand.Read(contents[:1024*1024]); err != nil {
+		t.Fatalf("Could not generate file contents: %v", err)
+	}
+	if err := ioutil.WriteFile(src, contents, 0644); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	if err := ioutil.WriteFile(dst, bytes.Repeat([]byte{0xff}, len(contents)), 0644); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	if err := ioutil.WriteFile(small, make([]byte, len(contents)/2), 0644); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+
+	var out bytes.Buffer
+	if !Convert(context.Background(), &out, "file:"+src, "file:"+dst) {
+		t.Fatalf("Conversion failed:\n%s", out.String())
+	}
+	if after, err := ioutil.ReadFile(dst); err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	} else if !bytes.Equal(after, contents) {
+		t.Errorf("Conversion did not copy the contents")
+	}
+
+	for _, tc := range []struct {
+		from string
+		to   string
+	}{
+		{"file:" + src, "file:" + small},
+		{"file:" + small, "file:" + src},
+		{"nosuchdriver:" + src, "file:" + dst},
+		{"file:" + path.Join(TempDir, "missing.img"), "file:" + dst},
+	} {
+		out.Reset()
+		if Convert(context.Background(), &out, tc.from, tc.to) {
+			t.Errorf("Conversion of %s to %s succeeded", tc.from, tc.to)
+		}
+	}
+}
+
+// copyRequest makes a request of the copy API and decodes the status replied
+func copyRequest(t *testing.T, method string, query string, status interface{}) int {
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest(method, "/debug/copy?"+query, nil))
+	if w.Code == http.StatusOK && status != nil {
+		if err := json.NewDecoder(w.Body).Decode(status); err != nil {
+			t.Fatalf("Cannot decode copy status: %v", err)
+		}
+	}
+	return w.Code
+}
+
+func TestCopyExports(t *testing.T) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+
+	// data followed by zeroes, copied over a destination full of junk
+	contents := make([]byte, 4*1024*1024)
+	if _, err := rand.Read(contents[:1024*1024]); err != nil {
+		t.Fatalf("Could not generate file contents: %v", err)
+	}
+	srcPath, dstPath := path.Join(TempDir, "src.img"), path.Join(TempDir, "dst.img")
+	if err := ioutil.WriteFile(srcPath, contents, 0644); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	if err := ioutil.WriteFile(dstPath, bytes.Repeat([]byte{0xff}, len(contents)), 0644); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	src := ExportConfig{Name: "src", Driver: "file", ReadOnly: true, DriverParameters: DriverParametersConfig{"path": srcPath}}
+	writable := ExportConfig{Name: "writable", Driver: "file", DriverParameters: DriverParametersConfig{"path": srcPath}}
+	dst := ExportConfig{Name: "dst", Driver: "file", DriverParameters: DriverParametersConfig{
+		"path":           dstPath,
+		"reconnectgrace": "10ms",
+		"readcachesize":  "1048576",
+	}}
+	setCopyExports(&Config{Servers: []ServerConfig{{Exports: []ExportConfig{src, writable, dst}}}})
+	defer setCopyExports(&Config{})
+
+	// as a connection to the destination would, with its read cache filled
+	ctx := context.Background()
+	backend, err := acquireBackend(ctx, &dst)
+	if err != nil {
+		t.Fatalf("Cannot acquire destination backend: %v", err)
+	}
+	defer releaseBackend(ctx, backend)
+	buf := make([]byte, len(contents))
+	if _, err := backend.ReadAt(ctx, buf, 0); err != nil {
+		t.Fatalf("Cannot read destination: %v", err)
+	}
+
+	var cs CopyStatus
+	if code := copyRequest(t, "POST", "src=src&dst=dst", &cs); code != http.StatusOK {
+		t.Fatalf("Starting copy got status %d", code)
+	}
+	for deadline := time.Now().Add(5 * time.Second); !cs.Done; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Copy did not finish: %+v", cs)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if code := copyRequest(t, "GET", fmt.Sprintf("id=%d", cs.Id), &cs); code != http.StatusOK {
+			t.Fatalf("Polling copy got status %d", code)
+		}
+	}
+	if cs.Error != "" || cs.Copied != uint64(len(contents)) || cs.Size != uint64(len(contents)) || cs.Source != "src" || cs.Destination != "dst" {
+		t.Errorf("Copy finished with %+v", cs)
+	}
+	if after, err := ioutil.ReadFile(dstPath); err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	} else if !bytes.Equal(after, contents) {
+		t.Errorf("Copy did not copy the contents")
+	}
+	// the copy wrote through the shared backend, so the cache is not stale
+	if _, err := backend.ReadAt(ctx, buf, 0); err != nil {
+		t.Fatalf("Cannot read destination: %v", err)
+	} else if !bytes.Equal(buf, contents) {
+		t.Errorf("Destination backend read stale contents after the copy")
+	}
+
+	var all []CopyStatus
+	if code := copyRequest(t, "GET", "", &all); code != http.StatusOK || len(all) != 1 || all[0] != cs {
+		t.Errorf("Listing copies got status %d and %+v", code, all)
+	}
+	if code := copyRequest(t, "DELETE", fmt.Sprintf("id=%d", cs.Id), nil); code != http.StatusOK {
+		t.Errorf("Forgetting copy got status %d", code)
+	}
+	for _, tc := range []struct {
+		method string
+		query  string
+		code   int
+	}{
+		{"GET", fmt.Sprintf("id=%d", cs.Id), http.StatusNotFound},
+		{"GET", "id=junk", http.StatusBadRequest},
+		{"POST", "src=missing&dst=dst", http.StatusNotFound},
+		{"POST", "src=src&dst=missing", http.StatusNotFound},
+		{"POST", "src=writable&dst=dst", http.StatusConflict},
+		{"POST", "src=src&dst=src", http.StatusConflict},
+		{"DELETE", "", http.StatusBadRequest},
+		{"PUT", "", http.StatusMethodNotAllowed},
+	} {
+		if code := copyRequest(t, tc.method, tc.query, nil); code != tc.code {
+			t.Errorf("%s %s got status %d, expected %d", tc.method, tc.query, code, tc.code)
+		}
+	}
+}
+
+func TestZeroPadding(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		clientFlags uint32
+		goOption    bool
+		padding     int
+	}{
+		{"EXPORT_NAME with NO_ZEROES", NBD_FLAG_C_FIXED_NEWSTYLE | NBD_FLAG_C_NO_ZEROES, false, 0},
+		{"EXPORT_NAME without NO_ZEROES", NBD_FLAG_C_FIXED_NEWSTYLE, false, NBD_EXPORT_NAME_PAD_LENGTH},
+		{"GO with NO_ZEROES", NBD_FLAG_C_FIXED_NEWSTYLE | NBD_FLAG_C_NO_ZEROES, true, 0},
+		{"GO without NO_ZEROES", NBD_FLAG_C_FIXED_NEWSTYLE, true, 0},
+	} {
+		ni := StartNbd(t, TestConfig{Driver: "file"})
+		ni.clientFlags = tc.clientFlags
+		if err := ni.CreateFile(t, 1024*1024); err != nil {
+			ni.Close()
+			t.Fatalf("Error on create file: %v", err)
+		}
+		if err := ni.Connect(t); err != nil {
+			ni.Close()
+			t.Fatalf("%s: error on connect: %v", tc.name, err)
+		}
+		var err error
+		if tc.goOption {
+			err = ni.Go(t)
+		} else {
+			err = ni.ExportName(t)
+		}
+		if err != nil {
+			ni.Close()
+			t.Fatalf("%s: error on negotiation: %v", tc.name, err)
+		}
+		if n := ni.Pending(t); n != tc.padding {
+			t.Errorf("%s: received %d bytes of padding, expected %d", tc.name, n, tc.padding)
+		}
+		ni.Close()
+	}
+}
+
+func TestPartialWritePayload(t *testing.T) {
+	ni := ConnectAndGo(t, TestConfig{}, 1024*1024)
+	defer ni.Close()
+
+	// send a write header claiming 64k of payload, then only part of it
+	cmd := nbdRequest{
+		NbdRequestMagic: NBD_REQUEST_MAGIC,
+		NbdCommandType:  NBD_CMD_WRITE,
+		NbdHandle:       getHandle(),
+		NbdOffset:       0,
+		NbdLength:       65536,
+	}
+	if err := binary.Write(ni.conn, binary.BigEndian, cmd); err != nil {
+		t.Fatalf("Could not send command: %v", err)
+	}
+	partial := make([]byte, 40000)
+	for i := range partial {
+		partial[i] = 0xff
+	}
+	if _, err := ni.conn.Write(partial); err != nil {
+		t.Fatalf("Could not send partial payload: %v", err)
+	}
+	ni.conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// reconnect and check nothing was written
+	if err := ni.Connect(t); err != nil {
+		t.Fatalf("Error on reconnect: %v", err)
+	}
+	if err := ni.Go(t); err != nil {
+		t.Fatalf("Error on go: %v", err)
+	}
+	rep, data, err := ni.Command(t, NBD_CMD_READ, 0, 0, 65536, nil)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if rep.NbdError != 0 {
+		t.Fatalf("Read returned error %d", rep.NbdError)
+	}
+	if !bytes.Equal(data, make([]byte, 65536)) {
+		t.Errorf("Partial write payload reached the backend")
+	}
+}
+
+func TestWriteChecksum(t *testing.T) {
+	ni := StartNbd(t, TestConfig{Driver: "file"})
+	defer ni.Close()
+	if err := ni.CreateFile(t, 1024*1024); err != nil {
+		t.Fatalf("Error on create file: %v", err)
+	}
+	if err := ni.Connect(t); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	opt := nbdClientOpt{
+		NbdOptMagic: NBD_OPTS_MAGIC,
+		NbdOptId:    NBD_OPT_X_WRITE_CHECKSUM,
+		NbdOptLen:   0,
+	}
+	if err := binary.Write(ni.conn, binary.BigEndian, opt); err != nil {
+		t.Fatalf("Could not send write checksum option: %v", err)
+	}
+	var optReply nbdOptReply
+	if err := binary.Read(ni.conn, binary.BigEndian, &optReply); err != nil {
+		t.Fatalf("Could not receive write checksum option reply: %v", err)
+	}
+	if optReply.NbdOptReplyType != NBD_REP_ACK {
+		t.Fatalf("Write checksum option was not acknowledged (%x)", optReply.NbdOptReplyType)
+	}
+	if err := ni.Go(t); err != nil {
+		t.Fatalf("Error on go: %v", err)
+	}
+
+	payload := make([]byte, 4096)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	for _, tc := range []struct {
+		name     string
+		offset   uint64
+		checksum uint32
+		nbdError uint32
+		expected []byte
+	}{
+		{"good checksum", 0, crc32.Checksum(payload, crc32.MakeTable(crc32.Castagnoli)), 0, payload},
+		{"bad checksum", 4096, crc32.Checksum(payload, crc32.MakeTable(crc32.Castagnoli)) ^ 1, NBD_EIO, make([]byte, 4096)},
+	} {
+		data := make([]byte, 4, 4+len(payload))
+		binary.BigEndian.PutUint32(data, tc.checksum)
+		data = append(data, payload...)
+		if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, tc.offset, uint32(len(payload)), data); err != nil {
+			t.Fatalf("%s: write failed: %v", tc.name, err)
+		} else if rep.NbdError != tc.nbdError {
+			t.Errorf("%s: write returned error %d, expected %d", tc.name, rep.NbdError, tc.nbdError)
+		}
+		if rep, data, err := ni.Command(t, NBD_CMD_READ, 0, tc.offset, uint32(len(payload)), nil); err != nil {
+			t.Fatalf("%s: read failed: %v", tc.name, err)
+		} else if rep.NbdError != 0 || !bytes.Equal(data, tc.expected) {
+			t.Errorf("%s: unexpected data read back", tc.name)
+		}
+	}
+}
+
+func TestColdRead(t *testing.T) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+	filename := path.Join(TempDir, "nbd.img")
+	if err := ioutil.WriteFile(filename, make([]byte, 1024*1024), 0644); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+
+	delay := 200 * time.Millisecond
+	ec := &ExportConfig{
+		Name:   "foo",
+		Driver: "file",
+		DriverParameters: DriverParametersConfig{
+			"path":                filename,
+			"coldreaddelay":       delay.String(),
+			"coldreadblocksize":   "65536",
+			"coldreadwarmonwrite": "true",
+		},
+	}
+	ctx := context.Background()
+	backend, err := openBackend(ctx, ec)
+	if err != nil {
+		t.Fatalf("Could not open backend: %v", err)
+	}
+	defer backend.Close(ctx)
+	if _, ok := backend.(*ColdReadBackend); !ok {
+		t.Fatalf("Backend was not decorated")
+	}
+
+	b := make([]byte, 4096)
+	if _, err := backend.WriteAt(ctx, make([]byte, 65536), 131072, false); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	for _, tc := range []struct {
+		name   string
+		offset int64
+		cold   bool
+	}{
+		{"first read", 0, true},
+		{"second read", 0, false},
+		{"same block", 8192, false},
+		{"next block", 65536, true},
+		{"written block", 131072, false},
+	} {
+		start := time.Now()
+		if _, err := backend.ReadAt(ctx, b, tc.offset); err != nil {
+			t.Fatalf("%s: read failed: %v", tc.name, err)
+		}
+		if cold := time.Since(start) >= delay; cold != tc.cold {
+			t.Errorf("%s: read took %s, expected cold=%v", tc.name, time.Since(start), tc.cold)
+		}
+	}
+}
+
+func TestExportLabels(t *testing.T) {
+	ni := StartNbd(t, TestConfig{Driver: "file"})
+	defer ni.Close()
+
+	// not ParseConfig, as the server is setting the path it reads
+	c, err := parseConfigFile(path.Join(ni.TempDir, "gonbdserver.conf"))
+	if err != nil {
+		t.Fatalf("Could not parse configuration: %v", err)
+	}
+	for _, tc := range []struct {
+		selector string
+		exports  []string
+	}{
+		{"", []string{"foo", "bar"}},
+		{"team=db", []string{"foo"}},
+		{"team=db,tier=gold", []string{"foo"}},
+		{"team=db,tier=silver", []string{}},
+		{"team=web", []string{"bar"}},
+		{"tier=gold", []string{"foo"}},
+	} {
+		selector, err := ParseLabelSelector(tc.selector)
+		if err != nil {
+			t.Errorf("Selector '%s': could not parse: %v", tc.selector, err)
+			continue
+		}
+		names := []string{}
+		for _, e := range c.ExportsMatchingLabels(selector) {
+			names = append(names, e.Name)
+		}
+		if fmt.Sprint(names) != fmt.Sprint(tc.exports) {
+			t.Errorf("Selector '%s': matched %v, expected %v", tc.selector, names, tc.exports)
+		}
+	}
+
+	for _, selector := range []string{"team", "=db", "team=db,team=web", "bad-key=x"} {
+		if _, err := ParseLabelSelector(selector); err == nil {
+			t.Errorf("Selector '%s' parsed, but should not have", selector)
+		}
+	}
+	for _, key := range []string{"", "1team", "te-am", "__reserved"} {
+		if err := validateLabels(&ExportConfig{Name: "foo", Labels: map[string]string{key: "x"}}); err == nil {
+			t.Errorf("Label key '%s' was accepted, but should not have been", key)
+		}
+	}
+}
+
+func TestAcquireBackendOpensOnce(t *testing.T) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+	for _, name := range []string{"slow.img", "other.img"} {
+		if err := ioutil.WriteFile(path.Join(TempDir, name), make([]byte, 64*1024), 0644); err != nil {
+			t.Fatalf("Could not write file: %v", err)
+		}
+	}
+
+	// opens of the slow export wait for the gate, then fail if told to
+	var opens int32
+	var gate chan struct{}
+	var openErr error
+	RegisterBackend("slowopentest", func(ctx context.Context, ec *ExportConfig) (Backend, error) {
+		atomic.AddInt32(&opens, 1)
+		<-gate
+		if openErr != nil {
+			return nil, openErr
+		}
+		return NewFileBackend(ctx, ec)
+	})
+	defer delete(BackendMap, "slowopentest")
+	slow := ExportConfig{Name: "slow", Driver: "slowopentest", DriverParameters: DriverParametersConfig{"path": path.Join(TempDir, "slow.img"), "multiconn": "true"}}
+	other := ExportConfig{Name: "other", Driver: "file", DriverParameters: DriverParametersConfig{"path": path.Join(TempDir, "other.img"), "multiconn": "true"}}
+
+	type acquired struct {
+		backend Backend
+		err     error
+	}
+	ctx := context.Background()
+	for _, fail := range []bool{false, true} {
+		atomic.StoreInt32(&opens, 0)
+		gate = make(chan struct{})
+		openErr = nil
+		if fail {
+			// not to share the backend released above, which closes once its timer fires
+			slow.Name = "failing"
+			openErr = syscall.EIO
+		}
+		results := make(chan acquired, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				backend, err := acquireBackend(ctx, &slow)
+				results <- acquired{backend, err}
+			}()
+		}
+		for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&opens) == 0; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Slow export was not opened")
+			}
+		}
+
+		// another export is not held up by the slow open
+		done := make(chan acquired, 1)
+		go func() {
+			backend, err := acquireBackend(ctx, &other)
+			done <- acquired{backend, err}
+		}()
+		select {
+		case a := <-done:
+			if a.err != nil {
+				t.Fatalf("Cannot acquire other export: %v", a.err)
+			}
+			releaseBackend(ctx, a.backend)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Acquiring other export waited for the slow open")
+		}
+
+		close(gate)
+		first, second := <-results, <-results
+		if fail {
+			if first.err == nil || second.err == nil {
+				t.Errorf("Failed open got errors %v and %v", first.err, second.err)
+			}
+		} else if first.err != nil || second.err != nil || first.backend != second.backend {
+			t.Errorf("Concurrent acquires got %v and %v, errors %v and %v", first.backend, second.backend, first.err, second.err)
+		}
+		if n := atomic.LoadInt32(&opens); n != 1 {
+			t.Errorf("Slow export opened %d times", n)
+		}
+		for _, a := range []acquired{first, second} {
+			if a.err == nil {
+				releaseBackend(ctx, a.backend)
+			}
+		}
+	}
+
+	// a failed open is not remembered
+	openErr = nil
+	if backend, err := acquireBackend(ctx, &slow); err != nil {
+		t.Errorf("Cannot acquire slow export after a failed open: %v", err)
+	} else {
+		releaseBackend(ctx, backend)
+	}
+}
+
+// slowCloseBackend waits for a gate to close before closing
+type slowCloseBackend struct {
+	Backend
+	closing chan struct{} // closed once the close has started
+	gate    chan struct{}
+}
+
+func (scb *slowCloseBackend) Close(ctx context.Context) error {
+	close(scb.closing)
+	<-scb.gate
+	return scb.Backend.Close(ctx)
+}
+
+func TestSlowCloseBackend(t *testing.T) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+	for _, name := range []string{"slow.img", "other.img"} {
+		if err := ioutil.WriteFile(path.Join(TempDir, name), make([]byte, 64*1024), 0644); err != nil {
+			t.Fatalf("Could not write file: %v", err)
+		}
+	}
+
+	var backend *slowCloseBackend
+	RegisterBackend("slowclosetest", func(ctx context.Context, ec *ExportConfig) (Backend, error) {
+		fb, err := NewFileBackend(ctx, ec)
+		if err != nil {
+			return nil, err
+		}
+		backend = &slowCloseBackend{Backend: fb, closing: make(chan struct{}), gate: make(chan struct{})}
+		return backend, nil
+	})
+	defer delete(BackendMap, "slowclosetest")
+	other := ExportConfig{Name: "other", Driver: "file", DriverParameters: DriverParametersConfig{"path": path.Join(TempDir, "other.img"), "multiconn": "true"}}
+
+	ctx := context.Background()
+	for _, params := range []DriverParametersConfig{
+		{"path": path.Join(TempDir, "slow.img")},                           // closed on release
+		{"path": path.Join(TempDir, "slow.img"), "reconnectgrace": "1ms"}, // closed once the grace period expires
+	} {
+		slow := ExportConfig{Name: "slow", Driver: "slowclosetest", DriverParameters: params}
+		b, err := acquireBackend(ctx, &slow)
+		if err != nil {
+			t.Fatalf("Cannot acquire slow export: %v", err)
+		}
+		go releaseBackend(ctx, b)
+		select {
+		case <-backend.closing:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Slow export was not closed")
+		}
+
+		// another export is not held up by the slow close
+		done := make(chan error, 1)
+		go func() {
+			b, err := acquireBackend(ctx, &other)
+			if err == nil {
+				err = releaseBackend(ctx, b)
+			}
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Cannot acquire other export: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Acquiring other export waited for the slow close")
+		}
+		close(backend.gate)
+	}
+}
+
+func TestReconnectSharesBackend(t *testing.T) {
+	ni := ConnectAndGo(t, TestConfig{ReconnectGrace: "500ms"}, 1024*1024)
+	defer ni.Close()
+
+	sharedEntry := func() *sharedBackendEntry {
+		sharedBackendsMutex.Lock()
+		defer sharedBackendsMutex.Unlock()
+		for _, e := range sharedBackends {
+			if strings.Contains(e.key, ni.TempDir) {
+				return e
+			}
+		}
+		return nil
+	}
+	first := sharedEntry()
+	if first == nil {
+		t.Fatalf("Backend was not shared")
+	}
+
+	// drop the connection abruptly, then reconnect within the grace period
+	ni.conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	if err := ni.Connect(t); err != nil {
+		t.Fatalf("Error on reconnect: %v", err)
+	}
+	if err := ni.Go(t); err != nil {
+		t.Fatalf("Error on go: %v", err)
+	}
+	if e := sharedEntry(); e != first {
+		t.Errorf("Reconnection did not reuse the backend")
+	}
+	if rep, _, err := ni.Command(t, NBD_CMD_READ, 0, 0, 4096, nil); err != nil || rep.NbdError != 0 {
+		t.Errorf("Read after reconnection failed")
+	}
+
+	// once the grace period has expired with no connection, the backend is closed
+	ni.conn.Close()
+	time.Sleep(time.Second)
+	if sharedEntry() != nil {
+		t.Errorf("Backend was not closed after the grace period")
+	}
+}
+
+func TestReadCacheReconnect(t *testing.T) {
+	counter := func(name string) int64 {
+		if v := exportExpvar("foo").Get(name); v != nil {
+			return v.(*expvar.Int).Value()
+		}
+		return 0
+	}
+	for _, writeThrough := range []bool{false, true} {
+		ni := StartNbd(t, TestConfig{Driver: "file", ReconnectGrace: "500ms", ReadCacheSize: "1048576", ReadCacheWriteThrough: writeThrough})
+		data := make([]byte, 1024*1024)
+		for i := range data {
+			data[i] = byte(i % 253)
+		}
+		if err := ioutil.WriteFile(path.Join(ni.TempDir, "nbd.img"), data, 0644); err != nil {
+			ni.Close()
+			t.Fatalf("Could not write file: %v", err)
+		}
+		if err := ni.Connect(t); err != nil {
+			ni.Close()
+			t.Fatalf("Error on connect: %v", err)
+		}
+		if err := ni.Go(t); err != nil {
+			ni.Close()
+			t.Fatalf("Error on go: %v", err)
+		}
+		// 256K from 4K in spans five 64K blocks, each missed once. As the
+		// read is split into several, the blocks may be hit as well
+		misses := counter("read_cache_misses")
+		if rep, got, err := ni.Command(t, NBD_CMD_READ, 0, 4096, 256*1024, nil); err != nil || rep.NbdError != 0 || !bytes.Equal(got, data[4096:4096+256*1024]) {
+			t.Fatalf("writethrough=%v: read failed or did not match: %v %v", writeThrough, rep, err)
+		}
+		if m := counter("read_cache_misses") - misses; m != 5 {
+			t.Errorf("writethrough=%v: first read had %d misses, expected 5", writeThrough, m)
+		}
+
+		// drop the connection, and reconnect within the grace period
+		ni.conn.Close()
+		time.Sleep(100 * time.Millisecond)
+		if err := ni.Connect(t); err != nil {
+			ni.Close()
+			t.Fatalf("Error on reconnect: %v", err)
+		}
+		if err := ni.Go(t); err != nil {
+			ni.Close()
+			t.Fatalf("Error on go: %v", err)
+		}
+		hits, misses := counter("read_cache_hits"), counter("read_cache_misses")
+		if rep, got, err := ni.Command(t, NBD_CMD_READ, 0, 64*1024, 128*1024, nil); err != nil || rep.NbdError != 0 || !bytes.Equal(got, data[64*1024:192*1024]) {
+			t.Fatalf("writethrough=%v: read after reconnecting failed or did not match: %v %v", writeThrough, rep, err)
+		}
+		if h, m := counter("read_cache_hits")-hits, counter("read_cache_misses")-misses; h == 0 || m != 0 {
+			t.Errorf("writethrough=%v: read after reconnecting had %d hits and %d misses, expected only hits", writeThrough, h, m)
+		}
+
+		// writes are seen by later reads, from the cache only if write-through
+		written := bytes.Repeat([]byte{0xaa}, 4096)
+		copy(data[65536+4096:], written)
+		if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 65536+4096, 4096, written); err != nil || rep.NbdError != 0 {
+			t.Fatalf("writethrough=%v: write failed: %v %v", writeThrough, rep, err)
+		}
+		misses = counter("read_cache_misses")
+		if rep, got, err := ni.Command(t, NBD_CMD_READ, 0, 65536, 65536, nil); err != nil || rep.NbdError != 0 || !bytes.Equal(got, data[65536:131072]) {
+			t.Errorf("writethrough=%v: read after write failed or did not match: %v %v", writeThrough, rep, err)
+		}
+		if m := counter("read_cache_misses") - misses; (m == 0) != writeThrough {
+			t.Errorf("writethrough=%v: read after write had %d misses", writeThrough, m)
+		}
+		ni.Close()
+	}
+}
+
+func TestIoPrio(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("I/O priorities are only supported on Linux")
+	}
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+	filename := path.Join(TempDir, "nbd.img")
+	if err := ioutil.WriteFile(filename, make([]byte, 1024*1024), 0644); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+
+	ec := &ExportConfig{
+		Name:             "foo",
+		Driver:           "file",
+		IoPrio:           IoPrioConfig{Class: "best-effort", Level: 7},
+		DriverParameters: DriverParametersConfig{"path": filename},
+	}
+	var out bytes.Buffer
+	if !SelfTest(context.Background(), &out, ec) {
+		t.Errorf("Self test with I/O priority failed:\n%s", out.String())
+	}
+
+	ec.IoPrio = IoPrioConfig{Class: "bogus"}
+	if _, err := openBackend(context.Background(), ec); err == nil {
+		t.Errorf("Unknown I/O priority class was accepted")
+	}
+}
+
+func TestInfoName(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		export       string
+		infoElements []uint16
+		infos        map[uint16]string
+	}{
+		{"default export", "", []uint16{NBD_INFO_NAME, NBD_INFO_DESCRIPTION, NBD_INFO_BLOCK_SIZE}, map[uint16]string{NBD_INFO_NAME: "foo", NBD_INFO_DESCRIPTION: "Test export"}},
+		{"name only", "", []uint16{NBD_INFO_NAME}, map[uint16]string{NBD_INFO_NAME: "foo"}},
+		{"not requested", "foo", []uint16{NBD_INFO_BLOCK_SIZE}, map[uint16]string{}},
+	} {
+		ni := StartNbd(t, TestConfig{Driver: "file"})
+		if err := ni.CreateFile(t, 1024*1024); err != nil {
+			ni.Close()
+			t.Fatalf("Error on create file: %v", err)
+		}
+		if err := ni.Connect(t); err != nil {
+			ni.Close()
+			t.Fatalf("%s: error on connect: %v", tc.name, err)
+		}
+		infos, err := ni.GoWithInfo(t, tc.export, tc.infoElements)
+		if err != nil {
+			ni.Close()
+			t.Fatalf("%s: error on go: %v", tc.name, err)
+		}
+		for _, infoType := range []uint16{NBD_INFO_NAME, NBD_INFO_DESCRIPTION} {
+			expected, ok := tc.infos[infoType]
+			if got, received := infos[infoType]; received != ok || string(got) != expected {
+				t.Errorf("%s: info type %d was %q (received=%v), expected %q (received=%v)", tc.name, infoType, got, received, expected, ok)
+			}
+		}
+		ni.Close()
+	}
+}
+
+func TestInfoRequests(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		infoElements []uint16
+		expected     []uint16
+	}{
+		{"block size only", []uint16{NBD_INFO_BLOCK_SIZE}, []uint16{NBD_INFO_EXPORT, NBD_INFO_BLOCK_SIZE}},
+		{"none", []uint16{}, []uint16{NBD_INFO_EXPORT, NBD_INFO_BLOCK_SIZE}},
+		{"ordered", []uint16{NBD_INFO_DESCRIPTION, NBD_INFO_NAME, NBD_INFO_BLOCK_SIZE}, []uint16{NBD_INFO_EXPORT, NBD_INFO_DESCRIPTION, NBD_INFO_NAME, NBD_INFO_BLOCK_SIZE}},
+		{"unsupported and repeated", []uint16{NBD_INFO_BLOCK_SIZE, 0x7fff, NBD_INFO_EXPORT, NBD_INFO_NAME, NBD_INFO_BLOCK_SIZE, NBD_INFO_NAME}, []uint16{NBD_INFO_EXPORT, NBD_INFO_BLOCK_SIZE, NBD_INFO_NAME}},
+	} {
+		ni := StartNbd(t, TestConfig{Driver: "file"})
+		if err := ni.CreateFile(t, 1024*1024); err != nil {
+			ni.Close()
+			t.Fatalf("Error on create file: %v", err)
+		}
+		if err := ni.Connect(t); err != nil {
+			ni.Close()
+			t.Fatalf("%s: error on connect: %v", tc.name, err)
+		}
+		if _, err := ni.GoWithInfo(t, "foo", tc.infoElements); err != nil {
+			ni.Close()
+			t.Fatalf("%s: error on go: %v", tc.name, err)
+		}
+		if fmt.Sprint(ni.infoOrder) != fmt.Sprint(tc.expected) {
+			t.Errorf("%s: received info types %v, expected %v", tc.name, ni.infoOrder, tc.expected)
+		}
+		ni.Close()
+	}
+}
+
+func TestOversizedPayload(t *testing.T) {
+	ni := ConnectAndGo(t, TestConfig{MaxPayload: "65536"}, 1024*1024)
+	defer ni.Close()
+
+	payload := make([]byte, 131072)
+	for i := range payload {
+		payload[i] = 0xff
+	}
+	for _, tc := range []struct {
+		name    string
+		cmdType uint16
+		length  uint32
+		data    []byte
+		error   uint32
+	}{
+		{"oversized write", NBD_CMD_WRITE, 131072, payload, NBD_EOVERFLOW},
+		{"oversized read", NBD_CMD_READ, 131072, nil, NBD_EOVERFLOW},
+		{"write zeroes beyond limit", NBD_CMD_WRITE_ZEROES, 131072, nil, 0}, // no payload, so no limit
+		{"write at limit", NBD_CMD_WRITE, 65536, make([]byte, 65536), 0},
+		{"read at limit", NBD_CMD_READ, 65536, nil, 0},
+	} {
+		rep, _, err := ni.Command(t, tc.cmdType, 0, 0, tc.length, tc.data)
+		if err != nil {
+			t.Fatalf("%s: command failed: %v", tc.name, err)
+		}
+		if rep.NbdError != tc.error {
+			t.Errorf("%s: returned error %d, expected %d", tc.name, rep.NbdError, tc.error)
+		}
+	}
+
+	// the rejected write must not have reached the backend
+	if _, data, err := ni.Command(t, NBD_CMD_READ, 0, 65536, 65536, nil); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	} else if !bytes.Equal(data, make([]byte, 65536)) {
+		t.Errorf("Oversized write reached the backend")
+	}
+}
+
+func TestLazyOpen(t *testing.T) {
+	ni := StartNbd(t, TestConfig{Driver: "file", LazySize: "1048576"})
+	defer ni.Close()
+
+	// the file does not exist yet, so negotiation can only succeed if the backend is not opened
+	if err := ni.Connect(t); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	if err := ni.Go(t); err != nil {
+		t.Fatalf("Error on go: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 0, 4096, make([]byte, 4096)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		} else if rep.NbdError != NBD_EIO {
+			t.Errorf("Write without backend returned error %d, expected %d", rep.NbdError, NBD_EIO)
+		}
+	}
+	ni.conn.Close()
+
+	if err := ni.CreateFile(t, 1048576); err != nil {
+		t.Fatalf("Error on create file: %v", err)
+	}
+	if err := ni.Connect(t); err != nil {
+		t.Fatalf("Error on reconnect: %v", err)
+	}
+	if err := ni.Go(t); err != nil {
+		t.Fatalf("Error on go: %v", err)
+	}
+	if rep, _, err := ni.Command(t, NBD_CMD_READ, 0, 0, 4096, nil); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	} else if rep.NbdError != 0 {
+		t.Errorf("Read once file exists returned error %d", rep.NbdError)
+	}
+}
+
+func TestBlockSizeRequired(t *testing.T) {
+	ni := StartNbd(t, TestConfig{Driver: "file", MinimumBlockSize: "4096"})
+	defer ni.Close()
+	if err := ni.CreateFile(t, 1024*1024); err != nil {
+		t.Fatalf("Error on create file: %v", err)
+	}
+	if err := ni.Connect(t); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+
+	// a client not asking for block size constraints is refused...
+	if _, err := ni.GoWithInfo(t, "foo", nil); err != optReplyError(NBD_REP_ERR_BLOCK_SIZE_REQD) {
+		t.Fatalf("Go without block size returned %v, expected NBD_REP_ERR_BLOCK_SIZE_REQD", err)
+	}
+
+	// ...but may retry on the same connection asking for them
+	infos, err := ni.GoWithInfo(t, "foo", []uint16{NBD_INFO_BLOCK_SIZE})
+	if err != nil {
+		t.Fatalf("Go with block size failed: %v", err)
+	}
+	if bs := infos[NBD_INFO_BLOCK_SIZE]; len(bs) != 12 || binary.BigEndian.Uint32(bs) != 4096 {
+		t.Errorf("Bad block size info %v", bs)
+	}
+	if rep, _, err := ni.Command(t, NBD_CMD_READ, 0, 0, 4096, nil); err != nil || rep.NbdError != 0 {
+		t.Errorf("Read after go failed")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	ec := &ExportConfig{
+		Name:             "dedup",
+		DriverParameters: DriverParametersConfig{"path": dir, "size": "1048576"},
+	}
+	storedBlocks := func() int {
+		n := 0
+		filepath.Walk(path.Join(dir, "blocks"), func(p string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				n++
+			}
+			return nil
+		})
+		return n
+	}
+
+	backend, err := NewDedupBackend(ctx, ec)
+	if err != nil {
+		t.Fatalf("Could not open dedup backend: %v", err)
+	}
+	if _, err := NewDedupBackend(ctx, ec); err == nil {
+		t.Errorf("Dedup store opened twice")
+	}
+	a := bytes.Repeat([]byte{0xaa}, DefaultDedupBlockSize)
+	b := bytes.Repeat([]byte{0xbb}, DefaultDedupBlockSize)
+	for i, data := range [][]byte{a, a, b, a, make([]byte, DefaultDedupBlockSize)} {
+		if _, err := backend.WriteAt(ctx, data, int64(i*DefaultDedupBlockSize), false); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	// partial writes making block 3 a copy of block 2
+	if _, err := backend.WriteAt(ctx, b[:100], 3*DefaultDedupBlockSize, false); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := backend.WriteAt(ctx, b[100:], 3*DefaultDedupBlockSize+100, false); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := backend.Flush(ctx); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if n := storedBlocks(); n != 2 {
+		t.Errorf("%d blocks stored, expected 2", n)
+	}
+
+	// an overwrite and a trim leave block a unreferenced
+	if _, err := backend.WriteAt(ctx, b, 0, true); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := backend.TrimAt(ctx, DefaultDedupBlockSize, DefaultDedupBlockSize); err != nil {
+		t.Fatalf("Trim failed: %v", err)
+	}
+	if err := backend.Close(ctx); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if n := storedBlocks(); n != 1 {
+		t.Errorf("%d blocks stored after garbage collection, expected 1", n)
+	}
+
+	// the map persists
+	backend, err = NewDedupBackend(ctx, ec)
+	if err != nil {
+		t.Fatalf("Could not reopen dedup backend: %v", err)
+	}
+	defer backend.Close(ctx)
+	expected := bytes.Join([][]byte{b, make([]byte, DefaultDedupBlockSize), b, b, make([]byte, DefaultDedupBlockSize)}, nil)
+	data := make([]byte, len(expected))
+	if _, err := backend.ReadAt(ctx, data, 0); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Data read back after reopen did not match")
+	}
+}
+
+func TestFileTruncated(t *testing.T) {
+	ni := ConnectAndGo(t, TestConfig{}, 1024*1024)
+	defer ni.Close()
+
+	if rep, _, err := ni.Command(t, NBD_CMD_READ, 0, 0, 4096, nil); err != nil || rep.NbdError != 0 {
+		t.Fatalf("Read before truncation failed")
+	}
+	if err := os.Truncate(path.Join(ni.TempDir, "nbd.img"), 0); err != nil {
+		t.Fatalf("Could not truncate file: %v", err)
+	}
+	// the read is beyond the end of the file, so would otherwise return zeroes
+	if rep, _, err := ni.Command(t, NBD_CMD_READ, 0, 65536, 4096, nil); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	} else if rep.NbdError != NBD_EIO {
+		t.Fatalf("Read after truncation returned error %d, expected %d", rep.NbdError, NBD_EIO)
+	}
+	// the read reply carries (zeroed) data despite the error
+	if _, err := io.ReadFull(ni.conn, make([]byte, 4096)); err != nil {
+		t.Fatalf("Could not read reply data: %v", err)
+	}
+	// later commands fail too, rather than extending the file
+	if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 0, 4096, make([]byte, 4096)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	} else if rep.NbdError != NBD_EIO {
+		t.Errorf("Write after truncation returned error %d, expected %d", rep.NbdError, NBD_EIO)
+	}
+}
+
+func TestFileTruncatedClose(t *testing.T) {
+	ni := ConnectAndGo(t, TestConfig{OnFileFailure: "close"}, 1024*1024)
+	defer ni.Close()
+
+	if err := os.Truncate(path.Join(ni.TempDir, "nbd.img"), 0); err != nil {
+		t.Fatalf("Could not truncate file: %v", err)
+	}
+	ni.Command(t, NBD_CMD_READ, 0, 65536, 4096, nil)
+	if _, _, err := ni.Command(t, NBD_CMD_FLUSH, 0, 0, 0, nil); err == nil {
+		t.Errorf("Connection was not closed when file was truncated")
+	}
+}
+
+// StartStripe starts a server with an nbdstripe export over four upstream
+// exports of 512KiB on the same server, and connects to it
+func StartStripe(t *testing.T, replicas string) *NbdInstance {
+	ni := StartNbd(t, TestConfig{Driver: "file", StripeReplicas: replicas, Upstreams: []int{0, 1, 2, 3}})
+	for _, i := range ni.Upstreams {
+		if err := ioutil.WriteFile(path.Join(ni.TempDir, fmt.Sprintf("up%d.img", i)), make([]byte, 512*1024), 0644); err != nil {
+			ni.Close()
+			t.Fatalf("Could not create upstream file: %v", err)
+		}
+	}
+	if err := ni.Connect(t); err != nil {
+		ni.Close()
+		t.Fatalf("Error on connect: %v", err)
+	}
+	if _, err := ni.GoWithInfo(t, "stripe", []uint16{NBD_INFO_BLOCK_SIZE}); err != nil {
+		ni.Close()
+		t.Fatalf("Error on go: %v", err)
+	}
+	return ni
+}
+
+func TestStripe(t *testing.T) {
+	ni := StartStripe(t, "1")
+	defer ni.Close()
+
+	data := make([]byte, 256*1024+4096)
+	rand.Read(data)
+	// unaligned, so the first and last chunks are partial
+	if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 61440, uint32(len(data)), data); err != nil || rep.NbdError != 0 {
+		t.Fatalf("Write failed")
+	}
+	if _, readData, err := ni.Command(t, NBD_CMD_READ, 0, 61440, uint32(len(data)), nil); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	} else if !bytes.Equal(readData, data) {
+		t.Errorf("Data read back did not match")
+	}
+
+	// each upstream holds every fourth chunk
+	logical := make([]byte, 61440+len(data))
+	copy(logical[61440:], data)
+	for chunk := 0; chunk*65536 < len(logical); chunk++ {
+		up, err := ioutil.ReadFile(path.Join(ni.TempDir, fmt.Sprintf("up%d.img", chunk%4)))
+		if err != nil {
+			t.Fatalf("Could not read upstream file: %v", err)
+		}
+		end := (chunk + 1) * 65536
+		if end > len(logical) {
+			end = len(logical)
+		}
+		offset := (chunk / 4) * 65536
+		if !bytes.Equal(up[offset:offset+end-chunk*65536], logical[chunk*65536:end]) {
+			t.Errorf("Chunk %d is not on upstream %d", chunk, chunk%4)
+		}
+	}
+}
+
+func TestStripeReplicaFailure(t *testing.T) {
+	ni := StartStripe(t, "2")
+	defer ni.Close()
+
+	data := make([]byte, 131072)
+	rand.Read(data)
+	if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 0, uint32(len(data)), data); err != nil || rep.NbdError != 0 {
+		t.Fatalf("Write failed")
+	}
+	// the first replica of the first member fails, so its reads are served by the second
+	if err := os.Truncate(path.Join(ni.TempDir, "up0.img"), 0); err != nil {
+		t.Fatalf("Could not truncate upstream file: %v", err)
+	}
+	if rep, readData, err := ni.Command(t, NBD_CMD_READ, 0, 0, uint32(len(data)), nil); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	} else if rep.NbdError != 0 {
+		t.Errorf("Read with a failed replica returned error %d", rep.NbdError)
+	} else if !bytes.Equal(readData, data) {
+		t.Errorf("Data read back did not match")
+	}
+}
+
+// faultyBackend is a file backend for testing which fails I/O to the block at badoffset
+type faultyBackend struct {
+	Backend
+	badOffset int64
+}
+
+func (fb *faultyBackend) bad(length int, offset int64) bool {
+	return offset <= fb.badOffset && offset+int64(length) > fb.badOffset
+}
+
+func (fb *faultyBackend) ReadAt(ctx context.Context, b []byte, offset int64) (int, error) {
+	if fb.bad(len(b), offset) {
+		return 0, syscall.EIO
+	}
+	return fb.Backend.ReadAt(ctx, b, offset)
+}
+
+func (fb *faultyBackend) WriteAt(ctx context.Context, b []byte, offset int64, fua bool) (int, error) {
+	if fb.bad(len(b), offset) {
+		return 0, syscall.EIO
+	}
+	return fb.Backend.WriteAt(ctx, b, offset, fua)
+}
+
+func init() {
+	RegisterBackend("faulty", func(ctx context.Context, ec *ExportConfig) (Backend, error) {
+		backend, err := NewFileBackend(ctx, ec)
+		if err != nil {
+			return nil, err
+		}
+		badOffset, _ := strconv.ParseInt(ec.DriverParameters["badoffset"], 10, 64)
+		return &faultyBackend{Backend: backend, badOffset: badOffset}, nil
+	})
+}
+
+func TestOnErrorReply(t *testing.T) {
+	ni := ConnectAndGo(t, TestConfig{Driver: "faulty", OnError: "reply"}, 1024*1024)
+	defer ni.Close()
+
+	if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 65536, 4096, make([]byte, 4096)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	} else if rep.NbdError != NBD_EIO {
+		t.Errorf("Write to bad block returned error %d, expected %d", rep.NbdError, NBD_EIO)
+	}
+	// the connection keeps serving
+	if rep, _, err := ni.Command(t, NBD_CMD_READ, 0, 0, 4096, nil); err != nil || rep.NbdError != 0 {
+		t.Errorf("Read after error failed")
+	}
+}
+
+func TestOnErrorDisconnect(t *testing.T) {
+	ni := ConnectAndGo(t, TestConfig{Driver: "faulty", OnError: "disconnect"}, 1024*1024)
+	defer ni.Close()
+
+	if rep, _, err := ni.Command(t, NBD_CMD_READ, 0, 0, 4096, nil); err != nil || rep.NbdError != 0 {
+		t.Fatalf("Read of good block failed")
+	}
+	ni.Command(t, NBD_CMD_WRITE, 0, 65536, 4096, make([]byte, 4096))
+	if _, _, err := ni.Command(t, NBD_CMD_READ, 0, 0, 4096, nil); err == nil {
+		t.Errorf("Connection was not closed on backend error")
+	}
+}
+
+// StartFailover starts a server with a faulty primary backend and a file
+// standby backend filled with 0xff, and connects to it
+func StartFailover(t *testing.T, mode string) *NbdInstance {
+	ni := StartNbd(t, TestConfig{Driver: "faulty", Failover: mode})
+	if err := ni.CreateFile(t, 1024*1024); err != nil {
+		ni.Close()
+		t.Fatalf("Error on create file: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(ni.TempDir, "standby.img"), bytes.Repeat([]byte{0xff}, 1024*1024), 0644); err != nil {
+		ni.Close()
+		t.Fatalf("Could not create standby file: %v", err)
+	}
+	if err := ni.Connect(t); err != nil {
+		ni.Close()
+		t.Fatalf("Error on connect: %v", err)
+	}
+	if err := ni.Go(t); err != nil {
+		ni.Close()
+		t.Fatalf("Error on go: %v", err)
+	}
+	return ni
+}
+
+// FirstByte reads the first byte of the block at offset
+func (ni *NbdInstance) FirstByte(t *testing.T, offset uint64) byte {
+	rep, data, err := ni.Command(t, NBD_CMD_READ, 0, offset, 4096, nil)
+	if err != nil || rep.NbdError != 0 {
+		t.Fatalf("Read failed")
+	}
+	return data[0]
+}
+
+func TestFailover(t *testing.T) {
+	ni := StartFailover(t, "auto")
+	defer ni.Close()
+
+	if b := ni.FirstByte(t, 0); b != 0 {
+		t.Fatalf("Read was not served by primary")
+	}
+	// the primary fails, so the read is retried on the standby...
+	if b := ni.FirstByte(t, 65536); b != 0xff {
+		t.Errorf("Read of bad block was not served by standby")
+	}
+	// ...which serves later commands
+	if b := ni.FirstByte(t, 0); b != 0xff {
+		t.Errorf("Read after failover was not served by standby")
+	}
+}
+
+func TestFailoverManual(t *testing.T) {
+	ni := StartFailover(t, "manual")
+	defer ni.Close()
+
+	if rep, _, err := ni.Command(t, NBD_CMD_READ, 0, 65536, 4096, nil); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	} else if rep.NbdError != NBD_EIO {
+		t.Fatalf("Read of bad block returned error %d, expected %d", rep.NbdError, NBD_EIO)
+	}
+	if _, err := io.ReadFull(ni.conn, make([]byte, 4096)); err != nil {
+		t.Fatalf("Could not read reply data: %v", err)
+	}
+	if b := ni.FirstByte(t, 0); b != 0 {
+		t.Errorf("Failed over without confirmation")
+	}
+	ConfirmFailovers()
+	if b := ni.FirstByte(t, 0); b != 0xff {
+		t.Errorf("Did not fail over on confirmation")
+	}
+}
+
+// Option sends an option with the given payload, and returns the type of the
+// final reply, skipping any others
+func (ni *NbdInstance) Option(t *testing.T, optId uint32, payload []byte) (uint32, error) {
+	replyType, _, err := ni.OptionReply(t, optId, payload)
+	return replyType, err
+}
+
+// OptionReply sends an option with the given payload, and returns the type and
+// payload of the final reply, skipping any others
+func (ni *NbdInstance) OptionReply(t *testing.T, optId uint32, payload []byte) (uint32, []byte, error) {
+	opt := nbdClientOpt{
+		NbdOptMagic: NBD_OPTS_MAGIC,
+		NbdOptId:    optId,
+		NbdOptLen:   uint32(len(payload)),
+	}
+	if err := binary.Write(ni.conn, binary.BigEndian, opt); err != nil {
+		return 0, nil, fmt.Errorf("Could not send option")
+	}
+	if _, err := ni.conn.Write(payload); err != nil {
+		return 0, nil, fmt.Errorf("Could not send option payload")
+	}
+	for {
+		var or nbdOptReply
+		if err := binary.Read(ni.conn, binary.BigEndian, &or); err != nil {
+			return 0, nil, fmt.Errorf("Could not receive option reply")
+		}
+		if or.NbdOptReplyMagic != NBD_REP_MAGIC || or.NbdOptId != optId {
+			return 0, nil, fmt.Errorf("Bad option reply")
+		}
+		data := make([]byte, or.NbdOptReplyLength)
+		if _, err := io.ReadFull(ni.conn, data); err != nil {
+			return 0, nil, fmt.Errorf("Could not receive option reply payload")
+		}
+		if or.NbdOptReplyType == NBD_REP_ACK || or.NbdOptReplyType&NBD_REP_FLAG_ERROR != 0 {
+			return or.NbdOptReplyType, data, nil
+		}
+	}
+}
+
+// metaContextPayload builds the payload of a meta context option
+func metaContextPayload(export string, numQueries uint32, queries ...string) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint32(len(export)))
+	b.WriteString(export)
+	binary.Write(&b, binary.BigEndian, numQueries)
+	for _, q := range queries {
+		binary.Write(&b, binary.BigEndian, uint32(len(q)))
+		b.WriteString(q)
+	}
+	return b.Bytes()
+}
+
+// metaContexts sends a meta context option, and returns the names of the
+// contexts replied with and the type of the final reply
+func (ni *NbdInstance) metaContexts(t *testing.T, optId uint32, payload []byte) ([]string, uint32, error) {
+	opt := nbdClientOpt{
+		NbdOptMagic: NBD_OPTS_MAGIC,
+		NbdOptId:    optId,
+		NbdOptLen:   uint32(len(payload)),
+	}
+	if err := binary.Write(ni.conn, binary.BigEndian, opt); err != nil {
+		return nil, 0, fmt.Errorf("Could not send option")
+	}
+	if _, err := ni.conn.Write(payload); err != nil {
+		return nil, 0, fmt.Errorf("Could not send option payload")
+	}
+	var contexts []string
+	for {
+		var or nbdOptReply
+		if err := binary.Read(ni.conn, binary.BigEndian, &or); err != nil {
+			return nil, 0, fmt.Errorf("Could not receive option reply")
+		}
+		data := make([]byte, or.NbdOptReplyLength)
+		if _, err := io.ReadFull(ni.conn, data); err != nil {
+			return nil, 0, fmt.Errorf("Could not receive option reply payload")
+		}
+		if or.NbdOptReplyType != NBD_REP_META_CONTEXT {
+			return contexts, or.NbdOptReplyType, nil
+		}
+		if len(data) < 4 {
+			return nil, 0, fmt.Errorf("Meta context reply too short")
+		}
+		contexts = append(contexts, fmt.Sprintf("%d:%s", binary.BigEndian.Uint32(data), data[4:]))
+	}
+}
+
+func TestMetaContextBounds(t *testing.T) {
+	ni := StartNbd(t, TestConfig{Driver: "file"})
+	defer ni.Close()
+	if err := ni.CreateFile(t, 1024*1024); err != nil {
+		t.Fatalf("Error on create file: %v", err)
+	}
+	if err := ni.Connect(t); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		payload   []byte
+		replyType uint32
+	}{
+		{"valid", metaContextPayload("foo", 1, "base:"), NBD_REP_ACK},
+		{"default export", metaContextPayload("", 0), NBD_REP_ACK},
+		{"unknown export", metaContextPayload("nosuch", 0), NBD_REP_ERR_UNKNOWN},
+		{"trailing bytes", append(metaContextPayload("foo", 1, "base:"), 1, 2, 3), NBD_REP_ERR_INVALID},
+		{"fewer queries than declared", metaContextPayload("foo", 2, "base:"), NBD_REP_ERR_INVALID},
+		{"query overruns option", metaContextPayload("foo", 1, "base:")[:14], NBD_REP_ERR_INVALID},
+		{"too many queries", metaContextPayload("foo", 100000), NBD_REP_ERR_INVALID},
+		{"truncated", []byte{0, 0}, NBD_REP_ERR_INVALID},
+	} {
+		replyType, err := ni.Option(t, NBD_OPT_LIST_META_CONTEXT, tc.payload)
+		if err != nil {
+			t.Fatalf("%s: option failed: %v", tc.name, err)
+		}
+		if replyType != tc.replyType {
+			t.Errorf("%s: reply type %x, expected %x", tc.name, replyType, tc.replyType)
+		}
+	}
+
+	// negotiation carries on after rejected options
+	if err := ni.Go(t); err != nil {
+		t.Fatalf("Error on go: %v", err)
+	}
+}
+
+func TestEphemeralOverlay(t *testing.T) {
+	ni := StartNbd(t, TestConfig{Driver: "file", EphemeralOverlay: true})
+	defer ni.Close()
+	base := make([]byte, 1024*1024)
+	for i := range base {
+		base[i] = byte(i % 251)
+	}
+	filename := path.Join(ni.TempDir, "nbd.img")
+	if err := ioutil.WriteFile(filename, base, 0644); err != nil {
+		t.Fatalf("Error writing base: %v", err)
+	}
+
+	for pass := 0; pass < 2; pass++ {
+		if err := ni.Connect(t); err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		if err := ni.Go(t); err != nil {
+			t.Fatalf("Error on go: %v", err)
+		}
+		// the overlay of the previous connection has been discarded
+		if _, data, err := ni.Command(t, NBD_CMD_READ, 0, 0, 12288, nil); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		} else if !bytes.Equal(data, base[:12288]) {
+			t.Fatalf("Pass %d read does not match base", pass)
+		}
+
+		// a write straddling two blocks must preserve the rest of each
+		patch := bytes.Repeat([]byte{0xff}, 100)
+		if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 8150, uint32(len(patch)), patch); err != nil || rep.NbdError != 0 {
+			t.Fatalf("Write failed")
+		}
+		expected := append([]byte(nil), base[:12288]...)
+		copy(expected[8150:], patch)
+		if _, data, err := ni.Command(t, NBD_CMD_READ, 0, 0, 12288, nil); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		} else if !bytes.Equal(data, expected) {
+			t.Errorf("Pass %d read after write does not include the write", pass)
+		}
+		if rep, _, err := ni.Command(t, NBD_CMD_FLUSH, 0, 0, 0, nil); err != nil || rep.NbdError != 0 {
+			t.Fatalf("Flush failed")
+		}
+		ni.conn.Close()
+
+		if contents, err := ioutil.ReadFile(filename); err != nil {
+			t.Fatalf("Error reading base: %v", err)
+		} else if !bytes.Equal(contents, base) {
+			t.Fatalf("Base was modified")
+		}
+	}
+}
+
+// goPayload builds the payload of an NBD_OPT_GO option requesting no info
+func goPayload(export string) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint32(len(export)))
+	b.WriteString(export)
+	binary.Write(&b, binary.BigEndian, uint16(0))
+	return b.Bytes()
+}
+
+func TestOptionErrorMessages(t *testing.T) {
+	ni := StartNbd(t, TestConfig{Driver: "file", MinimumBlockSize: "4096"})
+	defer ni.Close()
+	if err := ni.CreateFile(t, 1024*1024); err != nil {
+		t.Fatalf("Error on create file: %v", err)
+	}
+	if err := ni.Connect(t); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		optId     uint32
+		payload   []byte
+		replyType uint32
+		message   string
+	}{
+		{"unknown export", NBD_OPT_GO, goPayload("nosuch"), NBD_REP_ERR_UNKNOWN, "Export 'nosuch' not found"},
+		{"block size required", NBD_OPT_GO, goPayload("foo"), NBD_REP_ERR_BLOCK_SIZE_REQD, "Export 'foo' has a minimum block size of 4096, so NBD_INFO_BLOCK_SIZE must be requested"},
+		{"no TLS", NBD_OPT_STARTTLS, nil, NBD_REP_ERR_UNSUP, "TLS is not configured on this server"},
+		{"unsupported option", 999, []byte{1, 2, 3}, NBD_REP_ERR_UNSUP, "Option 999 is not supported"},
+		{"bad meta context", NBD_OPT_LIST_META_CONTEXT, []byte{0, 0}, NBD_REP_ERR_INVALID, ""},
+	} {
+		replyType, message, err := ni.OptionReply(t, tc.optId, tc.payload)
+		if err != nil {
+			t.Fatalf("%s: option failed: %v", tc.name, err)
+		}
+		if replyType != tc.replyType {
+			t.Errorf("%s: reply type %x, expected %x", tc.name, replyType, tc.replyType)
+		}
+		if tc.message != "" && string(message) != tc.message {
+			t.Errorf("%s: message '%s', expected '%s'", tc.name, message, tc.message)
+		} else if len(message) == 0 {
+			t.Errorf("%s: error reply has no message", tc.name)
+		}
+	}
+}
+
+func TestOpenFailure(t *testing.T) {
+	for _, tc := range []struct {
+		onOpenFailure string
+		verbose       bool
+		replyType     uint32
+		message       string
+	}{
+		{"", false, NBD_REP_ERR_UNKNOWN, "Export 'foo' is unavailable"},
+		{"policy", false, NBD_REP_ERR_POLICY, "Export 'foo' is unavailable"},
+		{"", true, NBD_REP_ERR_UNKNOWN, "Export 'foo' is unavailable: open "},
+	} {
+		// the export's file is never created, so its backend cannot be opened
+		ni := StartNbd(t, TestConfig{Driver: "file", OnOpenFailure: tc.onOpenFailure, VerboseErrors: tc.verbose})
+		if err := ni.Connect(t); err != nil {
+			ni.Close()
+			t.Fatalf("Error on connect: %v", err)
+		}
+		for _, optId := range []uint32{NBD_OPT_INFO, NBD_OPT_GO} {
+			replyType, message, err := ni.OptionReply(t, optId, goPayload("foo"))
+			if err != nil {
+				t.Fatalf("onopenfailure=%s verboseerrors=%v: option %d failed: %v", tc.onOpenFailure, tc.verbose, optId, err)
+			}
+			if replyType != tc.replyType {
+				t.Errorf("onopenfailure=%s verboseerrors=%v: option %d got reply type %x, expected %x", tc.onOpenFailure, tc.verbose, optId, replyType, tc.replyType)
+			}
+			if (tc.verbose && !strings.HasPrefix(string(message), tc.message)) || (!tc.verbose && string(message) != tc.message) {
+				t.Errorf("onopenfailure=%s verboseerrors=%v: option %d got message '%s', expected '%s'", tc.onOpenFailure, tc.verbose, optId, message, tc.message)
+			}
+		}
+		// negotiation carries on after the failure
+		if replyType, err := ni.Option(t, NBD_OPT_LIST, nil); err != nil || replyType != NBD_REP_ACK {
+			t.Errorf("onopenfailure=%s verboseerrors=%v: could not continue negotiating: %x, %v", tc.onOpenFailure, tc.verbose, replyType, err)
+		}
+		ni.Close()
+	}
+}
+
+func TestAcceptors(t *testing.T) {
+	ni := StartNbd(t, TestConfig{Driver: "file", Acceptors: "4"})
+	defer ni.Close()
+
+	// a burst of connections must all be accepted and sent the newstyle header
+	const n = 64
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			conn, err := net.Dial("unix", path.Join(ni.TempDir, "nbd.sock"))
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			var nsh nbdNewStyleHeader
+			if err := binary.Read(conn, binary.BigEndian, &nsh); err != nil {
+				errs <- err
+				return
+			}
+			if nsh.NbdMagic != NBD_MAGIC {
+				errs <- fmt.Errorf("Bad magic %x", nsh.NbdMagic)
+				return
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Connection failed: %v", err)
+		}
+	}
+}
+
+func TestDirtyBitmap(t *testing.T) {
+	ni := ConnectAndGo(t, TestConfig{DirtyBitmap: true}, 1024*1024)
+	defer ni.Close()
+	bitmap := path.Join(ni.TempDir, "nbd.dirty")
+
+	// a new bitmap cannot know what was written before, so all is dirty
+	if gen, extents, err := CheckpointDirtyBitmap(bitmap); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	} else if gen != 1 || len(extents) != 1 || extents[0] != (DirtyExtent{0, 1024 * 1024}) {
+		t.Fatalf("First checkpoint returned generation %d extents %v", gen, extents)
+	}
+
+	for _, offset := range []uint64{0, 4096, 200 * 1024, 255 * 1024} {
+		if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, offset, 4096, make([]byte, 4096)); err != nil || rep.NbdError != 0 {
+			t.Fatalf("Write failed")
+		}
+	}
+	expected := []DirtyExtent{{0, 64 * 1024}, {192 * 1024, 128 * 1024}}
+	if gen, extents, err := CheckpointDirtyBitmap(bitmap); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	} else if gen != 2 || fmt.Sprint(extents) != fmt.Sprint(expected) {
+		t.Fatalf("Second checkpoint returned generation %d extents %v, expected %v", gen, extents, expected)
+	}
+
+	// the bitmap persists once the export is closed
+	if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 512*1024, 4096, make([]byte, 4096)); err != nil || rep.NbdError != 0 {
+		t.Fatalf("Write failed")
+	}
+	ni.Disconnect(t)
+	expected = []DirtyExtent{{512 * 1024, 64 * 1024}}
+	if gen, extents, err := CheckpointDirtyBitmap(bitmap); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	} else if gen != 3 || fmt.Sprint(extents) != fmt.Sprint(expected) {
+		t.Fatalf("Third checkpoint returned generation %d extents %v, expected %v", gen, extents, expected)
+	}
+}
+
+func TestUnknownOption(t *testing.T) {
+	ni := StartNbd(t, TestConfig{Driver: "file"})
+	defer ni.Close()
+	if err := ni.CreateFile(t, 1024*1024); err != nil {
+		t.Fatalf("Error on create file: %v", err)
+	}
+	if err := ni.Connect(t); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		optId     uint32
+		payload   []byte
+		replyType uint32
+	}{
+		{"unknown option", 0x12345678, []byte("some future option data"), NBD_REP_ERR_UNSUP},
+		{"unknown option without data", 13, nil, NBD_REP_ERR_UNSUP},
+		{"oversized unknown option", 12, make([]byte, 100000), NBD_REP_ERR_UNSUP},
+		{"structured reply with data", NBD_OPT_STRUCTURED_REPLY, []byte{1, 2, 3, 4}, NBD_REP_ERR_INVALID},
+		{"list with data", NBD_OPT_LIST, []byte{1, 2, 3, 4}, NBD_REP_ERR_INVALID},
+		{"starttls with data", NBD_OPT_STARTTLS, []byte{1, 2, 3, 4}, NBD_REP_ERR_INVALID},
+	} {
+		replyType, err := ni.Option(t, tc.optId, tc.payload)
+		if err != nil {
+			t.Fatalf("%s: option failed: %v", tc.name, err)
+		}
+		if replyType != tc.replyType {
+			t.Errorf("%s: reply type %x, expected %x", tc.name, replyType, tc.replyType)
+		}
+	}
+
+	// negotiation carries on after each rejected option
+	if err := ni.Go(t); err != nil {
+		t.Fatalf("Error on go: %v", err)
+	}
+	if rep, _, err := ni.Command(t, NBD_CMD_READ, 0, 0, 4096, nil); err != nil || rep.NbdError != 0 {
+		t.Errorf("Read after go failed")
+	}
+}
+
+// alignedMemBackend is an in-memory backend for testing which rejects I/O not
+// aligned to 4096 bytes
+type alignedMemBackend struct {
+	data  []byte
+	mutex sync.Mutex
+}
+
+func (mb *alignedMemBackend) check(length int, offset int64) error {
+	if length%4096 != 0 || offset%4096 != 0 {
+		return syscall.EINVAL
+	}
+	return nil
+}
+
+func (mb *alignedMemBackend) WriteAt(ctx context.Context, b []byte, offset int64, fua bool) (int, error) {
+	if err := mb.check(len(b), offset); err != nil {
+		return 0, err
+	}
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	return copy(mb.data[offset:], b), nil
+}
+
+func (mb *alignedMemBackend) ReadAt(ctx context.Context, b []byte, offset int64) (int, error) {
+	if err := mb.check(len(b), offset); err != nil {
+		return 0, err
+	}
+	mb.mutex.Lock()
+	n := copy(b, mb.data[offset:])
+	mb.mutex.Unlock()
+	// widen the window in which a racing read-modify-write could lose an update
+	time.Sleep(time.Millisecond)
+	return n, nil
+}
+
+func (mb *alignedMemBackend) TrimAt(ctx context.Context, length int, offset int64) (int, error) {
+	if err := mb.check(length, offset); err != nil {
+		return 0, err
+	}
+	return length, nil
+}
+
+func (mb *alignedMemBackend) Flush(ctx context.Context) error { return nil }
+func (mb *alignedMemBackend) Close(ctx context.Context) error { return nil }
+func (mb *alignedMemBackend) Geometry(ctx context.Context) (uint64, uint64, uint64, uint64, error) {
+	return uint64(len(mb.data)), 4096, 4096, 32 * 1024 * 1024, nil
+}
+func (mb *alignedMemBackend) HasFua(ctx context.Context) bool   { return true }
+func (mb *alignedMemBackend) HasFlush(ctx context.Context) bool { return true }
+
+func TestAlignment(t *testing.T) {
+	ctx := context.Background()
+	ec := &ExportConfig{DriverParameters: DriverParametersConfig{"alignbuffer": "4096"}}
+	backend, err := newAlignBackend(ctx, ec, &alignedMemBackend{data: make([]byte, 64*1024)})
+	if err != nil {
+		t.Fatalf("Could not create align backend: %v", err)
+	}
+
+	// overlapping unaligned writes, each patching its own bytes of the
+	// same blocks, must not lose each other's updates
+	const writers = 16
+	const length = 777
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b := bytes.Repeat([]byte{byte(i + 1)}, length)
+			for j := 0; j < 20; j++ {
+				if _, err := backend.WriteAt(ctx, b, int64(3000+i*length), false); err != nil {
+					t.Errorf("Write %d failed: %v", i, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// read back unaligned
+	b := make([]byte, writers*length+2)
+	if _, err := backend.ReadAt(ctx, b, 2999); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if b[0] != 0 || b[len(b)-1] != 0 {
+		t.Errorf("Data either side of the writes was changed")
+	}
+	for i := 0; i < writers; i++ {
+		if !bytes.Equal(b[1+i*length:1+(i+1)*length], bytes.Repeat([]byte{byte(i + 1)}, length)) {
+			t.Errorf("Write %d was lost", i)
+		}
+	}
+
+	if _, err := backend.TrimAt(ctx, 10000, 100); err != nil {
+		t.Errorf("Unaligned trim failed: %v", err)
+	}
+	if _, minimum, _, _, _ := backend.Geometry(ctx); minimum != 1 {
+		t.Errorf("Minimum block size %d, expected 1", minimum)
+	}
+}
+
+func TestValidateBlockSizes(t *testing.T) {
+	for _, tc := range []struct {
+		minimum, preferred, maximum uint64
+		valid                       bool
+	}{
+		{0, 0, 0, true},
+		{4096, 0, 0, true},
+		{512, 4096, 1024 * 1024, true},
+		{4096, 4096, 4096, true},
+		{0, 65536, 0, true},
+		{4096, 0, 12288, true},
+		{3000, 0, 0, false},
+		{0, 5000, 0, false},
+		{4096, 512, 0, false},
+		{4096, 65536, 32768, false},
+		{512, 4096, 10000, false},
+		{4096, 0, 6000, false},
+		{0, 0, 1 << 33, false},
+	} {
+		ec := &ExportConfig{Name: "foo", MinimumBlockSize: tc.minimum, PreferredBlockSize: tc.preferred, MaximumBlockSize: tc.maximum}
+		if err := validateBlockSizes(ec); (err == nil) != tc.valid {
+			t.Errorf("Block sizes %d/%d/%d: got error %v, expected valid=%v", tc.minimum, tc.preferred, tc.maximum, err, tc.valid)
+		}
+	}
+}
+
+func TestChunkedIO(t *testing.T) {
+	// a command of 30K at offset 6K held in 4K memory blocks, split into
+	// chunks of up to 12K not straddling multiples of 12K
+	const memoryBlockSize = 4096
+	data := make([]byte, 30*1024)
+	rand.Read(data)
+	mem := make([][]byte, (len(data)+memoryBlockSize-1)/memoryBlockSize)
+	for i := range mem {
+		mem[i] = make([]byte, memoryBlockSize)
+		copy(mem[i], data[i*memoryBlockSize:])
+	}
+	backend := make([]byte, 64*1024)
+	var chunks []string
+	n, err := chunkedIO(mem, memoryBlockSize, 6*1024, uint64(len(data)), 12*1024, 12*1024, true, func(b []byte, offset uint64) (int, error) {
+		chunks = append(chunks, fmt.Sprintf("%d+%d", offset/1024, len(b)/1024))
+		return copy(backend[offset:], b), nil
+	})
+	if err != nil || n != uint64(len(data)) {
+		t.Fatalf("Write returned %d, %v", n, err)
+	}
+	if expected := "[6+6 12+12 24+12]"; fmt.Sprint(chunks) != expected {
+		t.Errorf("Write chunks were %v, expected %s", chunks, expected)
+	}
+	if !bytes.Equal(backend[6*1024:6*1024+len(data)], data) {
+		t.Errorf("Data written does not match")
+	}
+
+	for i := range mem {
+		mem[i] = make([]byte, memoryBlockSize)
+	}
+	if n, err := chunkedIO(mem, memoryBlockSize, 6*1024, uint64(len(data)), 12*1024, 12*1024, false, func(b []byte, offset uint64) (int, error) {
+		return copy(b, backend[offset:]), nil
+	}); err != nil || n != uint64(len(data)) {
+		t.Fatalf("Read returned %d, %v", n, err)
+	}
+	if got := bytes.Join(mem, nil); !bytes.Equal(got[:len(data)], data) {
+		t.Errorf("Data read does not match")
+	}
+
+	// a short transfer stops at the bytes transferred
+	if n, err := chunkedIO(mem, memoryBlockSize, 0, uint64(len(data)), 0, 0, false, func(b []byte, offset uint64) (int, error) {
+		if offset >= 8192 {
+			return 100, nil
+		}
+		return len(b), nil
+	}); err != nil || n != 8192+100 {
+		t.Errorf("Short read returned %d, %v", n, err)
+	}
+}
+
+func TestVectoredIO(t *testing.T) {
+	// the same command as TestChunkedIO, passed as memory block segments
+	const memoryBlockSize = 4096
+	mem := make([][]byte, 8)
+	for i := range mem {
+		mem[i] = make([]byte, memoryBlockSize)
+	}
+	var chunks []string
+	n, err := vectoredIO(mem, memoryBlockSize, 6*1024, 30*1024, 12*1024, 12*1024, func(bufs [][]byte, offset uint64) (int, error) {
+		lengths := make([]string, len(bufs))
+		for i, b := range bufs {
+			lengths[i] = fmt.Sprint(len(b) / 1024)
+		}
+		chunks = append(chunks, fmt.Sprintf("%d+%s", offset/1024, strings.Join(lengths, ",")))
+		return buffersLength(bufs), nil
+	})
+	if err != nil || n != 30*1024 {
+		t.Fatalf("I/O returned %d, %v", n, err)
+	}
+	if expected := "[6+4,2 12+2,4,4,2 24+2,4,4,2]"; fmt.Sprint(chunks) != expected {
+		t.Errorf("Chunks were %v, expected %s", chunks, expected)
+	}
+
+	// the file backend reads and writes more buffers than fit in one system call
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+	filename := path.Join(TempDir, "nbd.img")
+	const size = 4 * 1024 * 1024
+	if err := ioutil.WriteFile(filename, make([]byte, size), 0644); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	ctx := context.Background()
+	fb, err := NewFileBackend(ctx, &ExportConfig{Name: "foo", Driver: "file", DriverParameters: DriverParametersConfig{"path": filename}})
+	if err != nil {
+		t.Fatalf("Could not open backend: %v", err)
+	}
+	defer fb.Close(ctx)
+	backend := fb.(*FileBackend)
+	data := make([]byte, 3000*512)
+	rand.Read(data)
+	bufs := make([][]byte, 3000)
+	for i := range bufs {
+		bufs[i] = data[i*512 : (i+1)*512]
+	}
+	if n, err := backend.WriteAtv(ctx, bufs, 4096, true); err != nil || n != len(data) {
+		t.Fatalf("Vectored write returned %d, %v", n, err)
+	}
+	got := make([]byte, len(data))
+	if _, err := backend.ReadAt(ctx, got, 4096); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Data written does not match: %v", err)
+	}
+	for i := range bufs {
+		bufs[i] = got[i*512 : (i+1)*512]
+	}
+	for i := range got {
+		got[i] = 0
+	}
+	if n, err := backend.ReadAtv(ctx, bufs, 4096); err != nil || n != len(data) || !bytes.Equal(got, data) {
+		t.Errorf("Vectored read returned %d, %v, or did not match", n, err)
+	}
+	// a read past the end of the file stops there
+	if n, err := backend.ReadAtv(ctx, bufs[:2], size-512); err != io.EOF || n != 512 {
+		t.Errorf("Vectored read past the end returned %d, %v", n, err)
+	}
+}
+
+func BenchmarkVectoredRead(b *testing.B) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		b.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+	filename := path.Join(TempDir, "nbd.img")
+	const size = 64 * 1024 * 1024
+	if err := ioutil.WriteFile(filename, make([]byte, size), 0644); err != nil {
+		b.Fatalf("Could not write file: %v", err)
+	}
+
+	ctx := context.Background()
+	fb, err := NewFileBackend(ctx, &ExportConfig{Name: "foo", Driver: "file", DriverParameters: DriverParametersConfig{"path": filename}})
+	if err != nil {
+		b.Fatalf("Could not open backend: %v", err)
+	}
+	defer fb.Close(ctx)
+	backend := fb.(*FileBackend)
+	// 1M reads into 4K memory blocks, as the dispatcher makes them
+	const memoryBlockSize = 4096
+	const length = 1024 * 1024
+	mem := make([][]byte, length/memoryBlockSize)
+	for i := range mem {
+		mem[i] = make([]byte, memoryBlockSize)
+	}
+	for _, mode := range []string{"single", "vectored"} {
+		b.Run(mode, func(b *testing.B) {
+			b.SetBytes(length)
+			for i := 0; i < b.N; i++ {
+				offset := uint64(i) % (size / length) * length
+				var err error
+				if mode == "vectored" {
+					_, err = vectoredIO(mem, memoryBlockSize, offset, length, 0, 0, func(bufs [][]byte, offset uint64) (int, error) {
+						return backend.ReadAtv(ctx, bufs, int64(offset))
+					})
+				} else {
+					_, err = chunkedIO(mem, memoryBlockSize, offset, length, 0, 0, false, func(b []byte, offset uint64) (int, error) {
+						return backend.ReadAt(ctx, b, int64(offset))
+					})
+				}
+				if err != nil {
+					b.Fatalf("Read failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestStripeIOHints(t *testing.T) {
+	ni := StartNbd(t, TestConfig{Driver: "file", StripeReplicas: "2", Upstreams: []int{0, 1, 2, 3}})
+	defer ni.Close()
+	for _, i := range ni.Upstreams {
+		if err := ioutil.WriteFile(path.Join(ni.TempDir, fmt.Sprintf("up%d.img", i)), make([]byte, 512*1024), 0644); err != nil {
+			t.Fatalf("Could not create upstream file: %v", err)
+		}
+	}
+	if err := ni.Connect(t); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	infos, err := ni.GoWithInfo(t, "stripe", []uint16{NBD_INFO_BLOCK_SIZE})
+	if err != nil {
+		t.Fatalf("Error on go: %v", err)
+	}
+	// two members of 64K chunks make a stripe of 128K
+	if bs := infos[NBD_INFO_BLOCK_SIZE]; len(bs) != 12 || binary.BigEndian.Uint32(bs[4:]) != 128*1024 {
+		t.Errorf("Bad block size info %v, expected a preferred block size of 128K", bs)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	for _, useTls := range []bool{false, true} {
+		ni := StartNbd(t, TestConfig{Driver: "file", Tls: useTls})
+		if err := ni.CreateFile(t, 1024*1024); err != nil {
+			ni.Close()
+			t.Fatalf("Error on create file: %v", err)
+		}
+		opts := ProbeOptions{
+			Tls:           useTls,
+			TlsCaCertFile: path.Join(ni.TempDir, "server-cert.pem"),
+			TlsCertFile:   path.Join(ni.TempDir, "client-cert.pem"),
+			TlsKeyFile:    path.Join(ni.TempDir, "client-key.pem"),
+			TlsServerName: "localhost",
+			Structured:    true,
+		}
+		socket := path.Join(ni.TempDir, "nbd.sock")
+
+		var out bytes.Buffer
+		if !Probe(&out, socket, "foo", opts) {
+			t.Errorf("Probe (tls=%v) failed:\n%s", useTls, out.String())
+		}
+		for _, want := range []string{"export 'foo'", "description: Test export", "size: 1048576", "transmission flags: HAS_FLAGS SEND_FLUSH", "exports: 2 listed"} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("Probe (tls=%v) output lacks '%s':\n%s", useTls, want, out.String())
+			}
+		}
+		if useTls && !strings.Contains(out.String(), "tls: negotiated") {
+			t.Errorf("Probe did not report TLS:\n%s", out.String())
+		}
+
+		out.Reset()
+		if Probe(&out, "nbd+unix:///nosuch?socket="+socket, "", opts) {
+			t.Errorf("Probe (tls=%v) of unknown export succeeded:\n%s", useTls, out.String())
+		} else if !strings.Contains(out.String(), "unknown export") {
+			t.Errorf("Probe (tls=%v) did not report unknown export:\n%s", useTls, out.String())
+		}
+		ni.Close()
+	}
+
+	var out bytes.Buffer
+	if Probe(&out, "/nonexistent/nbd.sock", "", ProbeOptions{}) {
+		t.Errorf("Probe of unreachable server succeeded")
+	}
+}
+
+func TestExportMaxConnections(t *testing.T) {
+	ni := StartNbd(t, TestConfig{Driver: "file", MaxConnections: "2"})
+	defer ni.Close()
+	if err := ni.CreateFile(t, 1024*1024); err != nil {
+		t.Fatalf("Error on create file: %v", err)
+	}
+
+	var connected []*NbdInstance
+	defer func() {
+		for _, c := range connected {
+			c.CloseConnection()
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		c := &NbdInstance{t: t, quit: make(chan struct{}), TestConfig: ni.TestConfig}
+		if err := c.Connect(t); err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		connected = append(connected, c)
+		err := c.Go(t)
+		if i < 2 && err != nil {
+			t.Fatalf("Connection %d was refused: %v", i, err)
+		}
+		if i == 2 && err != optReplyError(NBD_REP_ERR_POLICY) {
+			t.Fatalf("Connection over the limit got %v, not NBD_REP_ERR_POLICY", err)
+		}
+	}
+
+	// closing a connection frees its slot
+	connected[0].Disconnect(t)
+	connected[0].CloseConnection()
+	time.Sleep(100 * time.Millisecond)
+	if err := connected[2].Go(t); err != nil {
+		t.Fatalf("Connection was refused after another closed: %v", err)
+	}
+}
+
+func TestServerMaxConnections(t *testing.T) {
+	ni := StartNbd(t, TestConfig{Driver: "file", ServerMaxConnections: "2"})
+	defer ni.Close()
+	// the limit is server-wide, so outlives the server
+	defer setMaxConnections(0)
+	if err := ni.CreateFile(t, 1024*1024); err != nil {
+		t.Fatalf("Error on create file: %v", err)
+	}
+
+	var connected []*NbdInstance
+	defer func() {
+		for _, c := range connected {
+			c.CloseConnection()
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		c := &NbdInstance{t: t, quit: make(chan struct{}), TestConfig: ni.TestConfig}
+		if err := c.Connect(t); err != nil {
+			t.Fatalf("Connection %d was refused: %v", i, err)
+		}
+		connected = append(connected, c)
+	}
+	rejected := expvarConnectionsRejected.Value()
+	over := &NbdInstance{t: t, quit: make(chan struct{}), TestConfig: ni.TestConfig}
+	if err := over.Connect(t); err == nil {
+		connected = append(connected, over)
+		t.Fatalf("Connection over the server-wide limit was accepted")
+	}
+	if n := expvarConnectionsRejected.Value() - rejected; n != 1 {
+		t.Errorf("nbd_connections_rejected went up by %d, not 1", n)
+	}
+
+	// closing a connection frees its slot
+	connected[0].Disconnect(t)
+	connected[0].CloseConnection()
+	connected = connected[1:]
+	time.Sleep(100 * time.Millisecond)
+	c := &NbdInstance{t: t, quit: make(chan struct{}), TestConfig: ni.TestConfig}
+	if err := c.Connect(t); err != nil {
+		t.Fatalf("Connection was refused after another closed: %v", err)
+	}
+	connected = append(connected, c)
+}
+
+func TestMaxExports(t *testing.T) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+
+	// the test configuration has two exports
+	tpl := template.Must(template.New("config").Parse(ConfigTemplate))
+	for _, tc := range []struct {
+		maxExports string
+		ok         bool
+	}{
+		{"", true},
+		{"2", true},
+		{"1", false},
+	} {
+		confFile := path.Join(TempDir, "gonbdserver.conf")
+		cf, err := os.Create(confFile)
+		if err != nil {
+			t.Fatalf("cannot create config file: %v", err)
+		}
+		if err := tpl.Execute(cf, TestConfig{TempDir: TempDir, Driver: "file", MaxExports: tc.maxExports}); err != nil {
+			t.Fatalf("executing template: %v", err)
+		}
+		cf.Close()
+		if _, err := parseConfigFile(confFile); (err == nil) != tc.ok {
+			t.Errorf("maxexports '%s': configuration parsed with error %v", tc.maxExports, err)
+		} else if !tc.ok && !strings.Contains(err.Error(), "exceeding the maximum of 1") {
+			t.Errorf("maxexports '%s': unexpected error %v", tc.maxExports, err)
+		}
+	}
+}
+
+func init() {
+	RegisterWriteInterceptor("rejectsecret", func(ctx context.Context, ec *ExportConfig) (WriteInterceptor, error) {
+		return WriteInterceptorFunc(func(ctx context.Context, b []byte, offset int64) ([]byte, error) {
+			if bytes.Contains(b, []byte("SECRET")) {
+				return nil, syscall.EPERM
+			}
+			return b, nil
+		}), nil
+	})
+	RegisterWriteInterceptor("invert", func(ctx context.Context, ec *ExportConfig) (WriteInterceptor, error) {
+		return WriteInterceptorFunc(func(ctx context.Context, b []byte, offset int64) ([]byte, error) {
+			for i := range b {
+				b[i] ^= 0xff
+			}
+			return b, nil
+		}), nil
+	})
+}
+
+func TestWriteInterceptors(t *testing.T) {
+	ni := ConnectAndGo(t, TestConfig{Interceptors: "passthrough,rejectsecret,invert"}, 1024*1024)
+	defer ni.Close()
+
+	data := bytes.Repeat([]byte("public"), 4096/6+1)[:4096]
+	if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 0, 4096, data); err != nil || rep.NbdError != 0 {
+		t.Fatalf("Write was not passed through")
+	}
+	if contents, err := ioutil.ReadFile(path.Join(ni.TempDir, "nbd.img")); err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	} else if contents[0] != 'p'^0xff || contents[4095] != data[4095]^0xff {
+		t.Errorf("Write was not transformed")
+	}
+
+	// rejection happens before the transformation, so the pattern is seen
+	secret := make([]byte, 4096)
+	copy(secret[100:], "SECRET")
+	if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 4096, 4096, secret); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	} else if rep.NbdError != NBD_EPERM {
+		t.Errorf("Write containing pattern returned error %d, expected %d", rep.NbdError, NBD_EPERM)
+	}
+	if contents, err := ioutil.ReadFile(path.Join(ni.TempDir, "nbd.img")); err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	} else if !bytes.Equal(contents[4096:8192], make([]byte, 4096)) {
+		t.Errorf("Rejected write reached the backend")
+	}
+}
+
+func TestExpvar(t *testing.T) {
+	value := func(v expvar.Var) int64 {
+		if i, ok := v.(*expvar.Int); ok {
+			return i.Value()
+		}
+		return 0
+	}
+	written, read := value(exportExpvar("foo").Get("bytes_written")), value(exportExpvar("foo").Get("bytes_read"))
+	succeeded := value(expvarNegotiations.Get("succeeded"))
+
+	ni := ConnectAndGo(t, TestConfig{}, 1024*1024)
+	defer ni.Close()
+	if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 0, 4096, make([]byte, 4096)); err != nil || rep.NbdError != 0 {
+		t.Fatalf("Write failed")
+	}
+	for i := 0; i < 2; i++ {
+		if rep, _, err := ni.Command(t, NBD_CMD_READ, 0, 0, 8192, nil); err != nil || rep.NbdError != 0 {
+			t.Fatalf("Read failed")
+		}
+	}
+	if n := value(exportExpvar("foo").Get("bytes_written")) - written; n != 4096 {
+		t.Errorf("bytes_written rose by %d, expected 4096", n)
+	}
+	if n := value(exportExpvar("foo").Get("bytes_read")) - read; n != 16384 {
+		t.Errorf("bytes_read rose by %d, expected 16384", n)
+	}
+	if value(expvarNegotiations.Get("succeeded")) != succeeded+1 {
+		t.Errorf("Successful negotiation was not counted")
+	}
+	if active := expvar.Get("nbd_connections_active").(expvar.Func)().(int64); active < 1 {
+		t.Errorf("nbd_connections_active is %d with a connection open", active)
+	}
+	if connections := expvar.Get("nbd_export_connections").(expvar.Func)().(map[string]int); connections["foo"] != 1 {
+		t.Errorf("nbd_export_connections reports %d connections to foo, expected 1", connections["foo"])
+	}
+}
+
+func TestCommandAfterExportName(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		clientFlags uint32
+		padding     int
+	}{
+		{"with NO_ZEROES", NBD_FLAG_C_FIXED_NEWSTYLE | NBD_FLAG_C_NO_ZEROES, 0},
+		{"without NO_ZEROES", NBD_FLAG_C_FIXED_NEWSTYLE, NBD_EXPORT_NAME_PAD_LENGTH},
+	} {
+		ni := StartNbd(t, TestConfig{Driver: "file"})
+		ni.clientFlags = tc.clientFlags
+		contents := make([]byte, 1024*1024)
+		if _, err := rand.Read(contents); err != nil {
+			t.Fatalf("Could not generate file contents: %v", err)
+		}
+		if err := ioutil.WriteFile(path.Join(ni.TempDir, "nbd.img"), contents, 0644); err != nil {
+			t.Fatalf("Could not write file: %v", err)
+		}
+		if err := ni.Connect(t); err != nil {
+			ni.Close()
+			t.Fatalf("%s: error on connect: %v", tc.name, err)
+		}
+
+		// send the option and the first command in a single write, so the
+		// command arrives before the server has sent the export details
+		export := "foo"
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, nbdClientOpt{
+			NbdOptMagic: NBD_OPTS_MAGIC,
+			NbdOptId:    NBD_OPT_EXPORT_NAME,
+			NbdOptLen:   uint32(len(export)),
+		})
+		buf.WriteString(export)
+		binary.Write(&buf, binary.BigEndian, nbdRequest{
+			NbdRequestMagic: NBD_REQUEST_MAGIC,
+			NbdCommandType:  NBD_CMD_READ,
+			NbdHandle:       getHandle(),
+			NbdOffset:       4096,
+			NbdLength:       4096,
+		})
+		if _, err := ni.conn.Write(buf.Bytes()); err != nil {
+			ni.Close()
+			t.Fatalf("%s: could not send export name and command: %v", tc.name, err)
+		}
+
+		var ed nbdExportDetails
+		if err := binary.Read(ni.conn, binary.BigEndian, &ed); err != nil {
+			ni.Close()
+			t.Fatalf("%s: could not receive export details: %v", tc.name, err)
+		}
+		if ed.NbdExportSize != uint64(len(contents)) {
+			t.Errorf("%s: export size is %d, expected %d", tc.name, ed.NbdExportSize, len(contents))
+		}
+		if _, err := io.ReadFull(ni.conn, make([]byte, tc.padding)); err != nil {
+			ni.Close()
+			t.Fatalf("%s: could not receive padding: %v", tc.name, err)
+		}
+		var rep nbdReply
+		if err := binary.Read(ni.conn, binary.BigEndian, &rep); err != nil {
+			ni.Close()
+			t.Fatalf("%s: could not receive reply: %v", tc.name, err)
+		}
+		if rep.NbdReplyMagic != NBD_REPLY_MAGIC || rep.NbdError != 0 {
+			t.Errorf("%s: bad reply magic %x or error %d", tc.name, rep.NbdReplyMagic, rep.NbdError)
+		}
+		data := make([]byte, 4096)
+		if _, err := io.ReadFull(ni.conn, data); err != nil {
+			t.Errorf("%s: could not receive read data: %v", tc.name, err)
+		} else if !bytes.Equal(data, contents[4096:8192]) {
+			t.Errorf("%s: read returned the wrong data", tc.name)
+		}
+		ni.Close()
+	}
+}
+
+func TestTraceReplay(t *testing.T) {
+	ni := ConnectAndGo(t, TestConfig{TraceFile: true}, 1024*1024)
+	defer ni.Close()
+
+	data := make([]byte, 4096)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("Could not generate data: %v", err)
+	}
+	for _, cmd := range []struct {
+		cmdType uint16
+		flags   uint16
+		offset  uint64
+		length  uint32
+		data    []byte
+	}{
+		{NBD_CMD_WRITE, NBD_CMD_FLAG_FUA, 0, 4096, data},
+		{NBD_CMD_READ, 0, 0, 8192, nil},
+		{NBD_CMD_TRIM, 0, 65536, 4096, nil},
+		{NBD_CMD_FLUSH, 0, 0, 0, nil},
+	} {
+		if rep, _, err := ni.Command(t, cmd.cmdType, cmd.flags, cmd.offset, cmd.length, cmd.data); err != nil || rep.NbdError != 0 {
+			t.Fatalf("Command %d failed", cmd.cmdType)
+		}
+	}
+	ni.Disconnect(t)
+	ni.CloseConnection()
+	time.Sleep(100 * time.Millisecond)
+
+	ec := &ExportConfig{
+		Name:             "foo",
+		Driver:           "file",
+		DriverParameters: DriverParametersConfig{"path": path.Join(ni.TempDir, "nbd.img"), "tracefile": path.Join(ni.TempDir, "nbd.trace")},
+	}
+	trace := path.Join(ni.TempDir, "nbd.trace")
+
+	// against the data the trace was recorded against, it replays exactly
+	if err := ni.CreateFile(t, 1024*1024); err != nil {
+		t.Fatalf("Error on create file: %v", err)
+	}
+	var out bytes.Buffer
+	if !ReplayTrace(context.Background(), &out, trace, ec) {
+		t.Errorf("Replay failed:\n%s", out.String())
+	} else if !strings.Contains(out.String(), "Replayed 5 operations") { // including the flush on disconnect
+		t.Errorf("Replay did not replay every operation:\n%s", out.String())
+	}
+	if contents, err := ioutil.ReadFile(path.Join(ni.TempDir, "nbd.img")); err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	} else if !bytes.Equal(contents[:4096], data) {
+		t.Errorf("Replay did not write the data recorded")
+	}
+
+	// against different data, the read does not match
+	if err := ioutil.WriteFile(path.Join(ni.TempDir, "nbd.img"), bytes.Repeat([]byte{0xff}, 1024*1024), 0644); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	out.Reset()
+	if ReplayTrace(context.Background(), &out, trace, ec) {
+		t.Errorf("Replay against different data succeeded:\n%s", out.String())
+	} else if !strings.Contains(out.String(), "MISMATCH #1 read of 8192 bytes at 0 returned different data") {
+		t.Errorf("Replay did not report the read mismatch:\n%s", out.String())
+	}
+}
+
+func TestFuaMode(t *testing.T) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+	filename := path.Join(TempDir, "nbd.img")
+	if err := ioutil.WriteFile(filename, make([]byte, 1024*1024), 0644); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+
+	ctx := context.Background()
+	for _, mode := range []string{"", "full", "range"} {
+		ec := &ExportConfig{Name: "foo", Driver: "file", DriverParameters: DriverParametersConfig{"path": filename, "fuamode": mode}}
+		backend, err := NewFileBackend(ctx, ec)
+		if err != nil {
+			t.Fatalf("Could not open backend with FUA mode '%s': %v", mode, err)
+		}
+		data := bytes.Repeat([]byte{byte(len(mode))}, 4096)
+		if n, err := backend.WriteAt(ctx, data, 65536, true); err != nil || n != len(data) {
+			t.Errorf("FUA write with FUA mode '%s' failed: %v", mode, err)
+		}
+		backend.Close(ctx)
+		if contents, err := ioutil.ReadFile(filename); err != nil {
+			t.Fatalf("Could not read file: %v", err)
+		} else if !bytes.Equal(contents[65536:65536+4096], data) {
+			t.Errorf("FUA write with FUA mode '%s' was not written", mode)
+		}
+	}
+
+	ec := &ExportConfig{Name: "foo", Driver: "file", DriverParameters: DriverParametersConfig{"path": filename, "fuamode": "barrier"}}
+	if _, err := NewFileBackend(ctx, ec); err == nil {
+		t.Errorf("Bad FUA mode was accepted")
+	}
+}
+
+func BenchmarkFuaWrite(b *testing.B) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		b.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+	filename := path.Join(TempDir, "nbd.img")
+	const size = 64 * 1024 * 1024
+	if err := ioutil.WriteFile(filename, make([]byte, size), 0644); err != nil {
+		b.Fatalf("Could not write file: %v", err)
+	}
+
+	ctx := context.Background()
+	for _, mode := range []string{"full", "range"} {
+		b.Run(mode, func(b *testing.B) {
+			ec := &ExportConfig{Name: "foo", Driver: "file", DriverParameters: DriverParametersConfig{"path": filename, "fuamode": mode}}
+			backend, err := NewFileBackend(ctx, ec)
+			if err != nil {
+				b.Fatalf("Could not open backend: %v", err)
+			}
+			defer backend.Close(ctx)
+			data := make([]byte, 4096)
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// random writes, one in eight FUA, so that a full sync
+				// also has the pages of the other writes to write out
+				offset := int64((uint64(i) * 2654435761) % (size / 4096) * 4096)
+				if _, err := backend.WriteAt(ctx, data, offset, i%8 == 0); err != nil {
+					b.Fatalf("Write failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestFileAccessAdvice(t *testing.T) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+	filename := path.Join(TempDir, "nbd.img")
+	data := make([]byte, 1024*1024)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+
+	ctx := context.Background()
+	for _, access := range []string{"normal", "sequential", "random"} {
+		for _, drop := range []string{"false", "true"} {
+			ec := &ExportConfig{Name: "foo", Driver: "file", DriverParameters: DriverParametersConfig{"path": filename, "access": access, "dropcache": drop}}
+			backend, err := NewFileBackend(ctx, ec)
+			if err != nil {
+				t.Fatalf("access=%s dropcache=%s: could not open backend: %v", access, drop, err)
+			}
+			// advice changes only caching, never the data read
+			got := make([]byte, len(data))
+			if n, err := backend.ReadAt(ctx, got, 0); err != nil || n != len(data) || !bytes.Equal(got, data) {
+				t.Errorf("access=%s dropcache=%s: read returned %d, %v, or did not match", access, drop, n, err)
+			}
+			backend.Close(ctx)
+		}
+	}
+
+	ec := &ExportConfig{Name: "foo", Driver: "file", DriverParameters: DriverParametersConfig{"path": filename, "access": "backwards"}}
+	if _, err := NewFileBackend(ctx, ec); err == nil {
+		t.Errorf("Bad access pattern was accepted")
+	}
+}
+
+func BenchmarkSequentialScan(b *testing.B) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		b.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+	filename := path.Join(TempDir, "nbd.img")
+	const size = 64 * 1024 * 1024
+	if err := ioutil.WriteFile(filename, make([]byte, size), 0644); err != nil {
+		b.Fatalf("Could not write file: %v", err)
+	}
+
+	ctx := context.Background()
+	for _, mode := range []struct {
+		name   string
+		access string
+		drop   string
+	}{
+		{"normal", "normal", "false"},
+		{"sequential", "sequential", "false"},
+		{"sequential-dropcache", "sequential", "true"},
+		{"random", "random", "false"},
+	} {
+		b.Run(mode.name, func(b *testing.B) {
+			ec := &ExportConfig{Name: "foo", Driver: "file", DriverParameters: DriverParametersConfig{"path": filename, "access": mode.access, "dropcache": mode.drop}}
+			backend, err := NewFileBackend(ctx, ec)
+			if err != nil {
+				b.Fatalf("Could not open backend: %v", err)
+			}
+			defer backend.Close(ctx)
+			// 128K reads scanning the file from start to end, over and over
+			data := make([]byte, 128*1024)
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				offset := int64(uint64(i) % (size / uint64(len(data))) * uint64(len(data)))
+				if _, err := backend.ReadAt(ctx, data, offset); err != nil {
+					b.Fatalf("Read failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestQuiesce(t *testing.T) {
+	ni := StartNbd(t, TestConfig{Driver: "file"})
+	defer ni.Close()
+	defer Resume()
+
+	Quiesce()
+	if quiesced := expvar.Get("nbd_quiesced").(expvar.Func)().(bool); !quiesced {
+		t.Errorf("nbd_quiesced does not report quiesce mode")
+	}
+	// the listener is still bound, but the connection is closed at once
+	conn, err := net.Dial("unix", path.Join(ni.TempDir, "nbd.sock"))
+	if err != nil {
+		t.Fatalf("Could not connect whilst quiesced: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	var nsh nbdNewStyleHeader
+	if err := binary.Read(conn, binary.BigEndian, &nsh); err == nil {
+		t.Errorf("Connection whilst quiesced was served")
+	}
+	conn.Close()
+
+	Resume()
+	if err := ni.Connect(t); err != nil {
+		t.Fatalf("Could not connect after resuming: %v", err)
+	}
+	if err := ni.Abort(t); err != nil {
+		t.Errorf("Error on abort: %v", err)
+	}
+}
+
+func TestConnRate(t *testing.T) {
+	// dial returns whether a new connection is served, i.e. sent the greeting
+	dial := func(ni *NbdInstance) bool {
+		conn, err := net.Dial("unix", path.Join(ni.TempDir, "nbd.sock"))
+		if err != nil {
+			t.Fatalf("Could not connect: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		var nsh nbdNewStyleHeader
+		return binary.Read(conn, binary.BigEndian, &nsh) == nil
+	}
+
+	// beyond the burst, connections are closed until the bucket refills
+	ni := StartNbd(t, TestConfig{Driver: "file", ConnRate: "1", ConnBurst: "2", OnConnRateExceeded: "close"})
+	closed := expvarConnectionsRateLimited.Get("closed")
+	before := int64(0)
+	if closed != nil {
+		before = closed.(*expvar.Int).Value()
+	}
+	served := 0
+	for i := 0; i < 5; i++ {
+		if dial(ni) {
+			served++
+		}
+	}
+	if served != 2 {
+		t.Errorf("onconnrateexceeded=close: %d of 5 rapid connections served, expected the burst of 2", served)
+	}
+	if closed := expvarConnectionsRateLimited.Get("closed").(*expvar.Int).Value() - before; closed != 3 {
+		t.Errorf("onconnrateexceeded=close: %d connections counted as closed, expected 3", closed)
+	}
+	ni.Close()
+
+	// or, by default, delayed until due
+	ni = StartNbd(t, TestConfig{Driver: "file", ConnRate: "20", ConnBurst: "1"})
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if !dial(ni) {
+			t.Errorf("Delayed connection %d was not served", i)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("5 connections at 20 per second with a burst of 1 were served in %v", elapsed)
+	}
+	ni.Close()
+}
+
+func TestNegotiationLimits(t *testing.T) {
+	ni := StartNbd(t, TestConfig{Driver: "file", MaxOptions: "8"})
+	defer ni.Close()
+	if err := ni.CreateFile(t, 1024*1024); err != nil {
+		t.Fatalf("Could not create file: %v", err)
+	}
+	// Connect sends the first option
+	if err := ni.Connect(t); err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	ni.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for i := 2; i <= 8; i++ {
+		if replyType, err := ni.Option(t, NBD_OPT_LIST, nil); err != nil || replyType != NBD_REP_ACK {
+			t.Fatalf("Option %d within the limit failed: %d, %v", i, replyType, err)
+		}
+	}
+	if _, err := ni.Option(t, NBD_OPT_LIST, nil); err == nil {
+		t.Errorf("Option past the limit was processed")
+	}
+	ni.CloseConnection()
+
+	ni = StartNbd(t, TestConfig{Driver: "file", NegotiationTimeout: "1s"})
+	defer ni.Close()
+	if err := ni.CreateFile(t, 1024*1024); err != nil {
+		t.Fatalf("Could not create file: %v", err)
+	}
+	if err := ni.Connect(t); err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	// drip-feed options, each well within the connection timeout
+	ni.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	for {
+		if _, err := ni.Option(t, NBD_OPT_LIST, nil); err != nil {
+			break
+		}
+		if time.Since(start) > 3*time.Second {
+			t.Fatalf("Negotiation was not aborted after the negotiation timeout")
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("Negotiation aborted after only %v", elapsed)
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	// the first read of each block stalls for a second
+	ni := ConnectAndGo(t, TestConfig{CommandTimeout: "200ms"}, 1024*1024)
+	defer ni.Close()
+	start := time.Now()
+	rep, _, err := ni.Command(t, NBD_CMD_READ, 0, 0, 4096, nil)
+	if err != nil {
+		t.Fatalf("Error on read: %v", err)
+	}
+	if rep.NbdError != NBD_EIO {
+		t.Fatalf("Stalled read returned error %d, expected NBD_EIO", rep.NbdError)
+	}
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Errorf("Stalled read was not failed until %v", elapsed)
+	}
+	// as for any failed read, the data is sent, zeroed
+	data := make([]byte, 4096)
+	if _, err := io.ReadFull(ni.conn, data); err != nil || !bytes.Equal(data, make([]byte, 4096)) {
+		t.Fatalf("Stalled read did not send zeroes: %v", err)
+	}
+	// once the block has been read, it no longer stalls
+	time.Sleep(time.Second)
+	if rep, _, err := ni.Command(t, NBD_CMD_READ, 0, 0, 4096, nil); err != nil || rep.NbdError != 0 {
+		t.Errorf("Read after the stall failed: %v, %v", rep, err)
+	}
+	if err := ni.Disconnect(t); err != nil {
+		t.Errorf("Error on disconnect: %v", err)
+	}
+}
+
+func TestWatchdogTeardown(t *testing.T) {
+	c := &Connection{
+		logger: log.New(ioutil.Discard, "", 0),
+		export: &Export{commandTimeout: 10 * time.Millisecond},
+		txCh:   make(chan Request), // nothing transmits, so a reply blocks
+	}
+	req := Request{nbdReq: nbdRequest{NbdCommandType: NBD_CMD_FLUSH}}
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	waited := func() chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			c.wg.Wait()
+			close(done)
+		}()
+		return done
+	}
+
+	// a watchdog stopped in time is no longer waited for
+	c.wg.Add(1) // as the dispatcher starting it is
+	w := c.startWatchdog(ctx, req)
+	c.wg.Done()
+	if !w.stop() {
+		t.Fatalf("Watchdog replied before it was due")
+	}
+	select {
+	case <-waited():
+	case <-time.After(time.Second):
+		t.Fatalf("Stopped watchdog still waited for")
+	}
+
+	// one replying is waited for until the connection is torn down
+	c.wg.Add(1)
+	w = c.startWatchdog(ctx, req)
+	c.wg.Done()
+	time.Sleep(50 * time.Millisecond)
+	if w.stop() {
+		t.Fatalf("Watchdog did not reply")
+	}
+	done := waited()
+	select {
+	case <-done:
+		t.Fatalf("Watchdog replying not waited for")
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancelFunc()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Watchdog still waited for once the connection was torn down")
+	}
+}
+
+func TestArchiveBackend(t *testing.T) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+	// compressible, but not uniform, data over several cache blocks
+	data := make([]byte, 5*archiveCacheBlockSize+1000)
+	for i := range data {
+		data[i] = byte(i / 7)
+	}
+	rand.Read(data[archiveCacheBlockSize : archiveCacheBlockSize+100])
+
+	var zb bytes.Buffer
+	zw := zip.NewWriter(&zb)
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("disk%d.img", method), Method: method})
+		if err != nil {
+			t.Fatalf("Could not create zip member: %v", err)
+		}
+		w.Write(data)
+	}
+	zw.Close()
+	if err := ioutil.WriteFile(path.Join(TempDir, "disks.zip"), zb.Bytes(), 0644); err != nil {
+		t.Fatalf("Could not write zip: %v", err)
+	}
+	var tb bytes.Buffer
+	tw := tar.NewWriter(&tb)
+	for _, name := range []string{"other.img", "disk.img"} {
+		tw.WriteHeader(&tar.Header{Name: "./" + name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+		tw.Write(data)
+	}
+	tw.Close()
+	if err := ioutil.WriteFile(path.Join(TempDir, "disks.tar"), tb.Bytes(), 0644); err != nil {
+		t.Fatalf("Could not write tar: %v", err)
+	}
+
+	ctx := context.Background()
+	for _, tc := range []struct {
+		archive string
+		member  string
+	}{
+		{"disks.zip", fmt.Sprintf("disk%d.img", zip.Store)},
+		{"disks.zip", fmt.Sprintf("disk%d.img", zip.Deflate)},
+		{"disks.tar", "disk.img"},
+	} {
+		ec := &ExportConfig{Name: "foo", Driver: "archive", ReadOnly: true, DriverParameters: DriverParametersConfig{
+			"path": path.Join(TempDir, tc.archive), "member": tc.member, "cacheblocks": "2"}}
+		backend, err := NewArchiveBackend(ctx, ec)
+		if err != nil {
+			t.Fatalf("Could not open %s in %s: %v", tc.member, tc.archive, err)
+		}
+		if size, _, _, _, _ := backend.Geometry(ctx); size != uint64(len(data)) {
+			t.Errorf("%s in %s has size %d, expected %d", tc.member, tc.archive, size, len(data))
+		}
+		// forwards, backwards past the cache, and over the end
+		for _, r := range [][2]int{{100, 5000}, {archiveCacheBlockSize - 10, 20}, {4 * archiveCacheBlockSize, archiveCacheBlockSize + 1000}, {10, archiveCacheBlockSize}} {
+			b := make([]byte, r[1])
+			if n, err := backend.ReadAt(ctx, b, int64(r[0])); err != nil || n != len(b) || !bytes.Equal(b, data[r[0]:r[0]+r[1]]) {
+				t.Errorf("Read of %d bytes at %d from %s in %s returned %d, %v, or did not match", r[1], r[0], tc.member, tc.archive, n, err)
+			}
+		}
+		if n, err := backend.ReadAt(ctx, make([]byte, 2000), int64(len(data)-1000)); n != 1000 || err != io.EOF {
+			t.Errorf("Read past the end of %s in %s returned %d, %v", tc.member, tc.archive, n, err)
+		}
+		if _, err := backend.WriteAt(ctx, make([]byte, 512), 0, false); err != syscall.EPERM {
+			t.Errorf("Write to %s in %s returned %v", tc.member, tc.archive, err)
+		}
+		backend.Close(ctx)
+	}
+
+	ec := &ExportConfig{Name: "foo", Driver: "archive", ReadOnly: true, DriverParameters: DriverParametersConfig{
+		"path": path.Join(TempDir, "disks.tar"), "member": "missing.img"}}
+	if _, err := NewArchiveBackend(ctx, ec); err == nil {
+		t.Errorf("Opened a missing member")
+	}
+	ec.DriverParameters["member"] = "disk.img"
+	ec.ReadOnly = false
+	if _, err := NewArchiveBackend(ctx, ec); err == nil {
+		t.Errorf("Opened an archive member read-write")
+	}
+}
+
+func TestPlaintextReadOnly(t *testing.T) {
+	ni := StartNbd(t, TestConfig{Driver: "file", Tls: true, PlaintextReadOnly: true})
+	defer ni.Close()
+	if err := ni.CreateFile(t, 1024*1024); err != nil {
+		t.Fatalf("Could not create file: %v", err)
+	}
+	for _, tls := range []bool{false, true} {
+		tc := ni.TestConfig
+		tc.Tls = tls
+		nic := &NbdInstance{t: t, quit: make(chan struct{}), TestConfig: tc}
+		if err := nic.Connect(t); err != nil {
+			t.Fatalf("Could not connect (TLS %v): %v", tls, err)
+		}
+		if err := nic.Go(t); err != nil {
+			t.Fatalf("Could not negotiate (TLS %v): %v", tls, err)
+		}
+		if readonly := nic.transmissionFlags&NBD_FLAG_READ_ONLY != 0; readonly == tls {
+			t.Errorf("Connection with TLS %v advertised read-only %v", tls, readonly)
+		}
+		expected := uint32(0)
+		if !tls {
+			expected = NBD_EPERM
+		}
+		if rep, _, err := nic.Command(t, NBD_CMD_WRITE, 0, 0, 4096, make([]byte, 4096)); err != nil {
+			t.Fatalf("Error on write (TLS %v): %v", tls, err)
+		} else if rep.NbdError != expected {
+			t.Errorf("Write with TLS %v returned error %d, expected %d", tls, rep.NbdError, expected)
+		}
+		if err := nic.Disconnect(t); err != nil {
+			t.Errorf("Error on disconnect: %v", err)
+		}
+	}
+}
+
+// countingConn counts the writes made to a connection
+type countingConn struct {
+	net.Conn
+	writes int64
+}
+
+func (cc *countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(&cc.writes, 1)
+	return cc.Conn.Write(b)
+}
+
+func TestTransmitBatching(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := &countingConn{Conn: server}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &Connection{
+		logger:     log.New(ioutil.Discard, "", 0),
+		conn:       conn,
+		export:     &Export{memoryBlockSize: 4096},
+		txCh:       make(chan Request, 1024),
+		memBlockCh: make(chan []byte, 1024),
+		killCh:     make(chan struct{}),
+	}
+	// many small read replies, all ready at once
+	const replies = 64
+	const length = 512
+	for i := 0; i < replies; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, length)
+		c.txCh <- Request{
+			nbdRep:  nbdReply{NbdReplyMagic: NBD_REPLY_MAGIC, NbdHandle: uint64(i)},
+			repData: [][]byte{data},
+			length:  length,
+			flags:   CMDT_REP_PAYLOAD,
+		}
+	}
+	atomic.StoreInt64(&c.numInflight, replies)
+	c.wg.Add(1)
+	go c.Transmit(ctx)
+
+	// each reply arrives whole, in the order queued
+	for i := 0; i < replies; i++ {
+		var rep nbdReply
+		if err := binary.Read(client, binary.BigEndian, &rep); err != nil {
+			t.Fatalf("Could not read reply %d: %v", i, err)
+		}
+		if rep.NbdHandle != uint64(i) {
+			t.Fatalf("Reply %d had handle %d", i, rep.NbdHandle)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(client, data); err != nil || !bytes.Equal(data, bytes.Repeat([]byte{byte(i)}, length)) {
+			t.Fatalf("Reply %d had bad data: %v", i, err)
+		}
+	}
+	// unbatched, each reply would take two writes
+	if writes := atomic.LoadInt64(&conn.writes); writes > 2 {
+		t.Errorf("%d replies took %d writes", replies, writes)
+	}
+	for start := time.Now(); atomic.LoadInt64(&c.numInflight) != 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("Replies are still in flight after being sent")
+		}
+	}
+
+	// a lone reply is sent at once
+	c.txCh <- Request{nbdRep: nbdReply{NbdReplyMagic: NBD_REPLY_MAGIC, NbdHandle: replies}}
+	client.SetDeadline(time.Now().Add(time.Second))
+	var rep nbdReply
+	if err := binary.Read(client, binary.BigEndian, &rep); err != nil || rep.NbdHandle != replies {
+		t.Errorf("Lone reply was not sent: %v", err)
+	}
+	cancel()
+	c.wg.Wait()
+}
+
+// flushCountingBackend counts the flushes of the backend it wraps
+type flushCountingBackend struct {
+	Backend
+	flushes int32
+}
+
+func (fcb *flushCountingBackend) Flush(ctx context.Context) error {
+	atomic.AddInt32(&fcb.flushes, 1)
+	return fcb.Backend.Flush(ctx)
+}
+
+func TestSyncInterval(t *testing.T) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+	filename := path.Join(TempDir, "nbd.img")
+	if err := ioutil.WriteFile(filename, make([]byte, 1024*1024), 0644); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	ctx := context.Background()
+	ec := &ExportConfig{Name: "syncinterval", Driver: "file", DriverParameters: DriverParametersConfig{"path": filename, "syncinterval": "20ms"}}
+	fb, err := NewFileBackend(ctx, ec)
+	if err != nil {
+		t.Fatalf("Could not open backend: %v", err)
+	}
+	counter := &flushCountingBackend{Backend: fb}
+	backend, err := newSyncIntervalBackend(ctx, ec, counter)
+	if err != nil {
+		t.Fatalf("Could not wrap backend: %v", err)
+	}
+
+	// a write is flushed in the background, once
+	if _, err := backend.WriteAt(ctx, make([]byte, 4096), 0, false); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if flushes := atomic.LoadInt32(&counter.flushes); flushes != 1 {
+		t.Errorf("Write was flushed %d times, expected once", flushes)
+	}
+	if expvar.Get("nbd_exports").(*expvar.Map).Get("syncinterval").(*expvar.Map).Get("last_background_flush") == nil {
+		t.Errorf("Time of the last background flush is not published")
+	}
+	// a write the client has flushed needs no background flush
+	backend.WriteAt(ctx, make([]byte, 4096), 0, false)
+	backend.Flush(ctx)
+	time.Sleep(100 * time.Millisecond)
+	if flushes := atomic.LoadInt32(&counter.flushes); flushes != 2 {
+		t.Errorf("Flushed %d times after a client flush, expected twice", flushes)
+	}
+	// closing stops the background flushes
+	backend.WriteAt(ctx, make([]byte, 4096), 0, false)
+	if err := backend.Close(ctx); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	flushes := atomic.LoadInt32(&counter.flushes)
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadInt32(&counter.flushes) != flushes {
+		t.Errorf("Background flushes continued after close")
+	}
+
+	// read-only exports are not flushed
+	ec.ReadOnly = true
+	if b, err := newSyncIntervalBackend(ctx, ec, counter); err != nil || b != Backend(counter) {
+		t.Errorf("Read-only export was wrapped: %v", err)
+	}
+}
+
+func TestCleanMarker(t *testing.T) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+	ctx := context.Background()
+	marker := func(name string) string {
+		b, _ := ioutil.ReadFile(path.Join(TempDir, name+".img.clean"))
+		return string(b)
+	}
+	unclean := func(name string) bool {
+		_, ok := expvar.Get("nbd_unclean_exports").(expvar.Func)().(map[string]string)[name]
+		return ok
+	}
+	config := func(name string) *ExportConfig {
+		filename := path.Join(TempDir, name+".img")
+		if err := ioutil.WriteFile(filename, make([]byte, 1024*1024), 0644); err != nil {
+			t.Fatalf("Could not write file: %v", err)
+		}
+		return &ExportConfig{Name: name, Driver: "file", DriverParameters: DriverParametersConfig{"path": filename, "cleanmarker": "true"}}
+	}
+
+	// the marker is dirty whilst any backend has the file open
+	ec := config("cleanfoo")
+	b1, err := NewFileBackend(ctx, ec)
+	if err != nil {
+		t.Fatalf("Could not open backend: %v", err)
+	}
+	b2, err := NewFileBackend(ctx, ec)
+	if err != nil {
+		t.Fatalf("Could not open backend: %v", err)
+	}
+	if m := marker("cleanfoo"); m != cleanMarkerDirty {
+		t.Errorf("Marker of open export is %q", m)
+	}
+	b1.Close(ctx)
+	if m := marker("cleanfoo"); m != cleanMarkerDirty {
+		t.Errorf("Marker of export still open is %q", m)
+	}
+	b2.Close(ctx)
+	if m := marker("cleanfoo"); m != cleanMarkerClean {
+		t.Errorf("Marker of closed export is %q", m)
+	}
+	if unclean("cleanfoo") {
+		t.Errorf("Export without a marker reported unclean")
+	}
+
+	// an export left dirty is reported when the configuration is loaded
+	ec = config("cleanbar")
+	if err := ioutil.WriteFile(path.Join(TempDir, "cleanbar.img.clean"), []byte(cleanMarkerDirty), 0644); err != nil {
+		t.Fatalf("Could not write marker: %v", err)
+	}
+	reportUncleanExports(log.New(ioutil.Discard, "", 0), &Config{Servers: []ServerConfig{{Exports: []ExportConfig{*ec}}}})
+	if !unclean("cleanbar") {
+		t.Errorf("Export left dirty was not reported")
+	}
+	b, err := NewFileBackend(ctx, ec)
+	if err != nil {
+		t.Fatalf("Could not open backend: %v", err)
+	}
+	b.Close(ctx)
+	if m := marker("cleanbar"); m != cleanMarkerClean {
+		t.Errorf("Marker of closed export is %q", m)
+	}
+
+	// read-only exports keep no marker
+	ec = config("cleanbaz")
+	ec.ReadOnly = true
+	if b, err := NewFileBackend(ctx, ec); err != nil {
+		t.Fatalf("Could not open backend: %v", err)
+	} else {
+		b.Close(ctx)
+	}
+	if m := marker("cleanbaz"); m != "" {
+		t.Errorf("Read-only export has a marker %q", m)
+	}
+}
+
+func TestAsyncWriteQueue(t *testing.T) {
+	const depth = 4
+	const writes = 2000
+	const size = 4096
+	q := newAsyncWriteQueue(depth)
+	disk := make([]byte, writes*size)
+	var outstanding, maxOutstanding int32
+	submit := func(offset int64) func(b []byte) (func() error, error) {
+		return func(b []byte) (func() error, error) {
+			n := atomic.AddInt32(&outstanding, 1)
+			for {
+				m := atomic.LoadInt32(&maxOutstanding)
+				if n <= m || atomic.CompareAndSwapInt32(&maxOutstanding, m, n) {
+					break
+				}
+			}
+			return func() error {
+				// a slow backend
+				time.Sleep(100 * time.Microsecond)
+				copy(disk[offset:], b)
+				atomic.AddInt32(&outstanding, -1)
+				return nil
+			}, nil
+		}
+	}
+	// flood writes from a single buffer reused at once, as the dispatch loop would
+	b := make([]byte, size)
+	start := time.Now()
+	for i := 0; i < writes; i++ {
+		for j := range b {
+			b[j] = byte(i)
+		}
+		offset := int64(i * size)
+		if err := q.write(context.Background(), b, offset, submit(offset)); err != nil {
+			t.Fatalf("Write %d failed: %v", i, err)
+		}
+		if n := atomic.LoadInt32(&outstanding); n > depth {
+			t.Fatalf("%d writes outstanding with a queue depth of %d", n, depth)
+		}
+	}
+	if err := q.drain(); err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+	elapsed := time.Since(start)
+	if n := atomic.LoadInt32(&outstanding); n != 0 {
+		t.Errorf("%d writes outstanding after draining", n)
+	}
+	if maxOutstanding > depth || q.maxOutstanding > depth {
+		t.Errorf("Up to %d writes were outstanding with a queue depth of %d", maxOutstanding, depth)
+	}
+	// writes must overlap for throughput to be sustained despite the slow backend
+	if maxOutstanding < 2 {
+		t.Errorf("Writes were not issued asynchronously")
+	}
+	for i := 0; i < writes; i++ {
+		if disk[i*size] != byte(i) || disk[(i+1)*size-1] != byte(i) {
+			t.Fatalf("Write %d did not land intact", i)
+		}
+	}
+	t.Logf("%d writes in %v", writes, elapsed)
+
+	// an error is reported by the next drain, and only by it
+	offset := int64(0)
+	if err := q.write(context.Background(), b, offset, func(b []byte) (func() error, error) {
+		return func() error { return syscall.EIO }, nil
+	}); err != nil {
+		t.Fatalf("Write failed at once: %v", err)
+	}
+	if err := q.drain(); err != syscall.EIO {
+		t.Errorf("Drain returned %v, expected EIO", err)
+	}
+	if err := q.drain(); err != nil {
+		t.Errorf("Second drain returned %v", err)
+	}
+}
+
+func TestAsyncQueueDepth(t *testing.T) {
+	if _, ok := BackendMap["aiofile"]; !ok {
+		t.Skip("Skipping test as driver aiofile not built")
+	}
+	ni := ConnectAndGo(t, TestConfig{Driver: "aiofile", AsyncQueueDepth: "8"}, 1024*1024)
+	defer ni.Close()
+	if ni.transmissionFlags&NBD_FLAG_SEND_FLUSH == 0 {
+		t.Fatalf("Flush not advertised with asynchronous writes")
+	}
+	for i := 0; i < 64; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 4096)
+		if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, uint64(i%16)*4096, 4096, data); err != nil || rep.NbdError != 0 {
+			t.Fatalf("Write %d failed: %v %d", i, err, rep.NbdError)
+		}
+	}
+	// reads see the last of the overlapping writes
+	for i := 0; i < 16; i++ {
+		rep, data, err := ni.Command(t, NBD_CMD_READ, 0, uint64(i)*4096, 4096, nil)
+		if err != nil || rep.NbdError != 0 {
+			t.Fatalf("Read %d failed: %v %d", i, err, rep.NbdError)
+		}
+		if !bytes.Equal(data, bytes.Repeat([]byte{byte(48 + i)}, 4096)) {
+			t.Errorf("Read %d returned stale data", i)
+		}
+	}
+	if rep, _, err := ni.Command(t, NBD_CMD_FLUSH, 0, 0, 0, nil); err != nil || rep.NbdError != 0 {
+		t.Fatalf("Flush failed: %v %d", err, rep.NbdError)
+	}
+}
+
+func TestSplitFd(t *testing.T) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+	ctx := context.Background()
+	filename := path.Join(TempDir, "nbd.img")
+	const size = 1024 * 1024
+	if err := ioutil.WriteFile(filename, make([]byte, size), 0644); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+
+	// direct I/O needs separate descriptors
+	if _, err := NewFileBackend(ctx, &ExportConfig{Name: "foo", Driver: "file", DriverParameters: DriverParametersConfig{"path": filename, "writedirect": "true"}}); err == nil {
+		t.Errorf("writedirect accepted without splitfd")
+	}
+
+	b, err := NewFileBackend(ctx, &ExportConfig{Name: "foo", Driver: "file", DriverParameters: DriverParametersConfig{"path": filename, "splitfd": "true"}})
+	if err != nil {
+		t.Fatalf("Could not open backend: %v", err)
+	}
+	fb := b.(*FileBackend)
+	if fb.readFile == fb.file {
+		t.Fatalf("splitfd did not open a separate descriptor for reads")
+	}
+	// every write must be visible at once to reads through the other descriptor
+	expected := make([]byte, size)
+	for i := 0; i < 256; i++ {
+		offset := int64(i*7919*512) % (size - 8192)
+		data := make([]byte, 512*(1+i%16))
+		rand.Read(data)
+		if _, err := fb.WriteAt(ctx, data, offset, i%4 == 0); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		copy(expected[offset:], data)
+		got := make([]byte, len(data))
+		if _, err := fb.ReadAt(ctx, got, offset); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		} else if !bytes.Equal(got, data) {
+			t.Fatalf("Read %d bytes at %d did not see the write just made", len(data), offset)
+		}
+	}
+	got := make([]byte, size)
+	if _, err := fb.ReadAtv(ctx, [][]byte{got[:size/2], got[size/2:]}, 0); err != nil {
+		t.Fatalf("Vectored read failed: %v", err)
+	} else if !bytes.Equal(got, expected) {
+		t.Errorf("Vectored read did not see every write")
+	}
+	if err := fb.Close(ctx); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, err := fb.readFile.Stat(); err == nil {
+		t.Errorf("Descriptor for reads left open")
+	}
+	if _, err := fb.file.Stat(); err == nil {
+		t.Errorf("Descriptor for writes left open")
+	}
+}
+
+func TestLoadReport(t *testing.T) {
+	ni := ConnectAndGo(t, TestConfig{Driver: "file"}, 1024*1024)
+	defer ni.Close()
+
+	lr := GetLoadReport()
+	if lr.Connections != 1 || lr.Status != "up" || lr.Load != 0 {
+		t.Errorf("Unexpected load report %+v", lr)
+	}
+	if reply := lr.agentCheckReply(); reply != "up 100%\n" {
+		t.Errorf("Agent check reply %q without a connection limit", reply)
+	}
+	setMaxConnections(4)
+	defer setMaxConnections(0)
+	if lr = GetLoadReport(); lr.Load != 25 || lr.agentCheckReply() != "up 75%\n" {
+		t.Errorf("Unexpected load report %+v with a connection limit", lr)
+	}
+
+	// served as JSON with -pprof
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest("GET", "/debug/load", nil))
+	var served LoadReport
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil {
+		t.Fatalf("Could not decode load report %q: %v", w.Body.String(), err)
+	} else if served.Connections != 1 || served.MaxConnections != 4 || served.Status != "up" {
+		t.Errorf("Unexpected load report served %+v", served)
+	}
+
+	// and as an agent check
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not find a free port: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	if err := runAgentCheck(ctx, log.New(ioutil.Discard, "", 0), addr); err != nil {
+		t.Fatalf("Could not serve agent checks: %v", err)
+	}
+	agentCheck := func() string {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Could not connect to agent check: %v", err)
+		}
+		defer conn.Close()
+		b, _ := ioutil.ReadAll(conn)
+		return string(b)
+	}
+	if reply := agentCheck(); reply != "up 75%\n" {
+		t.Errorf("Agent check replied %q", reply)
+	}
+	Quiesce()
+	reply := agentCheck()
+	Resume()
+	if reply != "drain\n" {
+		t.Errorf("Agent check replied %q when quiesced", reply)
+	}
+
+	// a failed backend takes the server out of service until closed
+	filename := path.Join(ni.TempDir, "failed.img")
+	if err := ioutil.WriteFile(filename, make([]byte, 65536), 0644); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	b, err := NewFileBackend(ctx, &ExportConfig{Name: "failed", Driver: "file", DriverParameters: DriverParametersConfig{"path": filename, "checkinterval": "0"}})
+	if err != nil {
+		t.Fatalf("Could not open backend: %v", err)
+	}
+	os.Remove(filename)
+	if _, err := b.ReadAt(ctx, make([]byte, 512), 0); err == nil {
+		t.Errorf("Read of deleted file succeeded")
+	}
+	if reply := agentCheck(); reply != "down\n" {
+		t.Errorf("Agent check replied %q with a failed backend", reply)
+	}
+	b.Close(ctx)
+	if lr = GetLoadReport(); lr.FailedBackends != 0 || lr.Status != "up" {
+		t.Errorf("Unexpected load report %+v once the failed backend was closed", lr)
+	}
+}
+
+// barrierCountingBackend counts the flushes and barriers of the backend it wraps
+type barrierCountingBackend struct {
+	flushCountingBackend
+	barriers int32
+}
+
+func (bcb *barrierCountingBackend) Barrier(ctx context.Context) error {
+	atomic.AddInt32(&bcb.barriers, 1)
+	return nil
+}
+
+func TestFlushBarrier(t *testing.T) {
+	var opened *barrierCountingBackend
+	RegisterBackend("barriertest", func(ctx context.Context, ec *ExportConfig) (Backend, error) {
+		fb, err := NewFileBackend(ctx, ec)
+		if err != nil {
+			return nil, err
+		}
+		opened = &barrierCountingBackend{flushCountingBackend: flushCountingBackend{Backend: fb}}
+		return opened, nil
+	})
+	defer delete(BackendMap, "barriertest")
+
+	for _, tc := range []struct {
+		driver       string
+		flushBarrier bool
+		barriers     int32
+	}{
+		{"barriertest", false, 0},
+		{"barriertest", true, 1},
+		{"file", true, 0}, // not supported, so a full flush
+	} {
+		opened = nil
+		ni := ConnectAndGo(t, TestConfig{Driver: tc.driver, FlushBarrier: tc.flushBarrier}, 1024*1024)
+		if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 0, 4096, make([]byte, 4096)); err != nil || rep.NbdError != 0 {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if rep, _, err := ni.Command(t, NBD_CMD_FLUSH, 0, 0, 0, nil); err != nil || rep.NbdError != 0 {
+			t.Fatalf("Flush failed: %v", err)
+		}
+		if opened != nil {
+			barriers, flushes := atomic.LoadInt32(&opened.barriers), atomic.LoadInt32(&opened.flushes)
+			if barriers != tc.barriers || barriers+flushes != 1 {
+				t.Errorf("flushbarrier=%v: flush made %d barriers and %d flushes", tc.flushBarrier, barriers, flushes)
+			}
+		}
+		ni.Close()
+	}
+}
+
+func TestWriteZeroesNoHole(t *testing.T) {
+	ni := ConnectAndGo(t, TestConfig{}, 1024*1024)
+	defer ni.Close()
+	filename := path.Join(ni.TempDir, "nbd.img")
+	if f, err := os.OpenFile(filename, os.O_RDWR, 0); err != nil {
+		t.Fatalf("Could not open file: %v", err)
+	} else {
+		err := punchHole(f, 0, 4096)
+		f.Close()
+		if err == errPunchHoleUnsupported {
+			t.Skip("Skipping test as holes are not supported here")
+		}
+	}
+	allocated := func() int64 {
+		info, err := os.Stat(filename)
+		if err != nil {
+			t.Fatalf("Could not stat file: %v", err)
+		}
+		return info.Sys().(*syscall.Stat_t).Blocks * 512
+	}
+
+	const length = 256 * 1024
+	if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 0, length, bytes.Repeat([]byte{0xff}, length)); err != nil || rep.NbdError != 0 {
+		t.Fatalf("Write failed: %v %v", rep, err)
+	}
+	before := allocated()
+	for _, tc := range []struct {
+		flags  uint16
+		offset uint64
+		freed  bool
+	}{
+		{NBD_CMD_FLAG_NO_HOLE, 0, false}, // zeroed in place (or written), so stay allocated
+		{0, length / 2, true},            // a hole is punched
+	} {
+		if rep, _, err := ni.Command(t, NBD_CMD_WRITE_ZEROES, tc.flags, tc.offset, length/2, nil); err != nil || rep.NbdError != 0 {
+			t.Fatalf("Write zeroes with flags %x failed: %v %v", tc.flags, rep, err)
+		}
+		if rep, got, err := ni.Command(t, NBD_CMD_READ, 0, tc.offset, length/2, nil); err != nil || rep.NbdError != 0 || !bytes.Equal(got, make([]byte, length/2)) {
+			t.Errorf("Write zeroes with flags %x did not zero: %v %v", tc.flags, rep, err)
+		}
+		after := allocated()
+		if freed := after <= before-length/2; freed != tc.freed {
+			t.Errorf("Write zeroes with flags %x changed the allocation from %d to %d bytes", tc.flags, before, after)
+		}
+		before = after
+	}
+}
+
+func TestReadOnlyFlush(t *testing.T) {
+	ni := ConnectAndGo(t, TestConfig{ReadOnly: true}, 1024*1024)
+	defer ni.Close()
+	if ni.transmissionFlags&NBD_FLAG_READ_ONLY == 0 {
+		t.Fatalf("Read-only export not advertised as such")
+	}
+	if ni.transmissionFlags&(NBD_FLAG_SEND_FLUSH|NBD_FLAG_SEND_FUA) != 0 {
+		t.Errorf("Read-only export advertised flush or FUA")
+	}
+	// a client flushing anyway is told it succeeded
+	if rep, _, err := ni.Command(t, NBD_CMD_FLUSH, 0, 0, 0, nil); err != nil || rep.NbdError != 0 {
+		t.Errorf("Flush of read-only export got %v %v", rep, err)
+	}
+	if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 0, 4096, make([]byte, 4096)); err != nil || rep.NbdError != NBD_EPERM {
+		t.Errorf("Write to read-only export got %v %v, expected EPERM", rep, err)
+	}
+}
+
+// testSizeProvider reports whatever size it is set to
+type testSizeProvider struct {
+	size    uint64 // accessed atomically
+	queries int32  // accessed atomically
+}
+
+func (sp *testSizeProvider) Size(ctx context.Context, ec *ExportConfig) (uint64, error) {
+	atomic.AddInt32(&sp.queries, 1)
+	return atomic.LoadUint64(&sp.size), nil
+}
+
+func TestSizeProvider(t *testing.T) {
+	sp := &testSizeProvider{}
+	RegisterSizeProvider("test", sp)
+	defer delete(SizeProviderMap, "test")
+
+	for _, ttl := range []string{"0s", "1h"} {
+		cachedSizesMutex.Lock()
+		delete(cachedSizes, "foo")
+		cachedSizesMutex.Unlock()
+		atomic.StoreInt32(&sp.queries, 0)
+		ni := StartNbd(t, TestConfig{Driver: "file", SizeProvider: "test", SizeTtl: ttl})
+		if err := ni.CreateFile(t, 4*1024*1024); err != nil {
+			ni.Close()
+			t.Fatalf("Error on create file: %v", err)
+		}
+		// the size is queried as each client negotiates, unless cached
+		for i, size := range []uint64{1024 * 1024, 3 * 1024 * 1024} {
+			atomic.StoreUint64(&sp.size, size)
+			if err := ni.Connect(t); err != nil {
+				ni.Close()
+				t.Fatalf("Error on connect: %v", err)
+			}
+			if err := ni.Go(t); err != nil {
+				ni.Close()
+				t.Fatalf("Error on go: %v", err)
+			}
+			expected := size
+			if ttl != "0s" {
+				expected = 1024 * 1024
+			}
+			if ni.exportSize != expected {
+				t.Errorf("sizettl=%s: negotiation %d got size %d, expected %d", ttl, i, ni.exportSize, expected)
+			}
+			if err := ni.Disconnect(t); err != nil {
+				t.Errorf("Error on disconnect: %v", err)
+			}
+		}
+		if queries, expected := atomic.LoadInt32(&sp.queries), map[string]int32{"0s": 2, "1h": 1}[ttl]; queries != expected {
+			t.Errorf("sizettl=%s: size queried %d times, expected %d", ttl, queries, expected)
+		}
+		ni.Close()
+	}
+}
+
+// flushFailingBackend fails flushes with ENOSPC while failing is set
+type flushFailingBackend struct {
+	Backend
+	failing *int32
+}
+
+func (ffb *flushFailingBackend) Flush(ctx context.Context) error {
+	if atomic.LoadInt32(ffb.failing) != 0 {
+		return syscall.ENOSPC
+	}
+	return ffb.Backend.Flush(ctx)
+}
+
+func TestFlushFailure(t *testing.T) {
+	var failing int32
+	RegisterBackend("flushfailtest", func(ctx context.Context, ec *ExportConfig) (Backend, error) {
+		fb, err := NewFileBackend(ctx, ec)
+		if err != nil {
+			return nil, err
+		}
+		return &flushFailingBackend{Backend: fb, failing: &failing}, nil
+	})
+	defer delete(BackendMap, "flushfailtest")
+
+	for _, policy := range []string{"continue", "rejectwrites"} {
+		ni := ConnectAndGo(t, TestConfig{Driver: "flushfailtest", OnFlushFailure: policy}, 1024*1024)
+		atomic.StoreInt32(&failing, 1)
+		if rep, _, err := ni.Command(t, NBD_CMD_FLUSH, 0, 0, 0, nil); err != nil || rep.NbdError != NBD_ENOSPC {
+			t.Errorf("onflushfailure=%s: failed flush got %v %v, expected ENOSPC", policy, rep, err)
+		}
+		if unhealthy := GetLoadReport().Unhealthy; unhealthy != 1 {
+			t.Errorf("onflushfailure=%s: %d exports reported unhealthy after a failed flush", policy, unhealthy)
+		}
+		// writes are rejected with the flush's error only if the policy says so
+		expected := map[string]uint32{"continue": 0, "rejectwrites": NBD_ENOSPC}[policy]
+		if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 0, 4096, make([]byte, 4096)); err != nil || rep.NbdError != expected {
+			t.Errorf("onflushfailure=%s: write after failed flush got %v %v, expected error %d", policy, rep, err, expected)
+		}
+		if rep, _, err := ni.Command(t, NBD_CMD_READ, 0, 0, 4096, nil); err != nil || rep.NbdError != 0 {
+			t.Errorf("onflushfailure=%s: read after failed flush got %v %v", policy, rep, err)
+		}
+		// once a flush succeeds, the export is healthy again
+		atomic.StoreInt32(&failing, 0)
+		if rep, _, err := ni.Command(t, NBD_CMD_FLUSH, 0, 0, 0, nil); err != nil || rep.NbdError != 0 {
+			t.Errorf("onflushfailure=%s: flush got %v %v", policy, rep, err)
+		}
+		if unhealthy := GetLoadReport().Unhealthy; unhealthy != 0 {
+			t.Errorf("onflushfailure=%s: %d exports reported unhealthy after a successful flush", policy, unhealthy)
+		}
+		if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 0, 4096, make([]byte, 4096)); err != nil || rep.NbdError != 0 {
+			t.Errorf("onflushfailure=%s: write after successful flush got %v %v", policy, rep, err)
+		}
+		ni.Close()
+	}
+}
+
+func TestStartTlsUnavailable(t *testing.T) {
+	for _, action := range []string{"", "unsup", "close"} {
+		ni := StartNbd(t, TestConfig{Driver: "file", OnStartTlsUnavailable: action})
+		if err := ni.CreateFile(t, 1024*1024); err != nil {
+			ni.Close()
+			t.Fatalf("Error on create file: %v", err)
+		}
+		if err := ni.Connect(t); err != nil {
+			ni.Close()
+			t.Fatalf("Error on connect: %v", err)
+		}
+		replyType, err := ni.Option(t, NBD_OPT_STARTTLS, nil)
+		if action == "close" {
+			if err == nil {
+				t.Errorf("onstarttlsunavailable=close: STARTTLS got reply %x rather than the connection being closed", replyType)
+			}
+		} else if err != nil {
+			t.Errorf("onstarttlsunavailable=%s: STARTTLS failed: %v", action, err)
+		} else if replyType != NBD_REP_ERR_UNSUP {
+			t.Errorf("onstarttlsunavailable=%s: STARTTLS got reply %x, expected NBD_REP_ERR_UNSUP", action, replyType)
+		} else if err := ni.Go(t); err != nil {
+			// the client may carry on in plaintext
+			t.Errorf("onstarttlsunavailable=%s: could not continue without TLS: %v", action, err)
+		}
+		ni.Close()
+	}
+}
+
+// blockingBackend blocks reads until released, recording how many are in progress at most
+type blockingBackend struct {
+	Backend
+	release    chan struct{}
+	inProgress *int32
+	maximum    *int32
+}
+
+func (bb *blockingBackend) ReadAt(ctx context.Context, b []byte, offset int64) (int, error) {
+	n := atomic.AddInt32(bb.inProgress, 1)
+	for {
+		m := atomic.LoadInt32(bb.maximum)
+		if n <= m || atomic.CompareAndSwapInt32(bb.maximum, m, n) {
+			break
+		}
+	}
+	<-bb.release
+	atomic.AddInt32(bb.inProgress, -1)
+	return len(b), nil
+}
+
+func TestWorkerPool(t *testing.T) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+	ctx := context.Background()
+	open := func(name string, params DriverParametersConfig) Backend {
+		filename := path.Join(TempDir, name+".img")
+		if err := ioutil.WriteFile(filename, make([]byte, 65536), 0644); err != nil {
+			t.Fatalf("Could not write file: %v", err)
+		}
+		params["path"] = filename
+		ec := &ExportConfig{Name: name, Driver: "file", DriverParameters: params}
+		fb, err := NewFileBackend(ctx, ec)
+		if err != nil {
+			t.Fatalf("Could not open backend: %v", err)
+		}
+		b, err := newWorkerPoolBackend(ctx, ec, fb)
+		if err != nil {
+			t.Fatalf("Could not wrap backend: %v", err)
+		}
+		return b
+	}
+
+	// two connections to a busy export, sharing its pool of two workers
+	release := make(chan struct{})
+	var inProgress, maximum int32
+	busy := []Backend{open("busy", DriverParametersConfig{"workerpool": "2"}), open("busy", DriverParametersConfig{"workerpool": "2"})}
+	for _, b := range busy {
+		wb := b.(*workerPoolCacherBackend)
+		wb.Backend = &blockingBackend{Backend: wb.Backend, release: release, inProgress: &inProgress, maximum: &maximum}
+	}
+	if busy[0].(*workerPoolCacherBackend).pool != busy[1].(*workerPoolCacherBackend).pool {
+		t.Fatalf("Connections to an export do not share its pool")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(b Backend) {
+			defer wg.Done()
+			b.ReadAt(ctx, make([]byte, 512), 0)
+		}(busy[i%2])
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// an export with its own pool is unaffected by the storm
+	quiet := open("quiet", DriverParametersConfig{"workerpool": "2"})
+	done := make(chan error)
+	go func() {
+		_, err := quiet.ReadAt(ctx, make([]byte, 512), 0)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Read from quiet export failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Read from quiet export starved by busy export")
+	}
+	if n := atomic.LoadInt32(&maximum); n != 2 {
+		t.Errorf("Busy export had %d reads in progress, expected its pool size of 2", n)
+	}
+
+	// whereas an export grouped with the busy one shares its fate
+	grouped := []Backend{open("g1", DriverParametersConfig{"workerpool": "2", "workerpoolgroup": "g"}), open("g2", DriverParametersConfig{"workerpool": "2", "workerpoolgroup": "g"})}
+	if grouped[0].(*workerPoolCacherBackend).pool != grouped[1].(*workerPoolCacherBackend).pool {
+		t.Errorf("Exports in a group do not share a pool")
+	}
+
+	close(release)
+	wg.Wait()
+	for _, b := range append(append(busy, grouped...), quiet) {
+		b.Close(ctx)
+	}
+	workerPoolsMutex.Lock()
+	defer workerPoolsMutex.Unlock()
+	if len(workerPools) != 0 {
+		t.Errorf("%d worker pools left running", len(workerPools))
+	}
+}
+
+func TestStrictNegotiation(t *testing.T) {
+	// NBD_OPT_INFO for export foo requesting no info types, with trailing data
+	trailing := []byte{0, 0, 0, 3, 'f', 'o', 'o', 0, 0, 0xde, 0xad, 0xbe, 0xef}
+	for _, strict := range []bool{false, true} {
+		for _, tc := range []struct {
+			name        string
+			clientFlags uint32
+			option      []byte
+		}{
+			{"reserved client flags", NBD_FLAG_C_FIXED_NEWSTYLE | NBD_FLAG_C_NO_ZEROES | 1<<5, nil},
+			{"trailing option data", 0, trailing},
+		} {
+			ni := StartNbd(t, TestConfig{Driver: "file", Strict: strict})
+			ni.clientFlags = tc.clientFlags
+			if err := ni.CreateFile(t, 1024*1024); err != nil {
+				ni.Close()
+				t.Fatalf("Error on create file: %v", err)
+			}
+			// a strict server disconnects a client setting reserved flags
+			err := ni.Connect(t)
+			if disconnected := strict && tc.clientFlags != 0; (err != nil) != disconnected {
+				t.Errorf("strict=%v: %s: connect returned %v", strict, tc.name, err)
+			}
+			if err != nil {
+				ni.Close()
+				continue
+			}
+			if tc.option != nil {
+				replyType, err := ni.Option(t, NBD_OPT_INFO, tc.option)
+				if err != nil {
+					t.Errorf("strict=%v: %s: info failed: %v", strict, tc.name, err)
+				} else if expected := map[bool]uint32{false: NBD_REP_ACK, true: NBD_REP_ERR_INVALID}[strict]; replyType != expected {
+					t.Errorf("strict=%v: %s: info got reply %x, expected %x", strict, tc.name, replyType, expected)
+				}
+			}
+			if err := ni.Go(t); err != nil {
+				t.Errorf("strict=%v: %s: go failed: %v", strict, tc.name, err)
+			}
+			ni.Close()
+		}
+	}
+}
+
+func TestCheckFraming(t *testing.T) {
+	ni := ConnectAndGo(t, TestConfig{CheckFraming: true}, 1024*1024)
+	defer ni.Close()
+
+	// well framed writes are applied as usual
+	data := bytes.Repeat([]byte{0x55}, 4096)
+	if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 0, 4096, data); err != nil || rep.NbdError != 0 {
+		t.Fatalf("Write failed: %v %v", rep, err)
+	}
+	if rep, got, err := ni.Command(t, NBD_CMD_READ, 0, 0, 4096, nil); err != nil || rep.NbdError != 0 || !bytes.Equal(got, data) {
+		t.Fatalf("Read back failed: %v %v", rep, err)
+	}
+
+	// a write sending more payload than it declares is detected, and the
+	// connection closed without applying it
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, nbdRequest{
+		NbdRequestMagic: NBD_REQUEST_MAGIC,
+		NbdCommandType:  NBD_CMD_WRITE,
+		NbdHandle:       getHandle(),
+		NbdOffset:       8192,
+		NbdLength:       4096,
+	})
+	buf.Write(bytes.Repeat([]byte{0xaa}, 8192))
+	ni.conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := ni.conn.Write(buf.Bytes()); err != nil {
+		t.Fatalf("Could not send write: %v", err)
+	}
+	var rep nbdReply
+	if err := binary.Read(ni.conn, binary.BigEndian, &rep); err == nil {
+		t.Errorf("Desynchronised write got reply %v, expected the connection to close", rep)
+	}
+	contents, err := ioutil.ReadFile(path.Join(ni.TempDir, "nbd.img"))
+	if err != nil {
+		t.Fatalf("Could not read back file: %v", err)
+	}
+	if !bytes.Equal(contents[8192:8192+4096], make([]byte, 4096)) {
+		t.Errorf("Desynchronised write was applied")
+	}
+}
+
+// writeMbrEntry writes entry i of the MBR (or EBR) in sector
+func writeMbrEntry(sector []byte, i int, partitionType uint8, firstLBA uint32, sectors uint32) {
+	e := sector[446+16*i:]
+	e[4] = partitionType
+	binary.LittleEndian.PutUint32(e[8:], firstLBA)
+	binary.LittleEndian.PutUint32(e[12:], sectors)
+	binary.LittleEndian.PutUint16(sector[510:], 0xaa55)
+}
+
+func TestAutoPartition(t *testing.T) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+	ctx := context.Background()
+	const size = 4 * 1024 * 1024
+
+	// MBR: two primary partitions, and an extended partition holding two logical ones
+	mbr := make([]byte, size)
+	writeMbrEntry(mbr, 0, 0x83, 2048, 1024)
+	writeMbrEntry(mbr, 1, 0x83, 4096, 2048)
+	writeMbrEntry(mbr, 2, 0x05, 6144, 2048)
+	ebr := mbr[6144*512:]
+	writeMbrEntry(ebr, 0, 0x83, 1, 511)
+	writeMbrEntry(ebr, 1, 0x05, 512, 1024)
+	ebr = mbr[(6144+512)*512:]
+	writeMbrEntry(ebr, 0, 0x83, 1, 1023)
+
+	// GPT: two partitions, one labelled, behind a protective MBR
+	gpt := make([]byte, size)
+	writeMbrEntry(gpt, 0, 0xee, 1, size/512-1)
+	entries := gpt[2*512 : 2*512+128*128]
+	for i, p := range []struct {
+		first, last uint64
+		label       string
+	}{{34, 2081, "root"}, {4096, 6143, ""}} {
+		e := entries[i*128:]
+		e[0] = 1 // type GUID
+		binary.LittleEndian.PutUint64(e[32:], p.first)
+		binary.LittleEndian.PutUint64(e[40:], p.last)
+		for j, c := range p.label {
+			binary.LittleEndian.PutUint16(e[56+2*j:], uint16(c))
+		}
+	}
+	header := gpt[512:1024]
+	copy(header, "EFI PART")
+	binary.LittleEndian.PutUint32(header[12:], 92)
+	binary.LittleEndian.PutUint64(header[72:], 2)
+	binary.LittleEndian.PutUint32(header[80:], 128)
+	binary.LittleEndian.PutUint32(header[84:], 128)
+	binary.LittleEndian.PutUint32(header[88:], crc32.ChecksumIEEE(entries))
+	binary.LittleEndian.PutUint32(header[16:], crc32.ChecksumIEEE(header[:92]))
+
+	for _, tc := range []struct {
+		name     string
+		image    []byte
+		expected []string // name, description, offset and size of each export
+	}{
+		{"mbr", mbr, []string{
+			"mbr  0 0",
+			"mbr-part1 Partition 1 of mbr 1048576 524288",
+			"mbr-part2 Partition 2 of mbr 2097152 1048576",
+			"mbr-part5 Partition 5 of mbr 3146240 261632",
+			"mbr-part6 Partition 6 of mbr 3408384 523776",
+		}},
+		{"gpt", gpt, []string{
+			"gpt  0 0",
+			"gpt-part1 root 17408 1048576",
+			"gpt-part2 Partition 2 of gpt 2097152 1048576",
+		}},
+		{"none", make([]byte, size), []string{"none  0 0"}},
+	} {
+		filename := path.Join(TempDir, tc.name+".img")
+		if err := ioutil.WriteFile(filename, tc.image, 0644); err != nil {
+			t.Fatalf("Could not write file: %v", err)
+		}
+		exports, err := expandPartitions([]ExportConfig{{Name: tc.name, Driver: "file", DriverParameters: DriverParametersConfig{"path": filename, "autopartition": "true"}}})
+		if err != nil {
+			t.Fatalf("%s: could not expand partitions: %v", tc.name, err)
+		}
+		var got []string
+		for _, ec := range exports {
+			offset, _ := strconv.Atoi(ec.DriverParameters["sliceoffset"])
+			sliceSize, _ := strconv.Atoi(ec.DriverParameters["slicesize"])
+			got = append(got, fmt.Sprintf("%s %s %d %d", ec.Name, ec.Description, offset, sliceSize))
+		}
+		if strings.Join(got, "\n") != strings.Join(tc.expected, "\n") {
+			t.Errorf("%s: exports\n%s\nexpected\n%s", tc.name, strings.Join(got, "\n"), strings.Join(tc.expected, "\n"))
+		}
+	}
+
+	// a partition's export serves just its slice of the image
+	exports, _ := expandPartitions([]ExportConfig{{Name: "mbr", Driver: "file", DriverParameters: DriverParametersConfig{"path": path.Join(TempDir, "mbr.img"), "autopartition": "true"}}})
+	ec := &exports[2]
+	b, err := openBackend(ctx, ec)
+	if err != nil {
+		t.Fatalf("Could not open partition: %v", err)
+	}
+	defer b.Close(ctx)
+	if size, _, _, _, err := b.Geometry(ctx); err != nil || size != 1048576 {
+		t.Errorf("Partition has size %d, expected 1048576", size)
+	}
+	data := bytes.Repeat([]byte{0x5a}, 4096)
+	if _, err := b.WriteAt(ctx, data, 4096, false); err != nil {
+		t.Fatalf("Write to partition failed: %v", err)
+	}
+	image, _ := ioutil.ReadFile(path.Join(TempDir, "mbr.img"))
+	if !bytes.Equal(image[2097152+4096:2097152+8192], data) {
+		t.Errorf("Write to partition did not land at its offset in the image")
+	}
+
+	if _, err := expandPartitions([]ExportConfig{{Name: "rbd", Driver: "rbd", DriverParameters: DriverParametersConfig{"autopartition": "true"}}}); err == nil {
+		t.Errorf("autopartition accepted for a driver without a disk image")
+	}
+}
+
+// slowReadBackend delays each read, so that reads are in flight for a while
+type slowReadBackend struct {
+	Backend
+}
+
+func (srb *slowReadBackend) ReadAt(ctx context.Context, b []byte, offset int64) (int, error) {
+	time.Sleep(200 * time.Millisecond)
+	return srb.Backend.ReadAt(ctx, b, offset)
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	RegisterBackend("slowreadtest", func(ctx context.Context, ec *ExportConfig) (Backend, error) {
+		fb, err := NewFileBackend(ctx, ec)
+		if err != nil {
+			return nil, err
+		}
+		return &slowReadBackend{Backend: fb}, nil
+	})
+	defer delete(BackendMap, "slowreadtest")
+
+	ni := ConnectAndGo(t, TestConfig{Driver: "slowreadtest"}, 1024*1024)
+	defer ni.Close()
+	conn := ni.conn
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// several reads in flight as the server shuts down
+	handles := make(map[uint64]bool)
+	for i := 0; i < 4; i++ {
+		cmd := nbdRequest{
+			NbdRequestMagic: NBD_REQUEST_MAGIC,
+			NbdCommandType:  NBD_CMD_READ,
+			NbdHandle:       getHandle(),
+			NbdOffset:       uint64(i) * 65536,
+			NbdLength:       65536,
+		}
+		if err := binary.Write(conn, binary.BigEndian, cmd); err != nil {
+			t.Fatalf("Could not send command: %v", err)
+		}
+		handles[cmd.NbdHandle] = true
+	}
+	time.Sleep(50 * time.Millisecond)
+	ni.closedMutex.Lock()
+	close(ni.quit)
+	ni.closed = true
+	ni.closedMutex.Unlock()
+
+	// each is replied to in full before the connection closes
+	for len(handles) > 0 {
+		var rep nbdReply
+		if err := binary.Read(conn, binary.BigEndian, &rep); err != nil {
+			t.Fatalf("Connection closed with %d reads in flight: %v", len(handles), err)
+		}
+		if !handles[rep.NbdHandle] || rep.NbdError != 0 {
+			t.Fatalf("Unexpected reply %v", rep)
+		}
+		delete(handles, rep.NbdHandle)
+		if _, err := io.ReadFull(conn, make([]byte, 65536)); err != nil {
+			t.Fatalf("Connection closed mid-reply: %v", err)
+		}
+	}
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Connection not closed cleanly after the last reply: %d bytes, %v", n, err)
+	}
+}
+
+func TestShutdownDrain(t *testing.T) {
+	RegisterBackend("slowreadtest", func(ctx context.Context, ec *ExportConfig) (Backend, error) {
+		fb, err := NewFileBackend(ctx, ec)
+		if err != nil {
+			return nil, err
+		}
+		return &slowReadBackend{Backend: fb}, nil
+	})
+	defer delete(BackendMap, "slowreadtest")
+
+	ni := ConnectAndGo(t, TestConfig{Driver: "slowreadtest"}, 1024*1024)
+	defer ni.Close()
+	conn := ni.conn
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// another client is still negotiating as the server shuts down
+	neg := &NbdInstance{t: t, TestConfig: ni.TestConfig}
+	if err := neg.Connect(t); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer neg.conn.Close()
+
+	read := func(handle uint64) {
+		cmd := nbdRequest{
+			NbdRequestMagic: NBD_REQUEST_MAGIC,
+			NbdCommandType:  NBD_CMD_READ,
+			NbdHandle:       handle,
+			NbdLength:       65536,
+		}
+		if err := binary.Write(conn, binary.BigEndian, cmd); err != nil {
+			t.Fatalf("Could not send command: %v", err)
+		}
+	}
+	inflight, late := getHandle(), getHandle()
+	read(inflight)
+	time.Sleep(50 * time.Millisecond)
+	ni.closedMutex.Lock()
+	close(ni.quit)
+	ni.closed = true
+	ni.closedMutex.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	read(late)
+
+	// the read in flight is served, and the one sent whilst draining refused
+	for replies := 0; replies < 2; replies++ {
+		var rep nbdReply
+		if err := binary.Read(conn, binary.BigEndian, &rep); err != nil {
+			t.Fatalf("Connection closed after %d replies: %v", replies, err)
+		}
+		switch {
+		case rep.NbdHandle == inflight && rep.NbdError == 0:
+			if _, err := io.ReadFull(conn, make([]byte, 65536)); err != nil {
+				t.Fatalf("Connection closed mid-reply: %v", err)
+			}
+		case rep.NbdHandle == late && rep.NbdError == NBD_ESHUTDOWN:
+		default:
+			t.Fatalf("Unexpected reply %v", rep)
+		}
+	}
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Connection not closed cleanly after the last reply: %d bytes, %v", n, err)
+	}
+
+	// negotiation is refused, but the client may still abort
+	neg.conn.SetDeadline(time.Now().Add(time.Second))
+	if replyType, err := neg.Option(t, NBD_OPT_STRUCTURED_REPLY, nil); err != nil || replyType != NBD_REP_ERR_SHUTDOWN {
+		t.Errorf("Option during shutdown got reply type %x, error %v", replyType, err)
+	}
+	if err := neg.Abort(t); err != nil {
+		t.Errorf("Abort during shutdown failed: %v", err)
+	}
+}
+
+// removeRequest makes a request of the remove API and decodes the result replied
+func removeRequest(t *testing.T, method string, query string, result *RemoveResult) int {
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest(method, "/debug/remove?"+query, nil))
+	if w.Code == http.StatusOK && result != nil {
+		if err := json.NewDecoder(w.Body).Decode(result); err != nil {
+			t.Fatalf("Cannot decode remove result: %v", err)
+		}
+	}
+	return w.Code
+}
+
+func TestRemoveExport(t *testing.T) {
+	RegisterBackend("slowreadtest", func(ctx context.Context, ec *ExportConfig) (Backend, error) {
+		fb, err := NewFileBackend(ctx, ec)
+		if err != nil {
+			return nil, err
+		}
+		return &slowReadBackend{Backend: fb}, nil
+	})
+	defer delete(BackendMap, "slowreadtest")
+
+	ni := ConnectAndGo(t, TestConfig{Driver: "slowreadtest"}, 1024*1024)
+	defer ni.Close()
+	conn := ni.conn
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	setCopyExports(&Config{Servers: []ServerConfig{{Exports: []ExportConfig{{Name: "foo"}}}}})
+	defer setCopyExports(&Config{})
+	defer forgetRemovedExports()
+
+	read := func(handle uint64) {
+		cmd := nbdRequest{
+			NbdRequestMagic: NBD_REQUEST_MAGIC,
+			NbdCommandType:  NBD_CMD_READ,
+			NbdHandle:       handle,
+			NbdLength:       65536,
+		}
+		if err := binary.Write(conn, binary.BigEndian, cmd); err != nil {
+			t.Fatalf("Could not send command: %v", err)
+		}
+	}
+	// another client negotiating as the export is removed
+	other := &NbdInstance{t: t, quit: make(chan struct{}), TestConfig: ni.TestConfig}
+	if err := other.Connect(t); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer other.conn.Close()
+
+	inflight, late := getHandle(), getHandle()
+	read(inflight)
+	time.Sleep(50 * time.Millisecond)
+	removed := make(chan RemoveResult, 1)
+	go func() {
+		var result RemoveResult
+		if code := removeRequest(t, "POST", "export=foo&linger=5s", &result); code != http.StatusOK {
+			t.Errorf("Removing export got status %d", code)
+		}
+		removed <- result
+	}()
+	time.Sleep(50 * time.Millisecond)
+	read(late)
+
+	// new connections to the export are refused whilst the existing one drains
+	other.conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := other.GoWithInfo(t, "foo", nil); err != optReplyError(NBD_REP_ERR_UNKNOWN) {
+		t.Errorf("Connecting to a removed export got %v", err)
+	}
+
+	// the read in flight is served, and the one sent whilst draining refused
+	for replies := 0; replies < 2; replies++ {
+		var rep nbdReply
+		if err := binary.Read(conn, binary.BigEndian, &rep); err != nil {
+			t.Fatalf("Connection closed after %d replies: %v", replies, err)
+		}
+		switch {
+		case rep.NbdHandle == inflight && rep.NbdError == 0:
+			if _, err := io.ReadFull(conn, make([]byte, 65536)); err != nil {
+				t.Fatalf("Connection closed mid-reply: %v", err)
+			}
+		case rep.NbdHandle == late && rep.NbdError == NBD_ESHUTDOWN:
+		default:
+			t.Fatalf("Unexpected reply %v", rep)
+		}
+	}
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Connection not closed cleanly after the last reply: %d bytes, %v", n, err)
+	}
+	select {
+	case result := <-removed:
+		if result != (RemoveResult{Export: "foo", Connections: 1, Drained: 1}) {
+			t.Errorf("Removing export got %+v", result)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Removing export did not return once its connection closed")
+	}
+
+	for _, tc := range []struct {
+		method string
+		query  string
+		code   int
+	}{
+		{"POST", "export=foo", http.StatusNotFound},
+		{"POST", "export=missing", http.StatusNotFound},
+		{"POST", "export=foo&linger=junk", http.StatusBadRequest},
+		{"GET", "export=foo", http.StatusMethodNotAllowed},
+	} {
+		if code := removeRequest(t, tc.method, tc.query, nil); code != tc.code {
+			t.Errorf("%s %s got status %d, expected %d", tc.method, tc.query, code, tc.code)
+		}
+	}
+}
+
+func TestCacheMemoryBudget(t *testing.T) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+	ctx := context.Background()
+	open := func(name string) *ReadCacheBackend {
+		filename := path.Join(TempDir, name+".img")
+		if err := ioutil.WriteFile(filename, make([]byte, 1024*1024), 0644); err != nil {
+			t.Fatalf("Could not write file: %v", err)
+		}
+		ec := &ExportConfig{Name: name, Driver: "file", DriverParameters: DriverParametersConfig{
+			"path":           filename,
+			"readcachesize":  "1048576",
+			"reconnectgrace": "1s",
+		}}
+		fb, err := NewFileBackend(ctx, ec)
+		if err != nil {
+			t.Fatalf("Could not open backend: %v", err)
+		}
+		b, err := newReadCacheBackend(ctx, ec, fb)
+		if err != nil {
+			t.Fatalf("Could not wrap backend: %v", err)
+		}
+		return b.(*ReadCacheBackend)
+	}
+
+	// each cache could hold its whole export, but together they may hold only 8 blocks
+	cacheMemory.setLimit(8 * DefaultReadCacheBlockSize)
+	defer cacheMemory.setLimit(0)
+	caches := []*ReadCacheBackend{open("budget1"), open("budget2")}
+	for _, rb := range caches {
+		for offset := int64(0); offset < 1024*1024; offset += DefaultReadCacheBlockSize {
+			if _, err := rb.ReadAt(ctx, make([]byte, 4096), offset); err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			if used := cacheMemory.used; used > cacheMemory.limit {
+				t.Fatalf("Caches hold %d bytes, over the budget of %d", used, cacheMemory.limit)
+			}
+		}
+	}
+	// the second cache to fill evicted from the first, so they share the budget
+	for i, rb := range caches {
+		if n := rb.lru.Len(); n != 4 {
+			t.Errorf("Cache %d holds %d blocks, expected 4", i, n)
+		}
+	}
+	for _, rb := range caches {
+		rb.Close(ctx)
+	}
+	if used := cacheMemory.used; used != 0 {
+		t.Errorf("Closed caches still charged with %d bytes", used)
+	}
+}
+
+func TestTemplateBackend(t *testing.T) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+	ctx := context.Background()
+
+	boot := bytes.Repeat([]byte{0xeb}, 446)
+	if err := ioutil.WriteFile(path.Join(TempDir, "boot.bin"), boot, 0644); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	template := path.Join(TempDir, "disk.yaml")
+	if err := ioutil.WriteFile(template, []byte(`size: 1073741824
+regions:
+- offset: 1048576
+  text: hello
+- offset: 0
+  file: boot.bin
+- offset: 510
+  hex: 55aa
+- offset: 2048
+  fill: 7
+  length: 1024
+`), 0644); err != nil {
+		t.Fatalf("Could not write template: %v", err)
+	}
+	expected := make([]byte, 1048576+5)
+	copy(expected, boot)
+	copy(expected[510:], []byte{0x55, 0xaa})
+	copy(expected[2048:], bytes.Repeat([]byte{7}, 1024))
+	copy(expected[1048576:], "hello")
+
+	// served read-only, or read-write with an overlay
+	for _, overlay := range []bool{false, true} {
+		ec := &ExportConfig{
+			Name:             "template",
+			Driver:           "template",
+			ReadOnly:         !overlay,
+			DriverParameters: DriverParametersConfig{"path": template},
+		}
+		if overlay {
+			ec.DriverParameters["ephemeraloverlay"] = "true"
+		}
+		backend, err := openBackend(ctx, ec)
+		if err != nil {
+			t.Fatalf("Could not open backend (overlay=%v): %v", overlay, err)
+		}
+		if size, _, _, _, err := backend.Geometry(ctx); err != nil || size != 1073741824 {
+			t.Errorf("Template disk (overlay=%v) has size %d: %v", overlay, size, err)
+		}
+		if overlay {
+			if _, err := backend.WriteAt(ctx, []byte("world"), 1048576, false); err != nil {
+				t.Errorf("Write to overlay failed: %v", err)
+			}
+			copy(expected[1048576:], "world")
+		} else if _, err := backend.WriteAt(ctx, []byte("world"), 1048576, false); err == nil {
+			t.Errorf("Write to read-only template disk succeeded")
+		}
+		// reads straddling regions, and within one
+		for _, r := range [][2]int{{0, len(expected)}, {500, 20}, {2000, 100}, {1048578, 2}} {
+			b := bytes.Repeat([]byte{0xff}, r[1])
+			if _, err := backend.ReadAt(ctx, b, int64(r[0])); err != nil {
+				t.Errorf("Read (overlay=%v) of %d bytes at %d failed: %v", overlay, r[1], r[0], err)
+			} else if !bytes.Equal(b, expected[r[0]:r[0]+r[1]]) {
+				t.Errorf("Read (overlay=%v) of %d bytes at %d returned the wrong data", overlay, r[1], r[0])
+			}
+		}
+		backend.Close(ctx)
+	}
+
+	for _, bad := range []string{
+		"size: 1024\nregions:\n- offset: 1020\n  hex: 0102030405\n",
+		"size: 1024\nregions:\n- offset: 0\n  text: hello\n- offset: 4\n  text: world\n",
+		"size: 1024\nregions:\n- offset: 0\n  text: hello\n  hex: 01\n",
+	} {
+		if err := ioutil.WriteFile(template, []byte(bad), 0644); err != nil {
+			t.Fatalf("Could not write template: %v", err)
+		}
+		if _, err := NewTemplateBackend(ctx, &ExportConfig{ReadOnly: true, DriverParameters: DriverParametersConfig{"path": template}}); err == nil {
+			t.Errorf("Bad template accepted: %q", bad)
+		}
+	}
+}
+
+// badRangeBackend fails any read overlapping a bad range
+type badRangeBackend struct {
+	Backend
+	badOffset int64
+	badLength int64
+}
+
+func (brb *badRangeBackend) ReadAt(ctx context.Context, b []byte, offset int64) (int, error) {
+	if offset < brb.badOffset+brb.badLength && offset+int64(len(b)) > brb.badOffset {
+		return 0, syscall.EIO
+	}
+	return brb.Backend.ReadAt(ctx, b, offset)
+}
+
+// structuredChunk is a structured reply chunk as received by the test client
+type structuredChunk struct {
+	header  nbdStructuredReply
+	payload []byte
+}
+
+// readStructured sends a read and returns the chunks of its structured reply
+func (ni *NbdInstance) readStructured(t *testing.T, offset uint64, length uint32) ([]structuredChunk, error) {
+	return ni.commandStructured(t, NBD_CMD_READ, 0, offset, length)
+}
+
+// commandStructured sends a command without a payload and returns the chunks
+// of its structured reply
+func (ni *NbdInstance) commandStructured(t *testing.T, cmdType uint16, flags uint16, offset uint64, length uint32) ([]structuredChunk, error) {
+	cmd := nbdRequest{
+		NbdRequestMagic: NBD_REQUEST_MAGIC,
+		NbdCommandFlags: flags,
+		NbdCommandType:  cmdType,
+		NbdHandle:       getHandle(),
+		NbdOffset:       offset,
+		NbdLength:       length,
+	}
+	ni.conn.SetDeadline(time.Now().Add(time.Second))
+	defer ni.conn.SetDeadline(time.Time{})
+	if err := binary.Write(ni.conn, binary.BigEndian, cmd); err != nil {
+		return nil, fmt.Errorf("Could not send command: %v", err)
+	}
+	var chunks []structuredChunk
+	for {
+		var c structuredChunk
+		if err := binary.Read(ni.conn, binary.BigEndian, &c.header); err != nil {
+			return nil, fmt.Errorf("Could not receive reply chunk: %v", err)
+		}
+		if c.header.NbdReplyMagic != NBD_STRUCTURED_REPLY_MAGIC || c.header.NbdHandle != cmd.NbdHandle {
+			return nil, fmt.Errorf("Reply chunk had wrong magic (%x) or handle", c.header.NbdReplyMagic)
+		}
+		c.payload = make([]byte, c.header.NbdLength)
+		if _, err := io.ReadFull(ni.conn, c.payload); err != nil {
+			return nil, fmt.Errorf("Could not receive reply chunk payload: %v", err)
+		}
+		chunks = append(chunks, c)
+		if c.header.NbdReplyFlags&NBD_REPLY_FLAG_DONE != 0 {
+			return chunks, nil
+		}
+	}
+}
+
+func TestStructuredReadErrors(t *testing.T) {
+	RegisterBackend("badrangetest", func(ctx context.Context, ec *ExportConfig) (Backend, error) {
+		fb, err := NewFileBackend(ctx, ec)
+		if err != nil {
+			return nil, err
+		}
+		return &badRangeBackend{Backend: fb, badOffset: 100 * 1024, badLength: 4096}, nil
+	})
+	defer delete(BackendMap, "badrangetest")
+
+	ni := StartNbd(t, TestConfig{Driver: "badrangetest"})
+	defer ni.Close()
+	if err := ni.CreateFile(t, 1024*1024); err != nil {
+		t.Fatalf("Error on create file: %v", err)
+	}
+	if err := ni.Connect(t); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	if replyType, err := ni.Option(t, NBD_OPT_STRUCTURED_REPLY, nil); err != nil || replyType != NBD_REP_ACK {
+		t.Fatalf("Structured replies not negotiated: reply type %x, error %v", replyType, err)
+	}
+	if err := ni.Go(t); err != nil {
+		t.Fatalf("Error on go: %v", err)
+	}
+	data := make([]byte, 256*1024)
+	for i := range data {
+		data[i] = byte(i / 4096)
+	}
+	if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 0, uint32(len(data)), data); err != nil || rep.NbdError != 0 {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	type want struct {
+		replyType uint16
+		offset    uint64
+		length    uint64
+	}
+	for _, tc := range []struct {
+		name   string
+		offset uint64
+		length uint32
+		chunks []want
+	}{
+		// the bad range lies within the 32K preferred block at 96K
+		{"bad middle", 0, 256 * 1024, []want{
+			{NBD_REPLY_TYPE_OFFSET_DATA, 0, 96 * 1024},
+			{NBD_REPLY_TYPE_ERROR_OFFSET, 96 * 1024, 0},
+			{NBD_REPLY_TYPE_OFFSET_DATA, 128 * 1024, 128 * 1024},
+		}},
+		{"bad end", 64 * 1024, 64 * 1024, []want{
+			{NBD_REPLY_TYPE_OFFSET_DATA, 64 * 1024, 32 * 1024},
+			{NBD_REPLY_TYPE_ERROR_OFFSET, 96 * 1024, 0},
+		}},
+		{"good", 128 * 1024, 4096, []want{
+			{NBD_REPLY_TYPE_OFFSET_DATA, 128 * 1024, 4096},
+		}},
+	} {
+		chunks, err := ni.readStructured(t, tc.offset, tc.length)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if len(chunks) != len(tc.chunks) {
+			t.Fatalf("%s: got %d chunks, expected %d", tc.name, len(chunks), len(tc.chunks))
+		}
+		for i, w := range tc.chunks {
+			c := chunks[i]
+			if c.header.NbdReplyType != w.replyType {
+				t.Fatalf("%s: chunk %d has type %d, expected %d", tc.name, i, c.header.NbdReplyType, w.replyType)
+			}
+			if done := c.header.NbdReplyFlags&NBD_REPLY_FLAG_DONE != 0; done != (i == len(tc.chunks)-1) {
+				t.Errorf("%s: chunk %d has DONE %v", tc.name, i, done)
+			}
+			switch w.replyType {
+			case NBD_REPLY_TYPE_OFFSET_DATA:
+				if offset := binary.BigEndian.Uint64(c.payload); offset != w.offset || uint64(len(c.payload)-8) != w.length {
+					t.Errorf("%s: chunk %d has %d bytes at %d, expected %d at %d", tc.name, i, len(c.payload)-8, offset, w.length, w.offset)
+				} else if !bytes.Equal(c.payload[8:], data[offset:offset+w.length]) {
+					t.Errorf("%s: chunk %d has the wrong data", tc.name, i)
+				}
+			case NBD_REPLY_TYPE_ERROR_OFFSET:
+				msgLen := int(binary.BigEndian.Uint16(c.payload[4:]))
+				if nbdError := binary.BigEndian.Uint32(c.payload); nbdError != NBD_EIO {
+					t.Errorf("%s: chunk %d has error %d, expected EIO", tc.name, i, nbdError)
+				}
+				if len(c.payload) != 6+msgLen+8 {
+					t.Fatalf("%s: chunk %d has bad length %d", tc.name, i, len(c.payload))
+				}
+				if offset := binary.BigEndian.Uint64(c.payload[6+msgLen:]); offset != w.offset {
+					t.Errorf("%s: chunk %d has error at %d, expected %d", tc.name, i, offset, w.offset)
+				}
+			}
+		}
+	}
+}
+
+// deviceHintBackend reports device hints for the file backend it wraps
+type deviceHintBackend struct {
+	Backend
+}
+
+func (dhb *deviceHintBackend) IOHints(ctx context.Context) IOHints {
+	return IOHints{Device: &DeviceHints{Rotational: true, QueueDepth: 32}}
+}
+
+func TestDeviceHints(t *testing.T) {
+	RegisterBackend("devicehinttest", func(ctx context.Context, ec *ExportConfig) (Backend, error) {
+		fb, err := NewFileBackend(ctx, ec)
+		if err != nil {
+			return nil, err
+		}
+		return &deviceHintBackend{Backend: fb}, nil
+	})
+	defer delete(BackendMap, "devicehinttest")
+
+	for _, requested := range []bool{false, true} {
+		ni := StartNbd(t, TestConfig{Driver: "devicehinttest"})
+		if err := ni.CreateFile(t, 1024*1024); err != nil {
+			ni.Close()
+			t.Fatalf("Error on create file: %v", err)
+		}
+		if err := ni.Connect(t); err != nil {
+			ni.Close()
+			t.Fatalf("Error on connect: %v", err)
+		}
+		infoElements := []uint16{NBD_INFO_BLOCK_SIZE}
+		if requested {
+			infoElements = append(infoElements, NBD_INFO_X_DEVICE_HINTS)
+		}
+		infos, err := ni.GoWithInfo(t, "foo", infoElements)
+		ni.Close()
+		if err != nil {
+			t.Fatalf("Error on go: %v", err)
+		}
+		hints, ok := infos[NBD_INFO_X_DEVICE_HINTS]
+		if !requested {
+			if ok {
+				t.Errorf("Device hints sent without being requested")
+			}
+			continue
+		}
+		if len(hints) != 8 {
+			t.Fatalf("Bad device hints info %v", hints)
+		}
+		if flags, latency, depth := binary.BigEndian.Uint16(hints), binary.BigEndian.Uint32(hints[2:]), binary.BigEndian.Uint16(hints[6:]); flags != NBD_X_DEVICE_ROTATIONAL || latency != 0 || depth != 32 {
+			t.Errorf("Device hints flags %x, seek latency %d, queue depth %d, expected rotational, 0 and 32", flags, latency, depth)
+		}
+	}
+
+	// the export's configuration overrides the backend's
+	ec := &ExportConfig{DriverParameters: DriverParametersConfig{"rotational": "false", "seeklatency": "8ms"}}
+	hints, err := exportDeviceHints(ec, &DeviceHints{Rotational: true, QueueDepth: 32})
+	if err != nil {
+		t.Fatalf("Device hints not accepted: %v", err)
+	}
+	if *hints != (DeviceHints{SeekLatency: 8 * time.Millisecond, QueueDepth: 32}) {
+		t.Errorf("Device hints %+v, expected non-rotational with an 8ms seek latency and queue depth 32", *hints)
+	}
+	if hints, err := exportDeviceHints(&ExportConfig{}, nil); err != nil || hints != nil {
+		t.Errorf("Device hints %v (error %v) advertised for an export without them", hints, err)
+	}
+	for _, bad := range []DriverParametersConfig{{"rotational": "yes"}, {"seeklatency": "-1s"}, {"queuedepth": "65536"}} {
+		if _, err := exportDeviceHints(&ExportConfig{DriverParameters: bad}, nil); err == nil {
+			t.Errorf("Bad device hints %v accepted", bad)
+		}
+	}
+}
+
+func TestAutoExport(t *testing.T) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+	for _, name := range []string{"a.raw", "b.raw", "c.txt"} {
+		if err := ioutil.WriteFile(path.Join(TempDir, name), make([]byte, 4096), 0644); err != nil {
+			t.Fatalf("Could not write file: %v", err)
+		}
+	}
+	if err := os.Mkdir(path.Join(TempDir, "dir.raw"), 0755); err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+
+	glob := path.Join(TempDir, "*.raw")
+	matched := make(map[string][]string)
+	exports, err := expandAutoExports([]ExportConfig{
+		{Name: "", Driver: "file", DriverParameters: DriverParametersConfig{"autoexport": glob, "sync": "true"}},
+		{Name: "img-", Driver: "file", DriverParameters: DriverParametersConfig{"autoexport": glob}},
+		{Name: "a.raw", Driver: "file", DriverParameters: DriverParametersConfig{"path": "/elsewhere"}},
+	}, matched)
+	if err != nil {
+		t.Fatalf("Could not expand autoexports: %v", err)
+	}
+	var got []string
+	for _, ec := range exports {
+		got = append(got, ec.Name+" "+ec.DriverParameters["path"]+" "+ec.DriverParameters["sync"]+" "+ec.DriverParameters["autoexport"])
+	}
+	// a.raw is configured explicitly, and dir.raw is not a file
+	expected := []string{
+		"b.raw " + path.Join(TempDir, "b.raw") + " true ",
+		"img-a.raw " + path.Join(TempDir, "a.raw") + "  ",
+		"img-b.raw " + path.Join(TempDir, "b.raw") + "  ",
+		"a.raw /elsewhere  ",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Autoexports %q, expected %q", got, expected)
+	}
+	if len(matched[glob]) != 3 {
+		t.Errorf("Glob matched %v, expected three files", matched[glob])
+	}
+
+	for _, bad := range []ExportConfig{
+		{Name: "rbd", Driver: "rbd", DriverParameters: DriverParametersConfig{"autoexport": glob}},
+		{Name: "path", Driver: "file", DriverParameters: DriverParametersConfig{"autoexport": glob, "path": "/elsewhere"}},
+		{Name: "pattern", Driver: "file", DriverParameters: DriverParametersConfig{"autoexport": "["}},
+	} {
+		if _, err := expandAutoExports([]ExportConfig{bad}, make(map[string][]string)); err == nil {
+			t.Errorf("Bad autoexport %s accepted", bad.Name)
+		}
+	}
+
+	// a new file is noticed
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	reload := make(chan struct{}, 1)
+	go watchAutoExports(ctx, log.New(ioutil.Discard, "", 0), matched, 10*time.Millisecond, reload)
+	select {
+	case <-reload:
+		t.Fatalf("Reload signalled with no change")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := ioutil.WriteFile(path.Join(TempDir, "d.raw"), nil, 0644); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	select {
+	case <-reload:
+	case <-time.After(time.Second):
+		t.Errorf("Reload not signalled for a new file")
+	}
+}
+
+func TestOutOfRange(t *testing.T) {
+	const size = 1024 * 1024
+	ni := ConnectAndGo(t, TestConfig{Driver: "file"}, size)
+	defer ni.Close()
+
+	for _, tc := range []struct {
+		name     string
+		cmdType  uint16
+		offset   uint64
+		length   uint32
+		nbdError uint32
+	}{
+		{"write ending at the end", NBD_CMD_WRITE, size - 4096, 4096, 0},
+		{"write starting at the end", NBD_CMD_WRITE, size, 4096, NBD_ENOSPC},
+		{"write straddling the end", NBD_CMD_WRITE, size - 4096, 8192, NBD_ENOSPC},
+		{"write beyond the end", NBD_CMD_WRITE, 2 * size, 4096, NBD_ENOSPC},
+		{"write with overflowing range", NBD_CMD_WRITE, 1<<64 - 4096, 8192, NBD_ENOSPC},
+		{"write zeroes straddling the end", NBD_CMD_WRITE_ZEROES, size - 4096, 8192, NBD_ENOSPC},
+		{"read ending at the end", NBD_CMD_READ, size - 4096, 4096, 0},
+		{"read straddling the end", NBD_CMD_READ, size - 4096, 8192, NBD_EINVAL},
+		{"trim beyond the end", NBD_CMD_TRIM, 2 * size, 4096, NBD_EINVAL},
+	} {
+		var data []byte
+		if tc.cmdType == NBD_CMD_WRITE {
+			data = make([]byte, tc.length)
+		}
+		rep, _, err := ni.Command(t, tc.cmdType, 0, tc.offset, tc.length, data)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if rep.NbdError != tc.nbdError {
+			t.Errorf("%s: got error %d, expected %d", tc.name, rep.NbdError, tc.nbdError)
+		}
+	}
+	// nothing was written beyond the end of the file
+	if fi, err := os.Stat(path.Join(ni.TempDir, "nbd.img")); err != nil || fi.Size() != size {
+		t.Errorf("File has grown to %d bytes", fi.Size())
+	}
+}
+
+func TestFileSmallerThanExport(t *testing.T) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+	filename := path.Join(TempDir, "small.img")
+	if err := ioutil.WriteFile(filename, make([]byte, 8192), 0644); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	ctx := context.Background()
+	backend, err := NewFileBackend(ctx, &ExportConfig{DriverParameters: DriverParametersConfig{"path": filename}})
+	if err != nil {
+		t.Fatalf("Could not open file backend: %v", err)
+	}
+	defer backend.Close(ctx)
+
+	// as if a size provider advertised more than the file holds
+	if _, err := backend.WriteAt(ctx, make([]byte, 4096), 4096, false); err != nil {
+		t.Errorf("Write within the file failed: %v", err)
+	}
+	if _, err := backend.WriteAt(ctx, make([]byte, 8192), 4096, false); err != syscall.ENOSPC {
+		t.Errorf("Write beyond the file returned %v, expected ENOSPC", err)
+	}
+	if fi, err := os.Stat(filename); err != nil || fi.Size() != 8192 {
+		t.Errorf("File has grown to %d bytes", fi.Size())
+	}
+}
+
+// flakyReadBackend fails its first reads with an error, then passes them on
+type flakyReadBackend struct {
+	Backend
+	failures int32 // reads still to fail, accessed atomically
+	err      error
+}
+
+func (frb *flakyReadBackend) ReadAt(ctx context.Context, b []byte, offset int64) (int, error) {
+	if atomic.AddInt32(&frb.failures, -1) >= 0 {
+		return 0, frb.err
+	}
+	return frb.Backend.ReadAt(ctx, b, offset)
+}
+
+func TestReadRetry(t *testing.T) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+	filename := path.Join(TempDir, "nbd.img")
+	if err := ioutil.WriteFile(filename, make([]byte, 65536), 0644); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	ctx := context.Background()
+	fb, err := NewFileBackend(ctx, &ExportConfig{DriverParameters: DriverParametersConfig{"path": filename}})
+	if err != nil {
+		t.Fatalf("Could not open file backend: %v", err)
+	}
+	defer fb.Close(ctx)
+
+	for _, tc := range []struct {
+		name     string
+		params   DriverParametersConfig
+		failures int32
+		err      error
+		expected error
+		maxTime  time.Duration
+	}{
+		{"recovers", DriverParametersConfig{"readretries": "3", "retrybackoff": "1ms"}, 2, syscall.EIO, nil, time.Second},
+		{"gives up", DriverParametersConfig{"readretries": "1", "retrybackoff": "1ms"}, 2, syscall.EIO, syscall.EIO, time.Second},
+		{"not retryable", DriverParametersConfig{"readretries": "3", "retrybackoff": "1ms"}, 1, syscall.EINVAL, syscall.EINVAL, time.Second},
+		{"listed error", DriverParametersConfig{"readretries": "3", "retrybackoff": "1ms", "retryerrors": "EIO,ETIMEDOUT"}, 1, syscall.ETIMEDOUT, nil, time.Second},
+		{"command timeout", DriverParametersConfig{"readretries": "10", "retrybackoff": "50ms", "commandtimeout": "120ms"}, 10, syscall.EIO, syscall.EIO, 120 * time.Millisecond},
+	} {
+		flaky := &flakyReadBackend{Backend: fb, failures: tc.failures, err: tc.err}
+		ec := &ExportConfig{Name: "retrytest", DriverParameters: tc.params}
+		backend, err := newReadRetryBackend(ctx, ec, flaky)
+		if err != nil {
+			t.Fatalf("%s: could not create read retry backend: %v", tc.name, err)
+		}
+		start := time.Now()
+		if _, err := backend.ReadAt(ctx, make([]byte, 4096), 0); err != tc.expected {
+			t.Errorf("%s: read returned %v, expected %v", tc.name, err, tc.expected)
+		}
+		if elapsed := time.Since(start); elapsed > tc.maxTime {
+			t.Errorf("%s: read took %s, more than %s", tc.name, elapsed, tc.maxTime)
+		}
+	}
+
+	for _, bad := range []DriverParametersConfig{{"readretries": "-1"}, {"readretries": "2", "retrybackoff": "soon"}, {"readretries": "2", "retryerrors": "EWHATEVER"}} {
+		if _, err := newReadRetryBackend(ctx, &ExportConfig{DriverParameters: bad}, fb); err == nil {
+			t.Errorf("Bad read retry configuration %v accepted", bad)
+		}
+	}
+}
+
+func TestCommandLists(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		config   TestConfig
+		readonly bool
+		zeroes   bool
+		writeErr uint32
+		readErr  uint32
+		flushErr uint32
+	}{
+		{"all allowed", TestConfig{Driver: "file"}, false, true, 0, 0, 0},
+		{"deny writes", TestConfig{Driver: "file", DenyCommands: "write, writezeroes, trim"}, true, false, NBD_EPERM, 0, 0},
+		{"deny write zeroes", TestConfig{Driver: "file", DenyCommands: "writezeroes"}, false, false, 0, 0, 0},
+		{"allow read only", TestConfig{Driver: "file", AllowCommands: "read"}, true, false, NBD_EPERM, 0, NBD_EINVAL},
+		{"allow read and write", TestConfig{Driver: "file", AllowCommands: "Read,Write,Flush"}, false, false, 0, 0, 0},
+	} {
+		func() {
+			ni := ConnectAndGo(t, tc.config, 1024*1024)
+			defer ni.Close()
+			if readonly := ni.transmissionFlags&NBD_FLAG_READ_ONLY != 0; readonly != tc.readonly {
+				t.Errorf("%s: read-only is %v, expected %v", tc.name, readonly, tc.readonly)
+			}
+			if zeroes := ni.transmissionFlags&NBD_FLAG_SEND_WRITE_ZEROES != 0; zeroes != tc.zeroes {
+				t.Errorf("%s: write zeroes advertised is %v, expected %v", tc.name, zeroes, tc.zeroes)
+			}
+			for _, c := range []struct {
+				cmdType  uint16
+				nbdError uint32
+			}{
+				{NBD_CMD_WRITE, tc.writeErr},
+				{NBD_CMD_READ, tc.readErr},
+				{NBD_CMD_FLUSH, tc.flushErr},
+			} {
+				var data []byte
+				length := uint32(4096)
+				if c.cmdType == NBD_CMD_WRITE {
+					data = make([]byte, length)
+				} else if c.cmdType == NBD_CMD_FLUSH {
+					length = 0
+				}
+				rep, _, err := ni.Command(t, c.cmdType, 0, 0, length, data)
+				if err != nil {
+					t.Fatalf("%s: command %d: %v", tc.name, c.cmdType, err)
+				}
+				if rep.NbdError != c.nbdError {
+					t.Errorf("%s: command %d got error %d, expected %d", tc.name, c.cmdType, rep.NbdError, c.nbdError)
+				}
+			}
+		}()
+	}
+}
+
+func TestBadCommandLists(t *testing.T) {
+	for _, bad := range []DriverParametersConfig{
+		{"denycommands": "disc"},
+		{"allowcommands": "read,bogus"},
+		{"denycommands": "read,,write"},
+	} {
+		if _, err := exportDeniedCommands(&ExportConfig{DriverParameters: bad}); err == nil {
+			t.Errorf("Command lists %v accepted", bad)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	ni := ConnectAndGo(t, TestConfig{Driver: "file", AccessLogFields: "peer, export, bytes_read, bytes_written, commands, reason"}, 1024*1024)
+	defer ni.Close()
+
+	for _, cmdType := range []uint16{NBD_CMD_WRITE, NBD_CMD_WRITE, NBD_CMD_READ} {
+		var data []byte
+		if cmdType == NBD_CMD_WRITE {
+			data = make([]byte, 4096)
+		}
+		if rep, _, err := ni.Command(t, cmdType, 0, 0, 4096, data); err != nil || rep.NbdError != 0 {
+			t.Fatalf("Command %d failed: %v", cmdType, err)
+		}
+	}
+	if err := ni.Disconnect(t); err != nil {
+		t.Fatal(err)
+	}
+
+	// the record is written as the connection is torn down
+	var buf []byte
+	var err error
+	for i := 0; i < 50 && len(buf) == 0; i++ {
+		if buf, err = ioutil.ReadFile(path.Join(ni.TempDir, "access.log")); err != nil {
+			t.Fatalf("Could not read access log: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	var record struct {
+		Peer         *string          `json:"peer"`
+		Export       string           `json:"export"`
+		BytesRead    int64            `json:"bytes_read"`
+		BytesWritten int64            `json:"bytes_written"`
+		Commands     map[string]int64 `json:"commands"`
+		Duration     *float64         `json:"duration"`
+		Reason       string           `json:"reason"`
+	}
+	if err := json.Unmarshal(buf, &record); err != nil {
+		t.Fatalf("Could not parse access log record %q: %v", buf, err)
+	}
+	if record.Peer == nil || record.Export != "foo" || record.Reason != closeClientDisconnected {
+		t.Errorf("Bad access log record %q", buf)
+	}
+	if record.BytesRead != 4096 || record.BytesWritten != 8192 {
+		t.Errorf("Access log recorded %d bytes read and %d written", record.BytesRead, record.BytesWritten)
+	}
+	if record.Commands["write"] != 2 || record.Commands["read"] != 1 || record.Commands["disc"] != 1 {
+		t.Errorf("Access log recorded commands %v", record.Commands)
+	}
+	if record.Duration != nil {
+		t.Errorf("Access log recorded a field not configured")
+	}
+}
+
+func TestAccessLogRotation(t *testing.T) {
+	TempDir, err := ioutil.TempDir("", "nbdtest")
+	if err != nil {
+		t.Fatalf("Could not create test directory: %v", err)
+	}
+	defer os.RemoveAll(TempDir)
+	filename := path.Join(TempDir, "access.log")
+	rw, err := newRotatingWriter(&AccessLogConfig{File: filename, MaxSize: 10, MaxFiles: 2})
+	if err != nil {
+		t.Fatalf("Could not open access log: %v", err)
+	}
+	defer rw.Close()
+	for _, line := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		if _, err := rw.Write([]byte(line)); err != nil {
+			t.Fatalf("Could not write access log: %v", err)
+		}
+	}
+	for suffix, expected := range map[string]string{"": "dddddd\n", ".1": "cccccc\n", ".2": "bbbbbb\n"} {
+		if buf, err := ioutil.ReadFile(filename + suffix); err != nil || string(buf) != expected {
+			t.Errorf("Access log%s holds %q, expected %q", suffix, buf, expected)
+		}
+	}
+	if _, err := os.Stat(filename + ".3"); !os.IsNotExist(err) {
+		t.Errorf("More rotated access logs kept than configured")
+	}
+
+	for _, bad := range []AccessLogConfig{
+		{MaxSize: -1},
+		{FileMode: "999"},
+		{Fields: []string{"peer", "password"}},
+	} {
+		if err := validateAccessLog(&bad); err == nil {
+			t.Errorf("Access log configuration %v accepted", bad)
+		}
+	}
+}
+
+func TestBlockStatus(t *testing.T) {
+	ni := StartNbd(t, TestConfig{Driver: "file"})
+	defer ni.Close()
+	if err := ni.CreateFile(t, 1024*1024); err != nil {
+		t.Fatalf("Error on create file: %v", err)
+	}
+	if err := ni.Connect(t); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+
+	// selecting needs structured replies
+	if contexts, replyType, err := ni.metaContexts(t, NBD_OPT_SET_META_CONTEXT, metaContextPayload("foo", 1, "base:allocation")); err != nil || replyType != NBD_REP_ERR_INVALID || len(contexts) != 0 {
+		t.Fatalf("Meta context selected without structured replies: %v, reply type %x, error %v", contexts, replyType, err)
+	}
+	if replyType, err := ni.Option(t, NBD_OPT_STRUCTURED_REPLY, nil); err != nil || replyType != NBD_REP_ACK {
+		t.Fatalf("Structured replies not negotiated: reply type %x, error %v", replyType, err)
+	}
+	for _, tc := range []struct {
+		name     string
+		optId    uint32
+		payload  []byte
+		contexts string
+	}{
+		{"list all", NBD_OPT_LIST_META_CONTEXT, metaContextPayload("foo", 0), "1:base:allocation"},
+		{"list namespace", NBD_OPT_LIST_META_CONTEXT, metaContextPayload("foo", 1, "base:"), "1:base:allocation"},
+		{"list other namespace", NBD_OPT_LIST_META_CONTEXT, metaContextPayload("foo", 1, "qemu:dirty-bitmap:a"), ""},
+		{"select namespace", NBD_OPT_SET_META_CONTEXT, metaContextPayload("foo", 1, "base:"), ""},
+		{"select none", NBD_OPT_SET_META_CONTEXT, metaContextPayload("foo", 0), ""},
+		{"select", NBD_OPT_SET_META_CONTEXT, metaContextPayload("", 2, "qemu:dirty-bitmap:a", "base:allocation"), "1:base:allocation"},
+	} {
+		contexts, replyType, err := ni.metaContexts(t, tc.optId, tc.payload)
+		if err != nil || replyType != NBD_REP_ACK {
+			t.Fatalf("%s: reply type %x, error %v", tc.name, replyType, err)
+		}
+		if got := strings.Join(contexts, ","); got != tc.contexts {
+			t.Errorf("%s: got contexts %q, expected %q", tc.name, got, tc.contexts)
+		}
+	}
+	if err := ni.Go(t); err != nil {
+		t.Fatalf("Error on go: %v", err)
+	}
+	data := make([]byte, 64*1024)
+	for i := range data {
+		data[i] = 1
+	}
+	if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 64*1024, uint32(len(data)), data); err != nil || rep.NbdError != 0 {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	const hole = NBD_STATE_HOLE | NBD_STATE_ZERO
+	for _, tc := range []struct {
+		name        string
+		flags       uint16
+		offset      uint64
+		length      uint32
+		descriptors []nbdBlockDescriptor
+	}{
+		{"whole", 0, 0, 1024 * 1024, []nbdBlockDescriptor{{64 * 1024, hole}, {64 * 1024, 0}, {896 * 1024, hole}}},
+		{"one", NBD_CMD_FLAG_REQ_ONE, 0, 1024 * 1024, []nbdBlockDescriptor{{64 * 1024, hole}}},
+		{"within data", 0, 96 * 1024, 4096, []nbdBlockDescriptor{{4096, 0}}},
+		{"straddling data", 0, 96 * 1024, 64 * 1024, []nbdBlockDescriptor{{32 * 1024, 0}, {32 * 1024, hole}}},
+	} {
+		chunks, err := ni.commandStructured(t, NBD_CMD_BLOCK_STATUS, tc.flags, tc.offset, tc.length)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if len(chunks) != 1 || chunks[0].header.NbdReplyType != NBD_REPLY_TYPE_BLOCK_STATUS {
+			t.Fatalf("%s: bad reply %v", tc.name, chunks)
+		}
+		payload := chunks[0].payload
+		if len(payload) < 4 || binary.BigEndian.Uint32(payload) != metaContextBaseAllocationId {
+			t.Fatalf("%s: bad block status payload %v", tc.name, payload)
+		}
+		descriptors := make([]nbdBlockDescriptor, (len(payload)-4)/8)
+		binary.Read(bytes.NewReader(payload[4:]), binary.BigEndian, descriptors)
+		if tc.name == "whole" && len(descriptors) == 1 && descriptors[0].NbdStatusFlags == 0 {
+			t.Skip("Filesystem does not report holes")
+		}
+		if fmt.Sprint(descriptors) != fmt.Sprint(tc.descriptors) {
+			t.Errorf("%s: got descriptors %v, expected %v", tc.name, descriptors, tc.descriptors)
+		}
+	}
+
+	// a query must have a length
+	chunks, err := ni.commandStructured(t, NBD_CMD_BLOCK_STATUS, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 1 || chunks[0].header.NbdReplyType != NBD_REPLY_TYPE_ERROR || binary.BigEndian.Uint32(chunks[0].payload) != NBD_EINVAL {
+		t.Errorf("Block status of zero length got reply %v", chunks)
+	}
+}
+
+// blockStatus queries the allocation of length bytes at offset, once the
+// base:allocation meta context has been selected
+func (ni *NbdInstance) blockStatus(t *testing.T, offset uint64, length uint32) ([]nbdBlockDescriptor, error) {
+	chunks, err := ni.commandStructured(t, NBD_CMD_BLOCK_STATUS, 0, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) != 1 || chunks[0].header.NbdReplyType != NBD_REPLY_TYPE_BLOCK_STATUS {
+		return nil, fmt.Errorf("Bad block status reply %v", chunks)
+	}
+	payload := chunks[0].payload
+	if len(payload) < 4 || binary.BigEndian.Uint32(payload) != metaContextBaseAllocationId {
+		return nil, fmt.Errorf("Bad block status payload %v", payload)
+	}
+	descriptors := make([]nbdBlockDescriptor, (len(payload)-4)/8)
+	binary.Read(bytes.NewReader(payload[4:]), binary.BigEndian, descriptors)
+	return descriptors, nil
+}
+
+func TestBlockStatusFallback(t *testing.T) {
+	backend := &badRangeBackend{}
+	c := &Connection{backend: backend}
+	descriptors, err := c.allocationExtents(context.Background(), 0, 8192, false)
+	if err != nil || len(descriptors) != 1 || descriptors[0] != (nbdExtendedBlockDescriptor{8192, 0}) {
+		t.Errorf("Backend without extents reported %v, error %v", descriptors, err)
+	}
+}
+
+func TestSparseRead(t *testing.T) {
+	ni := StartNbd(t, TestConfig{Driver: "file"})
+	defer ni.Close()
+	if err := ni.CreateFile(t, 1024*1024); err != nil {
+		t.Fatalf("Error on create file: %v", err)
+	}
+	if err := ni.Connect(t); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	if replyType, err := ni.Option(t, NBD_OPT_STRUCTURED_REPLY, nil); err != nil || replyType != NBD_REP_ACK {
+		t.Fatalf("Structured replies not negotiated: reply type %x, error %v", replyType, err)
+	}
+	if err := ni.Go(t); err != nil {
+		t.Fatalf("Error on go: %v", err)
+	}
+	data := make([]byte, 64*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 64*1024, uint32(len(data)), data); err != nil || rep.NbdError != 0 {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	chunks, err := ni.readStructured(t, 0, 256*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) == 1 && chunks[0].header.NbdReplyType == NBD_REPLY_TYPE_OFFSET_DATA {
+		t.Skip("Filesystem does not report holes")
+	}
+	type want struct {
+		replyType uint16
+		offset    uint64
+		length    uint64
+	}
+	expected := []want{
+		{NBD_REPLY_TYPE_OFFSET_HOLE, 0, 64 * 1024},
+		{NBD_REPLY_TYPE_OFFSET_DATA, 64 * 1024, 64 * 1024},
+		{NBD_REPLY_TYPE_OFFSET_HOLE, 128 * 1024, 128 * 1024},
+	}
+	if len(chunks) != len(expected) {
+		t.Fatalf("Got %d chunks, expected %d", len(chunks), len(expected))
+	}
+	for i, c := range chunks {
+		got := want{replyType: c.header.NbdReplyType, offset: binary.BigEndian.Uint64(c.payload)}
+		switch got.replyType {
+		case NBD_REPLY_TYPE_OFFSET_HOLE:
+			got.length = uint64(binary.BigEndian.Uint32(c.payload[8:]))
+		case NBD_REPLY_TYPE_OFFSET_DATA:
+			got.length = uint64(len(c.payload) - 8)
+			if !bytes.Equal(c.payload[8:], data) {
+				t.Errorf("Chunk %d has the wrong data", i)
+			}
+		}
+		if got != expected[i] {
+			t.Errorf("Chunk %d is %+v, expected %+v", i, got, expected[i])
+		}
+		if done := c.header.NbdReplyFlags&NBD_REPLY_FLAG_DONE != 0; done != (i == len(chunks)-1) {
+			t.Errorf("Chunk %d has done %v", i, done)
+		}
+	}
+}
+
+// extendedChunk is an extended reply chunk as received by the test client
+type extendedChunk struct {
+	header  nbdExtendedReply
+	payload []byte
+}
+
+// commandExtended sends a command with an extended header and returns the
+// chunks of its reply
+func (ni *NbdInstance) commandExtended(t *testing.T, cmdType uint16, flags uint16, offset uint64, length uint64, data []byte) ([]extendedChunk, error) {
+	cmd := nbdExtendedRequest{
+		NbdRequestMagic: NBD_EXTENDED_REQUEST_MAGIC,
+		NbdCommandFlags: flags,
+		NbdCommandType:  cmdType,
+		NbdHandle:       getHandle(),
+		NbdOffset:       offset,
+		NbdLength:       length,
+	}
+	ni.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer ni.conn.SetDeadline(time.Time{})
+	if err := binary.Write(ni.conn, binary.BigEndian, cmd); err != nil {
+		return nil, fmt.Errorf("Could not send command: %v", err)
+	}
+	if _, err := ni.conn.Write(data); err != nil {
+		return nil, fmt.Errorf("Could not send payload: %v", err)
+	}
+	var chunks []extendedChunk
+	for {
+		var c extendedChunk
+		if err := binary.Read(ni.conn, binary.BigEndian, &c.header); err != nil {
+			return nil, fmt.Errorf("Could not receive reply chunk: %v", err)
+		}
+		if c.header.NbdReplyMagic != NBD_EXTENDED_REPLY_MAGIC || c.header.NbdHandle != cmd.NbdHandle || c.header.NbdOffset != offset {
+			return nil, fmt.Errorf("Reply chunk had wrong magic (%x), handle or offset (%d)", c.header.NbdReplyMagic, c.header.NbdOffset)
+		}
+		c.payload = make([]byte, c.header.NbdLength)
+		if _, err := io.ReadFull(ni.conn, c.payload); err != nil {
+			return nil, fmt.Errorf("Could not receive reply chunk payload: %v", err)
+		}
+		chunks = append(chunks, c)
+		if c.header.NbdReplyFlags&NBD_REPLY_FLAG_DONE != 0 {
+			return chunks, nil
+		}
+	}
+}
+
+func TestExtendedHeaders(t *testing.T) {
+	const size = 8 * 1024 * 1024 * 1024
+	ni := StartNbd(t, TestConfig{Driver: "file", MaxPayload: "65536"})
+	defer ni.Close()
+	if err := ni.CreateFile(t, size); err != nil {
+		t.Fatalf("Error on create file: %v", err)
+	}
+	if err := ni.Connect(t); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	if replyType, err := ni.Option(t, NBD_OPT_EXTENDED_HEADERS, nil); err != nil || replyType != NBD_REP_ACK {
+		t.Fatalf("Extended headers not negotiated: reply type %x, error %v", replyType, err)
+	}
+	// there is no going back to plain structured replies
+	if replyType, err := ni.Option(t, NBD_OPT_STRUCTURED_REPLY, nil); err != nil || replyType != NBD_REP_ERR_EXT_HEADER_REQD {
+		t.Fatalf("Structured reply option after extended headers got reply type %x, error %v", replyType, err)
+	}
+	if err := ni.Go(t); err != nil {
+		t.Fatalf("Error on go: %v", err)
+	}
+
+	done := func(name string, chunks []extendedChunk, err error) {
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(chunks) != 1 || chunks[0].header.NbdReplyType != NBD_REPLY_TYPE_NONE {
+			t.Fatalf("%s: got reply %v", name, chunks)
+		}
+	}
+	readBack := func(name string, offset uint64, expected []byte) {
+		chunks, err := ni.commandExtended(t, NBD_CMD_READ, 0, offset, uint64(len(expected)), nil)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got := make([]byte, len(expected))
+		for _, c := range chunks {
+			switch c.header.NbdReplyType {
+			case NBD_REPLY_TYPE_OFFSET_DATA:
+				copy(got[binary.BigEndian.Uint64(c.payload)-offset:], c.payload[8:])
+			case NBD_REPLY_TYPE_OFFSET_HOLE:
+			default:
+				t.Fatalf("%s: got chunk of type %d", name, c.header.NbdReplyType)
+			}
+		}
+		if !bytes.Equal(got, expected) {
+			t.Errorf("%s: read back the wrong data", name)
+		}
+	}
+
+	data := make([]byte, 64*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	chunks, err := ni.commandExtended(t, NBD_CMD_WRITE, 0, 1024*1024, uint64(len(data)), data)
+	done("Write", chunks, err)
+	readBack("Read of write", 1024*1024, data)
+
+	// zeroes beyond the maximum payload are written a window at a time
+	chunks, err = ni.commandExtended(t, NBD_CMD_WRITE_ZEROES, NBD_CMD_FLAG_NO_HOLE, 1024*1024+4096, 256*1024, nil)
+	done("Write zeroes", chunks, err)
+	readBack("Read of zeroes", 1024*1024, append(data[:4096:4096], make([]byte, 60*1024)...))
+
+	// trims and zeroes of more than 4G are made in one command
+	chunks, err = ni.commandExtended(t, NBD_CMD_WRITE_ZEROES, 0, 0, 5*1024*1024*1024, nil)
+	done("Long write zeroes", chunks, err)
+	readBack("Read of long zeroes", 1024*1024, make([]byte, 64*1024))
+	chunks, err = ni.commandExtended(t, NBD_CMD_TRIM, 0, 1024*1024*1024, size-1024*1024*1024, nil)
+	done("Long trim", chunks, err)
+
+	// errors are replied to with an error chunk
+	chunks, err = ni.commandExtended(t, NBD_CMD_TRIM, 0, size-4096, 8192, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 1 || chunks[0].header.NbdReplyType != NBD_REPLY_TYPE_ERROR || binary.BigEndian.Uint32(chunks[0].payload) != NBD_EINVAL {
+		t.Errorf("Trim beyond the end got reply %v", chunks)
+	}
+}
+
+// singleConnBackend hides whether the file backend it wraps is consistent
+// across connections
+type singleConnBackend struct {
+	Backend
+}
+
+func TestMultiConn(t *testing.T) {
+	RegisterBackend("singleconntest", func(ctx context.Context, ec *ExportConfig) (Backend, error) {
+		fb, err := NewFileBackend(ctx, ec)
+		if err != nil {
+			return nil, err
+		}
+		return &singleConnBackend{Backend: fb}, nil
+	})
+	defer delete(BackendMap, "singleconntest")
+
+	for _, tc := range []struct {
+		name      string
+		config    TestConfig
+		multiConn bool
+		shared    bool
+	}{
+		{"file", TestConfig{Driver: "file"}, true, false},
+		{"file forced off", TestConfig{Driver: "file", MultiConn: "false"}, false, false},
+		{"inconsistent backend", TestConfig{Driver: "singleconntest"}, false, false},
+		{"inconsistent backend forced on", TestConfig{Driver: "singleconntest", MultiConn: "true"}, true, true},
+		{"inconsistent backend read-only", TestConfig{Driver: "singleconntest", ReadOnly: true}, true, false},
+	} {
+		ni := ConnectAndGo(t, tc.config, 1024*1024)
+		if multiConn := ni.transmissionFlags&NBD_FLAG_CAN_MULTI_CONN != 0; multiConn != tc.multiConn {
+			t.Errorf("%s: NBD_FLAG_CAN_MULTI_CONN advertised %v, expected %v", tc.name, multiConn, tc.multiConn)
+		}
+		shared := false
+		sharedBackendsMutex.Lock()
+		for _, e := range sharedBackends {
+			if strings.Contains(e.key, ni.TempDir) {
+				shared = true
+			}
+		}
+		sharedBackendsMutex.Unlock()
+		if shared != tc.shared {
+			t.Errorf("%s: backend shared %v, expected %v", tc.name, shared, tc.shared)
+		}
+		ni.Close()
+	}
+
+	if _, _, err := exportMultiConn(&ExportConfig{DriverParameters: DriverParametersConfig{"multiconn": "sometimes"}}); err == nil {
+		t.Errorf("Bad multiconn accepted")
+	}
+}
+
+// slowZeroBackend hides that the file backend it wraps can zero without writing
+type slowZeroBackend struct {
+	Backend
+}
+
+func TestFastZero(t *testing.T) {
+	RegisterBackend("slowzerotest", func(ctx context.Context, ec *ExportConfig) (Backend, error) {
+		fb, err := NewFileBackend(ctx, ec)
+		if err != nil {
+			return nil, err
+		}
+		return &slowZeroBackend{Backend: fb}, nil
+	})
+	defer delete(BackendMap, "slowzerotest")
+
+	data := make([]byte, 64*1024)
+	for i := range data {
+		data[i] = 0xff
+	}
+	zeroes := make([]byte, len(data))
+	for _, tc := range []struct {
+		name     string
+		driver   string
+		fastZero bool
+	}{
+		{"file", "file", true},
+		{"backend writing zeroes", "slowzerotest", false},
+	} {
+		ni := ConnectAndGo(t, TestConfig{Driver: tc.driver}, 1024*1024)
+		if fastZero := ni.transmissionFlags&NBD_FLAG_SEND_FAST_ZERO != 0; fastZero != tc.fastZero {
+			t.Errorf("%s: NBD_FLAG_SEND_FAST_ZERO advertised %v, expected %v", tc.name, fastZero, tc.fastZero)
+		}
+		if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 0, uint32(len(data)), data); err != nil || rep.NbdError != 0 {
+			t.Fatalf("%s: write failed: %v", tc.name, err)
+		}
+		rep, _, err := ni.Command(t, NBD_CMD_WRITE_ZEROES, NBD_CMD_FLAG_FAST_ZERO, 0, uint32(len(data)), nil)
+		if err != nil {
+			t.Fatalf("%s: write zeroes failed: %v", tc.name, err)
+		}
+		expected := zeroes
+		if !tc.fastZero {
+			// the range must be left alone
+			if rep.NbdError != NBD_ENOTSUP {
+				t.Errorf("%s: fast zero returned error %d, expected NBD_ENOTSUP", tc.name, rep.NbdError)
+			}
+			expected = data
+		} else if rep.NbdError != 0 {
+			t.Errorf("%s: fast zero returned error %d", tc.name, rep.NbdError)
+		}
+		if _, got, err := ni.Command(t, NBD_CMD_READ, 0, 0, uint32(len(data)), nil); err != nil || !bytes.Equal(got, expected) {
+			t.Errorf("%s: read after fast zero got the wrong data (error %v)", tc.name, err)
+		}
+		// without the flag, zeroes are written instead
+		if rep, _, err := ni.Command(t, NBD_CMD_WRITE_ZEROES, 0, 0, uint32(len(data)), nil); err != nil || rep.NbdError != 0 {
+			t.Errorf("%s: write zeroes failed: %v", tc.name, err)
+		}
+		if _, got, err := ni.Command(t, NBD_CMD_READ, 0, 0, uint32(len(data)), nil); err != nil || !bytes.Equal(got, zeroes) {
+			t.Errorf("%s: read after write zeroes got the wrong data (error %v)", tc.name, err)
+		}
+		ni.Close()
+	}
+}
+
+func TestWriteZeroesWithoutPayload(t *testing.T) {
+	RegisterBackend("slowzerotest", func(ctx context.Context, ec *ExportConfig) (Backend, error) {
+		fb, err := NewFileBackend(ctx, ec)
+		if err != nil {
+			return nil, err
+		}
+		return &slowZeroBackend{Backend: fb}, nil
+	})
+	defer delete(BackendMap, "slowzerotest")
+
+	// zeroes written are written from one block, however many are needed
+	c := &Connection{export: &Export{memoryBlockSize: 4096, maxPayload: 65536}}
+	if mem := c.zeroMemory(); len(mem) != 16 || &mem[0][0] != &mem[15][0] {
+		t.Errorf("Zero memory is %d separate blocks", len(mem))
+	}
+
+	ni := ConnectAndGo(t, TestConfig{Driver: "slowzerotest", MaxPayload: "65536"}, 1024*1024)
+	defer ni.Close()
+	data := make([]byte, 65536)
+	for i := range data {
+		data[i] = 0xff
+	}
+	for offset := uint64(0); offset < 512*1024; offset += uint64(len(data)) {
+		if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, offset, uint32(len(data)), data); err != nil || rep.NbdError != 0 {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	// beyond the maximum payload, and not aligned to it
+	if rep, _, err := ni.Command(t, NBD_CMD_WRITE_ZEROES, NBD_CMD_FLAG_NO_HOLE, 4096, 300*1024, nil); err != nil || rep.NbdError != 0 {
+		t.Fatalf("Write zeroes failed: %v", err)
+	}
+	for offset := uint64(0); offset < 512*1024; offset += uint64(len(data)) {
+		_, got, err := ni.Command(t, NBD_CMD_READ, 0, offset, uint32(len(data)), nil)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		for i, b := range got {
+			if pos := offset + uint64(i); (pos >= 4096 && pos < 4096+300*1024) != (b == 0) {
+				t.Fatalf("Byte %d is %x after write zeroes", pos, b)
+			}
+		}
+	}
+}
+
+func TestDontFragment(t *testing.T) {
+	RegisterBackend("badrangetest", func(ctx context.Context, ec *ExportConfig) (Backend, error) {
+		fb, err := NewFileBackend(ctx, ec)
+		if err != nil {
+			return nil, err
+		}
+		return &badRangeBackend{Backend: fb, badOffset: 100 * 1024, badLength: 4096}, nil
+	})
+	defer delete(BackendMap, "badrangetest")
+
+	// NBD_FLAG_SEND_DF needs structured replies
+	ni := ConnectAndGo(t, TestConfig{}, 1024*1024)
+	if ni.transmissionFlags&NBD_FLAG_SEND_DF != 0 {
+		t.Errorf("NBD_FLAG_SEND_DF advertised without structured replies")
+	}
+	ni.Close()
+
+	for _, driver := range []string{"file", "badrangetest"} {
+		ni := StartNbd(t, TestConfig{Driver: driver})
+		if err := ni.CreateFile(t, 1024*1024); err != nil {
+			t.Fatalf("Error on create file: %v", err)
+		}
+		if err := ni.Connect(t); err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		if replyType, err := ni.Option(t, NBD_OPT_STRUCTURED_REPLY, nil); err != nil || replyType != NBD_REP_ACK {
+			t.Fatalf("Structured replies not negotiated: reply type %x, error %v", replyType, err)
+		}
+		if err := ni.Go(t); err != nil {
+			t.Fatalf("Error on go: %v", err)
+		}
+		if ni.transmissionFlags&NBD_FLAG_SEND_DF == 0 {
+			t.Errorf("%s: NBD_FLAG_SEND_DF not advertised with structured replies", driver)
+		}
+		data := make([]byte, 64*1024)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 64*1024, uint32(len(data)), data); err != nil || rep.NbdError != 0 {
+			t.Fatalf("%s: write failed: %v", driver, err)
+		}
+
+		for _, tc := range []struct {
+			name      string
+			offset    uint64
+			length    uint32
+			replyType uint16 // of the only chunk
+			driver    string // the driver the case applies to
+		}{
+			// a read spanning holes and data is sent as data
+			{"sparse", 0, 256 * 1024, NBD_REPLY_TYPE_OFFSET_DATA, "file"},
+			{"good", 64 * 1024, 32 * 1024, NBD_REPLY_TYPE_OFFSET_DATA, "badrangetest"},
+			{"some bad", 64 * 1024, 64 * 1024, NBD_REPLY_TYPE_ERROR, "badrangetest"},
+		} {
+			if tc.driver != driver {
+				continue
+			}
+			chunks, err := ni.commandStructured(t, NBD_CMD_READ, NBD_CMD_FLAG_DF, tc.offset, tc.length)
+			if err != nil {
+				t.Fatalf("%s %s: %v", driver, tc.name, err)
+			}
+			if len(chunks) != 1 {
+				t.Errorf("%s %s: got %d chunks, expected one of type %d", driver, tc.name, len(chunks), tc.replyType)
+			} else if chunks[0].header.NbdReplyType != tc.replyType {
+				t.Errorf("%s %s: got a chunk of type %d, expected one of type %d", driver, tc.name, chunks[0].header.NbdReplyType, tc.replyType)
+			} else if tc.replyType == NBD_REPLY_TYPE_OFFSET_DATA && uint32(len(chunks[0].payload)) != 8+tc.length {
+				t.Errorf("%s %s: chunk has %d bytes", driver, tc.name, len(chunks[0].payload))
+			}
+		}
+
+		// a hole covering the whole read is a single chunk too
+		if driver == "file" {
+			chunks, err := ni.commandStructured(t, NBD_CMD_READ, NBD_CMD_FLAG_DF, 512*1024, 64*1024)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chunks) != 1 || (chunks[0].header.NbdReplyType != NBD_REPLY_TYPE_OFFSET_HOLE && chunks[0].header.NbdReplyType != NBD_REPLY_TYPE_OFFSET_DATA) {
+				t.Errorf("Read of a hole got %d chunks", len(chunks))
+			}
+		}
+		ni.Close()
+	}
+}
+
+func TestPhantomBeyondFile(t *testing.T) {
+	ni := StartNbd(t, TestConfig{Driver: "file", PhantomSize: "1048576"})
+	defer ni.Close()
+	if err := ni.CreateFile(t, 64*1024); err != nil {
+		t.Fatalf("Error on create file: %v", err)
+	}
+	if err := ni.Connect(t); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	if replyType, err := ni.Option(t, NBD_OPT_STRUCTURED_REPLY, nil); err != nil || replyType != NBD_REP_ACK {
+		t.Fatalf("Structured replies not negotiated: reply type %x, error %v", replyType, err)
+	}
+	if _, replyType, err := ni.metaContexts(t, NBD_OPT_SET_META_CONTEXT, metaContextPayload("foo", 1, "base:allocation")); err != nil || replyType != NBD_REP_ACK {
+		t.Fatalf("Meta context not selected: reply type %x, error %v", replyType, err)
+	}
+	if err := ni.Go(t); err != nil {
+		t.Fatalf("Error on go: %v", err)
+	}
+	if ni.exportSize != 1024*1024 {
+		t.Fatalf("Export has size %d, expected the phantom size", ni.exportSize)
+	}
+	// reads are sent as one chunk, so need no reassembly
+	read := func(offset uint64, length uint32) []byte {
+		chunks, err := ni.commandStructured(t, NBD_CMD_READ, NBD_CMD_FLAG_DF, offset, length)
+		if err != nil {
+			t.Fatalf("Read at %d failed: %v", offset, err)
+		}
+		if len(chunks) != 1 {
+			t.Fatalf("Read at %d got %d chunks", offset, len(chunks))
+		}
+		switch chunks[0].header.NbdReplyType {
+		case NBD_REPLY_TYPE_OFFSET_DATA:
+			return chunks[0].payload[8:]
+		case NBD_REPLY_TYPE_OFFSET_HOLE:
+			return make([]byte, length)
+		}
+		t.Fatalf("Read at %d got reply %v", offset, chunks[0])
+		return nil
+	}
+	fileSize := func() int64 {
+		fi, err := os.Stat(path.Join(ni.TempDir, "nbd.img"))
+		if err != nil {
+			t.Fatalf("Cannot stat backing file: %v", err)
+		}
+		return fi.Size()
+	}
+
+	// a write straddling the end of the file grows it
+	data := bytes.Repeat([]byte{0x5a}, 8192)
+	if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 60*1024, uint32(len(data)), data); err != nil || rep.NbdError != 0 {
+		t.Fatalf("Write straddling the end of the file failed: %v %v", rep, err)
+	}
+	if size := fileSize(); size != 68*1024 {
+		t.Errorf("Backing file has size %d after write, expected %d", size, 68*1024)
+	}
+	expected := append(append(make([]byte, 4096), data...), make([]byte, 4096)...)
+	if b := read(56*1024, 16*1024); !bytes.Equal(b, expected) {
+		t.Errorf("Read straddling the end of the file got the wrong data")
+	}
+	if b := read(512*1024, 64*1024); !bytes.Equal(b, make([]byte, 64*1024)) {
+		t.Errorf("Read beyond the end of the file did not return zeroes")
+	}
+
+	// zeroing beyond the end of the file leaves it be
+	for _, flags := range []uint16{0, NBD_CMD_FLAG_NO_HOLE, NBD_CMD_FLAG_FAST_ZERO} {
+		if rep, _, err := ni.Command(t, NBD_CMD_WRITE_ZEROES, flags, 64*1024, 64*1024, nil); err != nil || (rep.NbdError != 0 && !(flags == NBD_CMD_FLAG_FAST_ZERO && rep.NbdError == NBD_ENOTSUP)) {
+			t.Errorf("Write zeroes with flags %x straddling the end of the file failed: %v %v", flags, rep, err)
+		}
+		if rep, _, err := ni.Command(t, NBD_CMD_WRITE_ZEROES, flags, 900*1024, 64*1024, nil); err != nil || rep.NbdError != 0 {
+			t.Errorf("Write zeroes with flags %x beyond the end of the file failed: %v %v", flags, rep, err)
+		}
+	}
+	if size := fileSize(); size != 68*1024 {
+		t.Errorf("Backing file has size %d after write zeroes, expected %d", size, 68*1024)
+	}
+	if b := read(60*1024, 8192); !bytes.Equal(b, append(data[:4096:4096], make([]byte, 4096)...)) {
+		t.Errorf("Read after write zeroes straddling the end of the file got the wrong data")
+	}
+
+	// the range beyond the end of the file is a hole
+	descriptors, err := ni.blockStatus(t, 0, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := uint64(0)
+	for _, d := range descriptors {
+		if offset+uint64(d.NbdLength) > 68*1024 && d.NbdStatusFlags != NBD_STATE_HOLE|NBD_STATE_ZERO {
+			t.Errorf("Block status beyond the end of the file got %v", descriptors)
+			break
+		}
+		offset += uint64(d.NbdLength)
+	}
+	if offset != 1024*1024 {
+		t.Errorf("Block status covered %d bytes, expected the phantom size: %v", offset, descriptors)
+	}
+}
+
+func TestPhantomFile(t *testing.T) {
+	ni := ConnectAndGo(t, TestConfig{PhantomSize: "1048576"}, 64*1024)
+	defer ni.Close()
+	if ni.exportSize != 1024*1024 {
+		t.Fatalf("Export has size %d, expected the phantom size", ni.exportSize)
+	}
+	filename := path.Join(ni.TempDir, "nbd.img")
+
+	// beyond the end of the file reads as zeroes
+	if rep, b, err := ni.Command(t, NBD_CMD_READ, 0, 256*1024, 64*1024, nil); err != nil || rep.NbdError != 0 || !bytes.Equal(b, make([]byte, 64*1024)) {
+		t.Errorf("Read beyond the end of the file did not return zeroes: %v %v", rep, err)
+	}
+
+	// a write beyond the end of the file grows it just so far
+	data := bytes.Repeat([]byte{0xa5}, 4096)
+	if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 512*1024, uint32(len(data)), data); err != nil || rep.NbdError != 0 {
+		t.Fatalf("Write beyond the end of the file failed: %v %v", rep, err)
+	}
+	if fi, err := os.Stat(filename); err != nil || fi.Size() != 512*1024+4096 {
+		t.Errorf("Backing file not grown to the end of the write: %v %v", fi, err)
+	}
+	if rep, b, err := ni.Command(t, NBD_CMD_READ, 0, 512*1024, uint32(len(data)), nil); err != nil || rep.NbdError != 0 || !bytes.Equal(b, data) {
+		t.Errorf("Read of the write beyond the end of the file got the wrong data: %v %v", rep, err)
+	}
+
+	// nothing may be written beyond the phantom size
+	if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 1024*1024-2048, uint32(len(data)), data); err != nil || rep.NbdError != NBD_ENOSPC {
+		t.Errorf("Write beyond the phantom size got %v %v", rep, err)
+	}
+	ctx := context.Background()
+	b, err := NewFileBackend(ctx, &ExportConfig{Name: "phantom", Driver: "file", DriverParameters: DriverParametersConfig{"path": filename, "phantomsize": "1048576"}})
+	if err != nil {
+		t.Fatalf("Cannot open backend: %v", err)
+	}
+	defer b.Close(ctx)
+	if _, err := b.WriteAt(ctx, data, 1024*1024-2048, false); err != syscall.ENOSPC {
+		t.Errorf("Backend write beyond the phantom size got %v, expected ENOSPC", err)
+	}
+	if vw, ok := b.(VectoredWriter); !ok {
+		t.Errorf("Backend cannot write vectored")
+	} else if _, err := vw.WriteAtv(ctx, [][]byte{data}, 1024*1024-2048, false); err != syscall.ENOSPC {
+		t.Errorf("Backend vectored write beyond the phantom size got %v, expected ENOSPC", err)
+	}
+	if fi, err := os.Stat(filename); err != nil || fi.Size() != 512*1024+4096 {
+		t.Errorf("Backing file grown by a write beyond the phantom size: %v %v", fi, err)
+	}
+}
+
+func TestTrimBlockStatus(t *testing.T) {
+	ni := StartNbd(t, TestConfig{Driver: "file"})
+	defer ni.Close()
+	if err := ni.CreateFile(t, 1024*1024); err != nil {
+		t.Fatalf("Error on create file: %v", err)
+	}
+	if err := ni.Connect(t); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	if replyType, err := ni.Option(t, NBD_OPT_STRUCTURED_REPLY, nil); err != nil || replyType != NBD_REP_ACK {
+		t.Fatalf("Structured replies not negotiated: reply type %x, error %v", replyType, err)
+	}
+	if _, replyType, err := ni.metaContexts(t, NBD_OPT_SET_META_CONTEXT, metaContextPayload("foo", 1, "base:allocation")); err != nil || replyType != NBD_REP_ACK {
+		t.Fatalf("Meta context not selected: reply type %x, error %v", replyType, err)
+	}
+	if err := ni.Go(t); err != nil {
+		t.Fatalf("Error on go: %v", err)
+	}
+	if ni.transmissionFlags&NBD_FLAG_SEND_TRIM == 0 {
+		t.Errorf("NBD_FLAG_SEND_TRIM not advertised")
+	}
+	data := bytes.Repeat([]byte{1}, 128*1024)
+	if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 0, uint32(len(data)), data); err != nil || rep.NbdError != 0 {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if rep, _, err := ni.Command(t, NBD_CMD_TRIM, 0, 32*1024, 64*1024, nil); err != nil || rep.NbdError != 0 {
+		t.Fatalf("Trim failed: %v %v", rep, err)
+	}
+	descriptors, err := ni.blockStatus(t, 0, 128*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descriptors) == 1 && descriptors[0].NbdStatusFlags == 0 {
+		t.Skip("Filesystem does not report holes")
+	}
+	const hole = NBD_STATE_HOLE | NBD_STATE_ZERO
+	expected := []nbdBlockDescriptor{{32 * 1024, 0}, {64 * 1024, hole}, {32 * 1024, 0}}
+	if fmt.Sprint(descriptors) != fmt.Sprint(expected) {
+		t.Errorf("Block status after trim got %v, expected %v", descriptors, expected)
+	}
+}
+
+func TestStructuredReadChunks(t *testing.T) {
+	const mib = 1024 * 1024
+	ni := StartNbd(t, TestConfig{Driver: "file"})
+	defer ni.Close()
+	if err := ni.CreateFile(t, 64*mib); err != nil {
+		t.Fatalf("Error on create file: %v", err)
+	}
+	if err := ni.Connect(t); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	if replyType, err := ni.Option(t, NBD_OPT_STRUCTURED_REPLY, nil); err != nil || replyType != NBD_REP_ACK {
+		t.Fatalf("Structured replies not negotiated: reply type %x, error %v", replyType, err)
+	}
+	if err := ni.Go(t); err != nil {
+		t.Fatalf("Error on go: %v", err)
+	}
+	// data for the first and last 24MiB, with a hole between them
+	pattern := func(offset uint64) byte {
+		return byte(offset*7 + offset>>20)
+	}
+	data := make([]byte, 4*mib)
+	for off := uint64(0); off < 64*mib; off += 4 * mib {
+		if off >= 24*mib && off < 40*mib {
+			continue
+		}
+		for i := range data {
+			data[i] = pattern(off + uint64(i))
+		}
+		if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, off, uint32(len(data)), data); err != nil || rep.NbdError != 0 {
+			t.Fatalf("Write at %d failed: %v", off, err)
+		}
+	}
+
+	chunks, err := ni.readStructured(t, 0, 64*mib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type want struct {
+		replyType uint16
+		offset    uint64
+		length    uint64
+	}
+	var expected []want
+	hole := len(chunks) > 6 && chunks[6].header.NbdReplyType == NBD_REPLY_TYPE_OFFSET_HOLE
+	for off := uint64(0); off < 64*mib; off += 4 * mib {
+		if hole && off >= 24*mib && off < 40*mib {
+			if off == 24*mib {
+				expected = append(expected, want{NBD_REPLY_TYPE_OFFSET_HOLE, off, 16 * mib})
+			}
+			continue
+		}
+		expected = append(expected, want{NBD_REPLY_TYPE_OFFSET_DATA, off, 4 * mib})
+	}
+	if len(chunks) != len(expected) {
+		t.Fatalf("Got %d chunks, expected %d", len(chunks), len(expected))
+	}
+	for i, c := range chunks {
+		got := want{replyType: c.header.NbdReplyType, offset: binary.BigEndian.Uint64(c.payload)}
+		switch got.replyType {
+		case NBD_REPLY_TYPE_OFFSET_HOLE:
+			got.length = uint64(binary.BigEndian.Uint32(c.payload[8:]))
+		case NBD_REPLY_TYPE_OFFSET_DATA:
+			got.length = uint64(len(c.payload) - 8)
+			for j, b := range c.payload[8:] {
+				off := got.offset + uint64(j)
+				if expect := pattern(off); off < 24*mib || off >= 40*mib {
+					if b != expect {
+						t.Fatalf("Chunk %d has the wrong data at %d", i, off)
+					}
+				} else if b != 0 {
+					t.Fatalf("Chunk %d has data in the hole at %d", i, off)
+				}
+			}
+		}
+		if got != expected[i] {
+			t.Errorf("Chunk %d is %+v, expected %+v", i, got, expected[i])
+		}
+		if done := c.header.NbdReplyFlags&NBD_REPLY_FLAG_DONE != 0; done != (i == len(chunks)-1) {
+			t.Errorf("Chunk %d has done %v", i, done)
+		}
+	}
+
+	// with NBD_CMD_FLAG_DF the read is a single chunk, so must fit in one
+	if chunks, err := ni.commandStructured(t, NBD_CMD_READ, NBD_CMD_FLAG_DF, 0, 4*mib); err != nil {
+		t.Fatal(err)
+	} else if len(chunks) != 1 || len(chunks[0].payload) != 8+4*mib {
+		t.Errorf("Read with NBD_CMD_FLAG_DF got %d chunks", len(chunks))
+	}
+	if chunks, err := ni.commandStructured(t, NBD_CMD_READ, NBD_CMD_FLAG_DF, 0, 16*mib); err != nil {
+		t.Fatal(err)
+	} else if len(chunks) != 1 || chunks[0].header.NbdReplyType != NBD_REPLY_TYPE_ERROR || binary.BigEndian.Uint32(chunks[0].payload) != NBD_EOVERFLOW {
+		t.Errorf("Read with NBD_CMD_FLAG_DF over the chunk size got %v", chunks)
+	}
+	// and the connection carries on
+	if chunks, err := ni.readStructured(t, 0, 4096); err != nil || len(chunks) != 1 {
+		t.Errorf("Read after refused read got %v, %v", chunks, err)
+	}
+}
+
+func TestDontFragmentOverflow(t *testing.T) {
+	const mib = 1024 * 1024
+	ni := StartNbd(t, TestConfig{Driver: "file", MaximumBlockSize: "1048576"})
+	defer ni.Close()
+	if err := ni.CreateFile(t, 4*mib); err != nil {
+		t.Fatalf("Error on create file: %v", err)
+	}
+	if err := ni.Connect(t); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	if replyType, err := ni.Option(t, NBD_OPT_STRUCTURED_REPLY, nil); err != nil || replyType != NBD_REP_ACK {
+		t.Fatalf("Structured replies not negotiated: reply type %x, error %v", replyType, err)
+	}
+	if err := ni.Go(t); err != nil {
+		t.Fatalf("Error on go: %v", err)
+	}
+	// a read with NBD_CMD_FLAG_DF over the maximum block size is refused,
+	// rather than the client disconnected
+	if chunks, err := ni.commandStructured(t, NBD_CMD_READ, NBD_CMD_FLAG_DF, 0, 2*mib); err != nil {
+		t.Fatal(err)
+	} else if len(chunks) != 1 || chunks[0].header.NbdReplyType != NBD_REPLY_TYPE_ERROR || binary.BigEndian.Uint32(chunks[0].payload) != NBD_EOVERFLOW {
+		t.Errorf("Read with NBD_CMD_FLAG_DF over the maximum block size got %v", chunks)
+	}
+	if chunks, err := ni.commandStructured(t, NBD_CMD_READ, NBD_CMD_FLAG_DF, 0, mib); err != nil || len(chunks) != 1 {
+		t.Errorf("Read with NBD_CMD_FLAG_DF after refused read got %v, %v", chunks, err)
+	}
+}
+
+func TestStructuredReadAlignment(t *testing.T) {
+	const mib = 1024 * 1024
+	ni := StartNbd(t, TestConfig{Driver: "file", MaxChunkSize: "1572864", ChunkAlign: "1048576"})
+	defer ni.Close()
+	if err := ni.CreateFile(t, 8*mib); err != nil {
+		t.Fatalf("Error on create file: %v", err)
+	}
+	if err := ni.Connect(t); err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	if replyType, err := ni.Option(t, NBD_OPT_STRUCTURED_REPLY, nil); err != nil || replyType != NBD_REP_ACK {
+		t.Fatalf("Structured replies not negotiated: reply type %x, error %v", replyType, err)
+	}
+	if err := ni.Go(t); err != nil {
+		t.Fatalf("Error on go: %v", err)
+	}
+	// data but for an unaligned hole from 1.25MiB to 3.25MiB
+	data := make([]byte, 1*mib+mib/4)
+	for i := range data {
+		data[i] = byte(i) | 1
+	}
+	if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 0, uint32(len(data)), data); err != nil || rep.NbdError != 0 {
+		t.Fatalf("Write failed: %v", err)
+	}
+	data = make([]byte, 4*mib+3*mib/4)
+	for i := range data {
+		data[i] = byte(i) | 1
+	}
+	if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 3*mib+mib/4, uint32(len(data)), data); err != nil || rep.NbdError != 0 {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	type want struct {
+		replyType uint16
+		offset    uint64
+		length    uint64
+	}
+	for _, tc := range []struct {
+		name     string
+		offset   uint64
+		length   uint32
+		flags    uint16
+		expected []want // with holes reported
+	}{
+		{"unaligned", 4*mib + mib/2, 3*mib + mib/2, 0, []want{
+			{NBD_REPLY_TYPE_OFFSET_DATA, 4*mib + mib/2, mib + mib/2},
+			{NBD_REPLY_TYPE_OFFSET_DATA, 6 * mib, mib},
+			{NBD_REPLY_TYPE_OFFSET_DATA, 7 * mib, mib},
+		}},
+		{"sparse", 0, 8 * mib, 0, []want{
+			{NBD_REPLY_TYPE_OFFSET_DATA, 0, mib},
+			{NBD_REPLY_TYPE_OFFSET_DATA, mib, mib},
+			{NBD_REPLY_TYPE_OFFSET_HOLE, 2 * mib, mib},
+			{NBD_REPLY_TYPE_OFFSET_DATA, 3 * mib, mib},
+			{NBD_REPLY_TYPE_OFFSET_DATA, 4 * mib, mib},
+			{NBD_REPLY_TYPE_OFFSET_DATA, 5 * mib, mib},
+			{NBD_REPLY_TYPE_OFFSET_DATA, 6 * mib, mib},
+			{NBD_REPLY_TYPE_OFFSET_DATA, 7 * mib, mib},
+		}},
+		{"don't fragment", 4*mib + mib/2, mib + mib/2, NBD_CMD_FLAG_DF, []want{
+			{NBD_REPLY_TYPE_OFFSET_DATA, 4*mib + mib/2, mib + mib/2},
+		}},
+	} {
+		chunks, err := ni.commandStructured(t, NBD_CMD_READ, tc.flags, tc.offset, tc.length)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		expected := tc.expected
+		if tc.name == "sparse" && len(chunks) > 2 && chunks[2].header.NbdReplyType != NBD_REPLY_TYPE_OFFSET_HOLE {
+			// the filesystem does not report holes
+			expected = []want{
+				{NBD_REPLY_TYPE_OFFSET_DATA, 0, mib},
+				{NBD_REPLY_TYPE_OFFSET_DATA, mib, mib},
+				{NBD_REPLY_TYPE_OFFSET_DATA, 2 * mib, mib},
+				{NBD_REPLY_TYPE_OFFSET_DATA, 3 * mib, mib},
+				{NBD_REPLY_TYPE_OFFSET_DATA, 4 * mib, mib},
+				{NBD_REPLY_TYPE_OFFSET_DATA, 5 * mib, mib},
+				{NBD_REPLY_TYPE_OFFSET_DATA, 6 * mib, mib},
+				{NBD_REPLY_TYPE_OFFSET_DATA, 7 * mib, mib},
+			}
+		}
+		if len(chunks) != len(expected) {
+			t.Errorf("%s: got %d chunks, expected %d", tc.name, len(chunks), len(expected))
+			continue
+		}
+		for i, c := range chunks {
+			got := want{replyType: c.header.NbdReplyType, offset: binary.BigEndian.Uint64(c.payload)}
+			switch got.replyType {
+			case NBD_REPLY_TYPE_OFFSET_HOLE:
+				got.length = uint64(binary.BigEndian.Uint32(c.payload[8:]))
+			case NBD_REPLY_TYPE_OFFSET_DATA:
+				got.length = uint64(len(c.payload) - 8)
+			}
+			if got != expected[i] {
+				t.Errorf("%s: chunk %d is %+v, expected %+v", tc.name, i, got, expected[i])
+			}
+			if done := c.header.NbdReplyFlags&NBD_REPLY_FLAG_DONE != 0; done != (i == len(chunks)-1) {
+				t.Errorf("%s: chunk %d has done %v", tc.name, i, done)
+			}
+		}
+	}
+}
+
+func TestDetectZeros(t *testing.T) {
+	// hide the file backend's extents, so that only detection finds holes
+	RegisterBackend("noextentstest", func(ctx context.Context, ec *ExportConfig) (Backend, error) {
+		fb, err := NewFileBackend(ctx, ec)
+		if err != nil {
+			return nil, err
+		}
+		return &flushCountingBackend{Backend: fb}, nil
+	})
+	defer delete(BackendMap, "noextentstest")
+
+	for _, detect := range []bool{false, true} {
+		ni := StartNbd(t, TestConfig{Driver: "noextentstest", DetectZeros: detect})
+		if err := ni.CreateFile(t, 1024*1024); err != nil {
+			t.Fatalf("Error on create file: %v", err)
+		}
+		if err := ni.Connect(t); err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		if replyType, err := ni.Option(t, NBD_OPT_STRUCTURED_REPLY, nil); err != nil || replyType != NBD_REP_ACK {
+			t.Fatalf("Structured replies not negotiated: reply type %x, error %v", replyType, err)
+		}
+		if err := ni.Go(t); err != nil {
+			t.Fatalf("Error on go: %v", err)
+		}
+		// data, then zeroes written as data, then data
+		data := make([]byte, 256*1024)
+		for i := range data[:64*1024] {
+			data[i] = byte(i) | 1
+			data[192*1024+i] = byte(i) | 1
+		}
+		if rep, _, err := ni.Command(t, NBD_CMD_WRITE, 0, 0, uint32(len(data)), data); err != nil || rep.NbdError != 0 {
+			t.Fatalf("Write failed: %v", err)
+		}
+
+		chunks, err := ni.readStructured(t, 0, 256*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		type want struct {
+			replyType uint16
+			offset    uint64
+			length    uint64
+		}
+		expected := []want{{NBD_REPLY_TYPE_OFFSET_DATA, 0, 256 * 1024}}
+		if detect {
+			expected = []want{
+				{NBD_REPLY_TYPE_OFFSET_DATA, 0, 64 * 1024},
+				{NBD_REPLY_TYPE_OFFSET_HOLE, 64 * 1024, 128 * 1024},
+				{NBD_REPLY_TYPE_OFFSET_DATA, 192 * 1024, 64 * 1024},
+			}
+		}
+		if len(chunks) != len(expected) {
+			t.Fatalf("Detect %v: got %d chunks, expected %d", detect, len(chunks), len(expected))
+		}
+		for i, c := range chunks {
+			got := want{replyType: c.header.NbdReplyType, offset: binary.BigEndian.Uint64(c.payload)}
+			switch got.replyType {
+			case NBD_REPLY_TYPE_OFFSET_HOLE:
+				got.length = uint64(binary.BigEndian.Uint32(c.payload[8:]))
+			case NBD_REPLY_TYPE_OFFSET_DATA:
+				got.length = uint64(len(c.payload) - 8)
+				if !bytes.Equal(c.payload[8:], data[got.offset:got.offset+got.length]) {
+					t.Errorf("Detect %v: chunk %d has the wrong data", detect, i)
+				}
+			}
+			if got != expected[i] {
+				t.Errorf("Detect %v: chunk %d is %+v, expected %+v", detect, i, got, expected[i])
+			}
+			if done := c.header.NbdReplyFlags&NBD_REPLY_FLAG_DONE != 0; done != (i == len(chunks)-1) {
+				t.Errorf("Detect %v: chunk %d has done %v", detect, i, done)
+			}
+		}
+
+		// a read of zeroes alone is a single hole, even with NBD_CMD_FLAG_DF
+		if chunks, err := ni.commandStructured(t, NBD_CMD_READ, NBD_CMD_FLAG_DF, 512*1024, 64*1024); err != nil {
+			t.Fatal(err)
+		} else if detect && (len(chunks) != 1 || chunks[0].header.NbdReplyType != NBD_REPLY_TYPE_OFFSET_HOLE) {
+			t.Errorf("Read of zeroes with NBD_CMD_FLAG_DF got %d chunks", len(chunks))
+		}
+		ni.Close()
+	}
+}
+
+// trimFailingBackend fails trims from failOffset on
+type trimFailingBackend struct {
+	Backend
+	failOffset int64
+}
+
+func (tb *trimFailingBackend) TrimAt(ctx context.Context, length int, offset int64) (int, error) {
+	if offset+int64(length) > tb.failOffset {
+		return 0, syscall.EIO
+	}
+	return tb.Backend.TrimAt(ctx, length, offset)
+}
+
+func TestTrimAdvertised(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config TestConfig
+		trim   bool
+	}{
+		{"writable", TestConfig{}, true},
+		{"read-only", TestConfig{ReadOnly: true}, false},
+		{"trim denied", TestConfig{DenyCommands: "trim"}, false},
+	} {
+		ni := ConnectAndGo(t, tc.config, 1024*1024)
+		if trim := ni.transmissionFlags&NBD_FLAG_SEND_TRIM != 0; trim != tc.trim {
+			t.Errorf("%s: NBD_FLAG_SEND_TRIM advertised %v, expected %v", tc.name, trim, tc.trim)
+		}
+		ni.Close()
+	}
+}
+
+func TestTrimFailure(t *testing.T) {
+	RegisterBackend("trimfailtest", func(ctx context.Context, ec *ExportConfig) (Backend, error) {
+		fb, err := NewFileBackend(ctx, ec)
+		if err != nil {
+			return nil, err
+		}
+		return &trimFailingBackend{Backend: fb, failOffset: 64 * 1024}, nil
+	})
+	defer delete(BackendMap, "trimfailtest")
+
+	ni := ConnectAndGo(t, TestConfig{Driver: "trimfailtest"}, 1024*1024)
+	defer ni.Close()
+	// fails after the first few memory blocks are trimmed
+	if rep, _, err := ni.Command(t, NBD_CMD_TRIM, 0, 0, 256*1024, nil); err != nil {
+		t.Fatalf("Trim got no reply: %v", err)
+	} else if rep.NbdError != NBD_EIO {
+		t.Errorf("Failed trim got error %d, expected NBD_EIO", rep.NbdError)
+	}
+	// the server is still serving
+	if rep, _, err := ni.Command(t, NBD_CMD_READ, 0, 0, 4096, nil); err != nil || rep.NbdError != 0 {
+		t.Errorf("Read after a failed trim failed: %v", err)
+	}
+}
+
+func TestConnRateConfig(t *testing.T) {
+	for _, tc := range []struct {
+		rate   float64
+		action string
+		ok     bool
+	}{
+		{0, "", true},
+		{0, "delay", true},
+		{10, "close", true},
+		{0, "close", false},
+		{-1, "", false},
+		{10, "drop", false},
+	} {
+		l, err := NewListener(log.New(ioutil.Discard, "", 0), ServerConfig{Protocol: "unix", Address: "/nonexistent/nbd.sock", ConnRate: tc.rate, OnConnRateExceeded: tc.action})
+		if (err == nil) != tc.ok {
+			t.Errorf("connrate %v with onconnrateexceeded '%s': got error %v", tc.rate, tc.action, err)
+		} else if err == nil && l.closeOverConnRate && l.connRate == nil {
+			t.Errorf("connrate %v with onconnrateexceeded '%s': closes over no rate limit", tc.rate, tc.action)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package nbd
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Granularity at which OverlayBackend tracks written blocks
+const overlayBlockSize = 4096
+
+// OverlayBackend implements Backend
+//
+// It serves a base backend read-write, while never modifying it: writes are
+// copied into a scratch overlay file, and a bitmap records which blocks of the
+// overlay hold data, so reads of those blocks are served from the overlay and
+// all others from the base. A partial write to a block not yet in the overlay
+// first copies the block up from the base. The overlay belongs to a single
+// connection and is discarded when the backend is closed, so is of use for
+// booting golden images which guests expect to write to.
+//
+// As the overlay is discarded anyway, flush and FUA are no-ops on it, and trims
+// are ignored
+type OverlayBackend struct {
+	Backend              // the base backend, opened read-only
+	overlay *os.File     // the overlay file, already unlinked
+	size    uint64       // size of the export
+	written []uint64     // bitmap of blocks held in the overlay
+	mutex   sync.RWMutex // protects written, and serialises copying blocks up
+}
+
+// blocks returns the range of blocks covered by length bytes at offset
+func (ob *OverlayBackend) blocks(length int, offset int64) (uint64, uint64) {
+	if length <= 0 {
+		return 0, 0
+	}
+	return uint64(offset) / overlayBlockSize, (uint64(offset) + uint64(length) + overlayBlockSize - 1) / overlayBlockSize
+}
+
+// isWritten returns true if block i is held in the overlay. Call with the mutex held
+func (ob *OverlayBackend) isWritten(i uint64) bool {
+	return ob.written[i/64]&(1<<(i%64)) != 0
+}
+
+// blockRange returns the offset and length of block i, truncated to the size of the export
+func (ob *OverlayBackend) blockRange(i uint64) (int64, int) {
+	start := i * overlayBlockSize
+	end := start + overlayBlockSize
+	if end > ob.size {
+		end = ob.size
+	}
+	return int64(start), int(end - start)
+}
+
+// copyUp copies block i from the base into the overlay. Call with the mutex held for writing
+func (ob *OverlayBackend) copyUp(ctx context.Context, i uint64) error {
+	offset, length := ob.blockRange(i)
+	b := make([]byte, length)
+	if _, err := ob.Backend.ReadAt(ctx, b, offset); err != nil {
+		return err
+	}
+	_, err := ob.overlay.WriteAt(b, offset)
+	return err
+}
+
+// WriteAt implements Backend.WriteAt
+func (ob *OverlayBackend) WriteAt(ctx context.Context, b []byte, offset int64, fua bool) (int, error) {
+	first, last := ob.blocks(len(b), offset)
+	if first == last {
+		return 0, nil
+	}
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+	// only the first and last blocks may be partially written
+	edges := []uint64{first}
+	if last-1 != first {
+		edges = append(edges, last-1)
+	}
+	for _, i := range edges {
+		if ob.isWritten(i) {
+			continue
+		}
+		start, length := ob.blockRange(i)
+		if offset > start || offset+int64(len(b)) < start+int64(length) {
+			if err := ob.copyUp(ctx, i); err != nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := ob.overlay.WriteAt(b, offset)
+	if err != nil {
+		return n, err
+	}
+	for i := first; i < last; i++ {
+		ob.written[i/64] |= 1 << (i % 64)
+	}
+	return n, nil
+}
+
+// ReadAt implements Backend.ReadAt
+func (ob *OverlayBackend) ReadAt(ctx context.Context, b []byte, offset int64) (int, error) {
+	first, last := ob.blocks(len(b), offset)
+	ob.mutex.RLock()
+	defer ob.mutex.RUnlock()
+	// read each run of blocks from wherever it is held
+	for i := first; i < last; {
+		inOverlay := ob.isWritten(i)
+		j := i + 1
+		for j < last && ob.isWritten(j) == inOverlay {
+			j++
+		}
+		start := int64(i * overlayBlockSize)
+		if start < offset {
+			start = offset
+		}
+		end := int64(j * overlayBlockSize)
+		if end > offset+int64(len(b)) {
+			end = offset + int64(len(b))
+		}
+		chunk := b[start-offset : end-offset]
+		var err error
+		if inOverlay {
+			_, err = ob.overlay.ReadAt(chunk, start)
+		} else {
+			_, err = ob.Backend.ReadAt(ctx, chunk, start)
+		}
+		if err != nil {
+			return 0, err
+		}
+		i = j
+	}
+	return len(b), nil
+}
+
+// TrimAt implements Backend.TrimAt
+func (ob *OverlayBackend) TrimAt(ctx context.Context, length int, offset int64) (int, error) {
+	return length, nil
+}
+
+// Flush implements Backend.Flush
+func (ob *OverlayBackend) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Close implements Backend.Close
+//
+// The overlay, and with it every write made, is discarded
+func (ob *OverlayBackend) Close(ctx context.Context) error {
+	err := ob.Backend.Close(ctx)
+	if cerr := ob.overlay.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// HasFua implements Backend.HasFua
+func (ob *OverlayBackend) HasFua(ctx context.Context) bool {
+	return true
+}
+
+// HasFlush implements Backend.HasFlush
+func (ob *OverlayBackend) HasFlush(ctx context.Context) bool {
+	return true
+}
+
+// IOHints implements IOHinter.IOHints
+func (ob *OverlayBackend) IOHints(ctx context.Context) IOHints {
+	return backendIOHints(ctx, ob.Backend)
+}
+
+// isEphemeralOverlay returns true if an export writes to an overlay
+func isEphemeralOverlay(ec *ExportConfig) (bool, error) {
+	return isTrue(ec.DriverParameters["ephemeraloverlay"])
+}
+
+// overlayBaseConfig returns the configuration with which to open the base of
+// an export, which is opened read-only if the export writes to an overlay
+func overlayBaseConfig(ec *ExportConfig) (*ExportConfig, error) {
+	ephemeral, err := isEphemeralOverlay(ec)
+	if err != nil || !ephemeral {
+		return ec, err
+	}
+	if ec.ReadOnly {
+		return nil, errors.New("A read-only export cannot write to an ephemeral overlay")
+	}
+	bec := *ec
+	bec.ReadOnly = true
+	return &bec, nil
+}
+
+// newOverlayBackend wraps a backend in an OverlayBackend if the export configures
+// an ephemeral overlay. The overlay file is created in overlaydir if set, else in
+// the default temporary directory, and is unlinked at once so it cannot outlive us
+func newOverlayBackend(ctx context.Context, ec *ExportConfig, backend Backend) (Backend, error) {
+	ephemeral, err := isEphemeralOverlay(ec)
+	if err != nil || !ephemeral {
+		return backend, err
+	}
+	if ec.DriverParameters["reconnectgrace"] != "" {
+		return nil, errors.New("An ephemeral overlay belongs to one connection so cannot be shared with reconnectgrace")
+	}
+	if multiConn, _, err := exportMultiConn(ec); err != nil {
+		return nil, err
+	} else if multiConn {
+		return nil, errors.New("An ephemeral overlay belongs to one connection so cannot be shared with multiconn")
+	}
+	size, _, _, _, err := backend.Geometry(ctx)
+	if err != nil {
+		return nil, err
+	}
+	overlay, err := ioutil.TempFile(ec.DriverParameters["overlaydir"], "gonbdserver-overlay-")
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create overlay: %v", err)
+	}
+	if err := os.Remove(overlay.Name()); err != nil {
+		overlay.Close()
+		return nil, fmt.Errorf("Cannot unlink overlay: %v", err)
+	}
+	numBlocks := (size + overlayBlockSize - 1) / overlayBlockSize
+	return &OverlayBackend{
+		Backend: backend,
+		overlay: overlay,
+		size:    size,
+		written: make([]uint64, (numBlocks+63)/64),
+	}, nil
+}
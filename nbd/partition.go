@@ -0,0 +1,255 @@
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Partition table layout
+const (
+	mbrSectorSize            = 512
+	mbrEntriesOffset         = 446
+	mbrSignatureOffset       = 510
+	mbrSignature             = 0xaa55
+	mbrTypeEmpty             = 0x00
+	mbrTypeGptProtective     = 0xee
+	gptSignature             = "EFI PART"
+	gptMinimumHeaderLength   = 92
+	gptMaximumEntries        = 1024
+	gptMaximumEntryLength    = 4096
+	maximumLogicalPartitions = 128
+)
+
+// mbrEntry is an entry in an MBR (or EBR) partition table
+type mbrEntry struct {
+	Status   uint8
+	FirstCHS [3]byte
+	Type     uint8
+	LastCHS  [3]byte
+	FirstLBA uint32
+	Sectors  uint32
+}
+
+// partition is a partition found in a partition table
+type partition struct {
+	number int    // the partition's number, from 1, as Linux numbers them
+	offset uint64 // offset in bytes of the partition
+	size   uint64 // size in bytes of the partition
+	label  string // the partition's GPT label, if any
+}
+
+// isExtended returns true if an MBR partition type is an extended partition
+func isExtended(partitionType uint8) bool {
+	return partitionType == 0x05 || partitionType == 0x0f || partitionType == 0x85
+}
+
+// readMbr reads the MBR partition table of a disk image, returning the
+// partitions it lists, or whether it is a protective MBR for a GPT disk
+func readMbr(r io.ReaderAt) ([]partition, bool, error) {
+	sector := make([]byte, mbrSectorSize)
+	if _, err := r.ReadAt(sector, 0); err != nil {
+		return nil, false, err
+	}
+	if binary.LittleEndian.Uint16(sector[mbrSignatureOffset:]) != mbrSignature {
+		return nil, false, errors.New("No partition table found")
+	}
+	var entries [4]mbrEntry
+	if err := binary.Read(bytes.NewReader(sector[mbrEntriesOffset:mbrSignatureOffset]), binary.LittleEndian, &entries); err != nil {
+		return nil, false, err
+	}
+	var partitions []partition
+	for i, e := range entries {
+		switch {
+		case e.Type == mbrTypeGptProtective:
+			return nil, true, nil
+		case e.Type == mbrTypeEmpty || e.Sectors == 0:
+		case isExtended(e.Type):
+			logical, err := readEbrs(r, uint64(e.FirstLBA))
+			if err != nil {
+				return nil, false, err
+			}
+			partitions = append(partitions, logical...)
+		default:
+			partitions = append(partitions, partition{
+				number: i + 1,
+				offset: uint64(e.FirstLBA) * mbrSectorSize,
+				size:   uint64(e.Sectors) * mbrSectorSize,
+			})
+		}
+	}
+	return partitions, false, nil
+}
+
+// readEbrs follows the chain of EBRs in the extended partition starting at
+// sector base, returning the logical partitions they list, numbered from 5
+func readEbrs(r io.ReaderAt, base uint64) ([]partition, error) {
+	var partitions []partition
+	sector := make([]byte, mbrSectorSize)
+	for ebr := base; len(partitions) < maximumLogicalPartitions; {
+		if _, err := r.ReadAt(sector, int64(ebr*mbrSectorSize)); err != nil {
+			return nil, err
+		}
+		if binary.LittleEndian.Uint16(sector[mbrSignatureOffset:]) != mbrSignature {
+			return nil, fmt.Errorf("Bad extended boot record at sector %d", ebr)
+		}
+		var entries [2]mbrEntry
+		if err := binary.Read(bytes.NewReader(sector[mbrEntriesOffset:]), binary.LittleEndian, &entries); err != nil {
+			return nil, err
+		}
+		if entries[0].Type != mbrTypeEmpty && entries[0].Sectors != 0 {
+			// relative to this EBR
+			partitions = append(partitions, partition{
+				number: 5 + len(partitions),
+				offset: (ebr + uint64(entries[0].FirstLBA)) * mbrSectorSize,
+				size:   uint64(entries[0].Sectors) * mbrSectorSize,
+			})
+		}
+		if !isExtended(entries[1].Type) || entries[1].FirstLBA == 0 {
+			break
+		}
+		// relative to the start of the extended partition
+		ebr = base + uint64(entries[1].FirstLBA)
+	}
+	return partitions, nil
+}
+
+// readGpt reads the GPT partition table of a disk image, trying each common
+// sector size in turn
+func readGpt(r io.ReaderAt) ([]partition, error) {
+	for _, sectorSize := range []uint64{512, 4096} {
+		header := make([]byte, sectorSize)
+		if _, err := r.ReadAt(header, int64(sectorSize)); err != nil {
+			continue
+		}
+		if string(header[:8]) != gptSignature {
+			continue
+		}
+		headerLength := binary.LittleEndian.Uint32(header[12:])
+		if headerLength < gptMinimumHeaderLength || uint64(headerLength) > sectorSize {
+			return nil, fmt.Errorf("Bad GPT header length %d", headerLength)
+		}
+		crc := binary.LittleEndian.Uint32(header[16:])
+		binary.LittleEndian.PutUint32(header[16:], 0)
+		if crc32.ChecksumIEEE(header[:headerLength]) != crc {
+			return nil, errors.New("Bad GPT header checksum")
+		}
+		entriesLBA := binary.LittleEndian.Uint64(header[72:])
+		numEntries := binary.LittleEndian.Uint32(header[80:])
+		entryLength := binary.LittleEndian.Uint32(header[84:])
+		if numEntries > gptMaximumEntries || entryLength < 128 || entryLength > gptMaximumEntryLength {
+			return nil, fmt.Errorf("Bad GPT partition entry array (%d entries of %d bytes)", numEntries, entryLength)
+		}
+		entries := make([]byte, uint64(numEntries)*uint64(entryLength))
+		if _, err := r.ReadAt(entries, int64(entriesLBA*sectorSize)); err != nil {
+			return nil, err
+		}
+		if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(header[88:]) {
+			return nil, errors.New("Bad GPT partition entry array checksum")
+		}
+		var partitions []partition
+		for i := uint32(0); i < numEntries; i++ {
+			e := entries[i*entryLength : (i+1)*entryLength]
+			if bytes.Equal(e[:16], make([]byte, 16)) {
+				continue // unused entry
+			}
+			first, last := binary.LittleEndian.Uint64(e[32:]), binary.LittleEndian.Uint64(e[40:])
+			if last < first {
+				continue
+			}
+			name := make([]uint16, 36)
+			binary.Read(bytes.NewReader(e[56:128]), binary.LittleEndian, name)
+			for j, c := range name {
+				if c == 0 {
+					name = name[:j]
+					break
+				}
+			}
+			partitions = append(partitions, partition{
+				number: int(i) + 1,
+				offset: first * sectorSize,
+				size:   (last - first + 1) * sectorSize,
+				label:  string(utf16.Decode(name)),
+			})
+		}
+		return partitions, nil
+	}
+	return nil, errors.New("Protective MBR found but no GPT header")
+}
+
+// readPartitions returns the partitions of the disk image at path, from its
+// GPT if it has one, else from its MBR
+func readPartitions(path string) ([]partition, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	partitions, gpt, err := readMbr(f)
+	if err != nil {
+		return nil, err
+	}
+	if gpt {
+		return readGpt(f)
+	}
+	return partitions, nil
+}
+
+// expandPartitions returns the exports configured, with each export setting
+// autopartition followed by an export of each partition of its disk image.
+//
+// Each is named after the export with -part and the partition's number
+// appended (as Linux names partitions in /dev/disk/by-id), is configured as
+// the export but for serving a slice of the image, and is described by its
+// GPT label if it has one. An image whose partition table cannot be read is
+// still exported whole, with a warning
+func expandPartitions(exports []ExportConfig) ([]ExportConfig, error) {
+	var expanded []ExportConfig
+	for _, ec := range exports {
+		expanded = append(expanded, ec)
+		auto, err := isTrue(ec.DriverParameters["autopartition"])
+		if err != nil {
+			return nil, fmt.Errorf("Export %s: %v", ec.Name, err)
+		}
+		if !auto {
+			continue
+		}
+		switch strings.ToLower(ec.Driver) {
+		case "file", "aiofile":
+		default:
+			return nil, fmt.Errorf("Export %s: autopartition needs a disk image, so the file or aiofile driver", ec.Name)
+		}
+		if ec.DriverParameters["sliceoffset"] != "" || ec.DriverParameters["slicesize"] != "" {
+			return nil, fmt.Errorf("Export %s: autopartition cannot be combined with a slice", ec.Name)
+		}
+		partitions, err := readPartitions(ec.DriverParameters["path"])
+		if err != nil {
+			getBackendLogger().Printf("[WARN] Export %s has no partitions exported, as its partition table cannot be read: %v", ec.Name, err)
+			continue
+		}
+		for _, p := range partitions {
+			pec := ec
+			pec.Name = fmt.Sprintf("%s-part%d", ec.Name, p.number)
+			pec.Description = p.label
+			if pec.Description == "" {
+				pec.Description = fmt.Sprintf("Partition %d of %s", p.number, ec.Name)
+			}
+			pec.DriverParameters = make(DriverParametersConfig, len(ec.DriverParameters)+2)
+			for k, v := range ec.DriverParameters {
+				pec.DriverParameters[k] = v
+			}
+			delete(pec.DriverParameters, "autopartition")
+			pec.DriverParameters["sliceoffset"] = strconv.FormatUint(p.offset, 10)
+			pec.DriverParameters["slicesize"] = strconv.FormatUint(p.size, 10)
+			expanded = append(expanded, pec)
+		}
+	}
+	return expanded, nil
+}
@@ -0,0 +1,239 @@
+package nbd
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// PhantomFileBackend implements Backend
+//
+// It wraps a FileBackend and advertises a (larger) phantom size rather than
+// the size of the backing file. The backing file is only grown when a write
+// lands beyond its current end, so it stays small until written. Reads
+// beyond the current end of the file but within the phantom size return
+// zeroes. As FileBackend's optional interfaces are promoted through the
+// embedding, each that touches the file is overridden to respect the phantom
+// size too
+type PhantomFileBackend struct {
+	*FileBackend
+	phantomSize uint64       // the size we advertise
+	fileSize    uint64       // the current size of the backing file
+	sizeMutex   sync.RWMutex // protects fileSize
+}
+
+// WriteAt implements Backend.WriteAt
+func (pfb *PhantomFileBackend) WriteAt(ctx context.Context, b []byte, offset int64, fua bool) (int, error) {
+	if err := pfb.grow(len(b), offset); err != nil {
+		return 0, err
+	}
+	return pfb.FileBackend.WriteAt(ctx, b, offset, fua)
+}
+
+// WriteAtv implements VectoredWriter.WriteAtv
+func (pfb *PhantomFileBackend) WriteAtv(ctx context.Context, bufs [][]byte, offset int64, fua bool) (int, error) {
+	if err := pfb.grow(buffersLength(bufs), offset); err != nil {
+		return 0, err
+	}
+	return pfb.FileBackend.WriteAtv(ctx, bufs, offset, fua)
+}
+
+// grow checks a write of length bytes at offset lies within the phantom size,
+// and extends the backing file if it lands beyond its current end
+func (pfb *PhantomFileBackend) grow(length int, offset int64) error {
+	end := uint64(offset) + uint64(length)
+	if offset < 0 || end > pfb.phantomSize {
+		return syscall.ENOSPC
+	}
+	pfb.sizeMutex.RLock()
+	grow := end > pfb.fileSize
+	pfb.sizeMutex.RUnlock()
+	if !grow {
+		return nil
+	}
+	pfb.sizeMutex.Lock()
+	defer pfb.sizeMutex.Unlock()
+	// recheck as another writer may have grown the file in the meantime;
+	// never truncate to a smaller size
+	if end > pfb.fileSize {
+		if err := pfb.file.Truncate(int64(end)); err != nil {
+			return err
+		}
+		pfb.fileSize = end
+	}
+	return nil
+}
+
+// backed returns how many of length bytes at offset lie within the backing
+// file; the rest lie beyond its current end, so read as zeroes
+func (pfb *PhantomFileBackend) backed(length int, offset int64) int {
+	pfb.sizeMutex.RLock()
+	fileSize := pfb.fileSize
+	pfb.sizeMutex.RUnlock()
+	if uint64(offset) >= fileSize {
+		return 0
+	}
+	if rest := fileSize - uint64(offset); rest < uint64(length) {
+		return int(rest)
+	}
+	return length
+}
+
+// ReadAt implements Backend.ReadAt
+func (pfb *PhantomFileBackend) ReadAt(ctx context.Context, b []byte, offset int64) (int, error) {
+	if offset < 0 || uint64(offset)+uint64(len(b)) > pfb.phantomSize {
+		return 0, syscall.EINVAL
+	}
+	backed := pfb.backed(len(b), offset)
+	if backed > 0 {
+		if n, err := pfb.FileBackend.ReadAt(ctx, b[:backed], offset); err != nil {
+			return n, err
+		}
+	}
+	// the remainder lies beyond the end of the file
+	for i := backed; i < len(b); i++ {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// ReadAtv implements VectoredReader.ReadAtv
+func (pfb *PhantomFileBackend) ReadAtv(ctx context.Context, bufs [][]byte, offset int64) (int, error) {
+	length := buffersLength(bufs)
+	if offset < 0 || uint64(offset)+uint64(length) > pfb.phantomSize {
+		return 0, syscall.EINVAL
+	}
+	backed := pfb.backed(length, offset)
+	head, tail := splitBuffers(bufs, backed)
+	if len(head) > 0 {
+		if n, err := pfb.FileBackend.ReadAtv(ctx, head, offset); err != nil {
+			return n, err
+		}
+	}
+	// the remainder lies beyond the end of the file
+	for _, b := range tail {
+		for i := range b {
+			b[i] = 0
+		}
+	}
+	return length, nil
+}
+
+// splitBuffers splits bufs into the buffers holding the first n bytes and
+// those holding the rest, splitting a buffer straddling the boundary
+func splitBuffers(bufs [][]byte, n int) ([][]byte, [][]byte) {
+	for i, b := range bufs {
+		if n == 0 {
+			return bufs[:i], bufs[i:]
+		}
+		if n < len(b) {
+			// the full slice expression stops the append overwriting bufs
+			return append(bufs[:i:i], b[:n]), append([][]byte{b[n:]}, bufs[i+1:]...)
+		}
+		n -= len(b)
+	}
+	return bufs, nil
+}
+
+// PunchHoleAt implements HolePuncher.PunchHoleAt
+//
+// Just the part within the backing file is deallocated, as the rest already
+// reads as zeroes
+func (pfb *PhantomFileBackend) PunchHoleAt(ctx context.Context, length int, offset int64, fua bool) (int, error) {
+	if offset < 0 || uint64(offset)+uint64(length) > pfb.phantomSize {
+		return 0, syscall.ENOSPC
+	}
+	if backed := pfb.backed(length, offset); backed > 0 {
+		if n, err := pfb.FileBackend.PunchHoleAt(ctx, backed, offset, fua); err != nil {
+			return n, err
+		}
+	}
+	return length, nil
+}
+
+// TrimAt implements Backend.TrimAt
+//
+// Just the part within the backing file is trimmed, as the rest is not stored
+func (pfb *PhantomFileBackend) TrimAt(ctx context.Context, length int, offset int64) (int, error) {
+	if offset < 0 || uint64(offset)+uint64(length) > pfb.phantomSize {
+		return 0, syscall.EINVAL
+	}
+	if backed := pfb.backed(length, offset); backed > 0 {
+		if _, err := pfb.FileBackend.TrimAt(ctx, backed, offset); err != nil {
+			return 0, err
+		}
+	}
+	return length, nil
+}
+
+// ZeroAt implements Zeroer.ZeroAt
+//
+// Just the part within the backing file is zeroed, as the rest already reads
+// as zeroes
+func (pfb *PhantomFileBackend) ZeroAt(ctx context.Context, length int, offset int64, fua bool) (int, error) {
+	if offset < 0 || uint64(offset)+uint64(length) > pfb.phantomSize {
+		return 0, syscall.ENOSPC
+	}
+	if backed := pfb.backed(length, offset); backed > 0 {
+		if n, err := pfb.FileBackend.ZeroAt(ctx, backed, offset, fua); err != nil {
+			return n, err
+		}
+	}
+	return length, nil
+}
+
+// Extents implements ExtentLister.Extents
+//
+// The range beyond the end of the backing file is a hole
+func (pfb *PhantomFileBackend) Extents(ctx context.Context, length int, offset int64) ([]Extent, error) {
+	if offset < 0 || uint64(offset)+uint64(length) > pfb.phantomSize {
+		return nil, syscall.EINVAL
+	}
+	backed := pfb.backed(length, offset)
+	var extents []Extent
+	if backed > 0 {
+		var err error
+		if extents, err = pfb.FileBackend.Extents(ctx, backed, offset); err != nil {
+			return nil, err
+		}
+		covered := uint64(0)
+		for _, e := range extents {
+			covered += e.Length
+		}
+		if covered < uint64(backed) {
+			return extents, nil
+		}
+	}
+	if backed < length {
+		extents = append(extents, Extent{Length: uint64(length - backed), Hole: true, Zero: true})
+	}
+	return extents, nil
+}
+
+// Geometry implements Backend.Geometry
+func (pfb *PhantomFileBackend) Geometry(ctx context.Context) (uint64, uint64, uint64, uint64, error) {
+	_, minimumBlockSize, preferredBlockSize, maximumBlockSize, err := pfb.FileBackend.Geometry(ctx)
+	return pfb.phantomSize, minimumBlockSize, preferredBlockSize, maximumBlockSize, err
+}
+
+// newPhantomFileBackend wraps a file backend so it advertises the phantom size
+// passed as a string
+func newPhantomFileBackend(fb *FileBackend, phantomSize string) (Backend, error) {
+	size, err := strconv.ParseUint(phantomSize, 10, 64)
+	if err != nil {
+		fb.closeFiles()
+		return nil, fmt.Errorf("Bad phantom size: %v", err)
+	}
+	if size < fb.size {
+		fb.closeFiles()
+		return nil, fmt.Errorf("Phantom size %d is smaller than the backing file (%d bytes)", size, fb.size)
+	}
+	fb.grows = true
+	return &PhantomFileBackend{
+		FileBackend: fb,
+		phantomSize: size,
+		fileSize:    fb.size,
+	}, nil
+}
@@ -0,0 +1,399 @@
+package nbd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Names of the handshake flags a server may advertise
+var globalFlagNames = []struct {
+	flag uint16
+	name string
+}{
+	{NBD_FLAG_FIXED_NEWSTYLE, "FIXED_NEWSTYLE"},
+	{NBD_FLAG_NO_ZEROES, "NO_ZEROES"},
+}
+
+// Names of the transmission flags an export may advertise
+var transmissionFlagNames = []struct {
+	flag uint16
+	name string
+}{
+	{NBD_FLAG_HAS_FLAGS, "HAS_FLAGS"},
+	{NBD_FLAG_READ_ONLY, "READ_ONLY"},
+	{NBD_FLAG_SEND_FLUSH, "SEND_FLUSH"},
+	{NBD_FLAG_SEND_FUA, "SEND_FUA"},
+	{NBD_FLAG_ROTATIONAL, "ROTATIONAL"},
+	{NBD_FLAG_SEND_TRIM, "SEND_TRIM"},
+	{NBD_FLAG_SEND_WRITE_ZEROES, "SEND_WRITE_ZEROES"},
+	{NBD_FLAG_SEND_DF, "SEND_DF"},
+	{NBD_FLAG_CAN_MULTI_CONN, "CAN_MULTI_CONN"},
+	{NBD_FLAG_SEND_CACHE, "SEND_CACHE"},
+	{NBD_FLAG_SEND_FAST_ZERO, "SEND_FAST_ZERO"},
+}
+
+// flagNames returns the names of the flags set, with any unknown flags in hex
+func flagNames(flags uint16, names []struct {
+	flag uint16
+	name string
+}) string {
+	var s []string
+	for _, n := range names {
+		if flags&n.flag != 0 {
+			s = append(s, n.name)
+			flags &^= n.flag
+		}
+	}
+	if flags != 0 {
+		s = append(s, fmt.Sprintf("0x%x", flags))
+	}
+	if len(s) == 0 {
+		return "none"
+	}
+	return strings.Join(s, " ")
+}
+
+// ProbeOptions controls how Probe negotiates with a server
+type ProbeOptions struct {
+	Tls           bool   // negotiate TLS with NBD_OPT_STARTTLS
+	TlsInsecure   bool   // do not verify the server's certificate
+	TlsCaCertFile string // path to the CA certificate to verify the server's certificate with
+	TlsCertFile   string // path to a client certificate to present, if any
+	TlsKeyFile    string // path to the key of the client certificate
+	TlsServerName string // name to verify the server's certificate against, if not the host dialled
+	Structured    bool   // request structured replies with NBD_OPT_STRUCTURED_REPLY
+}
+
+// probeExport is what a server advertises about an export in reply to NBD_OPT_INFO
+type probeExport struct {
+	name        string
+	description string
+	size        uint64
+	flags       uint16
+	blockSizes  *nbdInfoBlockSize
+}
+
+// probeAddress returns the network and address to dial for an address, and
+// the export named by it if it is an NBD URL. The address may be an NBD URL,
+// a path to a Unix domain socket, or host[:port]
+func probeAddress(addr string) (string, string, string, error) {
+	if strings.Contains(addr, "://") {
+		return parseNbdUrl(addr)
+	}
+	if strings.HasPrefix(addr, "/") {
+		return "unix", addr, "", nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, strconv.Itoa(NBD_DEFAULT_PORT))
+	}
+	return "tcp", addr, "", nil
+}
+
+// writeOpt sends an option with its payload
+func writeOpt(w io.Writer, optId uint32, payload []byte) error {
+	opt := nbdClientOpt{
+		NbdOptMagic: NBD_OPTS_MAGIC,
+		NbdOptId:    optId,
+		NbdOptLen:   uint32(len(payload)),
+	}
+	if err := binary.Write(w, binary.BigEndian, opt); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readOptReplyPayload reads an option reply and its payload. An error reply
+// is returned as an error carrying the server's message
+func readOptReplyPayload(conn net.Conn, optId uint32) (uint32, []byte, error) {
+	or, err := readOptReply(conn, optId)
+	if err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, or.NbdOptReplyLength)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return 0, nil, err
+	}
+	if or.NbdOptReplyType&NBD_REP_FLAG_ERROR != 0 {
+		return or.NbdOptReplyType, nil, &probeRefusal{or.NbdOptReplyType, string(payload)}
+	}
+	return or.NbdOptReplyType, payload, nil
+}
+
+// probeRefusal is an error reply to an option
+type probeRefusal struct {
+	replyType uint32
+	message   string
+}
+
+// Error implements error
+func (pr *probeRefusal) Error() string {
+	names := map[uint32]string{
+		NBD_REP_ERR_UNSUP:           "unsupported",
+		NBD_REP_ERR_POLICY:          "forbidden by policy",
+		NBD_REP_ERR_INVALID:         "invalid",
+		NBD_REP_ERR_PLATFORM:        "unsupported on platform",
+		NBD_REP_ERR_TLS_REQD:        "TLS required",
+		NBD_REP_ERR_UNKNOWN:         "unknown export",
+		NBD_REP_ERR_SHUTDOWN:        "server shutting down",
+		NBD_REP_ERR_BLOCK_SIZE_REQD: "block size negotiation required",
+	}
+	name, ok := names[pr.replyType]
+	if !ok {
+		name = fmt.Sprintf("error 0x%x", pr.replyType)
+	}
+	if pr.message == "" {
+		return name
+	}
+	return fmt.Sprintf("%s: %s", name, pr.message)
+}
+
+// probeTlsConfig returns the client TLS configuration for a probe of host
+func probeTlsConfig(host string, opts ProbeOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         opts.TlsServerName,
+		InsecureSkipVerify: opts.TlsInsecure,
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+	if opts.TlsCaCertFile != "" {
+		caCert, err := ioutil.ReadFile(opts.TlsCaCertFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("No certificates in %s", opts.TlsCaCertFile)
+		}
+	}
+	if opts.TlsCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.TlsCertFile, opts.TlsKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// startTls upgrades a connection to TLS with NBD_OPT_STARTTLS
+func startTls(conn net.Conn, tlsConfig *tls.Config) (*tls.Conn, error) {
+	if err := writeOpt(conn, NBD_OPT_STARTTLS, nil); err != nil {
+		return nil, err
+	}
+	if replyType, _, err := readOptReplyPayload(conn, NBD_OPT_STARTTLS); err != nil {
+		return nil, err
+	} else if replyType != NBD_REP_ACK {
+		return nil, errors.New("Unexpected reply to STARTTLS")
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// listExports lists the exports with NBD_OPT_LIST
+func listExports(conn net.Conn) ([]string, error) {
+	if err := writeOpt(conn, NBD_OPT_LIST, nil); err != nil {
+		return nil, err
+	}
+	var names []string
+	for {
+		replyType, payload, err := readOptReplyPayload(conn, NBD_OPT_LIST)
+		if err != nil {
+			return nil, err
+		}
+		switch replyType {
+		case NBD_REP_ACK:
+			return names, nil
+		case NBD_REP_SERVER:
+			if len(payload) < 4 || uint64(binary.BigEndian.Uint32(payload)) > uint64(len(payload)-4) {
+				return nil, errors.New("Bad export list reply")
+			}
+			names = append(names, string(payload[4:4+binary.BigEndian.Uint32(payload)]))
+		}
+	}
+}
+
+// infoExport asks for the details of an export with NBD_OPT_INFO
+func infoExport(conn net.Conn, name string) (*probeExport, error) {
+	infoRequests := []uint16{NBD_INFO_NAME, NBD_INFO_DESCRIPTION, NBD_INFO_BLOCK_SIZE}
+	payload := make([]byte, 4+len(name)+2+2*len(infoRequests))
+	binary.BigEndian.PutUint32(payload, uint32(len(name)))
+	copy(payload[4:], name)
+	binary.BigEndian.PutUint16(payload[4+len(name):], uint16(len(infoRequests)))
+	for i, ir := range infoRequests {
+		binary.BigEndian.PutUint16(payload[4+len(name)+2+2*i:], ir)
+	}
+	if err := writeOpt(conn, NBD_OPT_INFO, payload); err != nil {
+		return nil, err
+	}
+	pe := &probeExport{name: name}
+	haveExport := false
+	for {
+		replyType, payload, err := readOptReplyPayload(conn, NBD_OPT_INFO)
+		if err != nil {
+			return nil, err
+		}
+		if replyType == NBD_REP_ACK {
+			if !haveExport {
+				return nil, errors.New("Server did not send export information")
+			}
+			return pe, nil
+		}
+		if replyType != NBD_REP_INFO || len(payload) < 2 {
+			continue
+		}
+		switch binary.BigEndian.Uint16(payload) {
+		case NBD_INFO_EXPORT:
+			if len(payload) >= 12 {
+				pe.size = binary.BigEndian.Uint64(payload[2:])
+				pe.flags = binary.BigEndian.Uint16(payload[10:])
+				haveExport = true
+			}
+		case NBD_INFO_NAME:
+			pe.name = string(payload[2:])
+		case NBD_INFO_DESCRIPTION:
+			pe.description = string(payload[2:])
+		case NBD_INFO_BLOCK_SIZE:
+			if len(payload) >= 14 {
+				pe.blockSizes = &nbdInfoBlockSize{
+					NbdInfoType:           NBD_INFO_BLOCK_SIZE,
+					NbdMinimumBlockSize:   binary.BigEndian.Uint32(payload[2:]),
+					NbdPreferredBlockSize: binary.BigEndian.Uint32(payload[6:]),
+					NbdMaximumBlockSize:   binary.BigEndian.Uint32(payload[10:]),
+				}
+			}
+		}
+	}
+}
+
+// Probe connects to the NBD server at addr as a client and reports what it
+// advertises to out: its handshake flags, whether it supports TLS and
+// structured replies (if asked for), the exports it lists, and the size, block
+// sizes and transmission flags of each. If export is empty, every export listed
+// is reported on (or the default export, if the server will not list them);
+// otherwise only the named export is. The connection is then aborted, without
+// entering transmission.
+//
+// It returns false if the server cannot be reached or negotiated with, or any
+// export reported on is refused
+func Probe(out io.Writer, addr string, export string, opts ProbeOptions) bool {
+	network, address, urlExport, err := probeAddress(addr)
+	if err != nil {
+		fmt.Fprintf(out, "%v\n", err)
+		return false
+	}
+	if export == "" {
+		export = urlExport
+	}
+	conn, err := net.DialTimeout(network, address, ProxyConnectTimeout)
+	if err != nil {
+		fmt.Fprintf(out, "Cannot connect to %s: %v\n", addr, err)
+		return false
+	}
+	defer func() {
+		conn.Close()
+	}()
+	conn.SetDeadline(time.Now().Add(ProxyConnectTimeout))
+
+	globalFlags, err := clientHandshake(conn)
+	if err != nil {
+		fmt.Fprintf(out, "Cannot negotiate with %s: %v\n", addr, err)
+		return false
+	}
+	fmt.Fprintf(out, "server %s\n", addr)
+	fmt.Fprintf(out, "  handshake flags: %s\n", flagNames(globalFlags, globalFlagNames))
+
+	if opts.Tls {
+		host := address
+		if network == "tcp" {
+			host, _, _ = net.SplitHostPort(address)
+		}
+		tlsConfig, err := probeTlsConfig(host, opts)
+		if err != nil {
+			fmt.Fprintf(out, "Cannot configure TLS: %v\n", err)
+			return false
+		}
+		tlsConn, err := startTls(conn, tlsConfig)
+		if err != nil {
+			fmt.Fprintf(out, "Cannot negotiate TLS: %v\n", err)
+			return false
+		}
+		conn = tlsConn
+		fmt.Fprintf(out, "  tls: negotiated (version 0x%04x, cipher suite 0x%04x)\n", tlsConn.ConnectionState().Version, tlsConn.ConnectionState().CipherSuite)
+	}
+
+	if opts.Structured {
+		if err := writeOpt(conn, NBD_OPT_STRUCTURED_REPLY, nil); err != nil {
+			fmt.Fprintf(out, "Cannot request structured replies: %v\n", err)
+			return false
+		}
+		if _, _, err := readOptReplyPayload(conn, NBD_OPT_STRUCTURED_REPLY); err != nil {
+			if _, ok := err.(*probeRefusal); !ok {
+				fmt.Fprintf(out, "Cannot request structured replies: %v\n", err)
+				return false
+			}
+			fmt.Fprintf(out, "  structured replies: refused (%v)\n", err)
+		} else {
+			fmt.Fprintf(out, "  structured replies: negotiated\n")
+		}
+	}
+
+	names, err := listExports(conn)
+	if err != nil {
+		if _, ok := err.(*probeRefusal); !ok {
+			fmt.Fprintf(out, "Cannot list exports: %v\n", err)
+			return false
+		}
+		fmt.Fprintf(out, "  exports: not listed (%v)\n", err)
+		names = []string{""}
+	} else {
+		fmt.Fprintf(out, "  exports: %d listed\n", len(names))
+	}
+	if export != "" {
+		names = []string{export}
+	}
+
+	ok := true
+	for _, name := range names {
+		pe, err := infoExport(conn, name)
+		if err != nil {
+			if _, refused := err.(*probeRefusal); !refused {
+				fmt.Fprintf(out, "Cannot get details of export '%s': %v\n", name, err)
+				return false
+			}
+			fmt.Fprintf(out, "export '%s': refused (%v)\n", name, err)
+			ok = false
+			continue
+		}
+		fmt.Fprintf(out, "export '%s'\n", pe.name)
+		if pe.description != "" {
+			fmt.Fprintf(out, "  description: %s\n", pe.description)
+		}
+		fmt.Fprintf(out, "  size: %d\n", pe.size)
+		if pe.blockSizes != nil {
+			fmt.Fprintf(out, "  block sizes: minimum %d, preferred %d, maximum %d\n", pe.blockSizes.NbdMinimumBlockSize, pe.blockSizes.NbdPreferredBlockSize, pe.blockSizes.NbdMaximumBlockSize)
+		} else {
+			fmt.Fprintf(out, "  block sizes: not advertised\n")
+		}
+		fmt.Fprintf(out, "  transmission flags: %s\n", flagNames(pe.flags, transmissionFlagNames))
+	}
+
+	// leave politely; the server may close the connection without replying
+	if writeOpt(conn, NBD_OPT_ABORT, nil) == nil {
+		readOptReplyPayload(conn, NBD_OPT_ABORT)
+	}
+	return ok
+}
@@ -15,15 +15,21 @@ const (
 	NBD_CMD_DISC         = 2
 	NBD_CMD_FLUSH        = 3
 	NBD_CMD_TRIM         = 4
-	NBD_CMD_WRITE_ZEROES = 5
+	NBD_CMD_CACHE        = 5
+	NBD_CMD_WRITE_ZEROES = 6
 	NBD_CMD_CLOSE        = 7
+	NBD_CMD_BLOCK_STATUS = 7 // once a meta context is selected; otherwise NBD_CMD_CLOSE, which predates it
 )
 
 // NBD command flags
 const (
-	NBD_CMD_FLAG_FUA = uint16(1 << 0)
-	NBD_CMD_MAY_TRIM = uint16(1 << 1)
-	NBD_CMD_FLAG_DF  = uint16(1 << 2)
+	NBD_CMD_FLAG_FUA       = uint16(1 << 0)
+	NBD_CMD_FLAG_NO_HOLE   = uint16(1 << 1)
+	NBD_CMD_FLAG_DF        = uint16(1 << 2)
+	NBD_CMD_FLAG_REQ_ONE   = uint16(1 << 3)
+	NBD_CMD_FLAG_FAST_ZERO = uint16(1 << 4)
+
+	NBD_CMD_MAY_TRIM = NBD_CMD_FLAG_NO_HOLE // deprecated name for NBD_CMD_FLAG_NO_HOLE
 )
 
 // NBD negotiation flags
@@ -36,7 +42,9 @@ const (
 	NBD_FLAG_SEND_TRIM         = uint16(1 << 5)
 	NBD_FLAG_SEND_WRITE_ZEROES = uint16(1 << 6)
 	NBD_FLAG_SEND_DF           = uint16(1 << 7)
-	NBD_FLAG_SEND_CLOSE        = uint16(1 << 8)
+	NBD_FLAG_CAN_MULTI_CONN    = uint16(1 << 8)
+	NBD_FLAG_SEND_CACHE        = uint16(1 << 10)
+	NBD_FLAG_SEND_FAST_ZERO    = uint16(1 << 11)
 )
 
 // NBD magic numbers
@@ -48,6 +56,8 @@ const (
 	NBD_OPTS_MAGIC             = 0x49484156454F5054
 	NBD_REP_MAGIC              = 0x3e889045565a9
 	NBD_STRUCTURED_REPLY_MAGIC = 0x668e33ef
+	NBD_EXTENDED_REQUEST_MAGIC = 0x21e41c71
+	NBD_EXTENDED_REPLY_MAGIC   = 0x6e8a278c
 )
 
 // NBD default port
@@ -57,14 +67,17 @@ const (
 
 // NBD options
 const (
-	NBD_OPT_EXPORT_NAME      = 1
-	NBD_OPT_ABORT            = 2
-	NBD_OPT_LIST             = 3
-	NBD_OPT_PEEK_EXPORT      = 4
-	NBD_OPT_STARTTLS         = 5
-	NBD_OPT_INFO             = 6
-	NBD_OPT_GO               = 7
-	NBD_OPT_STRUCTURED_REPLY = 8
+	NBD_OPT_EXPORT_NAME       = 1
+	NBD_OPT_ABORT             = 2
+	NBD_OPT_LIST              = 3
+	NBD_OPT_PEEK_EXPORT       = 4
+	NBD_OPT_STARTTLS          = 5
+	NBD_OPT_INFO              = 6
+	NBD_OPT_GO                = 7
+	NBD_OPT_STRUCTURED_REPLY  = 8
+	NBD_OPT_LIST_META_CONTEXT = 9
+	NBD_OPT_SET_META_CONTEXT  = 10
+	NBD_OPT_EXTENDED_HEADERS  = 11
 )
 
 // NBD option reply types
@@ -72,6 +85,7 @@ const (
 	NBD_REP_ACK                 = uint32(1)
 	NBD_REP_SERVER              = uint32(2)
 	NBD_REP_INFO                = uint32(3)
+	NBD_REP_META_CONTEXT        = uint32(4)
 	NBD_REP_FLAG_ERROR          = uint32(1 << 31)
 	NBD_REP_ERR_UNSUP           = uint32(1 | NBD_REP_FLAG_ERROR)
 	NBD_REP_ERR_POLICY          = uint32(2 | NBD_REP_FLAG_ERROR)
@@ -81,6 +95,7 @@ const (
 	NBD_REP_ERR_UNKNOWN         = uint32(6 | NBD_REP_FLAG_ERROR)
 	NBD_REP_ERR_SHUTDOWN        = uint32(7 | NBD_REP_FLAG_ERROR)
 	NBD_REP_ERR_BLOCK_SIZE_REQD = uint32(8 | NBD_REP_FLAG_ERROR)
+	NBD_REP_ERR_EXT_HEADER_REQD = uint32(11 | NBD_REP_FLAG_ERROR)
 )
 
 // NBD reply flags
@@ -90,11 +105,19 @@ const (
 
 // NBD reply types
 const (
-	NBD_REPLY_TYPE_NONE         = 0
-	NBD_REPLY_TYPE_ERROR        = 1
-	NBD_REPLY_TYPE_ERROR_OFFSET = 2
-	NBD_REPLY_TYPE_OFFSET_DATA  = 3
-	NBD_REPLY_TYPE_OFFSET_HOLE  = 4
+	NBD_REPLY_TYPE_NONE             = 0
+	NBD_REPLY_TYPE_ERROR            = 1
+	NBD_REPLY_TYPE_ERROR_OFFSET     = 2
+	NBD_REPLY_TYPE_OFFSET_DATA      = 3
+	NBD_REPLY_TYPE_OFFSET_HOLE      = 4
+	NBD_REPLY_TYPE_BLOCK_STATUS     = 5
+	NBD_REPLY_TYPE_BLOCK_STATUS_EXT = 6
+)
+
+// NBD base:allocation block status flags
+const (
+	NBD_STATE_HOLE = uint32(1 << 0)
+	NBD_STATE_ZERO = uint32(1 << 1)
 )
 
 // NBD hanshake flags
@@ -109,6 +132,9 @@ const (
 	NBD_FLAG_C_NO_ZEROES      = 1 << 1
 )
 
+// Length of the zero padding after the reply to NBD_OPT_EXPORT_NAME
+const NBD_EXPORT_NAME_PAD_LENGTH = 124
+
 // NBD errors
 const (
 	NBD_EPERM     = 1
@@ -117,8 +143,13 @@ const (
 	NBD_EINVAL    = 22
 	NBD_ENOSPC    = 28
 	NBD_EOVERFLOW = 75
+	NBD_ENOTSUP   = 95
+	NBD_ESHUTDOWN = 108
 )
 
+// Maximum length of a string (e.g. an export name) in the protocol
+const NBD_MAX_STRING_LENGTH = 4096
+
 // NBD info types
 const (
 	NBD_INFO_EXPORT      = 0
@@ -170,6 +201,16 @@ type nbdRequest struct {
 	NbdLength       uint32
 }
 
+// NBD extended request, once extended headers are negotiated
+type nbdExtendedRequest struct {
+	NbdRequestMagic uint32
+	NbdCommandFlags uint16
+	NbdCommandType  uint16
+	NbdHandle       uint64
+	NbdOffset       uint64
+	NbdLength       uint64
+}
+
 // NBD simple reply
 type nbdReply struct {
 	NbdReplyMagic uint32
@@ -177,6 +218,37 @@ type nbdReply struct {
 	NbdHandle     uint64
 }
 
+// NBD structured reply chunk header
+type nbdStructuredReply struct {
+	NbdReplyMagic uint32
+	NbdReplyFlags uint16
+	NbdReplyType  uint16
+	NbdHandle     uint64
+	NbdLength     uint32
+}
+
+// NBD extended reply chunk header, once extended headers are negotiated
+type nbdExtendedReply struct {
+	NbdReplyMagic uint32
+	NbdReplyFlags uint16
+	NbdReplyType  uint16
+	NbdHandle     uint64
+	NbdOffset     uint64
+	NbdLength     uint64
+}
+
+// NBD block descriptor, in an NBD_REPLY_TYPE_BLOCK_STATUS chunk
+type nbdBlockDescriptor struct {
+	NbdLength      uint32
+	NbdStatusFlags uint32
+}
+
+// NBD extended block descriptor, in an NBD_REPLY_TYPE_BLOCK_STATUS_EXT chunk
+type nbdExtendedBlockDescriptor struct {
+	NbdLength      uint64
+	NbdStatusFlags uint64
+}
+
 // NBD info export
 type nbdInfoExport struct {
 	NbdInfoType          uint16
@@ -194,11 +266,39 @@ type nbdInfoBlockSize struct {
 
 /* --- END OF NBD PROTOCOL SECTION --- */
 
+// Vendor extensions. These are not part of the NBD protocol, so are only used if
+// the client explicitly asks for them during negotiation
+const (
+	// Once acknowledged, the payload of every NBD_CMD_WRITE is preceded by a
+	// big-endian CRC32C (Castagnoli) of the payload, which the server checks
+	// before applying the write, replying NBD_EIO on a mismatch
+	NBD_OPT_X_WRITE_CHECKSUM = 0x47420001
+
+	// An info type a client may request with NBD_OPT_INFO or NBD_OPT_GO. If
+	// the export has device hints, the server replies with an info block of
+	// this type, carrying flags (NBD_X_DEVICE_ROTATIONAL), the approximate
+	// seek latency in microseconds and the queue depth at which the device
+	// performs best (16, 32 and 16 bits, 0 if unknown)
+	NBD_INFO_X_DEVICE_HINTS = 0x4742
+)
+
+// Flags in an NBD_INFO_X_DEVICE_HINTS block
+const (
+	NBD_X_DEVICE_ROTATIONAL = uint16(1 << 0) // the device is rotational, so seeks are slow
+)
+
+// NBD_INFO_X_DEVICE_HINTS info block
+type nbdInfoXDeviceHints struct {
+	NbdInfoType    uint16
+	NbdDeviceFlags uint16
+	NbdSeekLatency uint32
+	NbdQueueDepth  uint16
+}
+
 // Our internal flags to characterize commands
 const (
 	CMDT_CHECK_LENGTH_OFFSET     = 1 << iota // length and offset must be valid
 	CMDT_REQ_PAYLOAD                         // request carries a payload
-	CMDT_REQ_FAKE_PAYLOAD                    // request does not carry a payload, but we'll make a zero payload up
 	CMDT_REP_PAYLOAD                         // reply carries a payload
 	CMDT_CHECK_NOT_READ_ONLY                 // not valid on read-only media
 	CMDT_SET_DISCONNECT_RECEIVED             // a disconnect - don't process any further commands
@@ -209,8 +309,9 @@ var CmdTypeMap = map[int]uint64{
 	NBD_CMD_READ:         CMDT_CHECK_LENGTH_OFFSET | CMDT_REP_PAYLOAD,
 	NBD_CMD_WRITE:        CMDT_CHECK_LENGTH_OFFSET | CMDT_CHECK_NOT_READ_ONLY | CMDT_REQ_PAYLOAD,
 	NBD_CMD_DISC:         CMDT_SET_DISCONNECT_RECEIVED,
-	NBD_CMD_FLUSH:        CMDT_CHECK_NOT_READ_ONLY,
+	NBD_CMD_FLUSH:        0,
 	NBD_CMD_TRIM:         CMDT_CHECK_LENGTH_OFFSET | CMDT_CHECK_NOT_READ_ONLY,
-	NBD_CMD_WRITE_ZEROES: CMDT_CHECK_LENGTH_OFFSET | CMDT_CHECK_NOT_READ_ONLY | CMDT_REQ_FAKE_PAYLOAD,
+	NBD_CMD_CACHE:        CMDT_CHECK_LENGTH_OFFSET,
+	NBD_CMD_WRITE_ZEROES: CMDT_CHECK_LENGTH_OFFSET | CMDT_CHECK_NOT_READ_ONLY,
 	NBD_CMD_CLOSE:        CMDT_SET_DISCONNECT_RECEIVED,
 }
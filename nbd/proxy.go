@@ -0,0 +1,496 @@
+package nbd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How long to wait to connect to an upstream NBD server and negotiate with it
+var ProxyConnectTimeout = 10 * time.Second
+
+// errProxyClosed is returned for commands on an NbdProxyBackend that has been closed
+var errProxyClosed = errors.New("Proxy backend closed")
+
+// Map of NBD errors in replies from upstream to the errors NbdError maps back to them
+var nbdErrnoMap = map[uint32]syscall.Errno{
+	NBD_EPERM:     syscall.EPERM,
+	NBD_EIO:       syscall.EIO,
+	NBD_ENOMEM:    syscall.ENOMEM,
+	NBD_EINVAL:    syscall.EINVAL,
+	NBD_ENOSPC:    syscall.ENOSPC,
+	NBD_EOVERFLOW: syscall.EOVERFLOW,
+}
+
+// proxyRequest is a command sent upstream awaiting its reply
+type proxyRequest struct {
+	buf  []byte     // where to put the data read, for NBD_CMD_READ
+	done chan error // receives the outcome
+}
+
+// proxyConn is a connection to an upstream NBD server in transmission phase
+type proxyConn struct {
+	conn       net.Conn
+	sendMutex  sync.Mutex // serialises sending commands
+	mutex      sync.Mutex // protects the following
+	inflight   map[uint64]*proxyRequest
+	nextHandle uint64
+	broken     error // set once the connection has failed
+}
+
+// fail marks the connection broken, closes it, and fails the commands in flight on it
+func (pc *proxyConn) fail(err error) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	if pc.broken != nil {
+		return
+	}
+	pc.broken = err
+	pc.conn.Close()
+	for handle, req := range pc.inflight {
+		req.done <- err
+		delete(pc.inflight, handle)
+	}
+}
+
+// receive is the goroutine reading replies from upstream
+func (pc *proxyConn) receive() {
+	for {
+		var rep nbdReply
+		if err := binary.Read(pc.conn, binary.BigEndian, &rep); err != nil {
+			pc.fail(fmt.Errorf("Cannot read reply from upstream: %v", err))
+			return
+		}
+		if rep.NbdReplyMagic != NBD_REPLY_MAGIC {
+			pc.fail(errors.New("Upstream sent reply with bad magic"))
+			return
+		}
+		pc.mutex.Lock()
+		req, ok := pc.inflight[rep.NbdHandle]
+		delete(pc.inflight, rep.NbdHandle)
+		pc.mutex.Unlock()
+		if !ok {
+			pc.fail(errors.New("Upstream sent reply with unknown handle"))
+			return
+		}
+		if rep.NbdError != 0 {
+			err, ok := nbdErrnoMap[rep.NbdError]
+			if !ok {
+				err = syscall.EIO
+			}
+			req.done <- err
+			if req.buf != nil {
+				// servers differ as to whether the data follows a
+				// read error, so we cannot continue on this connection
+				pc.fail(errors.New("Upstream read failed"))
+				return
+			}
+			continue
+		}
+		if req.buf != nil {
+			if _, err := io.ReadFull(pc.conn, req.buf); err != nil {
+				req.done <- err
+				pc.fail(fmt.Errorf("Cannot read data from upstream: %v", err))
+				return
+			}
+		}
+		req.done <- nil
+	}
+}
+
+// NbdProxyBackend implements Backend
+//
+// It serves an export from an upstream NBD server, forwarding each command.
+// Commands from the connections sharing the backend are multiplexed over one
+// upstream connection. If the upstream connection fails, the commands in
+// flight on it fail, and the next command reconnects
+type NbdProxyBackend struct {
+	url     string
+	network string // network and address to dial
+	address string
+	export  string // name of the upstream export
+	size    uint64 // size of the upstream export
+	flags   uint16 // transmission flags of the upstream export
+	mutex   sync.Mutex
+	pc      *proxyConn // the current upstream connection, or nil
+	closed  bool
+}
+
+// parseNbdUrl parses an NBD URL of the form nbd://host[:port]/export or
+// nbd+unix:///export?socket=path, returning the network, address and export name
+func parseNbdUrl(s string) (string, string, string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", "", fmt.Errorf("Bad NBD URL '%s': %v", s, err)
+	}
+	export := strings.TrimPrefix(u.Path, "/")
+	switch u.Scheme {
+	case "nbd":
+		if u.Host == "" {
+			return "", "", "", fmt.Errorf("NBD URL '%s' has no host", s)
+		}
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), strconv.Itoa(NBD_DEFAULT_PORT))
+		}
+		return "tcp", host, export, nil
+	case "nbd+unix":
+		socket := u.Query().Get("socket")
+		if socket == "" {
+			return "", "", "", fmt.Errorf("NBD URL '%s' has no socket", s)
+		}
+		return "unix", socket, export, nil
+	default:
+		return "", "", "", fmt.Errorf("NBD URL '%s' has unsupported scheme '%s'", s, u.Scheme)
+	}
+}
+
+// readOptReply reads an option reply header from upstream and checks it
+func readOptReply(conn net.Conn, optId uint32) (*nbdOptReply, error) {
+	var or nbdOptReply
+	if err := binary.Read(conn, binary.BigEndian, &or); err != nil {
+		return nil, fmt.Errorf("Cannot read option reply: %v", err)
+	}
+	if or.NbdOptReplyMagic != NBD_REP_MAGIC || or.NbdOptId != optId {
+		return nil, errors.New("Bad option reply")
+	}
+	if or.NbdOptReplyLength > 65536 {
+		return nil, errors.New("Option reply is too long")
+	}
+	return &or, nil
+}
+
+// clientHandshake performs the client side of the initial handshake with an
+// NBD server, returning the server's global flags
+func clientHandshake(conn net.Conn) (uint16, error) {
+	var hdr nbdNewStyleHeader
+	if err := binary.Read(conn, binary.BigEndian, &hdr); err != nil {
+		return 0, fmt.Errorf("Cannot read handshake: %v", err)
+	}
+	if hdr.NbdMagic != NBD_MAGIC || hdr.NbdOptsMagic != NBD_OPTS_MAGIC {
+		return 0, errors.New("Bad handshake magic")
+	}
+	if hdr.NbdGlobalFlags&NBD_FLAG_FIXED_NEWSTYLE == 0 {
+		return 0, errors.New("Server does not support fixed newstyle negotiation")
+	}
+	clf := nbdClientFlags{NbdClientFlags: NBD_FLAG_C_FIXED_NEWSTYLE}
+	if hdr.NbdGlobalFlags&NBD_FLAG_NO_ZEROES != 0 {
+		clf.NbdClientFlags |= NBD_FLAG_C_NO_ZEROES
+	}
+	if err := binary.Write(conn, binary.BigEndian, clf); err != nil {
+		return 0, err
+	}
+	return hdr.NbdGlobalFlags, nil
+}
+
+// negotiate negotiates with an upstream NBD server, returning the size and
+// transmission flags of the export. We use NBD_OPT_GO, falling back to
+// NBD_OPT_EXPORT_NAME for servers that do not support it
+func (p *NbdProxyBackend) negotiate(conn net.Conn) (uint64, uint16, error) {
+	globalFlags, err := clientHandshake(conn)
+	if err != nil {
+		return 0, 0, err
+	}
+	noZeroes := globalFlags&NBD_FLAG_NO_ZEROES != 0
+
+	name := []byte(p.export)
+	opt := nbdClientOpt{
+		NbdOptMagic: NBD_OPTS_MAGIC,
+		NbdOptId:    NBD_OPT_GO,
+		NbdOptLen:   uint32(4 + len(name) + 2),
+	}
+	if err := binary.Write(conn, binary.BigEndian, opt); err != nil {
+		return 0, 0, err
+	}
+	if err := binary.Write(conn, binary.BigEndian, uint32(len(name))); err != nil {
+		return 0, 0, err
+	}
+	if _, err := conn.Write(name); err != nil {
+		return 0, 0, err
+	}
+	if err := binary.Write(conn, binary.BigEndian, uint16(0)); err != nil { // no info requests
+		return 0, 0, err
+	}
+
+	var ie *nbdInfoExport
+	for {
+		or, err := readOptReply(conn, NBD_OPT_GO)
+		if err != nil {
+			return 0, 0, err
+		}
+		switch or.NbdOptReplyType {
+		case NBD_REP_ACK:
+			if ie == nil {
+				return 0, 0, errors.New("Upstream did not send export information")
+			}
+			return ie.NbdExportSize, ie.NbdTransmissionFlags, nil
+		case NBD_REP_INFO:
+			payload := make([]byte, or.NbdOptReplyLength)
+			if _, err := io.ReadFull(conn, payload); err != nil {
+				return 0, 0, err
+			}
+			if len(payload) >= 12 && binary.BigEndian.Uint16(payload) == NBD_INFO_EXPORT {
+				ie = &nbdInfoExport{
+					NbdInfoType:          NBD_INFO_EXPORT,
+					NbdExportSize:        binary.BigEndian.Uint64(payload[2:]),
+					NbdTransmissionFlags: binary.BigEndian.Uint16(payload[10:]),
+				}
+			}
+		case NBD_REP_ERR_UNSUP:
+			if err := skip(conn, or.NbdOptReplyLength); err != nil {
+				return 0, 0, err
+			}
+			return p.exportName(conn, noZeroes)
+		default:
+			message := make([]byte, or.NbdOptReplyLength)
+			if _, err := io.ReadFull(conn, message); err != nil {
+				return 0, 0, err
+			}
+			if or.NbdOptReplyType&NBD_REP_FLAG_ERROR != 0 {
+				return 0, 0, fmt.Errorf("Upstream refused export %s: error %x %s", p.export, or.NbdOptReplyType, string(message))
+			}
+			// ignore other replies
+		}
+	}
+}
+
+// exportName enters transmission with NBD_OPT_EXPORT_NAME, returning the size
+// and transmission flags of the export
+func (p *NbdProxyBackend) exportName(conn net.Conn, noZeroes bool) (uint64, uint16, error) {
+	name := []byte(p.export)
+	opt := nbdClientOpt{
+		NbdOptMagic: NBD_OPTS_MAGIC,
+		NbdOptId:    NBD_OPT_EXPORT_NAME,
+		NbdOptLen:   uint32(len(name)),
+	}
+	if err := binary.Write(conn, binary.BigEndian, opt); err != nil {
+		return 0, 0, err
+	}
+	if _, err := conn.Write(name); err != nil {
+		return 0, 0, err
+	}
+	var ed nbdExportDetails
+	if err := binary.Read(conn, binary.BigEndian, &ed); err != nil {
+		return 0, 0, fmt.Errorf("Upstream refused export %s", p.export)
+	}
+	if !noZeroes {
+		if err := skip(conn, NBD_EXPORT_NAME_PAD_LENGTH); err != nil {
+			return 0, 0, err
+		}
+	}
+	return ed.NbdExportSize, ed.NbdExportFlags, nil
+}
+
+// dial connects to the upstream server and negotiates the export
+func (p *NbdProxyBackend) dial() (*proxyConn, uint64, uint16, error) {
+	conn, err := net.DialTimeout(p.network, p.address, ProxyConnectTimeout)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	conn.SetDeadline(time.Now().Add(ProxyConnectTimeout))
+	size, flags, err := p.negotiate(conn)
+	if err != nil {
+		conn.Close()
+		return nil, 0, 0, fmt.Errorf("Cannot negotiate with %s: %v", p.url, err)
+	}
+	conn.SetDeadline(time.Time{})
+	pc := &proxyConn{
+		conn:     conn,
+		inflight: make(map[uint64]*proxyRequest),
+	}
+	go pc.receive()
+	return pc, size, flags, nil
+}
+
+// conn returns the upstream connection, reconnecting if it has failed
+func (p *NbdProxyBackend) conn() (*proxyConn, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return nil, errProxyClosed
+	}
+	if p.pc != nil {
+		p.pc.mutex.Lock()
+		broken := p.pc.broken
+		p.pc.mutex.Unlock()
+		if broken == nil {
+			return p.pc, nil
+		}
+	}
+	pc, size, flags, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	if size != p.size || flags&NBD_FLAG_READ_ONLY != p.flags&NBD_FLAG_READ_ONLY {
+		pc.fail(errors.New("Upstream export changed"))
+		return nil, fmt.Errorf("Export %s changed on reconnection to %s", p.export, p.url)
+	}
+	p.pc = pc
+	return pc, nil
+}
+
+// do sends a command upstream and waits for its reply
+func (p *NbdProxyBackend) do(ctx context.Context, cmdType uint16, flags uint16, offset int64, length int, data []byte, buf []byte) error {
+	pc, err := p.conn()
+	if err != nil {
+		return err
+	}
+	req := &proxyRequest{
+		buf:  buf,
+		done: make(chan error, 1),
+	}
+	pc.mutex.Lock()
+	if pc.broken != nil {
+		pc.mutex.Unlock()
+		return pc.broken
+	}
+	pc.nextHandle++
+	handle := pc.nextHandle
+	pc.inflight[handle] = req
+	pc.mutex.Unlock()
+
+	nbdReq := nbdRequest{
+		NbdRequestMagic: NBD_REQUEST_MAGIC,
+		NbdCommandFlags: flags,
+		NbdCommandType:  cmdType,
+		NbdHandle:       handle,
+		NbdOffset:       uint64(offset),
+		NbdLength:       uint32(length),
+	}
+	pc.sendMutex.Lock()
+	err = binary.Write(pc.conn, binary.BigEndian, nbdReq)
+	if err == nil && data != nil {
+		_, err = pc.conn.Write(data)
+	}
+	pc.sendMutex.Unlock()
+	if err != nil {
+		pc.fail(fmt.Errorf("Cannot send command upstream: %v", err))
+	}
+
+	select {
+	case err := <-req.done:
+		return err
+	case <-ctx.Done():
+		// the reply could still arrive and write to buf, so abandon the connection
+		pc.fail(ctx.Err())
+		<-req.done
+		return ctx.Err()
+	}
+}
+
+// WriteAt implements Backend.WriteAt
+func (p *NbdProxyBackend) WriteAt(ctx context.Context, b []byte, offset int64, fua bool) (int, error) {
+	if p.flags&NBD_FLAG_READ_ONLY != 0 {
+		return 0, syscall.EPERM
+	}
+	var flags uint16
+	if fua && p.flags&NBD_FLAG_SEND_FUA != 0 {
+		flags |= NBD_CMD_FLAG_FUA
+	}
+	if err := p.do(ctx, NBD_CMD_WRITE, flags, offset, len(b), b, nil); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadAt implements Backend.ReadAt
+func (p *NbdProxyBackend) ReadAt(ctx context.Context, b []byte, offset int64) (int, error) {
+	if err := p.do(ctx, NBD_CMD_READ, 0, offset, len(b), nil, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// TrimAt implements Backend.TrimAt
+func (p *NbdProxyBackend) TrimAt(ctx context.Context, length int, offset int64) (int, error) {
+	if p.flags&NBD_FLAG_SEND_TRIM == 0 {
+		return length, nil
+	}
+	if err := p.do(ctx, NBD_CMD_TRIM, 0, offset, length, nil, nil); err != nil {
+		return 0, err
+	}
+	return length, nil
+}
+
+// Flush implements Backend.Flush
+func (p *NbdProxyBackend) Flush(ctx context.Context) error {
+	if p.flags&NBD_FLAG_SEND_FLUSH == 0 {
+		return nil
+	}
+	return p.do(ctx, NBD_CMD_FLUSH, 0, 0, 0, nil, nil)
+}
+
+// Close implements Backend.Close
+func (p *NbdProxyBackend) Close(ctx context.Context) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+	if p.pc == nil {
+		return nil
+	}
+	disc := nbdRequest{
+		NbdRequestMagic: NBD_REQUEST_MAGIC,
+		NbdCommandType:  NBD_CMD_DISC,
+	}
+	p.pc.sendMutex.Lock()
+	binary.Write(p.pc.conn, binary.BigEndian, disc)
+	p.pc.sendMutex.Unlock()
+	p.pc.fail(errProxyClosed)
+	return nil
+}
+
+// Geometry implements Backend.Geometry
+func (p *NbdProxyBackend) Geometry(ctx context.Context) (uint64, uint64, uint64, uint64, error) {
+	return p.size, 1, 4096, 32 * 1024 * 1024, nil
+}
+
+// HasFua implements Backend.HasFua
+func (p *NbdProxyBackend) HasFua(ctx context.Context) bool {
+	return p.flags&NBD_FLAG_SEND_FUA != 0
+}
+
+// HasFlush implements Backend.HasFlush
+func (p *NbdProxyBackend) HasFlush(ctx context.Context) bool {
+	return p.flags&NBD_FLAG_SEND_FLUSH != 0
+}
+
+// newNbdProxyBackend connects to the upstream export at an NBD URL
+func newNbdProxyBackend(u string) (*NbdProxyBackend, error) {
+	network, address, export, err := parseNbdUrl(u)
+	if err != nil {
+		return nil, err
+	}
+	p := &NbdProxyBackend{
+		url:     u,
+		network: network,
+		address: address,
+		export:  export,
+	}
+	if p.pc, p.size, p.flags, err = p.dial(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Generate a new NBD proxy backend
+func NewNbdProxyBackend(ctx context.Context, ec *ExportConfig) (Backend, error) {
+	u := ec.DriverParameters["url"]
+	if u == "" {
+		return nil, errors.New("NBD proxy exports need a URL")
+	}
+	return newNbdProxyBackend(u)
+}
+
+// Register our backend
+func init() {
+	RegisterBackend("nbd", NewNbdProxyBackend)
+}
@@ -0,0 +1,73 @@
+package nbd
+
+import (
+	"sync"
+	"time"
+)
+
+// connRateLimiter is a token bucket limiting the rate at which a listener
+// accepts connections. It holds up to burst tokens, refilled at rate per
+// second, and each connection accepted takes one
+type connRateLimiter struct {
+	mutex  sync.Mutex // protects the below
+	rate   float64    // tokens added per second
+	burst  float64    // most tokens held
+	tokens float64    // tokens held, negative if reserved ahead of time
+	last   time.Time  // when the tokens were last refilled
+}
+
+// newConnRateLimiter returns a limiter allowing rate connections per second,
+// in bursts of up to burst, starting full
+func newConnRateLimiter(rate float64, burst int) *connRateLimiter {
+	return &connRateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill adds the tokens due since the last refill. Call with the mutex held
+func (rl *connRateLimiter) refill(now time.Time) {
+	if elapsed := now.Sub(rl.last); elapsed > 0 {
+		rl.tokens += elapsed.Seconds() * rl.rate
+		if rl.tokens > rl.burst {
+			rl.tokens = rl.burst
+		}
+		rl.last = now
+	}
+}
+
+// allow takes a token if one is available, returning false if none is
+func (rl *connRateLimiter) allow(now time.Time) bool {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.refill(now)
+	if rl.tokens < 1 {
+		return false
+	}
+	rl.tokens--
+	return true
+}
+
+// reserve takes a token, whether or not one is available, returning how long
+// the caller must wait until it is due
+func (rl *connRateLimiter) reserve(now time.Time) time.Duration {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.refill(now)
+	rl.tokens--
+	if rl.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+}
+
+// cancel returns a token taken by reserve that was not used
+func (rl *connRateLimiter) cancel() {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if rl.tokens++; rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/ceph/go-ceph/rados"
 	"github.com/ceph/go-ceph/rbd"
 	"golang.org/x/net/context"
+	"strconv"
 )
 
 // RbdBackend implements Backend
@@ -21,6 +22,11 @@ type RbdBackend struct {
 	ioctx *rados.IOContext
 	image *rbd.Image
 	size  uint64
+
+	minimumBlockSize   uint64
+	preferredBlockSize uint64
+	maximumBlockSize   uint64
+	hints              IOHints
 }
 
 // WriteAt implements Backend.WriteAt
@@ -61,7 +67,70 @@ func (rb *RbdBackend) Close(ctx context.Context) error {
 
 // Size implements Backend.Size
 func (rb *RbdBackend) Geometry(ctx context.Context) (uint64, uint64, uint64, uint64, error) {
-	return rb.size, 4096, 4096, 32 * 1024 * 1024, nil
+	return rb.size, rb.minimumBlockSize, rb.preferredBlockSize, rb.maximumBlockSize, nil
+}
+
+// IOHints implements IOHinter.IOHints
+func (rb *RbdBackend) IOHints(ctx context.Context) IOHints {
+	return rb.hints
+}
+
+// rbdIOHints works out the I/O hints for an image: I/O of a whole object is
+// served by one OSD, and where the image uses fancy striping, I/O of a whole
+// stripe (a stripe unit in each of stripeCount objects) is spread across them
+func rbdIOHints(objectSize uint64, stripeUnit uint64, stripeCount uint64) IOHints {
+	size := objectSize
+	if stripeCount > 1 && stripeUnit != 0 && stripeUnit < objectSize {
+		size = stripeUnit * stripeCount
+	}
+	return IOHints{ReadSize: size, WriteSize: size, Alignment: size}
+}
+
+// rbdGeometry works out the block sizes to advertise for an image.
+//
+// An RBD image is stored as a series of RADOS objects (4MB by default). I/O that
+// covers only part of an object, or straddles two, means a read-modify-write
+// or an extra round trip to a different OSD, so we advertise the object size as
+// the preferred block size in order that clients align to object boundaries.
+// Where the image uses fancy striping (a stripe count above one), consecutive
+// stripe units land in different objects, so the stripe unit is the natural
+// unit instead (though the I/O hints may raise this towards the stripe width, see
+// rbdIOHints).
+//
+// The minimum block size is 4096 unless alignment is given, in which case it is
+// enforced as the minimum: either "object" (use the preferred block size above)
+// or a number of bytes
+func rbdGeometry(objectSize uint64, stripeUnit uint64, stripeCount uint64, alignment string) (uint64, uint64, uint64, error) {
+	preferredBlockSize := objectSize
+	if stripeCount > 1 && stripeUnit != 0 && stripeUnit < objectSize {
+		preferredBlockSize = stripeUnit
+	}
+	if preferredBlockSize == 0 {
+		preferredBlockSize = 4 * 1024 * 1024
+	}
+	preferredBlockSize = roundUpToNextPowerOfTwo(preferredBlockSize)
+
+	minimumBlockSize := uint64(4096)
+	switch alignment {
+	case "":
+	case "object":
+		minimumBlockSize = preferredBlockSize
+	default:
+		a, err := strconv.ParseUint(alignment, 10, 64)
+		if err != nil || a == 0 || a&(a-1) != 0 {
+			return 0, 0, 0, fmt.Errorf("Bad rbd alignment '%s': must be 'object' or a power of two", alignment)
+		}
+		minimumBlockSize = a
+	}
+	if preferredBlockSize < minimumBlockSize {
+		preferredBlockSize = minimumBlockSize
+	}
+
+	maximumBlockSize := uint64(32 * 1024 * 1024)
+	if maximumBlockSize < preferredBlockSize {
+		maximumBlockSize = preferredBlockSize
+	}
+	return minimumBlockSize, preferredBlockSize, maximumBlockSize, nil
 }
 
 // Size implements Backend.HasFua
@@ -122,12 +191,33 @@ func NewRbdBackend(ctx context.Context, ec *ExportConfig) (Backend, error) {
 		conn.Shutdown()
 		return nil, fmt.Errorf("rbd cannot get size: %s", err)
 	}
+	info, err := image.Stat()
+	if err != nil {
+		image.Close()
+		ioctx.Destroy()
+		conn.Shutdown()
+		return nil, fmt.Errorf("rbd cannot stat image: %s", err)
+	}
+	// images without fancy striping report a stripe count of one
+	stripeUnit, _ := image.GetStripeUnit()
+	stripeCount, _ := image.GetStripeCount()
+	minimumBlockSize, preferredBlockSize, maximumBlockSize, err := rbdGeometry(info.Obj_size, stripeUnit, stripeCount, ec.DriverParameters["alignment"])
+	if err != nil {
+		image.Close()
+		ioctx.Destroy()
+		conn.Shutdown()
+		return nil, err
+	}
 
 	return &RbdBackend{
-		conn:  conn,
-		ioctx: ioctx,
-		image: image,
-		size:  size,
+		conn:               conn,
+		ioctx:              ioctx,
+		image:              image,
+		size:               size,
+		minimumBlockSize:   minimumBlockSize,
+		preferredBlockSize: preferredBlockSize,
+		maximumBlockSize:   maximumBlockSize,
+		hints:              rbdIOHints(info.Obj_size, stripeUnit, stripeCount),
 	}, nil
 }
 
@@ -0,0 +1,52 @@
+// +build linux,!noceph
+
+package nbd
+
+import (
+	"testing"
+)
+
+func TestRbdGeometry(t *testing.T) {
+	for _, tc := range []struct {
+		objectSize  uint64
+		stripeUnit  uint64
+		stripeCount uint64
+		alignment   string
+		min         uint64
+		preferred   uint64
+		max         uint64
+		err         bool
+	}{
+		{4 * 1024 * 1024, 4 * 1024 * 1024, 1, "", 4096, 4 * 1024 * 1024, 32 * 1024 * 1024, false},
+		{0, 0, 0, "", 4096, 4 * 1024 * 1024, 32 * 1024 * 1024, false},
+		{4 * 1024 * 1024, 64 * 1024, 16, "", 4096, 64 * 1024, 32 * 1024 * 1024, false},
+		{64 * 1024 * 1024, 64 * 1024 * 1024, 1, "", 4096, 64 * 1024 * 1024, 64 * 1024 * 1024, false},
+		{4 * 1024 * 1024, 4 * 1024 * 1024, 1, "object", 4 * 1024 * 1024, 4 * 1024 * 1024, 32 * 1024 * 1024, false},
+		{4 * 1024 * 1024, 4 * 1024 * 1024, 1, "65536", 65536, 4 * 1024 * 1024, 32 * 1024 * 1024, false},
+		{4 * 1024 * 1024, 64 * 1024, 16, "1048576", 1048576, 1048576, 32 * 1024 * 1024, false},
+		{4 * 1024 * 1024, 4 * 1024 * 1024, 1, "1000", 0, 0, 0, true},
+		{4 * 1024 * 1024, 4 * 1024 * 1024, 1, "bogus", 0, 0, 0, true},
+	} {
+		min, preferred, max, err := rbdGeometry(tc.objectSize, tc.stripeUnit, tc.stripeCount, tc.alignment)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%+v: expected an error", tc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: unexpected error %v", tc, err)
+		} else if min != tc.min || preferred != tc.preferred || max != tc.max {
+			t.Errorf("%+v: got %d/%d/%d", tc, min, preferred, max)
+		}
+	}
+}
+
+func TestRbdIOHints(t *testing.T) {
+	if h := rbdIOHints(4*1024*1024, 4*1024*1024, 1); h != (IOHints{ReadSize: 4 * 1024 * 1024, WriteSize: 4 * 1024 * 1024, Alignment: 4 * 1024 * 1024}) {
+		t.Errorf("Unstriped image had hints %+v", h)
+	}
+	if h := rbdIOHints(4*1024*1024, 64*1024, 16); h != (IOHints{ReadSize: 1024 * 1024, WriteSize: 1024 * 1024, Alignment: 1024 * 1024}) {
+		t.Errorf("Striped image had hints %+v", h)
+	}
+}
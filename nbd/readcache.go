@@ -0,0 +1,285 @@
+package nbd
+
+import (
+	"container/list"
+	"errors"
+	"expvar"
+	"fmt"
+	"golang.org/x/net/context"
+	"strconv"
+	"sync"
+)
+
+// Default size of the blocks in which a read cache holds data
+const DefaultReadCacheBlockSize = 64 * 1024
+
+// ReadCacheBackend implements Backend
+//
+// It caches data read from the backend it wraps in memory, in blocks, evicting
+// the least recently used once full. With reconnectgrace (which it needs) the
+// decorated backend is shared by every connection to the export and outlives
+// them for the grace period, so the cache does too: a client that reconnects,
+// or another client reading the same data (e.g. diskless machines booting from
+// one image), is served from memory rather than from cold storage.
+//
+// Writes go straight to the backend. Blocks they overlap are updated in the
+// cache if it is write-through, or else dropped from it; trims drop them.
+//
+// The blocks cached are charged to the cache memory budget shared by every
+// export, so may be evicted before the cache is full
+type ReadCacheBackend struct {
+	Backend
+	size         uint64      // size of the backend
+	blockSize    int64       // size of each block cached
+	maxBlocks    int         // most blocks cached
+	writeThrough bool        // update cached blocks on writes, rather than dropping them
+	stats        *expvar.Map // the export's counters
+
+	mutex sync.Mutex              // protects the below
+	cache map[int64]*list.Element // cached blocks, by index
+	lru   *list.List              // cached blocks, most recently used first
+	epoch uint64                  // incremented by each write or trim, so reads racing one do not cache stale data
+
+	uncharged int64 // bytes added to the cache (less those dropped) not yet charged to the memory budget
+}
+
+// readCacheBlock is a block of data held in a read cache
+type readCacheBlock struct {
+	index int64
+	data  []byte
+}
+
+// readCacheMiss is a run of blocks missing from a read cache
+type readCacheMiss struct {
+	first, end int64 // indices of the first block and the one after the last
+}
+
+// ReadAt implements Backend.ReadAt
+func (rb *ReadCacheBackend) ReadAt(ctx context.Context, b []byte, offset int64) (int, error) {
+	end := offset + int64(len(b))
+	if len(b) == 0 || offset < 0 || uint64(end) > rb.size {
+		// not ours to second-guess
+		return rb.Backend.ReadAt(ctx, b, offset)
+	}
+	// copy what is cached, noting the runs of blocks that are not
+	var misses []readCacheMiss
+	rb.mutex.Lock()
+	epoch := rb.epoch
+	for i := offset / rb.blockSize; i*rb.blockSize < end; i++ {
+		if e, ok := rb.cache[i]; ok {
+			rb.lru.MoveToFront(e)
+			rb.copyBlock(b, offset, i, e.Value.(*readCacheBlock).data)
+		} else if len(misses) > 0 && misses[len(misses)-1].end == i {
+			misses[len(misses)-1].end++
+		} else {
+			misses = append(misses, readCacheMiss{first: i, end: i + 1})
+		}
+	}
+	rb.mutex.Unlock()
+	blocks := (end-1)/rb.blockSize - offset/rb.blockSize + 1
+	missed := int64(0)
+	for _, m := range misses {
+		missed += m.end - m.first
+	}
+	rb.stats.Add("read_cache_hits", blocks-missed)
+	rb.stats.Add("read_cache_misses", missed)
+
+	// read the missing blocks whole, to cache them
+	for _, m := range misses {
+		start := m.first * rb.blockSize
+		stop := m.end * rb.blockSize
+		if uint64(stop) > rb.size {
+			stop = int64(rb.size)
+		}
+		data := make([]byte, stop-start)
+		if n, err := rb.Backend.ReadAt(ctx, data, start); err != nil {
+			return 0, err
+		} else if n != len(data) {
+			return 0, fmt.Errorf("Short read of %d bytes at %d for read cache", n, start)
+		}
+		rb.mutex.Lock()
+		for i := m.first; i < m.end; i++ {
+			block := data[(i-m.first)*rb.blockSize:]
+			if int64(len(block)) > rb.blockSize {
+				block = block[:rb.blockSize]
+			}
+			rb.copyBlock(b, offset, i, block)
+			if rb.epoch == epoch {
+				rb.cacheBlock(i, block)
+			}
+		}
+		rb.unlock()
+	}
+	return len(b), nil
+}
+
+// copyBlock copies the part of block i (holding data) lying within b, which
+// is read from offset
+func (rb *ReadCacheBackend) copyBlock(b []byte, offset int64, i int64, data []byte) {
+	start := i * rb.blockSize
+	from, to := start, start+int64(len(data))
+	if from < offset {
+		from = offset
+	}
+	if end := offset + int64(len(b)); to > end {
+		to = end
+	}
+	if from < to {
+		copy(b[from-offset:to-offset], data[from-start:to-start])
+	}
+}
+
+// cacheBlock adds a block to the cache, evicting the least recently used if
+// the cache is full. Call with the mutex held
+func (rb *ReadCacheBackend) cacheBlock(i int64, data []byte) {
+	if e, ok := rb.cache[i]; ok {
+		rb.lru.MoveToFront(e)
+		return
+	}
+	if rb.lru.Len() >= rb.maxBlocks {
+		oldest := rb.lru.Back()
+		rb.lru.Remove(oldest)
+		delete(rb.cache, oldest.Value.(*readCacheBlock).index)
+		rb.uncharged -= int64(len(oldest.Value.(*readCacheBlock).data))
+	}
+	rb.cache[i] = rb.lru.PushFront(&readCacheBlock{index: i, data: data})
+	rb.uncharged += int64(len(data))
+}
+
+// unlock releases the mutex, then charges the memory budget for the blocks
+// added to and dropped from the cache whilst it was held
+func (rb *ReadCacheBackend) unlock() {
+	n := rb.uncharged
+	rb.uncharged = 0
+	rb.mutex.Unlock()
+	cacheMemory.charge(rb, n)
+}
+
+// evictOldest implements budgetedCache.evictOldest
+func (rb *ReadCacheBackend) evictOldest() int64 {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+	oldest := rb.lru.Back()
+	if oldest == nil {
+		return 0
+	}
+	rb.lru.Remove(oldest)
+	delete(rb.cache, oldest.Value.(*readCacheBlock).index)
+	return int64(len(oldest.Value.(*readCacheBlock).data))
+}
+
+// changed records that length bytes at offset have been written with b (nil
+// if trimmed, or if the write failed), updating or dropping the blocks cached
+func (rb *ReadCacheBackend) changed(b []byte, length int, offset int64) {
+	rb.mutex.Lock()
+	defer rb.unlock()
+	rb.epoch++
+	end := offset + int64(length)
+	for i := offset / rb.blockSize; i*rb.blockSize < end; i++ {
+		e, ok := rb.cache[i]
+		if !ok {
+			continue
+		}
+		if b != nil && rb.writeThrough {
+			block := e.Value.(*readCacheBlock)
+			start := i * rb.blockSize
+			from, to := start, start+int64(len(block.data))
+			if from < offset {
+				from = offset
+			}
+			if to > end {
+				to = end
+			}
+			copy(block.data[from-start:to-start], b[from-offset:to-offset])
+			continue
+		}
+		rb.lru.Remove(e)
+		delete(rb.cache, i)
+		rb.uncharged -= int64(len(e.Value.(*readCacheBlock).data))
+	}
+}
+
+// WriteAt implements Backend.WriteAt
+func (rb *ReadCacheBackend) WriteAt(ctx context.Context, b []byte, offset int64, fua bool) (int, error) {
+	n, err := rb.Backend.WriteAt(ctx, b, offset, fua)
+	if err != nil || n != len(b) {
+		// we cannot tell what was written
+		rb.changed(nil, len(b), offset)
+	} else {
+		rb.changed(b, len(b), offset)
+	}
+	return n, err
+}
+
+// TrimAt implements Backend.TrimAt
+func (rb *ReadCacheBackend) TrimAt(ctx context.Context, length int, offset int64) (int, error) {
+	n, err := rb.Backend.TrimAt(ctx, length, offset)
+	rb.changed(nil, length, offset)
+	return n, err
+}
+
+// Close implements Backend.Close
+func (rb *ReadCacheBackend) Close(ctx context.Context) error {
+	cacheMemory.forget(rb)
+	return rb.Backend.Close(ctx)
+}
+
+// Cache implements Cacher.Cache
+//
+// We read the range into the read cache
+func (rb *ReadCacheBackend) Cache(ctx context.Context, length int, offset int64) (int, error) {
+	if _, err := rb.ReadAt(ctx, make([]byte, length), offset); err != nil {
+		return 0, err
+	}
+	return length, nil
+}
+
+// IOHints implements IOHinter.IOHints
+func (rb *ReadCacheBackend) IOHints(ctx context.Context) IOHints {
+	return backendIOHints(ctx, rb.Backend)
+}
+
+// newReadCacheBackend wraps a backend in a ReadCacheBackend if the export
+// configures readcachesize, the number of bytes to cache
+func newReadCacheBackend(ctx context.Context, ec *ExportConfig, backend Backend) (Backend, error) {
+	sizeParam := ec.DriverParameters["readcachesize"]
+	if sizeParam == "" {
+		return backend, nil
+	}
+	if grace, err := reconnectGrace(ec); err != nil {
+		return nil, err
+	} else if grace == 0 {
+		return nil, errors.New("A read cache needs reconnectgrace, so that it is shared between connections")
+	}
+	cacheSize, err := strconv.ParseUint(sizeParam, 10, 63)
+	if err != nil {
+		return nil, fmt.Errorf("Bad read cache size '%s'", sizeParam)
+	}
+	blockSize := uint64(DefaultReadCacheBlockSize)
+	if bs := ec.DriverParameters["readcacheblocksize"]; bs != "" {
+		if blockSize, err = strconv.ParseUint(bs, 10, 31); err != nil || blockSize == 0 {
+			return nil, fmt.Errorf("Bad read cache block size '%s'", bs)
+		}
+	}
+	if cacheSize < blockSize {
+		return nil, fmt.Errorf("Read cache size %d is smaller than its block size %d", cacheSize, blockSize)
+	}
+	writeThrough, err := isTrue(ec.DriverParameters["readcachewritethrough"])
+	if err != nil {
+		return nil, err
+	}
+	size, _, _, _, err := backend.Geometry(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &ReadCacheBackend{
+		Backend:      backend,
+		size:         size,
+		blockSize:    int64(blockSize),
+		maxBlocks:    int(cacheSize / blockSize),
+		writeThrough: writeThrough,
+		stats:        exportExpvar(ec.Name),
+		cache:        make(map[int64]*list.Element),
+		lru:          list.New(),
+	}, nil
+}
@@ -0,0 +1,149 @@
+package nbd
+
+import (
+	"expvar"
+	"fmt"
+	"golang.org/x/net/context"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Default delay before the first retry of a read by ReadRetryBackend
+const defaultRetryBackoff = 10 * time.Millisecond
+
+// retryableErrors maps the names of the errors a read may be retried on to the errors
+var retryableErrors = map[string]syscall.Errno{
+	"EIO":       syscall.EIO,
+	"EAGAIN":    syscall.EAGAIN,
+	"EBUSY":     syscall.EBUSY,
+	"ETIMEDOUT": syscall.ETIMEDOUT,
+	"ENOMEM":    syscall.ENOMEM,
+	"ENXIO":     syscall.ENXIO,
+}
+
+// ReadRetryBackend implements Backend
+//
+// It retries reads the backend it wraps fails with a transient error (by
+// default EIO), up to a number of times, waiting a backoff before the first
+// retry and twice as long before each retry after, so that a glitch in
+// network storage or a marginal sector that reads on a second attempt is not
+// seen by the client. Retries stop short of the export's command timeout, so
+// the watchdog is left to fail the command rather than a retry outlasting it
+type ReadRetryBackend struct {
+	Backend
+	retries int                        // most times a read is retried
+	backoff time.Duration              // delay before the first retry
+	errnos  map[syscall.Errno]struct{} // errors on which a read is retried
+	timeout time.Duration              // the export's command timeout, or 0 for none
+	stats   *expvar.Map                // the export's counters
+	name    string                     // the export's name, for logging
+}
+
+// readRetryCacherBackend is a ReadRetryBackend wrapping a backend that is also a Cacher
+type readRetryCacherBackend struct {
+	*ReadRetryBackend
+}
+
+// retryable returns true if a read failing with err may be retried
+func (rb *ReadRetryBackend) retryable(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	errno, ok := err.(syscall.Errno)
+	if !ok {
+		return false
+	}
+	_, ok = rb.errnos[errno]
+	return ok
+}
+
+// ReadAt implements Backend.ReadAt
+func (rb *ReadRetryBackend) ReadAt(ctx context.Context, b []byte, offset int64) (int, error) {
+	start := time.Now()
+	backoff := rb.backoff
+	for attempt := 0; ; attempt++ {
+		n, err := rb.Backend.ReadAt(ctx, b, offset)
+		if err == nil || attempt == rb.retries || !rb.retryable(err) {
+			return n, err
+		}
+		if rb.timeout != 0 && time.Since(start)+backoff >= rb.timeout {
+			getBackendLogger().Printf("[WARN] Export %s read of %d bytes at offset %d failed (%v), with no time to retry before the command timeout", rb.name, len(b), offset, err)
+			return n, err
+		}
+		rb.stats.Add("read_retries", 1)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return n, err
+		}
+		backoff *= 2
+	}
+}
+
+// IOHints implements IOHinter.IOHints
+func (rb *ReadRetryBackend) IOHints(ctx context.Context) IOHints {
+	return backendIOHints(ctx, rb.Backend)
+}
+
+// Cache implements Cacher.Cache
+func (rcb *readRetryCacherBackend) Cache(ctx context.Context, length int, offset int64) (int, error) {
+	return rcb.Backend.(Cacher).Cache(ctx, length, offset)
+}
+
+// newReadRetryBackend wraps a backend in a ReadRetryBackend if the export
+// configures readretries. The delay before the first retry is retrybackoff,
+// and the errors retried on are listed, comma separated, in retryerrors
+func newReadRetryBackend(ctx context.Context, ec *ExportConfig, backend Backend) (Backend, error) {
+	retriesParam := ec.DriverParameters["readretries"]
+	if retriesParam == "" {
+		return backend, nil
+	}
+	retries, err := strconv.Atoi(retriesParam)
+	if err != nil || retries < 0 {
+		return nil, fmt.Errorf("Bad read retries '%s'", retriesParam)
+	}
+	if retries == 0 {
+		return backend, nil
+	}
+	backoff := defaultRetryBackoff
+	if backoffParam := ec.DriverParameters["retrybackoff"]; backoffParam != "" {
+		if backoff, err = time.ParseDuration(backoffParam); err != nil || backoff < 0 {
+			return nil, fmt.Errorf("Bad retry backoff '%s'", backoffParam)
+		}
+	}
+	errnos := make(map[syscall.Errno]struct{})
+	errorsParam := ec.DriverParameters["retryerrors"]
+	if errorsParam == "" {
+		errorsParam = "EIO"
+	}
+	for _, name := range strings.Split(errorsParam, ",") {
+		errno, ok := retryableErrors[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("Bad retry error '%s'", name)
+		}
+		errnos[errno] = struct{}{}
+	}
+	timeout, err := commandTimeout(ec)
+	if err != nil {
+		return nil, err
+	}
+	rb := &ReadRetryBackend{
+		Backend: backend,
+		retries: retries,
+		backoff: backoff,
+		errnos:  errnos,
+		timeout: timeout,
+		stats:   exportExpvar(ec.Name),
+		name:    ec.Name,
+	}
+	if _, isCacher := backend.(Cacher); isCacher {
+		return &readRetryCacherBackend{rb}, nil
+	}
+	return rb, nil
+}
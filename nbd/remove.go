@@ -0,0 +1,138 @@
+package nbd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Exports removed through the remove API, and the connections negotiated to
+// each export being served, so that removing an export can close them. A
+// removed export is not served again until the configuration is reloaded
+var (
+	removedExports      = make(map[string]struct{})
+	exportSessions      = make(map[string]map[*Connection]struct{})
+	removedExportsMutex sync.Mutex // protects the above
+)
+
+// RemoveResult reports the outcome of removing an export through the remove API
+type RemoveResult struct {
+	Export      string `json:"export"`      // name of the export removed
+	Connections int    `json:"connections"` // connections open to it when it was removed
+	Drained     int    `json:"drained"`     // connections closed gracefully
+	Forced      int    `json:"forced"`      // connections closed with commands still in flight after the linger timeout, or that failed meanwhile
+}
+
+func init() {
+	http.HandleFunc("/debug/remove", serveRemoveExport)
+}
+
+// forgetRemovedExports serves the exports removed through the remove API
+// again, if the configuration being served has them
+func forgetRemovedExports() {
+	removedExportsMutex.Lock()
+	defer removedExportsMutex.Unlock()
+	removedExports = make(map[string]struct{})
+}
+
+// isExportRemoved returns true if the named export has been removed
+func isExportRemoved(name string) bool {
+	removedExportsMutex.Lock()
+	defer removedExportsMutex.Unlock()
+	_, ok := removedExports[name]
+	return ok
+}
+
+// registerExportSession adds a connection that has negotiated to those closed
+// when its export is removed, returning false if the export has been removed
+// whilst the connection was negotiating
+func registerExportSession(c *Connection) bool {
+	removedExportsMutex.Lock()
+	defer removedExportsMutex.Unlock()
+	if _, ok := removedExports[c.export.name]; ok {
+		return false
+	}
+	sessions, ok := exportSessions[c.export.name]
+	if !ok {
+		sessions = make(map[*Connection]struct{})
+		exportSessions[c.export.name] = sessions
+	}
+	sessions[c] = struct{}{}
+	return true
+}
+
+// unregisterExportSession removes a connection added by registerExportSession
+func unregisterExportSession(c *Connection) {
+	removedExportsMutex.Lock()
+	defer removedExportsMutex.Unlock()
+	if sessions, ok := exportSessions[c.export.name]; ok {
+		if delete(sessions, c); len(sessions) == 0 {
+			delete(exportSessions, c.export.name)
+		}
+	}
+}
+
+// RemoveExport stops serving the named export. Connections to it are refused
+// from now on, and the connections already open to it are closed as they are
+// when the server shuts down: each refuses further commands with
+// NBD_ESHUTDOWN, waits up to linger for those it has received to be replied
+// to, flushes the backend, and closes. It returns once they have all closed
+func RemoveExport(name string, linger time.Duration) (RemoveResult, error) {
+	copyJobsMutex.Lock()
+	_, ok := copyExports[name]
+	delete(copyExports, name)
+	copyJobsMutex.Unlock()
+	if !ok {
+		return RemoveResult{}, fmt.Errorf("No such export %s", name)
+	}
+
+	removedExportsMutex.Lock()
+	removedExports[name] = struct{}{}
+	sessions := exportSessions[name]
+	delete(exportSessions, name)
+	removedExportsMutex.Unlock()
+
+	result := RemoveResult{Export: name, Connections: len(sessions)}
+	for c := range sessions {
+		c.linger = linger
+		close(c.removed)
+	}
+	for c := range sessions {
+		<-c.closed
+		if c.graceful {
+			result.Drained++
+		} else {
+			result.Forced++
+		}
+	}
+	return result, nil
+}
+
+// serveRemoveExport serves the remove API. A POST with export removes the
+// export, closing its connections gracefully within linger (a duration such as
+// 30s, or the shutdown timeout if omitted), and replies with the outcome as
+// JSON once they have closed
+func serveRemoveExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, fmt.Sprintf("Bad remove request %s", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	linger := getShutdownTimeout()
+	if q.Get("linger") != "" {
+		var err error
+		if linger, err = time.ParseDuration(q.Get("linger")); err != nil || linger < 0 {
+			http.Error(w, fmt.Sprintf("Bad linger '%s'", q.Get("linger")), http.StatusBadRequest)
+			return
+		}
+	}
+	result, err := RemoveExport(q.Get("export"), linger)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
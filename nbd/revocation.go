@@ -0,0 +1,237 @@
+package nbd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ocsp"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Timeout for a query to an OCSP responder
+var OcspTimeout = 5 * time.Second
+
+// revocationChecker checks client certificates presented during the TLS handshake
+// against a CRL and / or an OCSP responder
+type revocationChecker struct {
+	logger     *log.Logger
+	crlFile    string              // path to the CRL file
+	ocspServer string              // URL of the OCSP responder, or "aia"
+	failOpen   bool                // accept certificates whose status cannot be determined
+	caCerts    []*x509.Certificate // certificates that may sign the CRL, which is not trusted without them
+
+	crlMutex   sync.Mutex                // protects the below
+	crlModTime time.Time                 // modification time of the CRL file when loaded
+	crlSize    int64                     // size of the CRL file when loaded
+	revoked    map[revokedCert]time.Time // revoked certificates, with when they were revoked
+	crlErr     error                     // error from the last CRL load, if any
+}
+
+// revokedCert identifies a revoked certificate. Serial numbers are only unique
+// to an issuer, so a certificate is identified by both
+type revokedCert struct {
+	issuer string // the issuer's DER encoded name
+	serial string // the serial number, in decimal
+}
+
+// errUndetermined is returned when the revocation status of a certificate cannot be determined
+var errUndetermined = errors.New("revocation status could not be determined")
+
+// newRevocationChecker returns a revocationChecker for the given TLS configuration
+func newRevocationChecker(logger *log.Logger, t TlsConfig) (*revocationChecker, error) {
+	rc := &revocationChecker{
+		logger:     logger,
+		crlFile:    t.CrlFile,
+		ocspServer: t.OcspServer,
+		failOpen:   t.RevocationFailOpen,
+	}
+	if t.CaCertFile != "" {
+		caBytes, err := ioutil.ReadFile(t.CaCertFile)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			var block *pem.Block
+			block, caBytes = pem.Decode(caBytes)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+				rc.caCerts = append(rc.caCerts, cert)
+			}
+		}
+	}
+	if rc.crlFile != "" {
+		// load it now so a broken CRL is reported at startup
+		if err := rc.reloadCrl(); err != nil {
+			logger.Printf("[WARN] Could not load CRL %s: %v", rc.crlFile, err)
+		}
+	}
+	return rc, nil
+}
+
+// reloadCrl reloads the CRL if the file has changed since it was last loaded
+func (rc *revocationChecker) reloadCrl() error {
+	rc.crlMutex.Lock()
+	defer rc.crlMutex.Unlock()
+
+	stat, err := os.Stat(rc.crlFile)
+	if err != nil {
+		rc.crlErr = err
+		return err
+	}
+	if rc.revoked != nil && stat.ModTime().Equal(rc.crlModTime) && stat.Size() == rc.crlSize {
+		return rc.crlErr
+	}
+	rc.crlModTime = stat.ModTime()
+	rc.crlSize = stat.Size()
+
+	crlBytes, err := ioutil.ReadFile(rc.crlFile)
+	if err != nil {
+		rc.crlErr = err
+		return err
+	}
+	if block, _ := pem.Decode(crlBytes); block != nil {
+		crlBytes = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(crlBytes)
+	if err != nil {
+		rc.crlErr = fmt.Errorf("Cannot parse CRL: %v", err)
+		return rc.crlErr
+	}
+	// the entries can only be trusted if the CRL is signed by its issuer
+	signed := false
+	for _, ca := range rc.caCerts {
+		if bytes.Equal(ca.RawSubject, crl.RawIssuer) && crl.CheckSignatureFrom(ca) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		rc.crlErr = errors.New("CRL is not signed by a configured CA")
+		return rc.crlErr
+	}
+	if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+		rc.logger.Printf("[WARN] CRL %s is stale (next update was due %s)", rc.crlFile, crl.NextUpdate)
+	}
+	revoked := make(map[revokedCert]time.Time)
+	for _, r := range crl.RevokedCertificateEntries {
+		revoked[revokedCert{issuer: string(crl.RawIssuer), serial: r.SerialNumber.String()}] = r.RevocationTime
+	}
+	rc.revoked = revoked
+	rc.crlErr = nil
+	rc.logger.Printf("[INFO] Loaded CRL %s with %d revoked certificate(s)", rc.crlFile, len(revoked))
+	return nil
+}
+
+// checkCrl checks a certificate against the CRL
+func (rc *revocationChecker) checkCrl(cert *x509.Certificate) error {
+	if err := rc.reloadCrl(); err != nil {
+		rc.logger.Printf("[WARN] Could not load CRL %s: %v", rc.crlFile, err)
+		return errUndetermined
+	}
+	rc.crlMutex.Lock()
+	defer rc.crlMutex.Unlock()
+	if when, ok := rc.revoked[revokedCert{issuer: string(cert.RawIssuer), serial: cert.SerialNumber.String()}]; ok {
+		return fmt.Errorf("certificate with serial %s was revoked at %s", cert.SerialNumber, when)
+	}
+	return nil
+}
+
+// checkOcsp checks a certificate against the OCSP responder
+func (rc *revocationChecker) checkOcsp(cert *x509.Certificate, issuer *x509.Certificate) error {
+	if issuer == nil {
+		rc.logger.Printf("[WARN] Cannot check OCSP status of certificate with serial %s as the issuer is unknown", cert.SerialNumber)
+		return errUndetermined
+	}
+	server := rc.ocspServer
+	if server == "aia" {
+		if len(cert.OCSPServer) == 0 {
+			rc.logger.Printf("[WARN] Certificate with serial %s names no OCSP responder", cert.SerialNumber)
+			return errUndetermined
+		}
+		server = cert.OCSPServer[0]
+	}
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		rc.logger.Printf("[WARN] Cannot create OCSP request: %v", err)
+		return errUndetermined
+	}
+	client := &http.Client{Timeout: OcspTimeout}
+	resp, err := client.Post(server, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		rc.logger.Printf("[WARN] OCSP query to %s failed: %v", server, err)
+		return errUndetermined
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		rc.logger.Printf("[WARN] OCSP query to %s returned HTTP status %d", server, resp.StatusCode)
+		return errUndetermined
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		rc.logger.Printf("[WARN] Cannot read OCSP response from %s: %v", server, err)
+		return errUndetermined
+	}
+	ocspResp, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		rc.logger.Printf("[WARN] Cannot parse OCSP response from %s: %v", server, err)
+		return errUndetermined
+	}
+	switch ocspResp.Status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return fmt.Errorf("certificate with serial %s was revoked at %s (OCSP)", cert.SerialNumber, ocspResp.RevokedAt)
+	default:
+		return errUndetermined
+	}
+}
+
+// VerifyPeerCertificate is called by crypto/tls during the handshake. Returning
+// an error fails the handshake
+func (rc *revocationChecker) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return nil // no client certificate; whether that is acceptable is up to the client auth strategy
+	}
+	var cert, issuer *x509.Certificate
+	if len(verifiedChains) > 0 && len(verifiedChains[0]) > 0 {
+		cert = verifiedChains[0][0]
+		if len(verifiedChains[0]) > 1 {
+			issuer = verifiedChains[0][1]
+		}
+	} else {
+		var err error
+		if cert, err = x509.ParseCertificate(rawCerts[0]); err != nil {
+			return err
+		}
+	}
+
+	checks := []func() error{}
+	if rc.crlFile != "" {
+		checks = append(checks, func() error { return rc.checkCrl(cert) })
+	}
+	if rc.ocspServer != "" {
+		checks = append(checks, func() error { return rc.checkOcsp(cert, issuer) })
+	}
+	for _, check := range checks {
+		if err := check(); err != nil {
+			if err == errUndetermined && rc.failOpen {
+				continue
+			}
+			rc.logger.Printf("[INFO] Rejecting client certificate: %v", err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package nbd
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/net/context"
+	"io"
+)
+
+// selfTestLength is the (maximum) length of the scratch region used by SelfTest
+const selfTestLength = 4096
+
+// selfTest holds the state of a self-test of one export
+type selfTest struct {
+	out    io.Writer // where results are reported
+	failed bool      // true if any operation has failed
+}
+
+// report reports the result of one operation
+func (st *selfTest) report(op string, err error, format string, args ...interface{}) bool {
+	if err != nil {
+		st.failed = true
+		fmt.Fprintf(st.out, "FAIL %-10s %v\n", op, err)
+		return false
+	}
+	fmt.Fprintf(st.out, "PASS %-10s %s\n", op, fmt.Sprintf(format, args...))
+	return true
+}
+
+// skip reports an operation that was not attempted
+func (st *selfTest) skip(op string, reason string) {
+	fmt.Fprintf(st.out, "SKIP %-10s %s\n", op, reason)
+}
+
+// SelfTestExport looks up the named export in the configuration file and runs
+// SelfTest against it. It returns true if every operation passed
+func SelfTestExport(out io.Writer, name string) bool {
+	c, err := ParseConfig()
+	if err != nil {
+		fmt.Fprintf(out, "Cannot parse configuration file: %v\n", err)
+		return false
+	}
+	for _, s := range c.Servers {
+		for _, e := range s.Exports {
+			if e.Name == name {
+				return SelfTest(context.Background(), out, &e)
+			}
+		}
+	}
+	fmt.Fprintf(out, "No such export %s\n", name)
+	return false
+}
+
+// SelfTest opens the backend of an export and checks each operation works,
+// reporting pass or fail for each to out. It returns true if every operation passed.
+//
+// For writable exports a scratch region is written, trimmed and then restored
+// to its original contents, so it is safe to run against an export holding live
+// data provided no client is writing to the same region at the same time
+func SelfTest(ctx context.Context, out io.Writer, ec *ExportConfig) bool {
+	st := &selfTest{out: out}
+
+	backend, err := openBackend(ctx, ec)
+	if !st.report("open", err, "driver %s", ec.Driver) {
+		return false
+	}
+	defer backend.Close(ctx)
+
+	size, minimumBlockSize, preferredBlockSize, maximumBlockSize, err := backend.Geometry(ctx)
+	if !st.report("geometry", err, "size %d, block sizes %d/%d/%d", size, minimumBlockSize, preferredBlockSize, maximumBlockSize) {
+		return false
+	}
+	if ec.MinimumBlockSize != 0 {
+		minimumBlockSize = ec.MinimumBlockSize
+	}
+	if minimumBlockSize == 0 {
+		minimumBlockSize = 1
+	}
+	minimumBlockSize = roundUpToNextPowerOfTwo(minimumBlockSize)
+
+	// use a scratch region in the last few blocks of the export, aligned to the minimum block size
+	length := uint64(selfTestLength)
+	if length < minimumBlockSize {
+		length = minimumBlockSize
+	}
+	if length > size {
+		length = size & ^(minimumBlockSize - 1)
+	}
+	if length == 0 {
+		st.report("read", fmt.Errorf("export too small to test (%d bytes)", size), "")
+		return false
+	}
+	offset := (size - length) & ^(minimumBlockSize - 1)
+
+	original := make([]byte, length)
+	if !st.report("read", selfTestRead(ctx, backend, original, offset), "%d bytes at offset %d", length, offset) {
+		return false
+	}
+
+	if ec.ReadOnly {
+		st.skip("write", "export is read-only")
+		st.skip("trim", "export is read-only")
+		st.skip("flush", "export is read-only")
+		return !st.failed
+	}
+
+	pattern := make([]byte, length)
+	for i := range pattern {
+		pattern[i] = byte(i) ^ 0xa5
+	}
+	// if the pattern happens to match what is there, the verify would prove nothing
+	if bytes.Equal(pattern, original) {
+		for i := range pattern {
+			pattern[i] = ^pattern[i]
+		}
+	}
+	err = selfTestWrite(ctx, backend, pattern, offset)
+	if err == nil {
+		check := make([]byte, length)
+		if err = selfTestRead(ctx, backend, check, offset); err == nil && !bytes.Equal(check, pattern) {
+			err = fmt.Errorf("data read back at offset %d does not match data written", offset)
+		}
+	}
+	st.report("write", err, "%d bytes at offset %d written and verified", length, offset)
+
+	_, err = backend.TrimAt(ctx, int(length), int64(offset))
+	st.report("trim", err, "%d bytes at offset %d", length, offset)
+
+	// always attempt to put the original data back, whatever failed above
+	err = selfTestWrite(ctx, backend, original, offset)
+	if err == nil {
+		check := make([]byte, length)
+		if err = selfTestRead(ctx, backend, check, offset); err == nil && !bytes.Equal(check, original) {
+			err = fmt.Errorf("original data at offset %d could not be restored", offset)
+		}
+	}
+	st.report("restore", err, "%d bytes at offset %d restored and verified", length, offset)
+
+	if backend.HasFlush(ctx) {
+		st.report("flush", backend.Flush(ctx), "completed")
+	} else {
+		st.skip("flush", "driver does not support flush")
+	}
+	return !st.failed
+}
+
+// selfTestRead reads all of b at offset
+func selfTestRead(ctx context.Context, backend Backend, b []byte, offset uint64) error {
+	n, err := backend.ReadAt(ctx, b, int64(offset))
+	if err == nil && n != len(b) {
+		err = fmt.Errorf("short read (%d of %d bytes)", n, len(b))
+	}
+	return err
+}
+
+// selfTestWrite writes all of b at offset
+func selfTestWrite(ctx context.Context, backend Backend, b []byte, offset uint64) error {
+	n, err := backend.WriteAt(ctx, b, int64(offset), false)
+	if err == nil && n != len(b) {
+		err = fmt.Errorf("short write (%d of %d bytes)", n, len(b))
+	}
+	return err
+}
@@ -0,0 +1,174 @@
+package nbd
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"sync"
+	"time"
+)
+
+// sharedBackendEntry is a backend shared between the connections to an export
+type sharedBackendEntry struct {
+	key     string        // identifies the export configuration the backend was opened with
+	backend Backend       // the backend, once open
+	err     error         // why the backend could not be opened
+	opened  chan struct{} // closed once the backend is open, or failed to open
+	refs    int           // number of connections using the backend
+	grace   time.Duration // how long to keep the backend open once unused
+	timer   *time.Timer   // closes the backend once the grace period expires
+}
+
+// Backends shared between connections, by key and by backend
+var (
+	sharedBackends       = make(map[string]*sharedBackendEntry)
+	sharedBackendsByImpl = make(map[Backend]*sharedBackendEntry)
+	sharedBackendsMutex  sync.Mutex
+)
+
+// sharedBackendKey returns a key identifying an export configuration, so a
+// backend is only reused for an identical configuration (e.g. not across a
+// reload that changed the export's parameters)
+func sharedBackendKey(ec *ExportConfig) string {
+	return fmt.Sprintf("%v", *ec)
+}
+
+// reconnectGrace returns the reconnect grace period configured for an export, or zero if none
+func reconnectGrace(ec *ExportConfig) (time.Duration, error) {
+	graceParam := ec.DriverParameters["reconnectgrace"]
+	if graceParam == "" {
+		return 0, nil
+	}
+	grace, err := time.ParseDuration(graceParam)
+	if err != nil || grace < 0 {
+		return 0, fmt.Errorf("Bad reconnect grace period '%s'", graceParam)
+	}
+	return grace, nil
+}
+
+// exportMultiConn parses an export's multiconn parameter, returning whether
+// NBD_FLAG_CAN_MULTI_CONN is forced on or off. Forcing it on shares the
+// backend between connections
+func exportMultiConn(ec *ExportConfig) (bool, bool, error) {
+	on, off, err := isTrueFalse(ec.DriverParameters["multiconn"])
+	if err != nil {
+		return false, false, fmt.Errorf("Bad multiconn '%s'", ec.DriverParameters["multiconn"])
+	}
+	return on, off, nil
+}
+
+// isSharedBackend returns true if a backend from acquireBackend is shared
+// between connections
+func isSharedBackend(backend Backend) bool {
+	sharedBackendsMutex.Lock()
+	defer sharedBackendsMutex.Unlock()
+	_, ok := sharedBackendsByImpl[backend]
+	return ok
+}
+
+// acquireBackend opens the backend for a connection to an export.
+//
+// If the export sets multiconn, the backend is shared between connections to
+// the export, so that each sees the writes completed on the others, and a
+// flush on any makes them all durable, whatever the driver. It is closed once
+// the last of them closes it.
+//
+// If the export sets reconnectgrace, the backend is likewise shared, and is
+// kept open for the grace period after the last connection closes it. A client that drops its connection (e.g. on a transient network
+// failure) and reconnects within that period reuses the open backend rather
+// than waiting for it to be opened again. Note this is not session resume,
+// which NBD does not have: commands in flight on the dropped connection are
+// lost, and the client must resend them.
+//
+// The backend is opened without holding the lock on the shared backends, so
+// that a slow open does not hold up connections to other exports. Connections
+// to the export arriving meanwhile wait for the open, and share its result.
+//
+// Backends acquired this way must be released with releaseBackend
+func acquireBackend(ctx context.Context, ec *ExportConfig) (Backend, error) {
+	grace, err := reconnectGrace(ec)
+	if err != nil {
+		return nil, err
+	}
+	multiConn, _, err := exportMultiConn(ec)
+	if err != nil {
+		return nil, err
+	}
+	if grace == 0 && !multiConn {
+		return openBackend(ctx, ec)
+	}
+
+	key := sharedBackendKey(ec)
+	sharedBackendsMutex.Lock()
+	if e, ok := sharedBackends[key]; ok {
+		if e.timer != nil {
+			e.timer.Stop()
+			e.timer = nil
+		}
+		e.refs++
+		sharedBackendsMutex.Unlock()
+		<-e.opened
+		if e.err != nil {
+			return nil, e.err
+		}
+		return e.backend, nil
+	}
+	e := &sharedBackendEntry{
+		key:    key,
+		opened: make(chan struct{}),
+		refs:   1,
+		grace:  grace,
+	}
+	sharedBackends[key] = e
+	sharedBackendsMutex.Unlock()
+
+	backend, err := openBackend(ctx, ec)
+	sharedBackendsMutex.Lock()
+	defer sharedBackendsMutex.Unlock()
+	defer close(e.opened)
+	if err != nil {
+		// so the next connection tries again
+		delete(sharedBackends, key)
+		e.err = err
+		return nil, err
+	}
+	e.backend = backend
+	sharedBackendsByImpl[backend] = e
+	return backend, nil
+}
+
+// releaseBackend releases a backend obtained from acquireBackend. Shared
+// backends are closed once no connection has used them for the grace period;
+// others are closed immediately
+//
+// As with opening, backends are closed without holding the lock on the shared
+// backends, so that a slow close does not hold up connections to other exports
+func releaseBackend(ctx context.Context, backend Backend) error {
+	sharedBackendsMutex.Lock()
+	e, ok := sharedBackendsByImpl[backend]
+	if !ok {
+		sharedBackendsMutex.Unlock()
+		return backend.Close(ctx)
+	}
+	defer sharedBackendsMutex.Unlock()
+	e.refs--
+	if e.refs > 0 {
+		return nil
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(e.grace, func() {
+		sharedBackendsMutex.Lock()
+		// the backend may have been reacquired (and perhaps released
+		// again) after the timer fired but before we got the lock
+		if e.timer != timer || e.refs > 0 {
+			sharedBackendsMutex.Unlock()
+			return
+		}
+		// once removed, nothing else can reacquire the backend
+		delete(sharedBackends, e.key)
+		delete(sharedBackendsByImpl, e.backend)
+		sharedBackendsMutex.Unlock()
+		e.backend.Close(context.Background())
+	})
+	e.timer = timer
+	return nil
+}
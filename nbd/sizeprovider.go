@@ -0,0 +1,125 @@
+package nbd
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"sync"
+	"time"
+)
+
+// SizeProvider reports the current size of an export whose size depends on
+// state outside the server, such as a thin volume that grows, so that the
+// export reflects it without being reconfigured
+type SizeProvider interface {
+	// Size returns the current size in bytes of the export configured by ec
+	Size(ctx context.Context, ec *ExportConfig) (uint64, error)
+}
+
+// SizeProviderMap holds the size providers registered, by name
+var SizeProviderMap = make(map[string]SizeProvider)
+
+// RegisterSizeProvider registers a size provider, which exports may then name
+// in their sizeprovider parameter
+func RegisterSizeProvider(name string, provider SizeProvider) {
+	SizeProviderMap[name] = provider
+}
+
+// cachedSize is a size reported by a provider, cached until it expires
+type cachedSize struct {
+	size    uint64
+	expires time.Time
+}
+
+// Sizes reported by providers, by export name. Each connection opens its own
+// backend, so the cache is kept here, for the TTL to spare the provider a query
+// per negotiation
+var (
+	cachedSizes      = make(map[string]cachedSize)
+	cachedSizesMutex sync.Mutex
+)
+
+// SizeProviderBackend implements Backend
+//
+// It takes the size reported by its Geometry from a SizeProvider rather than
+// from the backend it wraps, querying the provider each time (so each time a
+// client negotiates), unless a size it reported within the TTL is cached. The
+// backend must be able to serve whatever size the provider reports
+type SizeProviderBackend struct {
+	Backend
+	ec       *ExportConfig // the export's configuration, passed to the provider
+	provider SizeProvider  // reports the size
+	ttl      time.Duration // how long the size reported is cached, or 0 not to cache it
+}
+
+// sizeProviderCacherBackend is a SizeProviderBackend wrapping a backend that is also a Cacher
+type sizeProviderCacherBackend struct {
+	*SizeProviderBackend
+}
+
+// Geometry implements Backend.Geometry
+func (sb *SizeProviderBackend) Geometry(ctx context.Context) (uint64, uint64, uint64, uint64, error) {
+	_, minimumBlockSize, preferredBlockSize, maximumBlockSize, err := sb.Backend.Geometry(ctx)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	size, err := sb.size(ctx)
+	return size, minimumBlockSize, preferredBlockSize, maximumBlockSize, err
+}
+
+// size returns the size reported by the provider, from the cache if it is current
+func (sb *SizeProviderBackend) size(ctx context.Context) (uint64, error) {
+	cachedSizesMutex.Lock()
+	defer cachedSizesMutex.Unlock()
+	now := time.Now()
+	if cs, ok := cachedSizes[sb.ec.Name]; ok && now.Before(cs.expires) {
+		return cs.size, nil
+	}
+	size, err := sb.provider.Size(ctx, sb.ec)
+	if err != nil {
+		return 0, fmt.Errorf("Cannot get size of export %s: %v", sb.ec.Name, err)
+	}
+	if sb.ttl > 0 {
+		cachedSizes[sb.ec.Name] = cachedSize{size: size, expires: now.Add(sb.ttl)}
+	}
+	return size, nil
+}
+
+// IOHints implements IOHinter.IOHints
+func (sb *SizeProviderBackend) IOHints(ctx context.Context) IOHints {
+	return backendIOHints(ctx, sb.Backend)
+}
+
+// Cache implements Cacher.Cache
+func (scb *sizeProviderCacherBackend) Cache(ctx context.Context, length int, offset int64) (int, error) {
+	return scb.Backend.(Cacher).Cache(ctx, length, offset)
+}
+
+// newSizeProviderBackend wraps a backend in a SizeProviderBackend if the export
+// configures a sizeprovider, caching the size it reports for sizettl
+func newSizeProviderBackend(ctx context.Context, ec *ExportConfig, backend Backend) (Backend, error) {
+	name := ec.DriverParameters["sizeprovider"]
+	if name == "" {
+		return backend, nil
+	}
+	provider, ok := SizeProviderMap[name]
+	if !ok {
+		return nil, fmt.Errorf("No such size provider %s", name)
+	}
+	ttl := time.Duration(0)
+	if ttlParam := ec.DriverParameters["sizettl"]; ttlParam != "" {
+		var err error
+		if ttl, err = time.ParseDuration(ttlParam); err != nil || ttl < 0 {
+			return nil, fmt.Errorf("Bad size TTL '%s'", ttlParam)
+		}
+	}
+	sb := &SizeProviderBackend{
+		Backend:  backend,
+		ec:       ec,
+		provider: provider,
+		ttl:      ttl,
+	}
+	if _, isCacher := backend.(Cacher); isCacher {
+		return &sizeProviderCacherBackend{sb}, nil
+	}
+	return sb, nil
+}
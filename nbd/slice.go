@@ -0,0 +1,89 @@
+package nbd
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"strconv"
+)
+
+// SliceBackend implements Backend
+//
+// It serves a slice of another backend, of a given size from a given offset
+// into it, e.g. one partition of a disk image
+type SliceBackend struct {
+	Backend
+	offset int64  // offset of the slice within the backend
+	size   uint64 // size of the slice
+}
+
+// sliceCacherBackend is a SliceBackend wrapping a backend that is also a Cacher
+type sliceCacherBackend struct {
+	*SliceBackend
+}
+
+// WriteAt implements Backend.WriteAt
+func (sb *SliceBackend) WriteAt(ctx context.Context, b []byte, offset int64, fua bool) (int, error) {
+	return sb.Backend.WriteAt(ctx, b, sb.offset+offset, fua)
+}
+
+// ReadAt implements Backend.ReadAt
+func (sb *SliceBackend) ReadAt(ctx context.Context, b []byte, offset int64) (int, error) {
+	return sb.Backend.ReadAt(ctx, b, sb.offset+offset)
+}
+
+// TrimAt implements Backend.TrimAt
+func (sb *SliceBackend) TrimAt(ctx context.Context, length int, offset int64) (int, error) {
+	return sb.Backend.TrimAt(ctx, length, sb.offset+offset)
+}
+
+// Geometry implements Backend.Geometry
+func (sb *SliceBackend) Geometry(ctx context.Context) (uint64, uint64, uint64, uint64, error) {
+	_, minimumBlockSize, preferredBlockSize, maximumBlockSize, err := sb.Backend.Geometry(ctx)
+	return sb.size, minimumBlockSize, preferredBlockSize, maximumBlockSize, err
+}
+
+// IOHints implements IOHinter.IOHints
+func (sb *SliceBackend) IOHints(ctx context.Context) IOHints {
+	return backendIOHints(ctx, sb.Backend)
+}
+
+// Cache implements Cacher.Cache
+func (scb *sliceCacherBackend) Cache(ctx context.Context, length int, offset int64) (int, error) {
+	return scb.Backend.(Cacher).Cache(ctx, length, scb.offset+offset)
+}
+
+// newSliceBackend wraps a backend in a SliceBackend if the export configures
+// sliceoffset or slicesize. The slice runs from sliceoffset (by default the
+// start) for slicesize bytes (by default to the end), and must lie within the
+// backend
+func newSliceBackend(ctx context.Context, ec *ExportConfig, backend Backend) (Backend, error) {
+	offsetParam, sizeParam := ec.DriverParameters["sliceoffset"], ec.DriverParameters["slicesize"]
+	if offsetParam == "" && sizeParam == "" {
+		return backend, nil
+	}
+	size, _, _, _, err := backend.Geometry(ctx)
+	if err != nil {
+		return nil, err
+	}
+	offset := uint64(0)
+	if offsetParam != "" {
+		if offset, err = strconv.ParseUint(offsetParam, 10, 63); err != nil || offset > size {
+			return nil, fmt.Errorf("Bad slice offset '%s'", offsetParam)
+		}
+	}
+	sliceSize := size - offset
+	if sizeParam != "" {
+		if sliceSize, err = strconv.ParseUint(sizeParam, 10, 64); err != nil || sliceSize > size-offset {
+			return nil, fmt.Errorf("Bad slice size '%s' (the backend has %d bytes from the slice offset)", sizeParam, size-offset)
+		}
+	}
+	sb := &SliceBackend{
+		Backend: backend,
+		offset:  int64(offset),
+		size:    sliceSize,
+	}
+	if _, isCacher := backend.(Cacher); isCacher {
+		return &sliceCacherBackend{sb}, nil
+	}
+	return sb, nil
+}
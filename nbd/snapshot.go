@@ -0,0 +1,152 @@
+package nbd
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// How long to wait for the device node of a ZFS volume snapshot to appear
+var SnapshotDeviceTimeout = 10 * time.Second
+
+// the number of snapshots taken by this process, used to generate unique names
+var snapshotCounter uint64
+
+// SnapshotBackend implements Backend
+//
+// It takes a read-only filesystem-native snapshot (ZFS or BTRFS) when the
+// export is connected, and serves a file (or, for a ZFS volume, the block
+// device) within that snapshot. Each connection gets its own snapshot, so each
+// client sees a consistent view whilst the live dataset keeps changing. The
+// snapshot is destroyed when the connection closes
+type SnapshotBackend struct {
+	*FileBackend
+	snapshot string   // the name of the snapshot, for logging and cleanup
+	destroy  []string // command to destroy the snapshot
+}
+
+// Close implements Backend.Close
+func (sb *SnapshotBackend) Close(ctx context.Context) error {
+	err := sb.FileBackend.Close(ctx)
+	if derr := runSnapshotCommand(sb.destroy...); derr != nil && err == nil {
+		err = fmt.Errorf("Cannot destroy snapshot %s: %v", sb.snapshot, derr)
+	}
+	return err
+}
+
+// HasFua implements Backend.HasFua
+func (sb *SnapshotBackend) HasFua(ctx context.Context) bool {
+	return false
+}
+
+// HasFlush implements Backend.HasFlush
+func (sb *SnapshotBackend) HasFlush(ctx context.Context) bool {
+	return false
+}
+
+// runSnapshotCommand runs a filesystem tool, returning its output in any error
+func runSnapshotCommand(args ...string) error {
+	if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// snapshotOutput runs a filesystem tool and returns its output
+func snapshotOutput(args ...string) (string, error) {
+	out, err := exec.Command(args[0], args[1:]...).Output()
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %v", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Generate a new snapshot backend
+func NewSnapshotBackend(ctx context.Context, ec *ExportConfig) (Backend, error) {
+	if !ec.ReadOnly {
+		return nil, errors.New("Snapshot exports must be read-only")
+	}
+	file := ec.DriverParameters["file"]
+	name := fmt.Sprintf("gonbdserver-%d-%d", os.Getpid(), atomic.AddUint64(&snapshotCounter, 1))
+
+	var snapshot, path string
+	var destroy []string
+	switch fsType := ec.DriverParameters["fstype"]; fsType {
+	case "zfs":
+		dataset := ec.DriverParameters["dataset"]
+		if dataset == "" {
+			return nil, errors.New("ZFS snapshot exports need a dataset")
+		}
+		snapshot = dataset + "@" + name
+		if file == "" {
+			// a volume; the snapshot appears as a device, provided snapdev=visible
+			path = filepath.Join("/dev/zvol", snapshot)
+		} else {
+			mountpoint, err := snapshotOutput("zfs", "get", "-H", "-o", "value", "mountpoint", dataset)
+			if err != nil {
+				return nil, err
+			}
+			path = filepath.Join(mountpoint, ".zfs", "snapshot", name, file)
+		}
+		if err := runSnapshotCommand("zfs", "snapshot", snapshot); err != nil {
+			return nil, err
+		}
+		destroy = []string{"zfs", "destroy", snapshot}
+	case "btrfs":
+		subvolume := ec.DriverParameters["subvolume"]
+		if subvolume == "" || file == "" {
+			return nil, errors.New("BTRFS snapshot exports need a subvolume and a file")
+		}
+		snapshotDir := ec.DriverParameters["snapshotdir"]
+		if snapshotDir == "" {
+			snapshotDir = filepath.Dir(filepath.Clean(subvolume))
+		}
+		snapshot = filepath.Join(snapshotDir, name)
+		path = filepath.Join(snapshot, file)
+		if err := runSnapshotCommand("btrfs", "subvolume", "snapshot", "-r", subvolume, snapshot); err != nil {
+			return nil, err
+		}
+		destroy = []string{"btrfs", "subvolume", "delete", snapshot}
+	default:
+		return nil, fmt.Errorf("Unknown snapshot filesystem type '%s'", fsType)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDONLY, 0)
+	for deadline := time.Now().Add(SnapshotDeviceTimeout); os.IsNotExist(err) && file == "" && time.Now().Before(deadline); {
+		// device nodes for volume snapshots are created asynchronously
+		time.Sleep(100 * time.Millisecond)
+		f, err = os.OpenFile(path, os.O_RDONLY, 0)
+	}
+	if err != nil {
+		runSnapshotCommand(destroy...)
+		return nil, err
+	}
+	// the size of a block device is not reported by stat, so seek to the end
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		runSnapshotCommand(destroy...)
+		return nil, err
+	}
+	return &SnapshotBackend{
+		FileBackend: &FileBackend{
+			file:     f,
+			readFile: f,
+			size:     uint64(size),
+		},
+		snapshot: snapshot,
+		destroy:  destroy,
+	}, nil
+}
+
+// Register our backend
+func init() {
+	RegisterBackend("snapshot", NewSnapshotBackend)
+}
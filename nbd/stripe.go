@@ -0,0 +1,248 @@
+package nbd
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default size of the chunks an NbdStripeBackend stripes across its upstreams
+const DefaultStripeChunkSize = 64 * 1024
+
+// stripeSegment is the part of a command falling within one stripe member
+type stripeSegment struct {
+	member int   // the member
+	offset int64 // offset within the member
+	start  int   // start of the segment within the command's range
+	end    int   // end of the segment within the command's range
+}
+
+// NbdStripeBackend implements Backend
+//
+// It stripes an export across several upstream NBD servers, in chunks of a
+// fixed size, aggregating their bandwidth and capacity. Each member of the
+// stripe may be a set of replicas, in which case writes go to every replica,
+// and reads are served by the first replica able to serve them. Commands are
+// split into per-member segments which are dispatched concurrently
+type NbdStripeBackend struct {
+	members    [][]*NbdProxyBackend // the replicas making up each stripe member
+	chunkSize  uint64               // size of each stripe chunk
+	memberSize uint64               // size of each member
+}
+
+// segments splits a range into the segments falling within each member
+func (sb *NbdStripeBackend) segments(offset int64, length int) []stripeSegment {
+	var segs []stripeSegment
+	n := uint64(len(sb.members))
+	for pos := 0; pos < length; {
+		addr := uint64(offset) + uint64(pos)
+		chunk := addr / sb.chunkSize
+		within := addr % sb.chunkSize
+		end := pos + int(sb.chunkSize-within)
+		if end > length {
+			end = length
+		}
+		segs = append(segs, stripeSegment{
+			member: int(chunk % n),
+			offset: int64((chunk/n)*sb.chunkSize + within),
+			start:  pos,
+			end:    end,
+		})
+		pos = end
+	}
+	return segs
+}
+
+// parallel runs f for each of n items concurrently, returning the first error
+func parallel(n int, f func(i int) error) error {
+	if n == 1 {
+		return f(0)
+	}
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = f(i)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteAt implements Backend.WriteAt
+func (sb *NbdStripeBackend) WriteAt(ctx context.Context, b []byte, offset int64, fua bool) (int, error) {
+	segs := sb.segments(offset, len(b))
+	err := parallel(len(segs), func(i int) error {
+		seg := segs[i]
+		replicas := sb.members[seg.member]
+		return parallel(len(replicas), func(r int) error {
+			_, err := replicas[r].WriteAt(ctx, b[seg.start:seg.end], seg.offset, fua)
+			return err
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadAt implements Backend.ReadAt
+func (sb *NbdStripeBackend) ReadAt(ctx context.Context, b []byte, offset int64) (int, error) {
+	segs := sb.segments(offset, len(b))
+	err := parallel(len(segs), func(i int) error {
+		seg := segs[i]
+		var err error
+		for _, replica := range sb.members[seg.member] {
+			if _, err = replica.ReadAt(ctx, b[seg.start:seg.end], seg.offset); err == nil {
+				return nil
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// TrimAt implements Backend.TrimAt
+func (sb *NbdStripeBackend) TrimAt(ctx context.Context, length int, offset int64) (int, error) {
+	segs := sb.segments(offset, length)
+	err := parallel(len(segs), func(i int) error {
+		seg := segs[i]
+		replicas := sb.members[seg.member]
+		return parallel(len(replicas), func(r int) error {
+			_, err := replicas[r].TrimAt(ctx, seg.end-seg.start, seg.offset)
+			return err
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return length, nil
+}
+
+// upstreams returns every upstream backend
+func (sb *NbdStripeBackend) upstreams() []*NbdProxyBackend {
+	var upstreams []*NbdProxyBackend
+	for _, replicas := range sb.members {
+		upstreams = append(upstreams, replicas...)
+	}
+	return upstreams
+}
+
+// Flush implements Backend.Flush
+func (sb *NbdStripeBackend) Flush(ctx context.Context) error {
+	upstreams := sb.upstreams()
+	return parallel(len(upstreams), func(i int) error {
+		return upstreams[i].Flush(ctx)
+	})
+}
+
+// Close implements Backend.Close
+func (sb *NbdStripeBackend) Close(ctx context.Context) error {
+	var err error
+	for _, u := range sb.upstreams() {
+		if cerr := u.Close(ctx); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Geometry implements Backend.Geometry
+func (sb *NbdStripeBackend) Geometry(ctx context.Context) (uint64, uint64, uint64, uint64, error) {
+	return sb.memberSize * uint64(len(sb.members)), 1, 4096, 32 * 1024 * 1024, nil
+}
+
+// HasFua implements Backend.HasFua
+func (sb *NbdStripeBackend) HasFua(ctx context.Context) bool {
+	for _, u := range sb.upstreams() {
+		if !u.HasFua(ctx) {
+			return false
+		}
+	}
+	return true
+}
+
+// HasFlush implements Backend.HasFlush
+func (sb *NbdStripeBackend) HasFlush(ctx context.Context) bool {
+	for _, u := range sb.upstreams() {
+		if !u.HasFlush(ctx) {
+			return false
+		}
+	}
+	return true
+}
+
+// IOHints implements IOHinter.IOHints
+//
+// I/O of a whole stripe, across every member, is dispatched to all of them at once
+func (sb *NbdStripeBackend) IOHints(ctx context.Context) IOHints {
+	width := sb.chunkSize * uint64(len(sb.members))
+	return IOHints{ReadSize: width, WriteSize: width, Alignment: width}
+}
+
+// Generate a new NBD stripe backend
+func NewNbdStripeBackend(ctx context.Context, ec *ExportConfig) (Backend, error) {
+	if ec.DriverParameters["urls"] == "" {
+		return nil, errors.New("NBD stripe exports need upstream URLs")
+	}
+	urls := strings.Split(ec.DriverParameters["urls"], ",")
+	chunkSize := uint64(DefaultStripeChunkSize)
+	if cs := ec.DriverParameters["stripechunk"]; cs != "" {
+		var err error
+		if chunkSize, err = strconv.ParseUint(cs, 10, 64); err != nil || chunkSize < 512 || chunkSize&(chunkSize-1) != 0 {
+			return nil, fmt.Errorf("Bad stripe chunk size '%s'", cs)
+		}
+	}
+	replicas := 1
+	if r := ec.DriverParameters["replicas"]; r != "" {
+		var err error
+		if replicas, err = strconv.Atoi(r); err != nil || replicas < 1 || len(urls)%replicas != 0 {
+			return nil, fmt.Errorf("Bad number of replicas '%s' for %d upstreams", r, len(urls))
+		}
+	}
+
+	sb := &NbdStripeBackend{
+		chunkSize: chunkSize,
+	}
+	for i, u := range urls {
+		p, err := newNbdProxyBackend(strings.TrimSpace(u))
+		if err != nil {
+			sb.Close(ctx)
+			return nil, err
+		}
+		if i%replicas == 0 {
+			sb.members = append(sb.members, nil)
+		}
+		m := len(sb.members) - 1
+		sb.members[m] = append(sb.members[m], p)
+		if i == 0 {
+			sb.memberSize = p.size
+		} else if p.size != sb.memberSize {
+			sb.Close(ctx)
+			return nil, fmt.Errorf("Upstream %s has size %d, but %s has size %d", u, p.size, urls[0], sb.memberSize)
+		}
+	}
+	if sb.memberSize%chunkSize != 0 {
+		sb.Close(ctx)
+		return nil, fmt.Errorf("Upstream size %d is not a multiple of the stripe chunk size %d", sb.memberSize, chunkSize)
+	}
+	return sb, nil
+}
+
+// Register our backend
+func init() {
+	RegisterBackend("nbdstripe", NewNbdStripeBackend)
+}
@@ -0,0 +1,126 @@
+package nbd
+
+import (
+	"expvar"
+	"fmt"
+	"golang.org/x/net/context"
+	"sync/atomic"
+	"time"
+)
+
+// SyncIntervalBackend implements Backend
+//
+// It flushes the backend it wraps at a fixed interval, whether or not the
+// client flushes, so that a client which rarely flushes loses at most an
+// interval's worth of writes to a crash of a write-back backend. This is a
+// safety net, not a guarantee: clients needing durability must still flush.
+// An interval in which nothing has been written since the last flush (by the
+// client or in the background) is skipped
+type SyncIntervalBackend struct {
+	Backend
+	dirty int32         // nonzero if written since the last flush, accessed atomically
+	stop  chan struct{} // closed to stop the background flushes
+	done  chan struct{} // closed once the background flushes have stopped
+	stats *expvar.Map   // the export's counters
+}
+
+// syncIntervalCacherBackend is a SyncIntervalBackend wrapping a backend that is also a Cacher
+type syncIntervalCacherBackend struct {
+	*SyncIntervalBackend
+}
+
+// WriteAt implements Backend.WriteAt
+func (sb *SyncIntervalBackend) WriteAt(ctx context.Context, b []byte, offset int64, fua bool) (int, error) {
+	n, err := sb.Backend.WriteAt(ctx, b, offset, fua)
+	atomic.StoreInt32(&sb.dirty, 1)
+	return n, err
+}
+
+// TrimAt implements Backend.TrimAt
+func (sb *SyncIntervalBackend) TrimAt(ctx context.Context, length int, offset int64) (int, error) {
+	n, err := sb.Backend.TrimAt(ctx, length, offset)
+	atomic.StoreInt32(&sb.dirty, 1)
+	return n, err
+}
+
+// Flush implements Backend.Flush
+func (sb *SyncIntervalBackend) Flush(ctx context.Context) error {
+	atomic.StoreInt32(&sb.dirty, 0)
+	err := sb.Backend.Flush(ctx)
+	if err != nil {
+		atomic.StoreInt32(&sb.dirty, 1)
+	}
+	return err
+}
+
+// Close implements Backend.Close
+func (sb *SyncIntervalBackend) Close(ctx context.Context) error {
+	close(sb.stop)
+	<-sb.done
+	return sb.Backend.Close(ctx)
+}
+
+// IOHints implements IOHinter.IOHints
+func (sb *SyncIntervalBackend) IOHints(ctx context.Context) IOHints {
+	return backendIOHints(ctx, sb.Backend)
+}
+
+// Cache implements Cacher.Cache
+func (scb *syncIntervalCacherBackend) Cache(ctx context.Context, length int, offset int64) (int, error) {
+	return scb.Backend.(Cacher).Cache(ctx, length, offset)
+}
+
+// run flushes the backend every interval until stopped
+func (sb *SyncIntervalBackend) run(name string, interval time.Duration) {
+	defer close(sb.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sb.stop:
+			return
+		case <-ticker.C:
+			if atomic.SwapInt32(&sb.dirty, 0) == 0 {
+				continue
+			}
+			if err := sb.Backend.Flush(context.Background()); err != nil {
+				atomic.StoreInt32(&sb.dirty, 1)
+				sb.stats.Add("background_flush_errors", 1)
+				getBackendLogger().Printf("[WARN] Background flush of export %s failed: %v", name, err)
+				continue
+			}
+			sb.stats.Add("background_flushes", 1)
+			last := new(expvar.Int)
+			last.Set(time.Now().Unix())
+			sb.stats.Set("last_background_flush", last)
+		}
+	}
+}
+
+// newSyncIntervalBackend wraps a backend in a SyncIntervalBackend if the export
+// configures a syncinterval. Read-only exports, and backends that cannot flush,
+// have nothing to flush so are left unwrapped
+func newSyncIntervalBackend(ctx context.Context, ec *ExportConfig, backend Backend) (Backend, error) {
+	intervalParam := ec.DriverParameters["syncinterval"]
+	if intervalParam == "" {
+		return backend, nil
+	}
+	interval, err := time.ParseDuration(intervalParam)
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("Bad sync interval '%s'", intervalParam)
+	}
+	if ec.ReadOnly || !backend.HasFlush(ctx) {
+		return backend, nil
+	}
+	sb := &SyncIntervalBackend{
+		Backend: backend,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		stats:   exportExpvar(ec.Name),
+	}
+	go sb.run(ec.Name, interval)
+	if _, isCacher := backend.(Cacher); isCacher {
+		return &syncIntervalCacherBackend{sb}, nil
+	}
+	return sb, nil
+}
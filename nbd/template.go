@@ -0,0 +1,197 @@
+package nbd
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// diskTemplate is the layout of a disk served by the template driver, as read
+// from its template file
+type diskTemplate struct {
+	Size    uint64           // size of the disk in bytes
+	Regions []templateRegion // regions of the disk with content; the rest reads as zeroes
+}
+
+// templateRegion is a region of a disk template with static content, given by
+// exactly one of File, Hex, Text and Fill
+type templateRegion struct {
+	Offset uint64 // offset of the region within the disk
+	File   string // file holding the content, relative to the template file
+	Hex    string // the content in hexadecimal
+	Text   string // the content as text
+	Fill   *uint8 // a byte the region is filled with
+	Length uint64 // length of a region filled with Fill
+}
+
+// content returns the content of the region, reading any file relative to dir
+func (tr *templateRegion) content(dir string) ([]byte, error) {
+	given := 0
+	for _, set := range []bool{tr.File != "", tr.Hex != "", tr.Text != "", tr.Fill != nil} {
+		if set {
+			given++
+		}
+	}
+	if given != 1 {
+		return nil, errors.New("needs exactly one of file, hex, text and fill")
+	}
+	switch {
+	case tr.File != "":
+		path := tr.File
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		return ioutil.ReadFile(path)
+	case tr.Hex != "":
+		return hex.DecodeString(tr.Hex)
+	case tr.Text != "":
+		return []byte(tr.Text), nil
+	}
+	data := make([]byte, tr.Length)
+	for i := range data {
+		data[i] = *tr.Fill
+	}
+	return data, nil
+}
+
+// templateExtent is the content of a region of a TemplateBackend's disk
+type templateExtent struct {
+	offset int64
+	data   []byte
+}
+
+// TemplateBackend implements Backend
+//
+// It serves a virtual disk laid out by a template: regions of static content
+// (e.g. a partition table and a small filesystem image) at given offsets, with
+// the rest of the disk reading as zeroes. The content is held in memory, so
+// however large the disk, nothing is stored for the zeroes. The disk is
+// read-only; with ephemeraloverlay, writes go to an overlay instead, which
+// makes for a disposable bootable image without a real file behind it
+type TemplateBackend struct {
+	size    uint64
+	extents []templateExtent // the regions with content, in order of offset
+}
+
+// WriteAt implements Backend.WriteAt
+func (tb *TemplateBackend) WriteAt(ctx context.Context, b []byte, offset int64, fua bool) (int, error) {
+	return 0, syscall.EPERM
+}
+
+// ReadAt implements Backend.ReadAt
+func (tb *TemplateBackend) ReadAt(ctx context.Context, b []byte, offset int64) (int, error) {
+	end := offset + int64(len(b))
+	if offset < 0 || uint64(end) > tb.size {
+		return 0, syscall.EINVAL
+	}
+	for i := range b {
+		b[i] = 0
+	}
+	// the first extent ending after the read starts
+	i := sort.Search(len(tb.extents), func(i int) bool {
+		return tb.extents[i].offset+int64(len(tb.extents[i].data)) > offset
+	})
+	for ; i < len(tb.extents) && tb.extents[i].offset < end; i++ {
+		e := tb.extents[i]
+		if e.offset >= offset {
+			copy(b[e.offset-offset:], e.data)
+		} else {
+			copy(b, e.data[offset-e.offset:])
+		}
+	}
+	return len(b), nil
+}
+
+// TrimAt implements Backend.TrimAt
+func (tb *TemplateBackend) TrimAt(ctx context.Context, length int, offset int64) (int, error) {
+	return 0, syscall.EPERM
+}
+
+// Flush implements Backend.Flush
+func (tb *TemplateBackend) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Close implements Backend.Close
+func (tb *TemplateBackend) Close(ctx context.Context) error {
+	return nil
+}
+
+// Geometry implements Backend.Geometry
+func (tb *TemplateBackend) Geometry(ctx context.Context) (uint64, uint64, uint64, uint64, error) {
+	return tb.size, 1, 4096, 128 * 1024 * 1024, nil
+}
+
+// HasFua implements Backend.HasFua
+func (tb *TemplateBackend) HasFua(ctx context.Context) bool {
+	return false
+}
+
+// HasFlush implements Backend.HasFlush
+func (tb *TemplateBackend) HasFlush(ctx context.Context) bool {
+	return false
+}
+
+// loadDiskTemplate reads a disk template from the YAML file at path, returning
+// the disk's size and the content of its regions in order. Regions must lie
+// within the disk and not overlap
+func loadDiskTemplate(path string) (uint64, []templateExtent, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	var t diskTemplate
+	if err := yaml.Unmarshal(buf, &t); err != nil {
+		return 0, nil, fmt.Errorf("Cannot parse template %s: %v", path, err)
+	}
+	if t.Size == 0 || t.Size > 1<<63-1 {
+		return 0, nil, fmt.Errorf("Bad template size %d", t.Size)
+	}
+	extents := make([]templateExtent, 0, len(t.Regions))
+	for i := range t.Regions {
+		r := &t.Regions[i]
+		data, err := r.content(filepath.Dir(path))
+		if err != nil {
+			return 0, nil, fmt.Errorf("Bad template region %d: %v", i, err)
+		}
+		if r.Offset > t.Size || uint64(len(data)) > t.Size-r.Offset {
+			return 0, nil, fmt.Errorf("Template region %d (%d bytes at %d) lies beyond the end of the disk", i, len(data), r.Offset)
+		}
+		if len(data) > 0 {
+			extents = append(extents, templateExtent{offset: int64(r.Offset), data: data})
+		}
+	}
+	sort.Slice(extents, func(i, j int) bool { return extents[i].offset < extents[j].offset })
+	for i := 1; i < len(extents); i++ {
+		if prev := extents[i-1]; prev.offset+int64(len(prev.data)) > extents[i].offset {
+			return 0, nil, fmt.Errorf("Template regions at %d and %d overlap", prev.offset, extents[i].offset)
+		}
+	}
+	return t.Size, extents, nil
+}
+
+// Generate a new template backend
+func NewTemplateBackend(ctx context.Context, ec *ExportConfig) (Backend, error) {
+	if !ec.ReadOnly {
+		return nil, errors.New("Template exports must be read-only, or write to an ephemeral overlay")
+	}
+	size, extents, err := loadDiskTemplate(ec.DriverParameters["path"])
+	if err != nil {
+		return nil, err
+	}
+	return &TemplateBackend{
+		size:    size,
+		extents: extents,
+	}, nil
+}
+
+// Register our backend
+func init() {
+	RegisterBackend("template", NewTemplateBackend)
+}
@@ -0,0 +1,336 @@
+package nbd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/net/context"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Trace file format: the magic, followed by a record for each operation on
+// the backend, in the order they completed. Each record is a traceRecord (big
+// endian), followed for writes by the data written
+const traceMagic = "GNBDTRAC"
+
+// traceRecord records one operation on a backend
+type traceRecord struct {
+	Type     uint16 // NBD_CMD_READ, NBD_CMD_WRITE, NBD_CMD_TRIM, NBD_CMD_FLUSH or NBD_CMD_CACHE
+	Flags    uint16 // NBD_CMD_FLAG_FUA for writes so flagged
+	Offset   uint64 // offset of the operation
+	Length   uint32 // length of the operation
+	Result   uint32 // the NBD error the operation returned, or zero
+	Checksum uint32 // for a read which succeeded, the CRC32C of the data read
+}
+
+// Names of the operations in a trace, for reporting
+var traceOpNames = map[uint16]string{
+	NBD_CMD_READ:  "read",
+	NBD_CMD_WRITE: "write",
+	NBD_CMD_TRIM:  "trim",
+	NBD_CMD_FLUSH: "flush",
+	NBD_CMD_CACHE: "cache",
+}
+
+// traceFile is a trace being recorded. Every connection to an export records
+// into the same trace, so operations from concurrent connections are
+// interleaved, but each record is written whole
+type traceFile struct {
+	path   string     // absolute path of the trace
+	refs   int        // number of backends recording into the trace (protected by traceFilesMutex)
+	mutex  sync.Mutex // protects the following
+	file   *os.File   // the trace
+	broken bool       // true once a record could not be written
+}
+
+// Traces being recorded, by path
+var (
+	traceFiles      = make(map[string]*traceFile)
+	traceFilesMutex sync.Mutex
+)
+
+// record appends a record, followed by data, to the trace. A trace that
+// cannot be written is abandoned (with a warning) rather than failing I/O
+func (tf *traceFile) record(tr traceRecord, data []byte) {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, tr)
+	b.Write(data)
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	if tf.broken {
+		return
+	}
+	if _, err := tf.file.Write(b.Bytes()); err != nil {
+		tf.broken = true
+		getBackendLogger().Printf("[WARN] Abandoning trace %s: %v", tf.path, err)
+	}
+}
+
+// acquireTraceFile opens the trace at path for recording, creating it afresh
+// unless already being recorded. It must be released with releaseTraceFile
+func acquireTraceFile(path string) (*traceFile, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	traceFilesMutex.Lock()
+	defer traceFilesMutex.Unlock()
+	if tf, ok := traceFiles[path]; ok {
+		tf.refs++
+		return tf, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write([]byte(traceMagic)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	tf := &traceFile{path: path, refs: 1, file: file}
+	traceFiles[path] = tf
+	return tf, nil
+}
+
+// releaseTraceFile releases a trace acquired with acquireTraceFile, closing it once unused
+func releaseTraceFile(tf *traceFile) error {
+	traceFilesMutex.Lock()
+	defer traceFilesMutex.Unlock()
+	tf.refs--
+	if tf.refs > 0 {
+		return nil
+	}
+	delete(traceFiles, tf.path)
+	return tf.file.Close()
+}
+
+// nbdResult returns the NBD error for an error, or zero if there is none
+func nbdResult(err error) uint32 {
+	if err == nil {
+		return 0
+	}
+	return NbdError(err)
+}
+
+// TraceBackend implements Backend
+//
+// It records every operation on the backend it wraps, with the data of each
+// write and a checksum of the data of each read, into a trace file, so that
+// the operations can later be replayed (see ReplayTrace) to reproduce a
+// problem deterministically
+type TraceBackend struct {
+	Backend
+	trace *traceFile
+}
+
+// traceCacherBackend is a TraceBackend wrapping a backend that is also a Cacher
+type traceCacherBackend struct {
+	*TraceBackend
+}
+
+// WriteAt implements Backend.WriteAt
+func (tb *TraceBackend) WriteAt(ctx context.Context, b []byte, offset int64, fua bool) (int, error) {
+	n, err := tb.Backend.WriteAt(ctx, b, offset, fua)
+	tr := traceRecord{Type: NBD_CMD_WRITE, Offset: uint64(offset), Length: uint32(len(b)), Result: nbdResult(err)}
+	if fua {
+		tr.Flags = NBD_CMD_FLAG_FUA
+	}
+	tb.trace.record(tr, b)
+	return n, err
+}
+
+// ReadAt implements Backend.ReadAt
+func (tb *TraceBackend) ReadAt(ctx context.Context, b []byte, offset int64) (int, error) {
+	n, err := tb.Backend.ReadAt(ctx, b, offset)
+	tr := traceRecord{Type: NBD_CMD_READ, Offset: uint64(offset), Length: uint32(len(b)), Result: nbdResult(err)}
+	if err == nil {
+		tr.Checksum = crc32.Checksum(b[:n], crc32cTable)
+	}
+	tb.trace.record(tr, nil)
+	return n, err
+}
+
+// TrimAt implements Backend.TrimAt
+func (tb *TraceBackend) TrimAt(ctx context.Context, length int, offset int64) (int, error) {
+	n, err := tb.Backend.TrimAt(ctx, length, offset)
+	tb.trace.record(traceRecord{Type: NBD_CMD_TRIM, Offset: uint64(offset), Length: uint32(length), Result: nbdResult(err)}, nil)
+	return n, err
+}
+
+// Flush implements Backend.Flush
+func (tb *TraceBackend) Flush(ctx context.Context) error {
+	err := tb.Backend.Flush(ctx)
+	tb.trace.record(traceRecord{Type: NBD_CMD_FLUSH, Result: nbdResult(err)}, nil)
+	return err
+}
+
+// Close implements Backend.Close
+func (tb *TraceBackend) Close(ctx context.Context) error {
+	err := tb.Backend.Close(ctx)
+	if terr := releaseTraceFile(tb.trace); terr != nil && err == nil {
+		err = terr
+	}
+	return err
+}
+
+// IOHints implements IOHinter.IOHints
+func (tb *TraceBackend) IOHints(ctx context.Context) IOHints {
+	return backendIOHints(ctx, tb.Backend)
+}
+
+// Cache implements Cacher.Cache
+func (tcb *traceCacherBackend) Cache(ctx context.Context, length int, offset int64) (int, error) {
+	n, err := tcb.Backend.(Cacher).Cache(ctx, length, offset)
+	tcb.trace.record(traceRecord{Type: NBD_CMD_CACHE, Offset: uint64(offset), Length: uint32(length), Result: nbdResult(err)}, nil)
+	return n, err
+}
+
+// newTraceBackend wraps a backend in a TraceBackend if the export configures a tracefile
+func newTraceBackend(ctx context.Context, ec *ExportConfig, backend Backend) (Backend, error) {
+	path := ec.DriverParameters["tracefile"]
+	if path == "" {
+		return backend, nil
+	}
+	tf, err := acquireTraceFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open trace: %v", err)
+	}
+	tb := &TraceBackend{Backend: backend, trace: tf}
+	if _, isCacher := backend.(Cacher); isCacher {
+		return &traceCacherBackend{tb}, nil
+	}
+	return tb, nil
+}
+
+// readTraceRecord reads the next record of a trace, and the data of a write.
+// It returns io.EOF at the end of the trace
+func readTraceRecord(r io.Reader) (*traceRecord, []byte, error) {
+	var tr traceRecord
+	if err := binary.Read(r, binary.BigEndian, &tr); err == io.EOF {
+		return nil, nil, err
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("Truncated trace record: %v", err)
+	}
+	if _, ok := traceOpNames[tr.Type]; !ok {
+		return nil, nil, fmt.Errorf("Unknown operation %d in trace", tr.Type)
+	}
+	var data []byte
+	if tr.Type == NBD_CMD_WRITE {
+		data = make([]byte, tr.Length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, nil, fmt.Errorf("Truncated trace data: %v", err)
+		}
+	}
+	return &tr, data, nil
+}
+
+// replayTraceRecord performs a recorded operation on a backend, returning its
+// result and, for a read which succeeded, the checksum of the data read
+func replayTraceRecord(ctx context.Context, backend Backend, tr *traceRecord, data []byte) (uint32, uint32) {
+	var err error
+	var checksum uint32
+	switch tr.Type {
+	case NBD_CMD_READ:
+		b := make([]byte, tr.Length)
+		var n int
+		if n, err = backend.ReadAt(ctx, b, int64(tr.Offset)); err == nil {
+			checksum = crc32.Checksum(b[:n], crc32cTable)
+		}
+	case NBD_CMD_WRITE:
+		_, err = backend.WriteAt(ctx, data, int64(tr.Offset), tr.Flags&NBD_CMD_FLAG_FUA != 0)
+	case NBD_CMD_TRIM:
+		_, err = backend.TrimAt(ctx, int(tr.Length), int64(tr.Offset))
+	case NBD_CMD_FLUSH:
+		err = backend.Flush(ctx)
+	case NBD_CMD_CACHE:
+		if cacher, ok := backend.(Cacher); ok {
+			_, err = cacher.Cache(ctx, int(tr.Length), int64(tr.Offset))
+		}
+	}
+	return nbdResult(err), checksum
+}
+
+// ReplayTrace opens the backend of an export and replays a trace recorded with
+// tracefile against it, one operation at a time in the order recorded. Each
+// operation whose result differs from that recorded, or read which returns
+// different data, is reported to out as a mismatch. It returns true if the
+// whole trace replayed without a mismatch.
+//
+// Replaying writes modifies the export, so replay against a copy of the data
+// the trace was recorded against (for reads to match) which may be discarded
+func ReplayTrace(ctx context.Context, out io.Writer, path string, ec *ExportConfig) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(out, "Cannot open trace: %v\n", err)
+		return false
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(traceMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != traceMagic {
+		fmt.Fprintf(out, "%s is not a trace\n", path)
+		return false
+	}
+
+	// do not record the replay over the trace being replayed
+	rec := *ec
+	rec.DriverParameters = make(DriverParametersConfig)
+	for k, v := range ec.DriverParameters {
+		if k != "tracefile" {
+			rec.DriverParameters[k] = v
+		}
+	}
+	backend, err := openBackend(ctx, &rec)
+	if err != nil {
+		fmt.Fprintf(out, "Cannot open backend: %v\n", err)
+		return false
+	}
+	defer backend.Close(ctx)
+
+	operations, mismatches := 0, 0
+	for {
+		tr, data, err := readTraceRecord(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			fmt.Fprintf(out, "Stopping after %d operations: %v\n", operations, err)
+			mismatches++
+			break
+		}
+		result, checksum := replayTraceRecord(ctx, backend, tr, data)
+		if result != tr.Result {
+			fmt.Fprintf(out, "MISMATCH #%d %s of %d bytes at %d returned error %d, recorded %d\n", operations, traceOpNames[tr.Type], tr.Length, tr.Offset, result, tr.Result)
+			mismatches++
+		} else if checksum != tr.Checksum {
+			fmt.Fprintf(out, "MISMATCH #%d %s of %d bytes at %d returned different data\n", operations, traceOpNames[tr.Type], tr.Length, tr.Offset)
+			mismatches++
+		}
+		operations++
+	}
+	fmt.Fprintf(out, "Replayed %d operations with %d mismatches\n", operations, mismatches)
+	return mismatches == 0
+}
+
+// ReplayTraceExport looks up the named export in the configuration file and
+// runs ReplayTrace against it
+func ReplayTraceExport(out io.Writer, path string, name string) bool {
+	c, err := ParseConfig()
+	if err != nil {
+		fmt.Fprintf(out, "Cannot parse configuration file: %v\n", err)
+		return false
+	}
+	for _, s := range c.Servers {
+		for _, e := range s.Exports {
+			if e.Name == name {
+				return ReplayTrace(context.Background(), out, path, &e)
+			}
+		}
+	}
+	fmt.Fprintf(out, "No such export %s\n", name)
+	return false
+}
@@ -0,0 +1,98 @@
+package nbd
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errCommandTimeout is the error with which a command the backend has not
+// completed within the export's command timeout is failed, sent as NBD_EIO
+var errCommandTimeout = errors.New("Command timed out")
+
+// commandWatchdog fails a command if the backend does not complete it in time.
+//
+// Its timer and the dispatcher race to reply to the command, and whichever
+// claims the reply first sends it. If the timer wins, the client is sent an
+// error at once, so a stalled backend does not leave the client to hit its own
+// timeout; the dispatcher carries on waiting for the backend, then discards
+// the result.
+//
+// Until the timer is stopped or has finished replying, it is counted in the
+// connection's waitgroup, so the connection is not torn down beneath it
+type commandWatchdog struct {
+	timer   *time.Timer
+	wg      *sync.WaitGroup // the connection's waitgroup
+	claimed int32           // set once the reply has been claimed, accessed atomically
+}
+
+// commandTimeout returns the export's command timeout, or 0 if it has none
+func commandTimeout(ec *ExportConfig) (time.Duration, error) {
+	timeoutParam := ec.DriverParameters["commandtimeout"]
+	if timeoutParam == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(timeoutParam)
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("Bad command timeout '%s'", timeoutParam)
+	}
+	return timeout, nil
+}
+
+// isWatchedCommand returns true if a command is passed to the backend, so may be
+// failed by the watchdog
+func isWatchedCommand(cmd uint16) bool {
+	switch cmd {
+	case NBD_CMD_READ, NBD_CMD_WRITE, NBD_CMD_WRITE_ZEROES, NBD_CMD_FLUSH, NBD_CMD_TRIM, NBD_CMD_CACHE:
+		return true
+	}
+	return false
+}
+
+// startWatchdog starts the watchdog for a command, returning nil if the export
+// has no command timeout
+func (c *Connection) startWatchdog(ctx context.Context, req Request) *commandWatchdog {
+	if c.export.commandTimeout == 0 || !isWatchedCommand(req.nbdReq.NbdCommandType) {
+		return nil
+	}
+	w := &commandWatchdog{wg: &c.wg}
+	c.wg.Add(1)
+	w.timer = time.AfterFunc(c.export.commandTimeout, func() {
+		defer c.wg.Done()
+		if !atomic.CompareAndSwapInt32(&w.claimed, 0, 1) {
+			return
+		}
+		c.logger.Printf("[WARN] Client %s command %d of %d bytes at offset %d not complete after %s, failing it", c.name, req.nbdReq.NbdCommandType, req.length, req.offset, c.export.commandTimeout)
+		// the backend still holds the command's memory, so the reply
+		// must not; a read is sent zeroes from memory of its own
+		req.reqData = nil
+		req.repData = nil
+		req.nbdRep.NbdError = c.backendError(ctx, errCommandTimeout)
+		if req.flags&CMDT_REP_PAYLOAD != 0 {
+			if req.repData = c.GetMemory(ctx, req.length); req.repData == nil {
+				return
+			}
+			c.ZeroMemory(ctx, req.repData)
+		}
+		select {
+		case c.txCh <- req:
+		case <-ctx.Done():
+		}
+	})
+	return w
+}
+
+// stop stops the watchdog, returning false if it has already replied to the command
+func (w *commandWatchdog) stop() bool {
+	if w == nil {
+		return true
+	}
+	if w.timer.Stop() {
+		// the timer will not fire, so is no longer counted
+		w.wg.Done()
+	}
+	return atomic.CompareAndSwapInt32(&w.claimed, 0, 1)
+}
@@ -0,0 +1,174 @@
+package nbd
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"strconv"
+	"sync"
+)
+
+// workerPool is a pool of goroutines performing the backend I/O of every
+// connection to an export
+type workerPool struct {
+	work chan func() // I/O to be performed by the pool
+	refs int         // number of backends using the pool
+}
+
+// Worker pools by name (see workerPoolName), so that the connections to an
+// export share one
+var (
+	workerPools      = make(map[string]*workerPool)
+	workerPoolsMutex sync.Mutex
+)
+
+// workerPoolName returns the name of an export's worker pool: that of its
+// workerpoolgroup if set, so a group of exports may share a pool, or else the
+// export's own
+func workerPoolName(ec *ExportConfig) string {
+	if group := ec.DriverParameters["workerpoolgroup"]; group != "" {
+		return "group " + group
+	}
+	return "export " + ec.Name
+}
+
+// acquireWorkerPool returns the named worker pool, starting one of the given
+// size if there is none. A pool already running keeps its size
+func acquireWorkerPool(name string, size int) *workerPool {
+	workerPoolsMutex.Lock()
+	defer workerPoolsMutex.Unlock()
+	if wp, ok := workerPools[name]; ok {
+		wp.refs++
+		return wp
+	}
+	wp := &workerPool{
+		work: make(chan func()),
+		refs: 1,
+	}
+	for i := 0; i < size; i++ {
+		go func() {
+			for f := range wp.work {
+				f()
+			}
+		}()
+	}
+	workerPools[name] = wp
+	return wp
+}
+
+// releaseWorkerPool releases a pool acquired by acquireWorkerPool, stopping it
+// once no backend uses it
+func releaseWorkerPool(name string, wp *workerPool) {
+	workerPoolsMutex.Lock()
+	defer workerPoolsMutex.Unlock()
+	if wp.refs--; wp.refs == 0 {
+		delete(workerPools, name)
+		close(wp.work)
+	}
+}
+
+// WorkerPoolBackend implements Backend
+//
+// It wraps another backend so that all its I/O is performed by the worker pool
+// of its export, shared by every connection to it (and to any other export in
+// its group). However many commands the
+// clients of the export have outstanding, at most the pool's size are passed to
+// the backend at once, and the rest wait for a worker. As each command blocked
+// in a system call holds an OS thread, a storm of I/O to one export therefore
+// cannot starve others of threads
+type WorkerPoolBackend struct {
+	Backend
+	name string      // name of the pool
+	pool *workerPool // the export's pool
+}
+
+// workerPoolCacherBackend is a WorkerPoolBackend wrapping a backend that is also a Cacher
+type workerPoolCacherBackend struct {
+	*WorkerPoolBackend
+}
+
+// run runs f on one of the pool's workers and waits for it to complete
+func (wb *WorkerPoolBackend) run(ctx context.Context, f func()) error {
+	done := make(chan struct{})
+	select {
+	case wb.pool.work <- func() { f(); close(done) }:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-done
+	return nil
+}
+
+// WriteAt implements Backend.WriteAt
+func (wb *WorkerPoolBackend) WriteAt(ctx context.Context, b []byte, offset int64, fua bool) (n int, err error) {
+	if rerr := wb.run(ctx, func() { n, err = wb.Backend.WriteAt(ctx, b, offset, fua) }); rerr != nil {
+		return 0, rerr
+	}
+	return
+}
+
+// ReadAt implements Backend.ReadAt
+func (wb *WorkerPoolBackend) ReadAt(ctx context.Context, b []byte, offset int64) (n int, err error) {
+	if rerr := wb.run(ctx, func() { n, err = wb.Backend.ReadAt(ctx, b, offset) }); rerr != nil {
+		return 0, rerr
+	}
+	return
+}
+
+// TrimAt implements Backend.TrimAt
+func (wb *WorkerPoolBackend) TrimAt(ctx context.Context, length int, offset int64) (n int, err error) {
+	if rerr := wb.run(ctx, func() { n, err = wb.Backend.TrimAt(ctx, length, offset) }); rerr != nil {
+		return 0, rerr
+	}
+	return
+}
+
+// Flush implements Backend.Flush
+func (wb *WorkerPoolBackend) Flush(ctx context.Context) (err error) {
+	if rerr := wb.run(ctx, func() { err = wb.Backend.Flush(ctx) }); rerr != nil {
+		return rerr
+	}
+	return
+}
+
+// Close implements Backend.Close
+func (wb *WorkerPoolBackend) Close(ctx context.Context) error {
+	err := wb.Backend.Close(ctx)
+	releaseWorkerPool(wb.name, wb.pool)
+	return err
+}
+
+// IOHints implements IOHinter.IOHints
+func (wb *WorkerPoolBackend) IOHints(ctx context.Context) IOHints {
+	return backendIOHints(ctx, wb.Backend)
+}
+
+// Cache implements Cacher.Cache
+func (wcb *workerPoolCacherBackend) Cache(ctx context.Context, length int, offset int64) (n int, err error) {
+	if rerr := wcb.run(ctx, func() { n, err = wcb.Backend.(Cacher).Cache(ctx, length, offset) }); rerr != nil {
+		return 0, rerr
+	}
+	return
+}
+
+// newWorkerPoolBackend wraps a backend in a WorkerPoolBackend if the export
+// configures workerpool, the number of workers in its pool
+func newWorkerPoolBackend(ctx context.Context, ec *ExportConfig, backend Backend) (Backend, error) {
+	sizeParam := ec.DriverParameters["workerpool"]
+	if sizeParam == "" {
+		return backend, nil
+	}
+	size, err := strconv.Atoi(sizeParam)
+	if err != nil || size < 1 {
+		return nil, fmt.Errorf("Bad worker pool size '%s'", sizeParam)
+	}
+	name := workerPoolName(ec)
+	wb := &WorkerPoolBackend{
+		Backend: backend,
+		name:    name,
+		pool:    acquireWorkerPool(name, size),
+	}
+	if _, isCacher := backend.(Cacher); isCacher {
+		return &workerPoolCacherBackend{wb}, nil
+	}
+	return wb, nil
+}